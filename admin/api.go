@@ -0,0 +1,213 @@
+package admin
+
+import (
+	"context"
+	"errors"
+	"github.com/johnnyeven/terra/bt"
+	"github.com/johnnyeven/terra/dht"
+	"net"
+	"time"
+)
+
+// API is what the admin API can do with a node. Local runs it in process and
+// Client over HTTP.
+type API interface {
+	RoutingTable(ctx context.Context) (*RoutingTable, error)
+	Transport(ctx context.Context) (*dht.TransportStats, error)
+	InfoHashes(ctx context.Context) (*InfoHashes, error)
+	// Peers returns at most n peers of infoHash, all if n is 0.
+	Peers(ctx context.Context, infoHash dht.NodeID, n int) ([]*dht.Peer, error)
+	Ping(ctx context.Context, addr string) (*PingResult, error)
+	Lookup(ctx context.Context, req *LookupRequest) (*bt.LookupResult, error)
+	// Announce returns how many nodes accepted the announce.
+	Announce(ctx context.Context, req *AnnounceRequest) (int, error)
+	Scrape(ctx context.Context, infoHash dht.NodeID) (*bt.ScrapeResult, error)
+	GetItem(ctx context.Context, req *GetItemRequest) (*dht.Item, error)
+	// PutItem returns how many nodes accepted the item.
+	PutItem(ctx context.Context, req *PutItemRequest) (int, error)
+	Bootstrap(ctx context.Context, addr string) error
+}
+
+// RoutingTable is a snapshot of the routing table.
+type RoutingTable struct {
+	Self dht.NodeID `json:"self"`
+	// the ID sent to IPv6 nodes, which differs from Self once the
+	// external IPs give each family its own ID (BEP 42)
+	SelfIPv6        dht.NodeID            `json:"selfIPv6"`
+	Mode            string                `json:"mode"`
+	LocalAddrs      []*net.UDPAddr        `json:"localAddrs"`
+	ExternalIPs     []net.IP              `json:"externalIPs"`
+	Nodes           int                   `json:"nodes"`
+	RejectedInserts dht.RejectedInserts   `json:"rejectedInserts"`
+	Buckets         []*dht.BucketSnapshot `json:"buckets"`
+}
+
+// InfoHashes is the content of the peer store.
+type InfoHashes struct {
+	Torrents   int          `json:"torrents"`
+	Peers      int          `json:"peers"`
+	InfoHashes []dht.NodeID `json:"infoHashes"`
+}
+
+// PingResult is the answer to a ping.
+type PingResult struct {
+	Node *dht.Node     `json:"node"`
+	RTT  time.Duration `json:"rtt"`
+}
+
+// LookupRequest asks for a find_node or get_peers lookup of Target. If Addr
+// is set only that node is queried, otherwise the lookup is iterative.
+type LookupRequest struct {
+	Target string `json:"target"`
+	Type   string `json:"type"`
+	Addr   string `json:"addr,omitempty"`
+}
+
+// AnnounceRequest asks to announce InfoHash on Port, 0 meaning the source
+// port.
+type AnnounceRequest struct {
+	InfoHash string `json:"infoHash"`
+	Port     int    `json:"port"`
+}
+
+// GetItemRequest asks for the BEP 44 item of Target, Salt is the one of a
+// mutable item.
+type GetItemRequest struct {
+	Target string `json:"target"`
+	Salt   []byte `json:"salt,omitempty"`
+}
+
+// PutItemRequest asks to store a BEP 44 item, signed by the caller if it
+// is mutable. CAS is the seq the nodes should have.
+type PutItemRequest struct {
+	Item *dht.Item `json:"item"`
+	CAS  *int64    `json:"cas,omitempty"`
+}
+
+// invalidArgument is an error of the arguments of a call.
+type invalidArgument struct {
+	error
+}
+
+var _ interface {
+	API
+} = (*Local)(nil)
+
+// Local is the API of a node of the process.
+type Local struct {
+	table *dht.DistributedHashTable
+}
+
+// NewLocal returns the API of table, which must be running.
+func NewLocal(table *dht.DistributedHashTable) *Local {
+	return &Local{table: table}
+}
+
+func (l *Local) RoutingTable(ctx context.Context) (*RoutingTable, error) {
+	rt := l.table.GetRoutingTable()
+	return &RoutingTable{
+		Self:            l.table.SelfID(false),
+		SelfIPv6:        l.table.SelfID(true),
+		Mode:            l.table.Mode,
+		LocalAddrs:      l.table.LocalAddrs(),
+		ExternalIPs:     l.table.ExternalIPs(),
+		Nodes:           rt.Len(),
+		RejectedInserts: rt.RejectedInserts(),
+		Buckets:         rt.Buckets(),
+	}, nil
+}
+
+func (l *Local) Transport(ctx context.Context) (*dht.TransportStats, error) {
+	stats := l.table.GetTransport().Stats()
+	return &stats, nil
+}
+
+func (l *Local) InfoHashes(ctx context.Context) (*InfoHashes, error) {
+	store := l.table.PeerStore()
+	return &InfoHashes{
+		Torrents:   store.Len(),
+		Peers:      store.PeerCount(),
+		InfoHashes: store.InfoHashes(),
+	}, nil
+}
+
+func (l *Local) Peers(ctx context.Context, infoHash dht.NodeID, n int) ([]*dht.Peer, error) {
+	return l.table.PeerStore().Get(infoHash, n), nil
+}
+
+func (l *Local) Ping(ctx context.Context, addr string) (*PingResult, error) {
+	udpAddr, err := net.ResolveUDPAddr(l.table.Network, addr)
+	if err != nil {
+		return nil, invalidArgument{err}
+	}
+
+	start := time.Now()
+	node, err := bt.PingAddr(ctx, l.table, udpAddr)
+	if err != nil {
+		return nil, err
+	}
+	return &PingResult{Node: node, RTT: time.Since(start)}, nil
+}
+
+func (l *Local) Lookup(ctx context.Context, req *LookupRequest) (*bt.LookupResult, error) {
+	target, err := dht.ParseNodeID(req.Target)
+	if err != nil {
+		return nil, invalidArgument{err}
+	}
+	if req.Type == "" {
+		req.Type = dht.FindNodeType
+	}
+	if req.Type != dht.FindNodeType && req.Type != dht.GetPeersType {
+		return nil, invalidArgument{errors.New("invalid type: " + req.Type)}
+	}
+
+	if req.Addr == "" {
+		return bt.Lookup(ctx, l.table, target, req.Type)
+	}
+
+	addr, err := net.ResolveUDPAddr(l.table.Network, req.Addr)
+	if err != nil {
+		return nil, invalidArgument{err}
+	}
+	return bt.Query(ctx, l.table, addr, target, req.Type)
+}
+
+func (l *Local) Announce(ctx context.Context, req *AnnounceRequest) (int, error) {
+	infoHash, err := dht.ParseNodeID(req.InfoHash)
+	if err != nil {
+		return 0, invalidArgument{err}
+	}
+	if req.Port < 0 || req.Port > 65535 {
+		return 0, invalidArgument{errors.New("invalid port")}
+	}
+	return bt.Announce(ctx, l.table, infoHash, req.Port)
+}
+
+func (l *Local) Scrape(ctx context.Context, infoHash dht.NodeID) (*bt.ScrapeResult, error) {
+	return bt.Scrape(ctx, l.table, infoHash)
+}
+
+func (l *Local) GetItem(ctx context.Context, req *GetItemRequest) (*dht.Item, error) {
+	target, err := dht.ParseNodeID(req.Target)
+	if err != nil {
+		return nil, invalidArgument{err}
+	}
+	return bt.Get(ctx, l.table, target, req.Salt)
+}
+
+func (l *Local) PutItem(ctx context.Context, req *PutItemRequest) (int, error) {
+	if req.Item == nil {
+		return 0, invalidArgument{errors.New("item not set")}
+	}
+	if err := req.Item.Verify(); err != nil {
+		return 0, invalidArgument{err}
+	}
+	return bt.Put(ctx, l.table, req.Item, req.CAS)
+}
+
+func (l *Local) Bootstrap(ctx context.Context, addr string) error {
+	if err := l.table.AddBootstrapNode(addr); err != nil {
+		return invalidArgument{err}
+	}
+	return nil
+}
@@ -0,0 +1,126 @@
+package admin
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/johnnyeven/terra/bt"
+	"github.com/johnnyeven/terra/dht"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+var _ interface {
+	API
+} = (*Client)(nil)
+
+// Client calls the admin API of a node over HTTP.
+type Client struct {
+	baseURL string
+	client  *http.Client
+}
+
+// NewClient returns a Client pointer of the admin server at addr, which is a
+// host:port or a URL.
+func NewClient(addr string) *Client {
+	if !strings.HasPrefix(addr, "http://") && !strings.HasPrefix(addr, "https://") {
+		addr = "http://" + addr
+	}
+	return &Client{
+		baseURL: strings.TrimSuffix(addr, "/"),
+		client:  &http.Client{},
+	}
+}
+
+func (c *Client) call(ctx context.Context, method, path string, body, v interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequest(method, c.baseURL+path, reader)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		e := &errorResponse{}
+		if err := json.NewDecoder(resp.Body).Decode(e); err != nil || e.Error == "" {
+			return fmt.Errorf("admin api: %s", resp.Status)
+		}
+		return errors.New(e.Error)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func (c *Client) RoutingTable(ctx context.Context) (*RoutingTable, error) {
+	v := &RoutingTable{}
+	return v, c.call(ctx, http.MethodGet, "/api/routing-table", nil, v)
+}
+
+func (c *Client) Transport(ctx context.Context) (*dht.TransportStats, error) {
+	v := &dht.TransportStats{}
+	return v, c.call(ctx, http.MethodGet, "/api/transport", nil, v)
+}
+
+func (c *Client) InfoHashes(ctx context.Context) (*InfoHashes, error) {
+	v := &InfoHashes{}
+	return v, c.call(ctx, http.MethodGet, "/api/peers", nil, v)
+}
+
+func (c *Client) Peers(ctx context.Context, infoHash dht.NodeID, n int) ([]*dht.Peer, error) {
+	v := make([]*dht.Peer, 0)
+	path := "/api/peers/" + infoHash.String() + "?limit=" + strconv.Itoa(n)
+	return v, c.call(ctx, http.MethodGet, path, nil, &v)
+}
+
+func (c *Client) Ping(ctx context.Context, addr string) (*PingResult, error) {
+	v := &PingResult{}
+	return v, c.call(ctx, http.MethodPost, "/api/ping", &addrRequest{Addr: addr}, v)
+}
+
+func (c *Client) Lookup(ctx context.Context, req *LookupRequest) (*bt.LookupResult, error) {
+	v := &bt.LookupResult{}
+	return v, c.call(ctx, http.MethodPost, "/api/lookup", req, v)
+}
+
+func (c *Client) Announce(ctx context.Context, req *AnnounceRequest) (int, error) {
+	v := &announceResponse{}
+	return v.Accepted, c.call(ctx, http.MethodPost, "/api/announce", req, v)
+}
+
+func (c *Client) Scrape(ctx context.Context, infoHash dht.NodeID) (*bt.ScrapeResult, error) {
+	v := &bt.ScrapeResult{}
+	return v, c.call(ctx, http.MethodPost, "/api/scrape", &scrapeRequest{InfoHash: infoHash.String()}, v)
+}
+
+func (c *Client) GetItem(ctx context.Context, req *GetItemRequest) (*dht.Item, error) {
+	v := &dht.Item{}
+	return v, c.call(ctx, http.MethodPost, "/api/item/get", req, v)
+}
+
+func (c *Client) PutItem(ctx context.Context, req *PutItemRequest) (int, error) {
+	v := &announceResponse{}
+	return v.Accepted, c.call(ctx, http.MethodPost, "/api/item/put", req, v)
+}
+
+func (c *Client) Bootstrap(ctx context.Context, addr string) error {
+	return c.call(ctx, http.MethodPost, "/api/bootstrap", &addrRequest{Addr: addr}, &okResponse{})
+}
@@ -0,0 +1,253 @@
+// Package admin serves an HTTP/JSON API to inspect and drive a running node.
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/johnnyeven/terra/bt"
+	"github.com/johnnyeven/terra/dht"
+	"github.com/sirupsen/logrus"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultTimeout is how long an action may take.
+const DefaultTimeout = 30 * time.Second
+
+// Server is the admin API of a node over HTTP.
+//
+//	GET  /api/routing-table   buckets and nodes of the routing table
+//	GET  /api/transport       transport stats
+//	GET  /api/peers           info_hashes of the peer store
+//	GET  /api/peers/<hash>    peers of an info_hash
+//	POST /api/ping            {"addr": "ip:port"}
+//	POST /api/lookup          {"target": "<hash>", "type": "find_node|get_peers", "addr": "ip:port"}
+//	POST /api/announce        {"infoHash": "<hash>", "port": 6881}
+//	POST /api/scrape          {"infoHash": "<hash>"}
+//	POST /api/item/get        {"target": "<hash>", "salt": "<base64>"}
+//	POST /api/item/put        {"item": {"v": "<base64>", "k": ..., "seq": 1, "sig": ...}, "cas": 0}
+//	POST /api/bootstrap       {"addr": "host:port"}
+type Server struct {
+	api     API
+	timeout time.Duration
+	mux     *http.ServeMux
+}
+
+// NewServer returns a Server pointer of table, the actions time out after
+// timeout.
+func NewServer(table *dht.DistributedHashTable, timeout time.Duration) *Server {
+	s := &Server{
+		api:     NewLocal(table),
+		timeout: timeout,
+		mux:     http.NewServeMux(),
+	}
+
+	s.mux.HandleFunc("/api/routing-table", s.get(s.routingTable))
+	s.mux.HandleFunc("/api/transport", s.get(s.transport))
+	s.mux.HandleFunc("/api/peers", s.get(s.infoHashes))
+	s.mux.HandleFunc("/api/peers/", s.get(s.peers))
+	s.mux.HandleFunc("/api/ping", s.post(s.ping))
+	s.mux.HandleFunc("/api/lookup", s.post(s.lookup))
+	s.mux.HandleFunc("/api/announce", s.post(s.announce))
+	s.mux.HandleFunc("/api/scrape", s.post(s.scrape))
+	s.mux.HandleFunc("/api/item/get", s.post(s.getItem))
+	s.mux.HandleFunc("/api/item/put", s.post(s.putItem))
+	s.mux.HandleFunc("/api/bootstrap", s.post(s.bootstrap))
+	return s
+}
+
+// Handle registers an additional handler for pattern.
+func (s *Server) Handle(pattern string, handler http.Handler) {
+	s.mux.Handle(pattern, handler)
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+// ListenAndServe serves the API on addr.
+func (s *Server) ListenAndServe(addr string) error {
+	logrus.Infof("admin api listening on %s", addr)
+	return http.ListenAndServe(addr, s)
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+type handlerFunc func(ctx context.Context, r *http.Request) (interface{}, error)
+
+func (s *Server) get(fn handlerFunc) http.HandlerFunc {
+	return s.handle(http.MethodGet, fn)
+}
+
+func (s *Server) post(fn handlerFunc) http.HandlerFunc {
+	return s.handle(http.MethodPost, fn)
+}
+
+func (s *Server) handle(method string, fn handlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.Method != method {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			json.NewEncoder(w).Encode(&errorResponse{Error: "method not allowed"})
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), s.timeout)
+		defer cancel()
+
+		v, err := fn(ctx, r)
+		if err != nil {
+			w.WriteHeader(errorStatus(err))
+			json.NewEncoder(w).Encode(&errorResponse{Error: err.Error()})
+			return
+		}
+		json.NewEncoder(w).Encode(v)
+	}
+}
+
+func errorStatus(err error) int {
+	switch err.(type) {
+	case invalidArgument:
+		return http.StatusBadRequest
+	case *dht.KRPCError:
+		return http.StatusBadGateway
+	}
+
+	switch err {
+	case dht.ErrTimeout, context.DeadlineExceeded:
+		return http.StatusGatewayTimeout
+	case bt.ErrNoNodes, dht.ErrQueueFull:
+		return http.StatusServiceUnavailable
+	case bt.ErrItemNotFound:
+		return http.StatusNotFound
+	}
+	return http.StatusInternalServerError
+}
+
+func decodeBody(r *http.Request, v interface{}) error {
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		return invalidArgument{err}
+	}
+	return nil
+}
+
+func (s *Server) routingTable(ctx context.Context, r *http.Request) (interface{}, error) {
+	return s.api.RoutingTable(ctx)
+}
+
+func (s *Server) transport(ctx context.Context, r *http.Request) (interface{}, error) {
+	return s.api.Transport(ctx)
+}
+
+func (s *Server) infoHashes(ctx context.Context, r *http.Request) (interface{}, error) {
+	return s.api.InfoHashes(ctx)
+}
+
+func (s *Server) peers(ctx context.Context, r *http.Request) (interface{}, error) {
+	infoHash, err := dht.ParseNodeID(strings.TrimPrefix(r.URL.Path, "/api/peers/"))
+	if err != nil {
+		return nil, invalidArgument{err}
+	}
+
+	n := 0
+	if limit := r.URL.Query().Get("limit"); limit != "" {
+		if n, err = strconv.Atoi(limit); err != nil {
+			return nil, invalidArgument{err}
+		}
+	}
+	return s.api.Peers(ctx, infoHash, n)
+}
+
+type addrRequest struct {
+	Addr string `json:"addr"`
+}
+
+func (s *Server) ping(ctx context.Context, r *http.Request) (interface{}, error) {
+	req := &addrRequest{}
+	if err := decodeBody(r, req); err != nil {
+		return nil, err
+	}
+	return s.api.Ping(ctx, req.Addr)
+}
+
+func (s *Server) lookup(ctx context.Context, r *http.Request) (interface{}, error) {
+	req := &LookupRequest{}
+	if err := decodeBody(r, req); err != nil {
+		return nil, err
+	}
+	return s.api.Lookup(ctx, req)
+}
+
+type announceResponse struct {
+	Accepted int `json:"accepted"`
+}
+
+func (s *Server) announce(ctx context.Context, r *http.Request) (interface{}, error) {
+	req := &AnnounceRequest{}
+	if err := decodeBody(r, req); err != nil {
+		return nil, err
+	}
+
+	accepted, err := s.api.Announce(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	return &announceResponse{Accepted: accepted}, nil
+}
+
+type scrapeRequest struct {
+	InfoHash string `json:"infoHash"`
+}
+
+func (s *Server) scrape(ctx context.Context, r *http.Request) (interface{}, error) {
+	req := &scrapeRequest{}
+	if err := decodeBody(r, req); err != nil {
+		return nil, err
+	}
+
+	infoHash, err := dht.ParseNodeID(req.InfoHash)
+	if err != nil {
+		return nil, invalidArgument{err}
+	}
+	return s.api.Scrape(ctx, infoHash)
+}
+
+func (s *Server) getItem(ctx context.Context, r *http.Request) (interface{}, error) {
+	req := &GetItemRequest{}
+	if err := decodeBody(r, req); err != nil {
+		return nil, err
+	}
+	return s.api.GetItem(ctx, req)
+}
+
+func (s *Server) putItem(ctx context.Context, r *http.Request) (interface{}, error) {
+	req := &PutItemRequest{}
+	if err := decodeBody(r, req); err != nil {
+		return nil, err
+	}
+
+	accepted, err := s.api.PutItem(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	return &announceResponse{Accepted: accepted}, nil
+}
+
+type okResponse struct {
+	OK bool `json:"ok"`
+}
+
+func (s *Server) bootstrap(ctx context.Context, r *http.Request) (interface{}, error) {
+	req := &addrRequest{}
+	if err := decodeBody(r, req); err != nil {
+		return nil, err
+	}
+	if err := s.api.Bootstrap(ctx, req.Addr); err != nil {
+		return nil, err
+	}
+	return &okResponse{OK: true}, nil
+}
@@ -0,0 +1,172 @@
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/johnnyeven/terra/bt"
+	"github.com/johnnyeven/terra/dht"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newMemoryNode returns a running node at addr of network, with the BEP 5
+// handlers.
+func newMemoryNode(t *testing.T, network *dht.MemoryNetwork, addr string) *dht.DistributedHashTable {
+	config := dht.GetNormalConfig()
+	config.TransportConstructor = dht.NewKRPCTransport
+	config.Handler = bt.BTHandlePacket
+	config.HandshakeFunc = bt.FindNode
+	config.PingFunc = bt.Ping
+	config.ListenFunc = network.ListenPacket
+	config.LocalAddr = addr
+	config.SeedNodes = nil
+	config.MaxQueriesPerSecondPerIP = 0
+	config.MaxPacketsPerSecondPerNode = 0
+
+	table := dht.NewDHT(config)
+	go table.Run()
+	<-table.Ready()
+	return table
+}
+
+// serve sends a request to s and returns the response status and body.
+func serve(s *Server, method, path, body string) (int, string) {
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest(method, path, strings.NewReader(body)))
+	return w.Code, w.Body.String()
+}
+
+// errorAPI fails every ping with err.
+type errorAPI struct {
+	API
+	err error
+}
+
+func (a *errorAPI) Ping(ctx context.Context, addr string) (*PingResult, error) {
+	return nil, a.err
+}
+
+func TestErrorStatus(t *testing.T) {
+	network := dht.NewMemoryNetwork()
+	table := newMemoryNode(t, network, "93.184.0.1:6881")
+	defer table.Close()
+	s := NewServer(table, time.Second)
+
+	tests := []struct {
+		err    error
+		status int
+	}{
+		{invalidArgument{errors.New("invalid addr")}, http.StatusBadRequest},
+		{&dht.KRPCError{Code: 203, Message: "Protocol Error"}, http.StatusBadGateway},
+		{dht.ErrTimeout, http.StatusGatewayTimeout},
+		{context.DeadlineExceeded, http.StatusGatewayTimeout},
+		{bt.ErrNoNodes, http.StatusServiceUnavailable},
+		{dht.ErrQueueFull, http.StatusServiceUnavailable},
+		{bt.ErrItemNotFound, http.StatusNotFound},
+		{errors.New("unexpected"), http.StatusInternalServerError},
+	}
+	for _, test := range tests {
+		s.api = &errorAPI{API: NewLocal(table), err: test.err}
+		status, body := serve(s, http.MethodPost, "/api/ping", `{"addr": "93.184.0.2:6881"}`)
+		if status != test.status {
+			t.Errorf("%v: status %d, want %d", test.err, status, test.status)
+		}
+		response := &errorResponse{}
+		if err := json.Unmarshal([]byte(body), response); err != nil || response.Error != test.err.Error() {
+			t.Errorf("%v: body %q", test.err, body)
+		}
+	}
+}
+
+func TestServerErrors(t *testing.T) {
+	network := dht.NewMemoryNetwork()
+	table := newMemoryNode(t, network, "93.184.0.1:6881")
+	defer table.Close()
+	s := NewServer(table, 200*time.Millisecond)
+	infoHash := dht.RandomNodeID().String()
+
+	tests := []struct {
+		method, path, body string
+		status             int
+	}{
+		{http.MethodPost, "/api/routing-table", "", http.StatusMethodNotAllowed},
+		{http.MethodGet, "/api/ping", "", http.StatusMethodNotAllowed},
+		{http.MethodGet, "/api/peers/zz" + infoHash[2:], "", http.StatusBadRequest},
+		{http.MethodGet, "/api/peers/" + infoHash[2:], "", http.StatusBadRequest},
+		{http.MethodGet, "/api/peers/" + infoHash + "?limit=x", "", http.StatusBadRequest},
+		{http.MethodPost, "/api/ping", "{", http.StatusBadRequest},
+		{http.MethodPost, "/api/ping", `{"addr": "93.184.0.1"}`, http.StatusBadRequest},
+		// nothing listens there
+		{http.MethodPost, "/api/ping", `{"addr": "93.184.0.2:6881"}`, http.StatusGatewayTimeout},
+		// the routing table is empty
+		{http.MethodPost, "/api/lookup", `{"target": "` + infoHash + `"}`, http.StatusServiceUnavailable},
+	}
+	for _, test := range tests {
+		status, body := serve(s, test.method, test.path, test.body)
+		if status != test.status {
+			t.Errorf("%s %s %s: status %d, want %d (%s)", test.method, test.path, test.body, status, test.status, body)
+		}
+	}
+}
+
+func TestServer(t *testing.T) {
+	network := dht.NewMemoryNetwork()
+	table := newMemoryNode(t, network, "93.184.0.1:6881")
+	defer table.Close()
+	remote := newMemoryNode(t, network, "93.184.0.2:6881")
+	defer remote.Close()
+	s := NewServer(table, time.Second)
+
+	status, body := serve(s, http.MethodPost, "/api/ping", `{"addr": "93.184.0.2:6881"}`)
+	if status != http.StatusOK {
+		t.Fatalf("ping: status %d (%s)", status, body)
+	}
+	ping := &struct {
+		Node struct {
+			ID   string       `json:"id"`
+			Addr *net.UDPAddr `json:"addr"`
+		} `json:"node"`
+	}{}
+	if err := json.Unmarshal([]byte(body), ping); err != nil {
+		t.Fatal(err)
+	}
+	if ping.Node.ID != remote.SelfID(false).String() || ping.Node.Addr.String() != "93.184.0.2:6881" {
+		t.Errorf("ping answered by %s at %v, want %s", ping.Node.ID, ping.Node.Addr, remote.SelfID(false))
+	}
+
+	status, body = serve(s, http.MethodGet, "/api/routing-table", "")
+	if status != http.StatusOK {
+		t.Fatalf("routing table: status %d (%s)", status, body)
+	}
+	rt := &struct {
+		Self string `json:"self"`
+		Mode string `json:"mode"`
+	}{}
+	if err := json.Unmarshal([]byte(body), rt); err != nil {
+		t.Fatal(err)
+	}
+	if rt.Self != table.SelfID(false).String() || rt.Mode != table.Mode {
+		t.Errorf("routing table of %s in mode %s", rt.Self, rt.Mode)
+	}
+
+	infoHash := dht.RandomNodeID()
+	for i := 1; i <= 3; i++ {
+		table.PeerStore().Add(infoHash, &dht.Peer{IP: net.IPv4(93, 184, 1, byte(i)), Port: 6881, LastSeen: time.Now()})
+	}
+	status, body = serve(s, http.MethodGet, "/api/peers/"+infoHash.String()+"?limit=2", "")
+	if status != http.StatusOK {
+		t.Fatalf("peers: status %d (%s)", status, body)
+	}
+	var peers []*dht.Peer
+	if err := json.Unmarshal([]byte(body), &peers); err != nil {
+		t.Fatal(err)
+	}
+	if len(peers) != 2 {
+		t.Errorf("%d peers, want 2", len(peers))
+	}
+}
@@ -8,25 +8,36 @@ import (
 	"errors"
 	"github.com/johnnyeven/terra/dht/util"
 	"strings"
+	"time"
+	"math/rand"
 )
 
 func BTHandlePacket(table *dht.DistributedHashTable, packet dht.Packet) {
+	addr := packet.RemoteAddr.(*net.UDPAddr)
+
 	data, err := util.Decode(packet.Data)
 	if err != nil {
-		logrus.Errorf("Decode err: %v", err)
+		logrus.Debugf("Decode err: %v", err)
+		dht.DecodeErrorsTotal.Inc()
+		table.ReportMalformed(addr.IP)
+		return
 	}
 
 	response, err := dht.ParseMessage(data)
 	if err != nil {
-		logrus.Errorf("ParseMessage err: %v", err)
+		logrus.Debugf("ParseMessage err: %v", err)
+		dht.DecodeErrorsTotal.Inc()
+		table.ReportMalformed(addr.IP)
+		return
 	}
 
 	if err := dht.ParseKey(response, "y", "string"); err != nil {
+		dht.DecodeErrorsTotal.Inc()
 		return
 	}
 
 	if handler, ok := handlers[response["y"].(string)]; ok {
-		handler(table, packet.RemoteAddr.(*net.UDPAddr), response)
+		handler(table, addr, response)
 	}
 }
 
@@ -41,29 +52,42 @@ var handlers = map[string]dhtHandler{
 func handleRequest(table *dht.DistributedHashTable, addr *net.UDPAddr, data map[string]interface{}) bool {
 	tranID := data["t"].(string)
 
+	// a read-only node answers no query, not even with an error
+	if table.ReadOnly {
+		return false
+	}
+
+	if !table.AllowQuery(addr.IP) {
+		return false
+	}
+
 	if err := dht.ParseKeys(data, [][]string{{"q", "string"}, {"a", "map"}}); err != nil {
+		table.ReportMalformed(addr.IP)
 		errResponse := table.GetTransport().MakeError(nil, addr, tranID, dht.ProtocolError, err.Error())
-		table.GetTransport().GetClient().(*dht.KRPCClient).Send(errResponse)
+		reply(table, errResponse, "")
 		return false
 	}
 
 	q := data["q"].(string)
 	a := data["a"].(map[string]interface{})
+	dht.CountPacket(dht.DirectionIn, "q", q)
 
 	if err := dht.ParseKey(a, "id", "string"); err != nil {
+		table.ReportMalformed(addr.IP)
 		errResponse := table.GetTransport().MakeError(nil, addr, tranID, dht.ProtocolError, err.Error())
-		table.GetTransport().GetClient().(*dht.KRPCClient).Send(errResponse)
+		reply(table, errResponse, q)
 		return false
 	}
 
 	id := a["id"].(string)
-	if id == table.Self.ID.RawString() {
+	if selfID, err := dht.NodeIDFromString(id); err == nil && table.IsSelf(selfID) {
 		return false
 	}
 
 	if len(id) != 20 {
+		table.ReportMalformed(addr.IP)
 		errResponse := table.GetTransport().MakeError(nil, addr, tranID, dht.ProtocolError, "invalid id length")
-		table.GetTransport().GetClient().(*dht.KRPCClient).Send(errResponse)
+		reply(table, errResponse, q)
 		return false
 	}
 
@@ -71,68 +95,352 @@ func handleRequest(table *dht.DistributedHashTable, addr *net.UDPAddr, data map[
 		table.GetRoutingTable().RemoveByAddr(addr.String())
 
 		errResponse := table.GetTransport().MakeError(nil, addr, tranID, dht.ProtocolError, "invalid id")
-		table.GetTransport().GetClient().(*dht.KRPCClient).Send(errResponse)
+		reply(table, errResponse, q)
 		return false
 	}
 
+	// a read-only node can not be queried, so it must not be in the routing
+	// table where find_node would return it
+	ro, _ := data["ro"].(int)
+	table.GetRoutingTable().SetReadOnly(addr.String(), ro == 1)
+
+	nodeID, _ := dht.NodeIDFromString(id)
+	node := &dht.Node{ID: nodeID, Addr: addr, LastActiveTime: time.Now()}
+	table.Events().Publish(dht.Event{Type: dht.EventQueryReceived, Node: node, Addr: addr, Method: q})
+
 	switch q {
 	case dht.PingType:
 		logrus.Info("ping request")
-		response := table.GetTransport().MakeResponse(nil, addr, tranID, map[string]interface{}{"id": table.ID(id)})
-		table.GetTransport().GetClient().(*dht.KRPCClient).Send(response)
+		response := table.GetTransport().MakeResponse(nil, addr, tranID, map[string]interface{}{"id": table.ID(addr, id)})
+		reply(table, response, q)
 		break
 	case dht.FindNodeType:
 		logrus.Info("find_node request")
 		if err := dht.ParseKey(a, "target", "string"); err != nil {
 			response := table.GetTransport().MakeError(nil, addr, tranID, dht.ProtocolError, err.Error())
-			table.GetTransport().GetClient().(*dht.KRPCClient).Send(response)
+			reply(table, response, q)
 			return false
 		}
 
 		target := a["target"].(string)
-		if len(target) != 20 {
+		targetID, err := dht.NodeIDFromString(target)
+		if err != nil {
 			response := table.GetTransport().MakeError(nil, addr, tranID, dht.ProtocolError, "invalid target")
-			table.GetTransport().GetClient().(*dht.KRPCClient).Send(response)
+			reply(table, response, q)
 			return false
 		}
 
-		var nodes string
-		targetID := dht.NewIdentityFromString(target)
+		data := map[string]interface{}{
+			"id": table.ID(addr, target),
+		}
 
 		no, _ := table.GetRoutingTable().GetNodeBucketByID(targetID)
-		if no != nil {
-			nodes = no.CompactNodeInfo()
+		if no != nil && no.Addr.IP.To4() != nil {
+			data["nodes"] = no.CompactNodeInfo()
+		} else if no != nil {
+			data["nodes6"] = no.CompactNodeInfo()
 		} else {
-			nodes = strings.Join(
-				table.GetRoutingTable().GetNeighborCompactInfos(targetID, table.K),
-				"",
-			)
-		}
-
-		data := map[string]interface{}{
-			"id": table.ID(target),
-			"nodes": nodes,
+			addNodes(table, data, targetID, addr, a)
 		}
 		response := table.GetTransport().MakeResponse(nil, addr, tranID, data)
-		table.GetTransport().GetClient().(*dht.KRPCClient).Send(response)
+		reply(table, response, q)
 
 		break
 	case dht.GetPeersType:
 		logrus.Info("get_peers request")
+		infoHash, err := parseInfoHash(a)
+		if err != nil {
+			response := table.GetTransport().MakeError(nil, addr, tranID, dht.ProtocolError, err.Error())
+			reply(table, response, q)
+			return false
+		}
+		observeInfoHash(table, node, q, infoHash, a)
+
+		data := map[string]interface{}{
+			"id":    table.ID(addr, infoHash.RawString()),
+			"token": table.Token(addr),
+		}
+		// only the peers of the address family of the querier, and no seed
+		// to a seed asking with noseed=1
+		noSeed, _ := a["noseed"].(int)
+		values := make([]interface{}, 0)
+		for _, peer := range table.PeerStore().Get(infoHash, 0) {
+			if (peer.IP.To4() != nil) != (addr.IP.To4() != nil) || (noSeed != 0 && peer.Seed) {
+				continue
+			}
+			values = append(values, peer.CompactIPPortInfo())
+			if len(values) == table.K*2 {
+				break
+			}
+		}
+		if len(values) > 0 {
+			data["values"] = values
+		} else {
+			addNodes(table, data, infoHash, addr, a)
+		}
+		if scrape, _ := a["scrape"].(int); scrape != 0 {
+			seeds, peers := table.PeerStore().BloomFilters(infoHash)
+			data["BFsd"] = seeds.String()
+			data["BFpe"] = peers.String()
+		}
+		response := table.GetTransport().MakeResponse(nil, addr, tranID, data)
+		reply(table, response, q)
 		break
 	case dht.AnnouncePeerType:
 		logrus.Info("announce_peer request")
+		infoHash, err := parseInfoHash(a)
+		if err == nil {
+			err = dht.ParseKey(a, "token", "string")
+		}
+		if err != nil {
+			response := table.GetTransport().MakeError(nil, addr, tranID, dht.ProtocolError, err.Error())
+			reply(table, response, q)
+			return false
+		}
+		if !table.ValidateToken(a["token"].(string), addr) {
+			response := table.GetTransport().MakeError(nil, addr, tranID, dht.ProtocolError, "invalid token")
+			reply(table, response, q)
+			return false
+		}
+		observeInfoHash(table, node, q, infoHash, a)
+
+		seed, _ := a["seed"].(int)
+		table.PeerStore().Add(infoHash, &dht.Peer{IP: addr.IP, Port: announcedPort(addr, a), Seed: seed != 0})
+		response := table.GetTransport().MakeResponse(nil, addr, tranID, map[string]interface{}{"id": table.ID(addr, id)})
+		reply(table, response, q)
+		break
+	case dht.SampleInfohashesType:
+		logrus.Info("sample_infohashes request")
+		if err := dht.ParseKey(a, "target", "string"); err != nil {
+			response := table.GetTransport().MakeError(nil, addr, tranID, dht.ProtocolError, err.Error())
+			reply(table, response, q)
+			return false
+		}
+		targetID, err := dht.NodeIDFromString(a["target"].(string))
+		if err != nil {
+			response := table.GetTransport().MakeError(nil, addr, tranID, dht.ProtocolError, "invalid target")
+			reply(table, response, q)
+			return false
+		}
+
+		infoHashes := table.PeerStore().InfoHashes()
+		samples := make([]string, 0, maxSamples)
+		for _, i := range rand.Perm(len(infoHashes)) {
+			if len(samples) == maxSamples {
+				break
+			}
+			samples = append(samples, infoHashes[i].RawString())
+		}
+
+		data := map[string]interface{}{
+			"id":       table.ID(addr, targetID.RawString()),
+			"interval": sampleInterval,
+			"num":      len(infoHashes),
+			"samples":  strings.Join(samples, ""),
+		}
+		addNodes(table, data, targetID, addr, a)
+		response := table.GetTransport().MakeResponse(nil, addr, tranID, data)
+		reply(table, response, q)
+	case dht.GetType:
+		logrus.Debug("get request")
+		if err := dht.ParseKey(a, "target", "string"); err != nil {
+			response := table.GetTransport().MakeError(nil, addr, tranID, dht.ProtocolError, err.Error())
+			reply(table, response, q)
+			return false
+		}
+		target, err := dht.NodeIDFromString(a["target"].(string))
+		if err != nil {
+			response := table.GetTransport().MakeError(nil, addr, tranID, dht.ProtocolError, "invalid target")
+			reply(table, response, q)
+			return false
+		}
+
+		data := map[string]interface{}{
+			"id":    table.ID(addr, target.RawString()),
+			"token": table.Token(addr),
+		}
+		addNodes(table, data, target, addr, a)
+		if item := table.ItemStore().Get(target); item != nil {
+			args := itemArgs(item)
+			// the querier knows the salt, and the value if it has the seq
+			delete(args, "salt")
+			if seq, ok := a["seq"].(int); ok && item.Mutable() && int64(seq) >= item.Seq {
+				delete(args, "v")
+				delete(args, "sig")
+			}
+			for key, value := range args {
+				data[key] = value
+			}
+		}
+		response := table.GetTransport().MakeResponse(nil, addr, tranID, data)
+		reply(table, response, q)
+	case dht.PutType:
+		logrus.Debug("put request")
+		if err := dht.ParseKey(a, "token", "string"); err != nil {
+			response := table.GetTransport().MakeError(nil, addr, tranID, dht.ProtocolError, err.Error())
+			reply(table, response, q)
+			return false
+		}
+		if !table.ValidateToken(a["token"].(string), addr) {
+			response := table.GetTransport().MakeError(nil, addr, tranID, dht.ProtocolError, "invalid token")
+			reply(table, response, q)
+			return false
+		}
+
+		item, cas, err := parseItemArgs(a)
+		if err == nil {
+			err = table.ItemStore().Put(item, cas)
+		}
+		if err != nil {
+			code, message := dht.ProtocolError, err.Error()
+			if e, ok := err.(*dht.KRPCError); ok {
+				code, message = e.Code, e.Message
+			}
+			response := table.GetTransport().MakeError(nil, addr, tranID, code, message)
+			reply(table, response, q)
+			return false
+		}
+
+		response := table.GetTransport().MakeResponse(nil, addr, tranID, map[string]interface{}{"id": table.ID(addr, id)})
+		reply(table, response, q)
 	}
 
 	return true
 }
 
+// addNodes adds the nodes closest to target to the response data, in nodes
+// for the IPv4 ones and nodes6 for the IPv6 ones (BEP 32). The families are
+// the ones of the want argument, the one of the querier if it is missing.
+func addNodes(table *dht.DistributedHashTable, data map[string]interface{}, target dht.NodeID, addr *net.UDPAddr, a map[string]interface{}) {
+	ipv4, ipv6 := false, false
+	want, _ := a["want"].([]interface{})
+	for _, w := range want {
+		switch w {
+		case "n4":
+			ipv4 = true
+		case "n6":
+			ipv6 = true
+		}
+	}
+	if !ipv4 && !ipv6 {
+		ipv6 = addr.IP.To4() == nil
+		ipv4 = !ipv6
+	}
+
+	if ipv4 {
+		data["nodes"] = strings.Join(table.GetRoutingTable().GetNeighborCompactInfos(target, table.K), "")
+	}
+	if ipv6 {
+		data["nodes6"] = strings.Join(table.GetRoutingTable().GetNeighborCompactInfos6(target, table.K), "")
+	}
+}
+
+// itemArgs returns the keys of item in a put query or a get response. The
+// value is encoded again, which gives back V as Verify checks it is canonical.
+func itemArgs(item *dht.Item) map[string]interface{} {
+	v, _ := item.Value()
+	args := map[string]interface{}{"v": v}
+	if item.Mutable() {
+		args["k"] = string(item.K)
+		args["seq"] = int(item.Seq)
+		args["sig"] = string(item.Sig)
+		if len(item.Salt) > 0 {
+			args["salt"] = string(item.Salt)
+		}
+	}
+	return args
+}
+
+// parseItemArgs returns the item of a put query or a get response, and the
+// cas of a put. The value is encoded again, so a value which is not in
+// canonical bencoding fails the signature check.
+func parseItemArgs(args map[string]interface{}) (*dht.Item, *int64, error) {
+	v, ok := args["v"]
+	if !ok {
+		return nil, nil, errors.New("v not found")
+	}
+	item := &dht.Item{V: []byte(util.Encode(v))}
+
+	if k, ok := args["k"].(string); ok {
+		sig, _ := args["sig"].(string)
+		seq, _ := args["seq"].(int)
+		salt, _ := args["salt"].(string)
+		item.K, item.Sig, item.Seq = []byte(k), []byte(sig), int64(seq)
+		if salt != "" {
+			item.Salt = []byte(salt)
+		}
+	}
+
+	var cas *int64
+	if c, ok := args["cas"].(int); ok && item.Mutable() {
+		expected := int64(c)
+		cas = &expected
+	}
+	return item, cas, nil
+}
+
+// reply sends the response or error to a query of method q.
+func reply(table *dht.DistributedHashTable, response *dht.Request, q string) {
+	response.CMD = q
+	table.GetTransport().GetClient().(*dht.KRPCClient).Send(response)
+}
+
+const (
+	// the most info_hashes answered to a sample_infohashes query, so that the
+	// response fits in a packet
+	maxSamples = 20
+	// seconds the querying node should wait before sampling us again
+	sampleInterval = 300
+)
+
+// parseInfoHash returns the info_hash argument of a query.
+func parseInfoHash(a map[string]interface{}) (dht.NodeID, error) {
+	if err := dht.ParseKey(a, "info_hash", "string"); err != nil {
+		return dht.NodeID{}, err
+	}
+	infoHash, err := dht.NodeIDFromString(a["info_hash"].(string))
+	if err != nil {
+		return dht.NodeID{}, errors.New("invalid info_hash")
+	}
+	return infoHash, nil
+}
+
+// observeInfoHash publishes the info_hash of a get_peers or announce_peer
+// query.
+func observeInfoHash(table *dht.DistributedHashTable, node *dht.Node, q string, target dht.NodeID, a map[string]interface{}) {
+	event := dht.Event{
+		Type:   dht.EventInfoHashObserved,
+		Node:   node,
+		Addr:   node.Addr,
+		Method: q,
+		Target: target,
+	}
+	if q == dht.AnnouncePeerType {
+		event.Port = announcedPort(node.Addr, a)
+	}
+	table.Events().Publish(event)
+}
+
+// announcedPort returns the port of an announce_peer query, which is the
+// source port if implied_port is set.
+func announcedPort(addr *net.UDPAddr, a map[string]interface{}) int {
+	if implied, ok := a["implied_port"].(int); ok && implied != 0 {
+		return addr.Port
+	}
+	if port, ok := a["port"].(int); ok {
+		return port
+	}
+	return addr.Port
+}
+
 func handleResponse(table *dht.DistributedHashTable, addr *net.UDPAddr, data map[string]interface{}) bool {
 	tranID := data["t"].(string)
 	tran := table.GetTransport().Get(tranID, addr)
 	if tran == nil {
+		dht.CountPacket(dht.DirectionIn, "r", "")
 		return false
 	}
+	dht.CountPacket(dht.DirectionIn, "r", tran.CMD)
 
 	if err := dht.ParseKey(data, "r", "map"); err != nil {
 		return false
@@ -147,7 +455,7 @@ func handleResponse(table *dht.DistributedHashTable, addr *net.UDPAddr, data map
 	}
 	id := r["id"].(string)
 
-	if tran.ClientID.(*dht.Identity) != nil && tran.ClientID.(*dht.Identity).RawString() != r["id"].(string) {
+	if clientID, ok := tran.ClientID.(dht.NodeID); ok && !clientID.IsZero() && clientID.RawString() != id {
 		table.GetRoutingTable().RemoveByAddr(addr.String())
 		return false
 	}
@@ -157,19 +465,41 @@ func handleResponse(table *dht.DistributedHashTable, addr *net.UDPAddr, data map
 		return false
 	}
 
+	if ip, ok := data["ip"].(string); ok {
+		if external := parseCompactIP(ip); external != nil {
+			table.VoteExternalIP(addr, external)
+		}
+	}
+
+	// the response of a Call is handled by the caller
+	if tran.Callback != nil {
+		tran.ResponseChannel <- struct{}{}
+		table.GetRoutingTable().Insert(node)
+		tran.Callback(r, nil)
+		return true
+	}
+
 	switch q {
 	case dht.PingType:
 		break
 	case dht.FindNodeType:
 		logrus.Debug("find_node response")
-		target := a["target"].(string)
-		if err := findOrContinueRequestTarget(table, dht.NewIdentityFromString(target), r, dht.FindNodeType); err != nil {
+		targetID, err := dht.NodeIDFromString(a["target"].(string))
+		if err != nil {
+			return false
+		}
+		if err := findOrContinueRequestTarget(table, targetID, r, dht.FindNodeType); err != nil {
 			return false
 		}
 	case dht.GetPeersType:
 		fmt.Println("get_peers response")
 	case dht.AnnouncePeerType:
 		fmt.Println("ammounce_peer response")
+	case dht.SampleInfohashesType:
+		logrus.Debug("sample_infohashes response")
+		if err := handleSamples(table, node, r); err != nil {
+			return false
+		}
 	default:
 		return false
 	}
@@ -190,39 +520,89 @@ func handleError(table *dht.DistributedHashTable, addr *net.UDPAddr, data map[st
 		return false
 	}
 
-	if tran := table.GetTransport().Get(data["t"].(string), addr); tran != nil {
+	code, _ := e[0].(int)
+	message, _ := e[1].(string)
+	tran := table.GetTransport().Get(data["t"].(string), addr)
+	if tran == nil {
+		dht.CountPacket(dht.DirectionIn, "e", "")
+	} else {
+		dht.CountPacket(dht.DirectionIn, "e", tran.CMD)
 		tran.ResponseChannel <- struct{}{}
-		logrus.Errorf("handled error errCode: %d, errMsg: %s", e[0].(int), e[1].(string))
+		logrus.Errorf("handled error errCode: %d, errMsg: %s", code, message)
+		if tran.Callback != nil {
+			tran.Callback(nil, &dht.KRPCError{Code: code, Message: message})
+		}
 	}
 	return true
 }
 
-func findOrContinueRequestTarget(table *dht.DistributedHashTable, targetID *dht.Identity, data map[string]interface{}, requestType string) error {
-	if err := dht.ParseKey(data, "nodes", "string"); err != nil {
+// handleSamples publishes the info_hashes of a sample_infohashes response and
+// inserts the returned nodes.
+func handleSamples(table *dht.DistributedHashTable, node *dht.Node, r map[string]interface{}) error {
+	if err := dht.ParseKey(r, "samples", "string"); err != nil {
 		return err
 	}
-	nodes := data["nodes"].(string)
-	if len(nodes)%26 != 0 {
-		return errors.New("the length of nodes should can be divided by 26")
+	samples := r["samples"].(string)
+	if len(samples)%20 != 0 {
+		return errors.New("the length of samples should can be divided by 20")
+	}
+
+	now := time.Now()
+	for i := 0; i < len(samples)/20; i++ {
+		infoHash, _ := dht.NodeIDFromString(samples[i*20 : (i+1)*20])
+		table.Events().Publish(dht.Event{
+			Type:   dht.EventInfoHashObserved,
+			Time:   now,
+			Node:   node,
+			Addr:   node.Addr,
+			Method: dht.SampleInfohashesType,
+			Target: infoHash,
+		})
+	}
+
+	for _, n := range dht.ParseNodes(r, table.Network) {
+		table.GetRoutingTable().Insert(n)
+	}
+	return nil
+}
+
+// parseCompactIP returns the IP of the 6 or 18 bytes compact address of the
+// ip key of a response, nil if it is invalid.
+func parseCompactIP(compact string) net.IP {
+	switch len(compact) {
+	case net.IPv4len + 2, net.IPv6len + 2:
+		return net.IP(compact[:len(compact)-2])
+	}
+	return nil
+}
+
+func findOrContinueRequestTarget(table *dht.DistributedHashTable, targetID dht.NodeID, data map[string]interface{}, requestType string) error {
+	nodes, ok := data["nodes"].(string)
+	nodes6, ok6 := data["nodes6"].(string)
+	if !ok && !ok6 {
+		return errors.New("nodes not found")
+	}
+	if len(nodes)%26 != 0 || len(nodes6)%38 != 0 {
+		return errors.New("the length of nodes should can be divided by 26, and the one of nodes6 by 38")
 	}
 
 	hasNew, found := false, false
-	for i := 0; i < len(nodes)/26; i++ {
-		node, _ := dht.NewNodeFromCompactInfo(string(nodes[i*26:(i+1)*26]), table.Network)
-		if node.ID.RawString() == targetID.RawString() {
+	for _, node := range dht.ParseNodes(data, table.Network) {
+		if node.ID == targetID {
 			found = true
 		}
 
 		if table.GetRoutingTable().Insert(node) {
 			hasNew = true
 		}
-		logrus.Infof("new_node received, id: %x, ip: %s, port: %d", []byte(node.ID.RawString()), node.Addr.IP.String(), node.Addr.Port)
+		logrus.Infof("new_node received, id: %s, ip: %s, port: %d", node.ID, node.Addr.IP.String(), node.Addr.Port)
 	}
+	// Lookup publishes EventLookupCompleted once its lookup is over
 	if found || !hasNew {
 		return nil
 	}
 
-	id := targetID.RawData()
+	id := targetID.Bytes()
 	for _, node := range table.GetRoutingTable().GetNeighbors(targetID, table.K) {
 		switch requestType {
 		case dht.FindNodeType:
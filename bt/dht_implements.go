@@ -4,7 +4,7 @@ import "github.com/johnnyeven/terra/dht"
 
 func Ping(node *dht.Node, t *dht.Transport) {
 	data := map[string]interface{}{
-		"id": t.GetDHT().ID(node.ID.RawString()),
+		"id": t.GetDHT().ID(node.Addr, node.ID.RawString()),
 	}
 
 	request := t.MakeRequest(node.ID, node.Addr, dht.PingType, data)
@@ -12,31 +12,58 @@ func Ping(node *dht.Node, t *dht.Transport) {
 }
 
 func FindNode(node *dht.Node, t *dht.Transport, target []byte) {
+	findNode(node, t, target, dht.PriorityQuery)
+}
+
+// RefreshNode sends a find_node query with the lowest priority, it is used to
+// refresh the buckets of the routing table.
+func RefreshNode(node *dht.Node, t *dht.Transport, target []byte) {
+	findNode(node, t, target, dht.PriorityRefresh)
+}
+
+func findNode(node *dht.Node, t *dht.Transport, target []byte, priority int) {
 	if len(target) == 0 {
-		target = t.GetDHT().Self.ID.RawData()
+		target = t.GetDHT().SelfID(node.Addr.IP.To4() == nil).Bytes()
 	}
 	data := map[string]interface{}{
-		"id":     t.GetDHT().ID(string(target)),
+		"id":     t.GetDHT().ID(node.Addr, string(target)),
 		"target": string(target),
 	}
 
 	request := t.MakeRequest(node.ID, node.Addr, dht.FindNodeType, data)
+	request.Priority = priority
 	t.Request(request)
 }
 
 func GetPeers(node *dht.Node, t *dht.Transport, infoHash []byte) {
 	data := map[string]interface{}{
-		"id":        t.GetDHT().ID(string(infoHash)),
-		"info_hash": infoHash,
+		"id":        t.GetDHT().ID(node.Addr, string(infoHash)),
+		"info_hash": string(infoHash),
 	}
 
 	request := t.MakeRequest(node.ID, node.Addr, dht.GetPeersType, data)
 	t.Request(request)
 }
 
+// SampleInfohashes sends a BEP51 sample_infohashes query, the samples of the
+// response are published as observed info_hashes.
+func SampleInfohashes(node *dht.Node, t *dht.Transport, target []byte) {
+	if len(target) == 0 {
+		target = t.GetDHT().SelfID(node.Addr.IP.To4() == nil).Bytes()
+	}
+	data := map[string]interface{}{
+		"id":     t.GetDHT().ID(node.Addr, string(target)),
+		"target": string(target),
+	}
+
+	request := t.MakeRequest(node.ID, node.Addr, dht.SampleInfohashesType, data)
+	request.Priority = dht.PriorityRefresh
+	t.Request(request)
+}
+
 func AnnouncePeer(node *dht.Node, t *dht.Transport, infoHash string, impliedPort, port int, token string) {
 	data := map[string]interface{}{
-		"id":           t.GetDHT().ID(node.ID.RawString()),
+		"id":           t.GetDHT().ID(node.Addr, node.ID.RawString()),
 		"info_hash":    infoHash,
 		"implied_port": impliedPort,
 		"port":         port,
@@ -0,0 +1,96 @@
+package bt
+
+import (
+	"context"
+	"errors"
+	"github.com/johnnyeven/terra/dht"
+	"sync"
+)
+
+var ErrItemNotFound = errors.New("item not found")
+
+// Get looks the BEP 44 item stored under target up and returns it. salt is
+// the one of a mutable item, nodes do not return it. The mutable item of
+// the highest seq is returned, the items which do not match target or have
+// an invalid signature are ignored.
+func Get(ctx context.Context, table *dht.DistributedHashTable, target dht.NodeID, salt []byte) (*dht.Item, error) {
+	var found *dht.Item
+	_, err := lookup(ctx, table, target, dht.GetType, nil, func(node *dht.Node, r map[string]interface{}) {
+		item, _, err := parseItemArgs(r)
+		if err != nil {
+			return
+		}
+		if item.Mutable() {
+			item.Salt = salt
+		}
+		if item.Target() != target || item.Verify() != nil {
+			return
+		}
+		if found == nil || (item.Mutable() && item.Seq > found.Seq) {
+			found = item
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if found == nil {
+		return nil, ErrItemNotFound
+	}
+	return found, nil
+}
+
+// Put stores item on the K closest nodes of its target, which a get lookup
+// finds. If cas is not nil a mutable item is only stored by the nodes which
+// have the seq *cas. It returns how many nodes accepted the item, and the
+// error of one which did not if none did.
+func Put(ctx context.Context, table *dht.DistributedHashTable, item *dht.Item, cas *int64) (int, error) {
+	if err := item.Verify(); err != nil {
+		return 0, err
+	}
+
+	target := item.Target()
+	result, err := lookup(ctx, table, target, dht.GetType, nil, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	accepted := 0
+	var lastErr error
+	for _, node := range result.Nodes {
+		token, ok := result.Tokens[node.ID]
+		if !ok {
+			continue
+		}
+
+		a := itemArgs(item)
+		a["id"] = table.ID(node.Addr, target.RawString())
+		a["token"] = token
+		if cas != nil && item.Mutable() {
+			a["cas"] = int(*cas)
+		}
+		wg.Add(1)
+		go func(node *dht.Node) {
+			defer wg.Done()
+			_, err := Call(ctx, table.GetTransport(), node, dht.PutType, a)
+
+			mutex.Lock()
+			defer mutex.Unlock()
+			if err == nil {
+				accepted++
+			} else {
+				lastErr = err
+			}
+		}(node)
+	}
+	wg.Wait()
+
+	if accepted == 0 {
+		if ctx.Err() != nil {
+			return 0, ctx.Err()
+		}
+		return 0, lastErr
+	}
+	return accepted, nil
+}
@@ -0,0 +1,368 @@
+package bt
+
+import (
+	"context"
+	"errors"
+	"github.com/johnnyeven/terra/dht"
+	"github.com/johnnyeven/terra/dht/util"
+	"net"
+	"sort"
+	"sync"
+)
+
+// lookupConcurrency is how many queries of a lookup are in flight at once.
+const lookupConcurrency = 3
+
+var ErrNoNodes = errors.New("the routing table is empty")
+
+// Call sends the query q with the arguments a to node and waits for the
+// response, which is returned. It fails with dht.ErrTimeout if node does not
+// answer, or with a *dht.KRPCError if it answers an error.
+func Call(ctx context.Context, t *dht.Transport, node *dht.Node, q string, a map[string]interface{}) (map[string]interface{}, error) {
+	type result struct {
+		response map[string]interface{}
+		err      error
+	}
+	results := make(chan result, 1)
+	var once sync.Once
+
+	request := t.MakeRequest(node.ID, node.Addr, q, a)
+	request.Callback = func(response interface{}, err error) {
+		once.Do(func() {
+			r, _ := response.(map[string]interface{})
+			results <- result{r, err}
+		})
+	}
+	t.Request(request)
+
+	select {
+	case r := <-results:
+		return r.response, r.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// withID returns a copy of the arguments a with the node ID id, the queries
+// of a lookup go to nodes of both families.
+func withID(a map[string]interface{}, id string) map[string]interface{} {
+	args := make(map[string]interface{}, len(a)+1)
+	for key, value := range a {
+		args[key] = value
+	}
+	args["id"] = id
+	return args
+}
+
+// LookupResult is the outcome of an iterative lookup.
+type LookupResult struct {
+	Target dht.NodeID `json:"target"`
+	// the closest nodes to the target which answered
+	Nodes []*dht.Node `json:"nodes"`
+	// the get_peers tokens of Nodes
+	Tokens map[dht.NodeID]string `json:"-"`
+	// the peers returned by get_peers
+	Peers []*dht.Peer `json:"peers,omitempty"`
+}
+
+type lookupCandidate struct {
+	node      *dht.Node
+	queried   bool
+	responded bool
+}
+
+// Lookup runs an iterative find_node or get_peers lookup of target. It queries
+// the closest known nodes, lookupConcurrency at a time, until the K closest
+// nodes have all been queried.
+func Lookup(ctx context.Context, table *dht.DistributedHashTable, target dht.NodeID, q string) (*LookupResult, error) {
+	if q != dht.FindNodeType && q != dht.GetPeersType {
+		return nil, errors.New("invalid lookup type: " + q)
+	}
+	return lookup(ctx, table, target, q, nil, nil)
+}
+
+// lookup runs the lookup of Lookup, which can also be a BEP 44 get. The
+// queries have the arguments extra besides the usual ones and each response
+// is passed to onResponse, from the goroutine of the lookup.
+func lookup(ctx context.Context, table *dht.DistributedHashTable, target dht.NodeID, q string,
+	extra map[string]interface{}, onResponse func(node *dht.Node, r map[string]interface{})) (*LookupResult, error) {
+
+	seeds := table.GetRoutingTable().GetNeighbors(target, table.K)
+	if len(seeds) == 0 {
+		return nil, ErrNoNodes
+	}
+
+	type response struct {
+		candidate *lookupCandidate
+		r         map[string]interface{}
+		err       error
+	}
+
+	candidates := make([]*lookupCandidate, 0, len(seeds))
+	known := make(map[dht.NodeID]bool)
+	add := func(node *dht.Node) {
+		if known[node.ID] || table.IsSelf(node.ID) {
+			return
+		}
+		known[node.ID] = true
+		candidates = append(candidates, &lookupCandidate{node: node})
+	}
+	for _, node := range seeds {
+		add(node)
+	}
+
+	result := &LookupResult{Target: target, Tokens: make(map[dht.NodeID]string)}
+	seenPeers := make(map[string]bool)
+	responses := make(chan response, lookupConcurrency)
+	inFlight := 0
+
+	a := map[string]interface{}{}
+	if q == dht.GetPeersType {
+		a["info_hash"] = target.RawString()
+	} else {
+		a["target"] = target.RawString()
+	}
+	if table.DualStack() {
+		a["want"] = []interface{}{"n4", "n6"}
+	}
+	for key, value := range extra {
+		a[key] = value
+	}
+
+	for {
+		sort.Slice(candidates, func(i, j int) bool {
+			return target.CompareDistance(candidates[i].node.ID, candidates[j].node.ID) < 0
+		})
+
+		// query the closest unqueried nodes among the K closest
+		for i := 0; i < len(candidates) && i < table.K && inFlight < lookupConcurrency; i++ {
+			c := candidates[i]
+			if c.queried {
+				continue
+			}
+			c.queried = true
+			inFlight++
+			go func(c *lookupCandidate) {
+				r, err := Call(ctx, table.GetTransport(), c.node, q, withID(a, table.ID(c.node.Addr, target.RawString())))
+				responses <- response{c, r, err}
+			}(c)
+		}
+
+		if inFlight == 0 {
+			break
+		}
+
+		var resp response
+		select {
+		case resp = <-responses:
+			inFlight--
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		if resp.err != nil {
+			continue
+		}
+		resp.candidate.responded = true
+		if onResponse != nil {
+			onResponse(resp.candidate.node, resp.r)
+		}
+
+		for _, node := range dht.ParseNodes(resp.r, table.Network) {
+			add(node)
+		}
+		if token, ok := resp.r["token"].(string); ok {
+			result.Tokens[resp.candidate.node.ID] = token
+		}
+		for _, peer := range parsePeers(resp.r) {
+			if addr := peer.Addr(); !seenPeers[addr] {
+				seenPeers[addr] = true
+				result.Peers = append(result.Peers, peer)
+			}
+		}
+	}
+
+	found := len(result.Peers) > 0
+	for _, c := range candidates {
+		if !c.responded {
+			continue
+		}
+		if c.node.ID == target {
+			found = true
+		}
+		if len(result.Nodes) < table.K {
+			result.Nodes = append(result.Nodes, c.node)
+		}
+	}
+
+	table.Events().Publish(dht.Event{
+		Type:   dht.EventLookupCompleted,
+		Method: q,
+		Target: target,
+		Found:  found,
+	})
+	return result, nil
+}
+
+// Announce announces that we are a peer of infoHash listening on port to the
+// closest nodes of a get_peers lookup. If port is 0 the source port is
+// announced. It returns how many nodes accepted the announce.
+func Announce(ctx context.Context, table *dht.DistributedHashTable, infoHash dht.NodeID, port int) (int, error) {
+	result, err := Lookup(ctx, table, infoHash, dht.GetPeersType)
+	if err != nil {
+		return 0, err
+	}
+
+	impliedPort := 0
+	if port == 0 {
+		impliedPort = 1
+	}
+
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	accepted := 0
+	for _, node := range result.Nodes {
+		token, ok := result.Tokens[node.ID]
+		if !ok {
+			continue
+		}
+
+		a := map[string]interface{}{
+			"id":           table.ID(node.Addr, infoHash.RawString()),
+			"info_hash":    infoHash.RawString(),
+			"implied_port": impliedPort,
+			"port":         port,
+			"token":        token,
+		}
+		wg.Add(1)
+		go func(node *dht.Node) {
+			defer wg.Done()
+			if _, err := Call(ctx, table.GetTransport(), node, dht.AnnouncePeerType, a); err == nil {
+				mutex.Lock()
+				accepted++
+				mutex.Unlock()
+			}
+		}(node)
+	}
+	wg.Wait()
+
+	if accepted == 0 && ctx.Err() != nil {
+		return 0, ctx.Err()
+	}
+	return accepted, nil
+}
+
+// ScrapeResult is the estimated size of the swarm of an info_hash.
+type ScrapeResult struct {
+	InfoHash dht.NodeID `json:"infoHash"`
+	Seeders  int        `json:"seeders"`
+	Leechers int        `json:"leechers"`
+	// how many of the closest nodes returned bloom filters
+	Nodes int `json:"nodes"`
+}
+
+// Scrape estimates the seeders and leechers of infoHash as BEP 33 describes:
+// it runs a get_peers lookup with scrape=1 and merges the bloom filters
+// returned by the K closest nodes which answered.
+func Scrape(ctx context.Context, table *dht.DistributedHashTable, infoHash dht.NodeID) (*ScrapeResult, error) {
+	type filters struct {
+		seeds, peers *dht.BloomFilter
+	}
+	responses := make(map[dht.NodeID]filters)
+
+	extra := map[string]interface{}{"scrape": 1}
+	result, err := lookup(ctx, table, infoHash, dht.GetPeersType, extra, func(node *dht.Node, r map[string]interface{}) {
+		sd, _ := r["BFsd"].(string)
+		pe, _ := r["BFpe"].(string)
+		seeds, ok := dht.BloomFilterFromString(sd)
+		if !ok {
+			return
+		}
+		peers, ok := dht.BloomFilterFromString(pe)
+		if !ok {
+			return
+		}
+		responses[node.ID] = filters{seeds, peers}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	seeds, peers := &dht.BloomFilter{}, &dht.BloomFilter{}
+	scrape := &ScrapeResult{InfoHash: infoHash}
+	for _, node := range result.Nodes {
+		f, ok := responses[node.ID]
+		if !ok {
+			continue
+		}
+		seeds.Merge(f.seeds)
+		peers.Merge(f.peers)
+		scrape.Nodes++
+	}
+	scrape.Seeders = seeds.Estimate()
+	scrape.Leechers = peers.Estimate()
+	return scrape, nil
+}
+
+// PingAddr pings the node at addr and returns it with the ID it answered.
+func PingAddr(ctx context.Context, table *dht.DistributedHashTable, addr *net.UDPAddr) (*dht.Node, error) {
+	r, err := Call(ctx, table.GetTransport(), &dht.Node{Addr: addr}, dht.PingType, map[string]interface{}{
+		"id": table.ID(addr, ""),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	id, _ := r["id"].(string)
+	return dht.NewNode(id, addr.Network(), addr.String())
+}
+
+// Query sends a find_node or get_peers query of target to the node at addr
+// only, the result holds the nodes and peers it returned.
+func Query(ctx context.Context, table *dht.DistributedHashTable, addr *net.UDPAddr, target dht.NodeID, q string) (*LookupResult, error) {
+	a := map[string]interface{}{"id": table.ID(addr, target.RawString())}
+	switch q {
+	case dht.FindNodeType:
+		a["target"] = target.RawString()
+	case dht.GetPeersType:
+		a["info_hash"] = target.RawString()
+	default:
+		return nil, errors.New("invalid query type: " + q)
+	}
+
+	r, err := Call(ctx, table.GetTransport(), &dht.Node{Addr: addr}, q, a)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &LookupResult{Target: target, Tokens: make(map[dht.NodeID]string)}
+	result.Nodes = dht.ParseNodes(r, table.Network)
+	result.Peers = parsePeers(r)
+	return result, nil
+}
+
+// parsePeers returns the peers of the values of a get_peers response, 6
+// bytes for an IPv4 peer and 18 bytes for an IPv6 one.
+func parsePeers(r map[string]interface{}) []*dht.Peer {
+	values, _ := r["values"].([]interface{})
+	peers := make([]*dht.Peer, 0, len(values))
+	for _, value := range values {
+		info, ok := value.(string)
+		if !ok {
+			continue
+		}
+		if len(info) == net.IPv6len+2 {
+			port := int(info[16])<<8 | int(info[17])
+			peers = append(peers, &dht.Peer{IP: net.IP(info[:16]), Port: port})
+			continue
+		}
+		if len(info) != 6 {
+			continue
+		}
+		ip, port, err := util.DecodeCompactIPPortInfo(info)
+		if err != nil {
+			continue
+		}
+		peers = append(peers, &dht.Peer{IP: ip, Port: port})
+	}
+	return peers
+}
@@ -0,0 +1,401 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/johnnyeven/terra/dht/util"
+	"github.com/spf13/cobra"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// The JSON view of bencode keeps the strings which are readable text as JSON
+// strings and replaces the others by an object with a single key:
+//
+//	{"$hex": "..."}                              any string
+//	{"$nodes": [{"id": "...", "addr": "..."}]}   compact node info, with --expand
+//	{"$peers": ["ip:port", ...]}                 compact peer info, with --expand
+//	{"$peer": "ip:port"}                         a single compact peer, with --expand
+//
+// Dict keys which are not readable are written as "$hex:...".
+const (
+	hexKey   = "$hex"
+	nodesKey = "$nodes"
+	peersKey = "$peers"
+	peerKey  = "$peer"
+
+	hexKeyPrefix = "$hex:"
+)
+
+var (
+	bencodeExpand bool
+	bencodeIndent bool
+	bencodeOutput string
+)
+
+var bencodeCmd = &cobra.Command{
+	Use:   "bencode",
+	Short: "Convert bencode to JSON and back",
+}
+
+var bencodeDecodeCmd = &cobra.Command{
+	Use:   "decode [file]",
+	Short: "Print bencode read from a file or stdin as JSON",
+	Long: `Print bencode read from a file or stdin as JSON.
+
+Strings which are not readable text are printed as {"$hex": "..."}. With
+--expand, the compact node and peer fields of KRPC messages and tracker
+responses (nodes, nodes6, values, peers, peers6, ip) are printed as node IDs
+and IP:port instead. The output can be turned back into bencode by
+terra bencode encode.`,
+	Args: cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cmd.SilenceUsage = true
+
+		data, err := readInput(args)
+		if err != nil {
+			return err
+		}
+		value, err := util.Decode(data)
+		if err != nil {
+			return fmt.Errorf("decode bencode: %v", err)
+		}
+
+		view := bencodeToJSON(value, "", bencodeExpand)
+		var out []byte
+		if bencodeIndent {
+			out, err = json.MarshalIndent(view, "", "  ")
+		} else {
+			out, err = json.Marshal(view)
+		}
+		if err != nil {
+			return err
+		}
+		return writeOutput(append(out, '\n'))
+	},
+}
+
+var bencodeEncodeCmd = &cobra.Command{
+	Use:   "encode [file]",
+	Short: "Convert JSON read from a file or stdin to canonical bencode",
+	Long: `Convert JSON read from a file or stdin to canonical bencode, as printed
+by terra bencode decode. Numbers must be integers, and true, false and null
+can not be encoded.`,
+	Args: cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cmd.SilenceUsage = true
+
+		data, err := readInput(args)
+		if err != nil {
+			return err
+		}
+
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.UseNumber()
+		var view interface{}
+		if err := decoder.Decode(&view); err != nil {
+			return fmt.Errorf("decode JSON: %v", err)
+		}
+
+		value, err := jsonToBencode(view, "")
+		if err != nil {
+			return err
+		}
+		return writeOutput([]byte(util.Encode(value)))
+	},
+}
+
+// readInput reads the file of args, or stdin if there is none or it is "-".
+func readInput(args []string) ([]byte, error) {
+	if len(args) == 0 || args[0] == "-" {
+		return ioutil.ReadAll(os.Stdin)
+	}
+	return ioutil.ReadFile(args[0])
+}
+
+func writeOutput(data []byte) error {
+	var w io.Writer = os.Stdout
+	if bencodeOutput != "" && bencodeOutput != "-" {
+		file, err := os.Create(bencodeOutput)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		w = file
+	}
+	_, err := w.Write(data)
+	return err
+}
+
+// readable reports whether s can be shown as a JSON string without loss.
+func readable(s string) bool {
+	if !utf8.ValidString(s) {
+		return false
+	}
+	for _, r := range s {
+		if !unicode.IsPrint(r) && r != '\n' && r != '\r' && r != '\t' {
+			return false
+		}
+	}
+	return true
+}
+
+// bencodeToJSON returns the JSON view of a decoded bencode value, key is the
+// dict key of the value.
+func bencodeToJSON(value interface{}, key string, expand bool) interface{} {
+	switch v := value.(type) {
+	case int:
+		return v
+	case string:
+		if expand {
+			if expanded, ok := expandCompact(key, v); ok {
+				return expanded
+			}
+		}
+		if readable(v) {
+			return v
+		}
+		return map[string]interface{}{hexKey: hex.EncodeToString([]byte(v))}
+	case []interface{}:
+		list := make([]interface{}, len(v))
+		for i, item := range v {
+			// the items of values are compact peers
+			itemKey := ""
+			if key == "values" {
+				itemKey = "ip"
+			}
+			list[i] = bencodeToJSON(item, itemKey, expand)
+		}
+		return list
+	case map[string]interface{}:
+		dict := make(map[string]interface{}, len(v))
+		for k, item := range v {
+			name := k
+			if !readable(k) || strings.HasPrefix(k, "$") {
+				name = hexKeyPrefix + hex.EncodeToString([]byte(k))
+			}
+			dict[name] = bencodeToJSON(item, k, expand)
+		}
+		return dict
+	}
+	return value
+}
+
+// expandCompact returns the expanded view of the compact string s of key.
+func expandCompact(key, s string) (interface{}, bool) {
+	switch key {
+	case "nodes", "nodes6":
+		size := 26
+		if key == "nodes6" {
+			size = 38
+		}
+		if len(s) == 0 || len(s)%size != 0 {
+			return nil, false
+		}
+		nodes := make([]interface{}, 0, len(s)/size)
+		for i := 0; i < len(s); i += size {
+			nodes = append(nodes, map[string]interface{}{
+				"id":   hex.EncodeToString([]byte(s[i : i+20])),
+				"addr": compactPeer(s[i+20 : i+size]),
+			})
+		}
+		return map[string]interface{}{nodesKey: nodes}, true
+	case "peers", "peers6":
+		size := 6
+		if key == "peers6" {
+			size = 18
+		}
+		if len(s) == 0 || len(s)%size != 0 {
+			return nil, false
+		}
+		peers := make([]interface{}, 0, len(s)/size)
+		for i := 0; i < len(s); i += size {
+			peers = append(peers, compactPeer(s[i:i+size]))
+		}
+		return map[string]interface{}{peersKey: peers}, true
+	case "ip":
+		if len(s) != 6 && len(s) != 18 {
+			return nil, false
+		}
+		return map[string]interface{}{peerKey: compactPeer(s)}, true
+	}
+	return nil, false
+}
+
+// compactPeer returns ip:port of a 6 or 18 bytes compact peer.
+func compactPeer(s string) string {
+	ip := net.IP(s[:len(s)-2])
+	port := binary.BigEndian.Uint16([]byte(s[len(s)-2:]))
+	return net.JoinHostPort(ip.String(), strconv.Itoa(int(port)))
+}
+
+// parseCompactPeer is the reverse of compactPeer.
+func parseCompactPeer(addr string) (string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return "", fmt.Errorf("invalid IP %q", host)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	n, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return "", fmt.Errorf("invalid port %q", port)
+	}
+
+	var buf [2]byte
+	binary.BigEndian.PutUint16(buf[:], uint16(n))
+	return string(ip) + string(buf[:]), nil
+}
+
+// jsonToBencode returns the bencode value of a JSON view, path locates the
+// value in the errors.
+func jsonToBencode(view interface{}, path string) (interface{}, error) {
+	switch v := view.(type) {
+	case string:
+		return v, nil
+	case json.Number:
+		n, err := strconv.Atoi(v.String())
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s is not an integer", pathName(path), v)
+		}
+		return n, nil
+	case []interface{}:
+		list := make([]interface{}, len(v))
+		for i, item := range v {
+			value, err := jsonToBencode(item, fmt.Sprintf("%s[%d]", path, i))
+			if err != nil {
+				return nil, err
+			}
+			list[i] = value
+		}
+		return list, nil
+	case map[string]interface{}:
+		if len(v) == 1 {
+			for key, item := range v {
+				if strings.HasPrefix(key, "$") && !strings.HasPrefix(key, hexKeyPrefix) {
+					return parseMarker(key, item, path)
+				}
+			}
+		}
+
+		dict := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			name := key
+			if strings.HasPrefix(key, hexKeyPrefix) {
+				raw, err := hex.DecodeString(key[len(hexKeyPrefix):])
+				if err != nil {
+					return nil, fmt.Errorf("%s: invalid key %q: %v", pathName(path), key, err)
+				}
+				name = string(raw)
+			}
+			value, err := jsonToBencode(item, path+"."+key)
+			if err != nil {
+				return nil, err
+			}
+			dict[name] = value
+		}
+		return dict, nil
+	case nil:
+		return nil, fmt.Errorf("%s: null can not be encoded", pathName(path))
+	}
+	return nil, fmt.Errorf("%s: %v can not be encoded", pathName(path), view)
+}
+
+// parseMarker returns the string of a {"$hex"}, {"$nodes"}, {"$peers"} or
+// {"$peer"} object.
+func parseMarker(key string, item interface{}, path string) (interface{}, error) {
+	invalid := func(err error) error {
+		return fmt.Errorf("%s: invalid %s: %v", pathName(path), key, err)
+	}
+
+	switch key {
+	case hexKey:
+		s, ok := item.(string)
+		if !ok {
+			return nil, invalid(errors.New("should be a string"))
+		}
+		raw, err := hex.DecodeString(s)
+		if err != nil {
+			return nil, invalid(err)
+		}
+		return string(raw), nil
+	case peerKey:
+		s, ok := item.(string)
+		if !ok {
+			return nil, invalid(errors.New("should be a string"))
+		}
+		peer, err := parseCompactPeer(s)
+		if err != nil {
+			return nil, invalid(err)
+		}
+		return peer, nil
+	case peersKey, nodesKey:
+		items, ok := item.([]interface{})
+		if !ok {
+			return nil, invalid(errors.New("should be a list"))
+		}
+		var buf bytes.Buffer
+		for _, item := range items {
+			addr, id := item, ""
+			if key == nodesKey {
+				node, ok := item.(map[string]interface{})
+				if !ok {
+					return nil, invalid(errors.New("nodes should be objects with id and addr"))
+				}
+				s, _ := node["id"].(string)
+				raw, err := hex.DecodeString(s)
+				if err != nil || len(raw) != 20 {
+					return nil, invalid(fmt.Errorf("invalid node id %q", s))
+				}
+				addr, id = node["addr"], string(raw)
+			}
+
+			s, ok := addr.(string)
+			if !ok {
+				return nil, invalid(errors.New("addresses should be strings"))
+			}
+			peer, err := parseCompactPeer(s)
+			if err != nil {
+				return nil, invalid(err)
+			}
+			buf.WriteString(id)
+			buf.WriteString(peer)
+		}
+		return buf.String(), nil
+	}
+
+	return nil, fmt.Errorf("%s: unknown key %s, an object with a single $ key should be %s, %s, %s or %s", pathName(path), key, hexKey, nodesKey, peersKey, peerKey)
+}
+
+func pathName(path string) string {
+	if path == "" {
+		return "root"
+	}
+	return strings.TrimPrefix(path, ".")
+}
+
+func init() {
+	bencodeDecodeCmd.Flags().BoolVar(&bencodeExpand, "expand", false, "print the compact node and peer fields as node IDs and IP:port")
+	bencodeDecodeCmd.Flags().BoolVar(&bencodeIndent, "indent", false, "indent the JSON")
+
+	for _, cmd := range []*cobra.Command{bencodeDecodeCmd, bencodeEncodeCmd} {
+		cmd.Flags().StringVarP(&bencodeOutput, "output", "o", "", "write to this file instead of stdout")
+		bencodeCmd.AddCommand(cmd)
+	}
+	RootCmd.AddCommand(bencodeCmd)
+}
@@ -0,0 +1,94 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/johnnyeven/terra/admin"
+	"github.com/johnnyeven/terra/dht"
+	"github.com/spf13/cobra"
+	"os"
+	"time"
+)
+
+// flags of the commands which query the network
+var (
+	clientJSON             bool
+	clientTimeout          time.Duration
+	clientBootstrapTimeout time.Duration
+	clientListen           string
+	adminAddr              string
+)
+
+// addClientFlags adds the flags of the commands which query the network,
+// either through the admin API of a node or through a standalone node.
+func addClientFlags(cmd *cobra.Command) {
+	cmd.Flags().BoolVar(&clientJSON, "json", false, "print the result as JSON")
+	cmd.Flags().DurationVar(&clientTimeout, "timeout", 30*time.Second, "give up after this duration")
+	cmd.Flags().DurationVar(&clientBootstrapTimeout, "bootstrap-timeout", 30*time.Second, "how long the standalone node joins the network before the command starts")
+	cmd.Flags().StringVar(&adminAddr, "admin", "", "use the node whose admin API is at this address instead of a standalone node")
+	cmd.Flags().StringVar(&clientListen, "listen", ":0", "the UDP address of the standalone node")
+}
+
+// withAPI calls fn with the admin API of the node given by --admin, or of a
+// standalone node started for the command. The standalone node joins the
+// network first if bootstrap is set, within --bootstrap-timeout. The
+// --timeout of the command starts after that.
+func withAPI(cmd *cobra.Command, bootstrap bool, fn func(ctx context.Context, api admin.API) error) error {
+	cmd.SilenceUsage = true
+
+	if adminAddr != "" {
+		ctx, cancel := context.WithTimeout(context.Background(), clientTimeout)
+		defer cancel()
+		return fn(ctx, admin.NewClient(adminAddr))
+	}
+
+	config := newConfig(dht.ClientMode)
+	config.LocalAddr = clientListen
+	if bootstrap {
+		config.SeedNodes = defaultSeedNodes
+	}
+
+	table := dht.NewDHT(config)
+	go table.Run()
+	<-table.Ready()
+	defer table.Close()
+
+	if bootstrap {
+		bootstrapCtx, cancel := context.WithTimeout(context.Background(), clientBootstrapTimeout)
+		err := waitBootstrap(bootstrapCtx, table)
+		cancel()
+		if err != nil {
+			return err
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), clientTimeout)
+	defer cancel()
+	return fn(ctx, admin.NewLocal(table))
+}
+
+// waitBootstrap waits until the routing table of table holds K nodes.
+func waitBootstrap(ctx context.Context, table *dht.DistributedHashTable) error {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+
+	for table.GetRoutingTable().Len() < table.K {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			if table.GetRoutingTable().Len() > 0 {
+				return nil
+			}
+			return errors.New("bootstrap timed out")
+		}
+	}
+	return nil
+}
+
+// printJSON prints v as indented JSON.
+func printJSON(v interface{}) error {
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(v)
+}
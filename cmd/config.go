@@ -0,0 +1,292 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"github.com/johnnyeven/terra/dht"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// configOption binds a field of dht.Config to a config file key, an
+// environment variable and a flag. The key is also the flag name, and the
+// environment variable is TERRA_ followed by the key in upper snake case.
+type configOption struct {
+	field string
+	key   string
+	usage string
+}
+
+var configOptions = []configOption{
+	{"Mode", "mode", "the node mode, client or crawler, the defaults of the other options depend on it"},
+	{"Network", "network", "the UDP network, udp4 or udp6"},
+	{"LocalAddr", "listen", "the UDP address to listen on"},
+	{"ExtraLocalAddrs", "extra-listen", "more UDP addresses to listen on with the same node, e.g. [::]:6881 for IPv6"},
+	{"SeedNodes", "seed-nodes", "the bootstrap nodes, host:port separated by commas"},
+	{"NodeID", "node-id", "the node ID in hex or base32, random if not set"},
+	{"K", "k", "how many nodes are returned by find_node and get_peers"},
+	{"BucketSize", "bucket-size", "how many nodes a bucket of the routing table holds"},
+	{"MaxNodes", "max-nodes", "how many nodes the routing table holds"},
+	{"RefreshNodeCount", "refresh-node-count", "how many nodes of a bucket are queried when it is refreshed"},
+	{"BucketExpiredAfter", "bucket-expired-after", "how long a bucket may stay unchanged before it is refreshed"},
+	{"NodeExpiredAfter", "node-expired-after", "how long a node may stay inactive before it is pinged"},
+	{"CheckBucketPeriod", "check-bucket-period", "how often the buckets are checked"},
+	{"MaxTransactionCursor", "max-transaction-cursor", "the transaction IDs wrap around at this value"},
+	{"MaxPacketsPerSecond", "max-packets-per-second", "how many packets can be sent per second, 0 means unlimited"},
+	{"MaxBytesPerSecond", "max-bytes-per-second", "how many bytes can be sent per second, 0 means unlimited"},
+	{"MaxPacketsPerSecondPerNode", "max-packets-per-second-per-node", "how many packets can be sent to the same address per second, 0 means unlimited"},
+	{"MaxPendingRequests", "max-pending-requests", "how many queries can wait for a response, 0 means unlimited"},
+	{"RequestQueueSize", "request-queue-size", "how many requests can wait to be sent"},
+	{"PacketQueueSize", "packet-queue-size", "how many received packets can wait for the handler"},
+	{"BlocklistFile", "blocklist-file", "a file of IP ranges whose packets are dropped"},
+	{"MaxQueriesPerSecondPerIP", "max-queries-per-second-per-ip", "how many queries an IP can send per second, 0 means unlimited"},
+	{"QueryBurstPerIP", "query-burst-per-ip", "how many queries an IP can send at once"},
+	{"MaxStrikes", "max-strikes", "how many strikes get an IP banned, 0 disables banning"},
+	{"BanDuration", "ban-duration", "how long an IP stays banned"},
+	{"MaxNodesPerIPPerBucket", "max-nodes-per-ip-per-bucket", "how many nodes of the same IP a bucket holds, 0 means unlimited"},
+	{"MaxNodesPerSubnetPerBucket", "max-nodes-per-subnet-per-bucket", "how many nodes of the same subnet a bucket holds, 0 means unlimited"},
+	{"MaxNodesPerIP", "max-nodes-per-ip", "how many nodes of the same IP the routing table holds, 0 means unlimited"},
+	{"MaxNodesPerSubnet", "max-nodes-per-subnet", "how many nodes of the same subnet the routing table holds, 0 means unlimited"},
+	{"PublicNetwork", "public-network", "reject nodes with private, reserved or loopback addresses"},
+	{"ReadOnly", "read-only", "send the queries with ro=1 and answer none, other nodes then leave this one out of their routing table"},
+	{"MaxTorrents", "max-torrents", "how many torrents the peer store holds, 0 means unlimited"},
+	{"MaxPeersPerTorrent", "max-peers-per-torrent", "how many peers of a torrent the peer store holds, 0 means unlimited"},
+	{"PeerExpiredAfter", "peer-expired-after", "how long an announced peer is kept"},
+	{"MaxItems", "max-items", "how many BEP 44 items the item store holds, 0 means unlimited"},
+	{"ItemExpiredAfter", "item-expired-after", "how long a BEP 44 item is kept after it has been put"},
+	{"AdminAddr", "admin", "serve the admin HTTP API on this address, e.g. 127.0.0.1:8080"},
+	{"MetricsAddr", "metrics", "serve the Prometheus /metrics endpoint on this address, it may be the admin address"},
+	{"CaptureFile", "capture-file", "write every sent and received packet to this pcap file"},
+}
+
+// envName returns the environment variable of a config key.
+func envName(key string) string {
+	return "TERRA_" + strings.ToUpper(strings.Replace(key, "-", "_", -1))
+}
+
+var configPrintJSON bool
+
+var configCmd = &cobra.Command{
+	Use:   "config",
+	Short: "Inspect the node configuration",
+}
+
+var configPrintCmd = &cobra.Command{
+	Use:   "print",
+	Short: "Print the effective configuration",
+	Long: `Print the effective configuration of serve with the same config file,
+environment and flags. Each option is taken from the first of its flag, its
+TERRA_<KEY> environment variable, the config file and the mode defaults.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cmd.SilenceUsage = true
+
+		config, err := loadConfig(cmd.Flags())
+		if err != nil {
+			return err
+		}
+
+		values := configValues(config)
+		if configPrintJSON {
+			return printJSON(values)
+		}
+
+		keys := make([]string, 0, len(values))
+		for key := range values {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			fmt.Printf("%s: %v\n", key, values[key])
+		}
+		return nil
+	},
+}
+
+// addConfigFlags adds a flag of each config option to flags, with the
+// defaults of the crawler mode.
+func addConfigFlags(flags *pflag.FlagSet) {
+	config := newConfig(dht.CrawlerMode)
+	config.SeedNodes = defaultSeedNodes
+	defaults := reflect.ValueOf(config).Elem()
+	for _, option := range configOptions {
+		v := defaults.FieldByName(option.field)
+		usage := option.usage + " (" + envName(option.key) + ")"
+
+		switch v.Interface().(type) {
+		case string:
+			flags.String(option.key, v.String(), usage)
+		case int:
+			flags.Int(option.key, int(v.Int()), usage)
+		case uint64:
+			flags.Uint64(option.key, v.Uint(), usage)
+		case bool:
+			flags.Bool(option.key, v.Bool(), usage)
+		case time.Duration:
+			flags.Duration(option.key, time.Duration(v.Int()), usage)
+		case []string:
+			flags.StringSlice(option.key, v.Interface().([]string), usage)
+		default:
+			panic("unsupported config option type: " + option.field)
+		}
+	}
+}
+
+// loadConfig returns the config given by flags, the environment and the
+// config file, on top of the defaults of the mode.
+func loadConfig(flags *pflag.FlagSet) (*dht.Config, error) {
+	mode, source, err := configValue(flags, "mode")
+	if err != nil {
+		return nil, err
+	}
+	if mode == nil {
+		mode = dht.CrawlerMode
+	}
+	modeName := fmt.Sprint(mode)
+	if modeName != dht.ClientMode && modeName != dht.CrawlerMode {
+		return nil, fmt.Errorf("invalid mode %q from %s: should be %s or %s", modeName, source, dht.ClientMode, dht.CrawlerMode)
+	}
+
+	config := newConfig(modeName)
+	config.SeedNodes = defaultSeedNodes
+
+	fields := reflect.ValueOf(config).Elem()
+	for _, option := range configOptions {
+		raw, source, err := configValue(flags, option.key)
+		if err != nil {
+			return nil, err
+		}
+		if raw == nil {
+			continue
+		}
+
+		field := fields.FieldByName(option.field)
+		value, err := parseConfigValue(field.Type(), raw)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s from %s: %v", option.key, source, err)
+		}
+		field.Set(value)
+	}
+
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// configValue returns the raw value of key and where it comes from, or nil
+// if it is not set.
+func configValue(flags *pflag.FlagSet, key string) (interface{}, string, error) {
+	if flag := flags.Lookup(key); flag != nil && flag.Changed {
+		if flag.Value.Type() == "stringSlice" {
+			value, err := flags.GetStringSlice(key)
+			return value, "flag --" + key, err
+		}
+		return flag.Value.String(), "flag --" + key, nil
+	}
+
+	if !viper.IsSet(key) {
+		return nil, "", nil
+	}
+	source := "config file key " + key
+	if _, ok := os.LookupEnv(envName(key)); ok {
+		source = "environment variable " + envName(key)
+	}
+	return viper.Get(key), source, nil
+}
+
+// parseConfigValue converts a flag, environment or config file value to t.
+func parseConfigValue(t reflect.Type, raw interface{}) (reflect.Value, error) {
+	if t == reflect.TypeOf([]string(nil)) {
+		var values []string
+		switch v := raw.(type) {
+		case []string:
+			values = v
+		case []interface{}:
+			for _, item := range v {
+				values = append(values, fmt.Sprint(item))
+			}
+		default:
+			values = strings.FieldsFunc(fmt.Sprint(v), func(r rune) bool {
+				return r == ',' || r == ' '
+			})
+		}
+		return reflect.ValueOf(values), nil
+	}
+
+	s := strings.TrimSpace(fmt.Sprint(raw))
+	switch t {
+	case reflect.TypeOf(""):
+		return reflect.ValueOf(s), nil
+	case reflect.TypeOf(0):
+		v, err := strconv.Atoi(s)
+		if err != nil {
+			return reflect.Value{}, errors.New("should be an integer")
+		}
+		return reflect.ValueOf(v), nil
+	case reflect.TypeOf(uint64(0)):
+		v, err := strconv.ParseUint(s, 10, 64)
+		if err != nil {
+			return reflect.Value{}, errors.New("should be a positive integer")
+		}
+		return reflect.ValueOf(v), nil
+	case reflect.TypeOf(false):
+		v, err := strconv.ParseBool(s)
+		if err != nil {
+			return reflect.Value{}, errors.New("should be true or false")
+		}
+		return reflect.ValueOf(v), nil
+	case reflect.TypeOf(time.Duration(0)):
+		v, err := time.ParseDuration(s)
+		if err != nil {
+			return reflect.Value{}, errors.New("should be a duration like 30s or 15m")
+		}
+		return reflect.ValueOf(v), nil
+	}
+	return reflect.Value{}, errors.New("unsupported type " + t.String())
+}
+
+// configValues returns the config options of config by key.
+func configValues(config *dht.Config) map[string]interface{} {
+	fields := reflect.ValueOf(config).Elem()
+	values := make(map[string]interface{}, len(configOptions))
+	for _, option := range configOptions {
+		v := fields.FieldByName(option.field).Interface()
+		if d, ok := v.(time.Duration); ok {
+			v = d.String()
+		}
+		values[option.key] = v
+	}
+	return values
+}
+
+func init() {
+	// every field of dht.Config but the functions must be an option
+	t := reflect.TypeOf(dht.Config{})
+	options := make(map[string]bool, len(configOptions))
+	for _, option := range configOptions {
+		options[option.field] = true
+	}
+	for i := 0; i < t.NumField(); i++ {
+		if f := t.Field(i); f.Type.Kind() != reflect.Func && !options[f.Name] {
+			panic("dht.Config field without config option: " + f.Name)
+		}
+	}
+
+	for _, option := range configOptions {
+		viper.BindEnv(option.key, envName(option.key))
+	}
+
+	addConfigFlags(configPrintCmd.Flags())
+	configPrintCmd.Flags().BoolVar(&configPrintJSON, "json", false, "print the configuration as JSON")
+
+	configCmd.AddCommand(configPrintCmd)
+	RootCmd.AddCommand(configCmd)
+}
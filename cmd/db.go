@@ -0,0 +1,193 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/johnnyeven/terra/dht"
+	"github.com/johnnyeven/terra/storage"
+	"github.com/spf13/cobra"
+	"io"
+	"os"
+	"time"
+)
+
+var (
+	dbPath          string
+	dbSince         time.Duration
+	dbLimit         int
+	dbOutput        string
+	dbPeersLifetime time.Duration
+)
+
+// torrentRecord is a torrent with its peers, as printed by the db commands.
+type torrentRecord struct {
+	*storage.Torrent
+	Peers []*dht.Peer `json:"peers,omitempty"`
+}
+
+var dbCmd = &cobra.Command{
+	Use:   "db",
+	Short: "Query the torrents and peers stored by the crawler",
+	PersistentPreRun: func(cmd *cobra.Command, args []string) {
+		// errors of the db commands are not usage errors
+		cmd.SilenceUsage = true
+	},
+}
+
+var dbCountCmd = &cobra.Command{
+	Use:   "count",
+	Short: "Print the number of stored torrents",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		store, err := storage.OpenFileStoreReadOnly(dbPath)
+		if err != nil {
+			return err
+		}
+		defer store.Close()
+
+		fmt.Println(store.Count())
+		return nil
+	},
+}
+
+var dbGetCmd = &cobra.Command{
+	Use:   "get <info_hash>",
+	Short: "Print a torrent and its peers as JSON",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		infoHash, err := dht.ParseNodeID(args[0])
+		if err != nil {
+			return err
+		}
+
+		store, err := storage.OpenFileStoreReadOnly(dbPath)
+		if err != nil {
+			return err
+		}
+		defer store.Close()
+
+		record, err := getTorrentRecord(store, infoHash)
+		if err != nil {
+			return err
+		}
+
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(record)
+	},
+}
+
+var dbListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List the torrents in order of last seen time",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		store, err := storage.OpenFileStoreReadOnly(dbPath)
+		if err != nil {
+			return err
+		}
+		defer store.Close()
+
+		var from time.Time
+		if dbSince > 0 {
+			from = time.Now().Add(-dbSince)
+		}
+
+		count := 0
+		return store.Range(from, time.Time{}, func(torrent *storage.Torrent) bool {
+			name := ""
+			if torrent.Metadata != nil {
+				name = torrent.Metadata.Name
+			}
+			fmt.Printf("%s\t%s\t%d\t%s\n", torrent.InfoHash, torrent.LastSeen.Format(time.RFC3339), torrent.Seen, name)
+
+			count++
+			return dbLimit <= 0 || count < dbLimit
+		})
+	},
+}
+
+var dbExportCmd = &cobra.Command{
+	Use:   "export",
+	Short: "Export the torrents and their peers as JSON lines",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		store, err := storage.OpenFileStoreReadOnly(dbPath)
+		if err != nil {
+			return err
+		}
+		defer store.Close()
+
+		var w io.Writer = os.Stdout
+		if dbOutput != "" {
+			f, err := os.Create(dbOutput)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			w = f
+		}
+
+		encoder := json.NewEncoder(w)
+		var exportErr error
+		err = store.Range(time.Time{}, time.Time{}, func(torrent *storage.Torrent) bool {
+			record := &torrentRecord{Torrent: torrent}
+			if record.Peers, exportErr = store.Peers(torrent.InfoHash); exportErr != nil {
+				return false
+			}
+			exportErr = encoder.Encode(record)
+			return exportErr == nil
+		})
+		if err != nil {
+			return err
+		}
+		return exportErr
+	},
+}
+
+var dbCompactCmd = &cobra.Command{
+	Use:   "compact",
+	Short: "Remove the old peers and rewrite the database file",
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		store, err := storage.OpenFileStore(dbPath)
+		if err != nil {
+			return err
+		}
+		defer store.Close()
+
+		removed, err := store.CompactPeers(time.Now().Add(-dbPeersLifetime))
+		if err != nil {
+			return err
+		}
+		if err := store.Compact(); err != nil {
+			return err
+		}
+		fmt.Printf("%d peers removed\n", removed)
+		return nil
+	},
+}
+
+func getTorrentRecord(store storage.Store, infoHash dht.NodeID) (*torrentRecord, error) {
+	torrent, err := store.Get(infoHash)
+	if err != nil {
+		return nil, err
+	}
+	peers, err := store.Peers(infoHash)
+	if err != nil {
+		return nil, err
+	}
+	return &torrentRecord{Torrent: torrent, Peers: peers}, nil
+}
+
+func init() {
+	dbCmd.PersistentFlags().StringVar(&dbPath, "db", "terra.db", "the database file")
+
+	dbListCmd.Flags().DurationVar(&dbSince, "since", 0, "only list the torrents seen within this duration")
+	dbListCmd.Flags().IntVar(&dbLimit, "limit", 0, "list at most this many torrents, 0 means no limit")
+	dbExportCmd.Flags().StringVarP(&dbOutput, "output", "o", "", "the output file (default is stdout)")
+	dbCompactCmd.Flags().DurationVar(&dbPeersLifetime, "peers-older-than", 24*time.Hour, "remove the peers not seen within this duration")
+
+	dbCmd.AddCommand(dbCountCmd, dbGetCmd, dbListCmd, dbExportCmd, dbCompactCmd)
+	RootCmd.AddCommand(dbCmd)
+}
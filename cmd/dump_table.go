@@ -0,0 +1,55 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"github.com/johnnyeven/terra/admin"
+	"github.com/spf13/cobra"
+	"time"
+)
+
+var dumpTableCmd = &cobra.Command{
+	Use:   "dump-table",
+	Short: "Print the routing table of a node",
+	Long: `Print the routing table of a node.
+
+Without --admin, a standalone node joins the network and its routing table is
+printed once it holds K nodes or --timeout is over.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return withAPI(cmd, true, func(ctx context.Context, api admin.API) error {
+			table, err := api.RoutingTable(ctx)
+			if err != nil {
+				return err
+			}
+
+			if clientJSON {
+				return printJSON(table)
+			}
+
+			fmt.Printf("self %s, %s mode, %d nodes in %d buckets\n", table.Self, table.Mode, table.Nodes, len(table.Buckets))
+			if table.SelfIPv6 != table.Self {
+				fmt.Printf("self %s for IPv6 nodes\n", table.SelfIPv6)
+			}
+			for _, addr := range table.LocalAddrs {
+				fmt.Printf("listening on %s\n", addr)
+			}
+			for _, ip := range table.ExternalIPs {
+				fmt.Printf("external IP %s\n", ip)
+			}
+			for _, bucket := range table.Buckets {
+				fmt.Printf("bucket %s/%d\t%d nodes\t%d candidates\tchanged %s\n",
+					bucket.Prefix, bucket.PrefixLen, len(bucket.Nodes), bucket.Candidates, bucket.LastChangeTime.Format(time.RFC3339))
+				for _, node := range bucket.Nodes {
+					fmt.Printf("  %s\t%s\tactive %s\n", node.ID, node.Addr, node.LastActiveTime.Format(time.RFC3339))
+				}
+			}
+			return nil
+		})
+	},
+}
+
+func init() {
+	addClientFlags(dumpTableCmd)
+	RootCmd.AddCommand(dumpTableCmd)
+}
@@ -0,0 +1,171 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/johnnyeven/terra/admin"
+	"github.com/johnnyeven/terra/dht"
+	"github.com/spf13/cobra"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+var (
+	itemSalt      string
+	itemKeyFile   string
+	itemSeq       int64
+	itemCAS       int64
+	itemJSONValue bool
+)
+
+var itemCmd = &cobra.Command{
+	Use:   "item",
+	Short: "Store and retrieve BEP 44 items in the DHT",
+}
+
+var itemGetCmd = &cobra.Command{
+	Use:   "get <target>",
+	Short: "Look an item up and print its value",
+	Long: `Look the item stored under a target up and print its value, as is if it
+is a string and as JSON otherwise. The target of a mutable item is printed by
+item put, --salt must be the one it was put with.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if _, err := dht.ParseNodeID(args[0]); err != nil {
+			return err
+		}
+
+		req := &admin.GetItemRequest{Target: args[0], Salt: []byte(itemSalt)}
+		return withAPI(cmd, true, func(ctx context.Context, api admin.API) error {
+			item, err := api.GetItem(ctx, req)
+			if err != nil {
+				return err
+			}
+			value, err := item.Value()
+			if err != nil {
+				return err
+			}
+
+			if clientJSON {
+				return printJSON(struct {
+					Target dht.NodeID  `json:"target"`
+					Seq    int64       `json:"seq"`
+					Value  interface{} `json:"value"`
+				}{item.Target(), item.Seq, bencodeToJSON(value, "", false)})
+			}
+			if s, ok := value.(string); ok {
+				fmt.Println(s)
+				return nil
+			}
+			return printJSON(bencodeToJSON(value, "", false))
+		})
+	},
+}
+
+var itemPutCmd = &cobra.Command{
+	Use:   "put <value>",
+	Short: "Store an item on the nodes closest to its target",
+	Long: `Store an item on the nodes closest to its target and print the target.
+
+The item is immutable, stored under the SHA-1 of its value, unless --key-file
+is given: it is then mutable, signed with the ed25519 key of the file and
+stored under the SHA-1 of the public key and --salt. The file holds the hex
+encoded 32 byte seed of the key, it is created with a new key if it does not
+exist. A mutable item replaces the stored one if its --seq is higher.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		var value interface{} = args[0]
+		if itemJSONValue {
+			decoder := json.NewDecoder(strings.NewReader(args[0]))
+			decoder.UseNumber()
+			var view interface{}
+			if err := decoder.Decode(&view); err != nil {
+				return fmt.Errorf("decode JSON: %v", err)
+			}
+			var err error
+			if value, err = jsonToBencode(view, ""); err != nil {
+				return err
+			}
+		}
+
+		req := &admin.PutItemRequest{}
+		var err error
+		if itemKeyFile == "" {
+			req.Item, err = dht.NewImmutableItem(value)
+		} else {
+			var key ed25519.PrivateKey
+			if key, err = loadItemKey(itemKeyFile); err != nil {
+				return err
+			}
+			req.Item, err = dht.NewMutableItem(key, []byte(itemSalt), itemSeq, value)
+			if cmd.Flags().Changed("cas") {
+				req.CAS = &itemCAS
+			}
+		}
+		if err != nil {
+			return err
+		}
+
+		return withAPI(cmd, true, func(ctx context.Context, api admin.API) error {
+			accepted, err := api.PutItem(ctx, req)
+			if err != nil {
+				return err
+			}
+
+			if clientJSON {
+				return printJSON(struct {
+					Target   dht.NodeID `json:"target"`
+					Accepted int        `json:"accepted"`
+				}{req.Item.Target(), accepted})
+			}
+			fmt.Printf("%s\tstored on %d nodes\n", req.Item.Target(), accepted)
+			return nil
+		})
+	},
+}
+
+// loadItemKey reads the ed25519 key of path, or writes a new one to it if
+// it does not exist.
+func loadItemKey(path string) (ed25519.PrivateKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		seed := make([]byte, ed25519.SeedSize)
+		if _, err := rand.Read(seed); err != nil {
+			return nil, err
+		}
+		if err := ioutil.WriteFile(path, []byte(hex.EncodeToString(seed)+"\n"), 0600); err != nil {
+			return nil, err
+		}
+		return ed25519.NewKeyFromSeed(seed), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	seed, err := hex.DecodeString(string(bytes.TrimSpace(data)))
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return nil, fmt.Errorf("%s: not a hex encoded %d byte seed", path, ed25519.SeedSize)
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+func init() {
+	addClientFlags(itemGetCmd)
+	itemGetCmd.Flags().StringVar(&itemSalt, "salt", "", "the salt of a mutable item")
+
+	addClientFlags(itemPutCmd)
+	itemPutCmd.Flags().StringVar(&itemSalt, "salt", "", "the salt of a mutable item, so one key can sign several items")
+	itemPutCmd.Flags().StringVar(&itemKeyFile, "key-file", "", "sign a mutable item with the key of this file")
+	itemPutCmd.Flags().Int64Var(&itemSeq, "seq", 1, "the sequence number of a mutable item")
+	itemPutCmd.Flags().Int64Var(&itemCAS, "cas", 0, "only replace a mutable item whose sequence number is this")
+	itemPutCmd.Flags().BoolVar(&itemJSONValue, "json-value", false, "the value is JSON, as bencode encode takes, instead of a string")
+
+	itemCmd.AddCommand(itemGetCmd, itemPutCmd)
+	RootCmd.AddCommand(itemCmd)
+}
@@ -0,0 +1,114 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"github.com/johnnyeven/terra/admin"
+	"github.com/johnnyeven/terra/bt"
+	"github.com/johnnyeven/terra/dht"
+	"github.com/spf13/cobra"
+	"net"
+)
+
+var lookupTarget string
+
+var findNodeCmd = &cobra.Command{
+	Use:   "find-node <addr|id>",
+	Short: "Ask a node for the nodes closest to a target, or look an ID up",
+	Long: `Ask a node for the nodes closest to a target, or look an ID up.
+
+With an address, a single find_node query of --target (a random ID by
+default) is sent to it. With an ID, an iterative lookup of the ID is run.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		req := &admin.LookupRequest{Type: dht.FindNodeType}
+		if _, _, err := net.SplitHostPort(args[0]); err == nil {
+			req.Addr = args[0]
+			req.Target = lookupTarget
+			if req.Target == "" {
+				req.Target = dht.RandomNodeID().String()
+			}
+		} else if _, err := dht.ParseNodeID(args[0]); err != nil {
+			return err
+		} else {
+			req.Target = args[0]
+		}
+
+		return withAPI(cmd, req.Addr == "", func(ctx context.Context, api admin.API) error {
+			result, err := api.Lookup(ctx, req)
+			if err != nil {
+				return err
+			}
+			return printLookupResult(result)
+		})
+	},
+}
+
+var getPeersCmd = &cobra.Command{
+	Use:   "get-peers <info_hash>",
+	Short: "Look the peers of an info_hash up",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if _, err := dht.ParseNodeID(args[0]); err != nil {
+			return err
+		}
+
+		req := &admin.LookupRequest{Type: dht.GetPeersType, Target: args[0]}
+		return withAPI(cmd, true, func(ctx context.Context, api admin.API) error {
+			result, err := api.Lookup(ctx, req)
+			if err != nil {
+				return err
+			}
+			return printLookupResult(result)
+		})
+	},
+}
+
+var scrapeCmd = &cobra.Command{
+	Use:   "scrape <info_hash>",
+	Short: "Estimate the seeders and leechers of an info_hash",
+	Long: `Estimate the seeders and leechers of an info_hash from the BEP 33 bloom
+filters of the nodes closest to it, without connecting to any peer.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		infoHash, err := dht.ParseNodeID(args[0])
+		if err != nil {
+			return err
+		}
+
+		return withAPI(cmd, true, func(ctx context.Context, api admin.API) error {
+			result, err := api.Scrape(ctx, infoHash)
+			if err != nil {
+				return err
+			}
+			if clientJSON {
+				return printJSON(result)
+			}
+			fmt.Printf("seeders\t%d\nleechers\t%d\nnodes\t%d\n", result.Seeders, result.Leechers, result.Nodes)
+			return nil
+		})
+	},
+}
+
+func printLookupResult(result *bt.LookupResult) error {
+	if clientJSON {
+		return printJSON(result)
+	}
+
+	for _, node := range result.Nodes {
+		fmt.Printf("node\t%s\t%s\n", node.ID, node.Addr)
+	}
+	for _, peer := range result.Peers {
+		fmt.Printf("peer\t%s\n", peer.Addr())
+	}
+	return nil
+}
+
+func init() {
+	addClientFlags(findNodeCmd)
+	findNodeCmd.Flags().StringVar(&lookupTarget, "target", "", "the target ID of the query sent to an address")
+	addClientFlags(getPeersCmd)
+	addClientFlags(scrapeCmd)
+
+	RootCmd.AddCommand(findNodeCmd, getPeersCmd, scrapeCmd)
+}
@@ -0,0 +1,33 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"github.com/johnnyeven/terra/admin"
+	"github.com/spf13/cobra"
+)
+
+var pingCmd = &cobra.Command{
+	Use:   "ping <addr>",
+	Short: "Ping a DHT node",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return withAPI(cmd, false, func(ctx context.Context, api admin.API) error {
+			result, err := api.Ping(ctx, args[0])
+			if err != nil {
+				return err
+			}
+
+			if clientJSON {
+				return printJSON(result)
+			}
+			fmt.Printf("%s\t%s\t%s\n", result.Node.ID, result.Node.Addr, result.RTT)
+			return nil
+		})
+	},
+}
+
+func init() {
+	addClientFlags(pingCmd)
+	RootCmd.AddCommand(pingCmd)
+}
@@ -0,0 +1,162 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"github.com/johnnyeven/terra/dht"
+	"github.com/spf13/cobra"
+	"io"
+	"net"
+	"os"
+	"time"
+)
+
+var (
+	replayLocal string
+	replaySpeed float64
+	replayWait  time.Duration
+)
+
+var replayCmd = &cobra.Command{
+	Use:   "replay <file.pcap>",
+	Short: "Feed the packets of a capture file to a node",
+	Long: `Feed the packets received by a node, as captured with --capture-file, to a
+new node on an in-memory network, so an incident can be reproduced offline.
+
+The local address of the capture is the one found in most packets unless
+--local is given, the packets sent to it are replayed and the others are
+skipped. The node takes the ID found in the packets it sent unless --node-id
+is given. It is configured like serve, without seed nodes and without the
+firewall and send rate limits, so that every packet is handled and answered
+as fast as it is replayed. The packets it sends go nowhere but to its own
+--capture-file.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cmd.SilenceUsage = true
+
+		packets, err := readCapture(args[0])
+		if err != nil {
+			return err
+		}
+
+		local, err := captureLocalAddr(packets)
+		if err != nil {
+			return err
+		}
+
+		config, err := loadConfig(cmd.Flags())
+		if err != nil {
+			return err
+		}
+		if config.NodeID == "" {
+			id, err := dht.CapturedNodeID(packets, local)
+			if err != nil {
+				return err
+			}
+			config.NodeID = id.String()
+		}
+
+		network := dht.NewMemoryNetwork()
+		config.ListenFunc = network.ListenPacket
+		config.LocalAddr = local.String()
+		config.SeedNodes = nil
+		config.MaxQueriesPerSecondPerIP = 0
+		config.MaxStrikes = 0
+		config.MaxPacketsPerSecond = 0
+		config.MaxBytesPerSecond = 0
+		config.MaxPacketsPerSecondPerNode = 0
+		if local.IP.To4() == nil {
+			config.Network = "udp6"
+		}
+
+		table := dht.NewDHT(config)
+		go table.Run()
+		<-table.Ready()
+		defer table.Close()
+
+		to := table.GetTransport().LocalAddr().(*net.UDPAddr)
+		var replayed, dropped, skipped int
+		var last time.Time
+		for _, packet := range packets {
+			if packet.Dst.String() != local.String() {
+				skipped++
+				continue
+			}
+
+			if replaySpeed > 0 && !last.IsZero() {
+				time.Sleep(time.Duration(float64(packet.Time.Sub(last)) / replaySpeed))
+			}
+			last = packet.Time
+
+			if network.DeliverWait(packet.Data, packet.Src, to) {
+				replayed++
+			} else {
+				dropped++
+			}
+		}
+		time.Sleep(replayWait)
+
+		stats := table.GetTransport().Stats()
+		fmt.Printf("local address %s, node ID %s\n", local, table.Self.ID)
+		fmt.Printf("%d packets replayed, %d dropped, %d sent by the local address skipped\n", replayed, dropped, skipped)
+		fmt.Printf("%d packets sent in response\n", stats.PacketsOut)
+		fmt.Printf("%d nodes in the routing table, %d torrents and %d peers in the peer store\n",
+			table.GetRoutingTable().Len(), table.PeerStore().Len(), table.PeerStore().PeerCount())
+		return nil
+	},
+}
+
+func readCapture(path string) ([]*dht.CapturedPacket, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	reader, err := dht.NewPcapReader(file)
+	if err != nil {
+		return nil, err
+	}
+
+	packets := make([]*dht.CapturedPacket, 0)
+	for {
+		packet, err := reader.Next()
+		if err == io.EOF {
+			return packets, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		packets = append(packets, packet)
+	}
+}
+
+// captureLocalAddr returns --local, or the address found in most packets.
+func captureLocalAddr(packets []*dht.CapturedPacket) (*net.UDPAddr, error) {
+	if replayLocal != "" {
+		return net.ResolveUDPAddr("udp", replayLocal)
+	}
+
+	counts := make(map[string]int)
+	var local *net.UDPAddr
+	for _, packet := range packets {
+		for _, addr := range []*net.UDPAddr{packet.Src, packet.Dst} {
+			counts[addr.String()]++
+			if local == nil || counts[addr.String()] > counts[local.String()] {
+				local = addr
+			}
+		}
+	}
+	if local == nil {
+		return nil, errors.New("no UDP packet in the capture file")
+	}
+	return local, nil
+}
+
+func init() {
+	addConfigFlags(replayCmd.Flags())
+	replayCmd.Flags().StringVar(&replayLocal, "local", "", "the address of the captured node, found from the packets if not set")
+	replayCmd.Flags().Float64Var(&replaySpeed, "speed", 0, "replay at this multiple of the captured pace, 0 means as fast as possible")
+	replayCmd.Flags().DurationVar(&replayWait, "wait", time.Second, "how long the node may handle the last packets before the summary")
+	RootCmd.AddCommand(replayCmd)
+}
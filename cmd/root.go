@@ -18,9 +18,8 @@ import (
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 	"github.com/sirupsen/logrus"
-	"github.com/johnnyeven/terra/dht"
-	"github.com/johnnyeven/terra/bt"
 	"strings"
+	"os"
 )
 
 var (
@@ -32,22 +31,9 @@ var (
 var RootCmd = &cobra.Command{
 	Use:   "terra",
 	Short: "A P2P demo application",
-	Run: func(cmd *cobra.Command, args []string) {
-
-		config := dht.GetNormalConfig()
-		config.SeedNodes = []string{
-			"router.bittorrent.com:6881",
-			"router.utorrent.com:6881",
-			"dht.transmissionbt.com:6881",
-		}
-		config.TransportConstructor = dht.NewKRPCTransport
-		config.Handler = bt.BTHandlePacket
-		config.HandshakeFunc = bt.FindNode
-		config.PingFunc = bt.Ping
-
-		table := dht.NewDHT(config)
-		table.Run()
-	},
+	Run:   runServe,
+	// errors are logged by Execute
+	SilenceErrors: true,
 }
 
 // Execute adds all child commands to the root command and sets flags appropriately.
@@ -55,6 +41,7 @@ var RootCmd = &cobra.Command{
 func Execute() {
 	if err := RootCmd.Execute(); err != nil {
 		logrus.Errorf("%v", err)
+		os.Exit(1)
 	}
 }
 
@@ -64,9 +51,11 @@ func init() {
 	// Here you will define your flags and configuration settings.
 	// Cobra supports persistent flags, which, if defined here,
 	// will be global for your application.
-	RootCmd.Flags().StringVar(&cfgFile, "config", "", "config file (default is ./.terra.yaml)")
+	RootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file (default is ./.terra.yaml)")
+
+	RootCmd.PersistentFlags().StringVarP(&configFileGroup, "file-group", "g", "", "the config file is ./.terra.<group>.yaml")
 
-	RootCmd.Flags().StringVarP(&configFileGroup, "file-group", "g", "", "")
+	addServeFlags(RootCmd.Flags())
 }
 
 // initCmdConfig reads in config file and ENV variables if set.
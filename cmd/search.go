@@ -0,0 +1,120 @@
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/johnnyeven/terra/search"
+	"github.com/johnnyeven/terra/storage"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+var (
+	searchQuery  search.Query
+	searchSince  string
+	searchJSON   bool
+	searchHTTP   string
+	searchReload time.Duration
+)
+
+var searchCmd = &cobra.Command{
+	Use:   "search <query>",
+	Short: "Search the names and file paths of the stored torrents",
+	Long: `Search the names and file paths of the stored torrents.
+
+With --http the index is served over HTTP instead, GET /search?q=<query>
+answers the results as JSON. The index is then rebuilt from the database
+every --reload, while the crawler keeps writing it.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if searchHTTP == "" && len(args) == 0 {
+			return errors.New("a query is required")
+		}
+		cmd.SilenceUsage = true
+
+		index := search.NewIndex()
+		if err := rebuildIndex(index); err != nil {
+			return err
+		}
+
+		if searchHTTP != "" {
+			if searchReload > 0 {
+				go reloadIndex(index, searchReload)
+			}
+			mux := http.NewServeMux()
+			mux.Handle("/search", search.Handler(index))
+			logrus.Infof("%d torrents indexed, serving search on %s", index.Len(), searchHTTP)
+			return http.ListenAndServe(searchHTTP, mux)
+		}
+
+		searchQuery.Text = strings.Join(args, " ")
+		if searchSince != "" {
+			var err error
+			if searchQuery.Since, err = search.ParseTime(searchSince); err != nil {
+				return err
+			}
+		}
+
+		results, total := index.Search(&searchQuery)
+		if searchJSON {
+			encoder := json.NewEncoder(os.Stdout)
+			for _, result := range results {
+				if err := encoder.Encode(result); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+
+		for _, result := range results {
+			metadata := result.Torrent.Metadata
+			fmt.Printf("%s\t%.2f\t%d\t%d\t%s\n", result.Torrent.InfoHash, result.Score, metadata.Size, search.FileCount(metadata), metadata.Name)
+		}
+		fmt.Printf("%d of %d results\n", len(results), total)
+		return nil
+	},
+}
+
+// rebuildIndex replaces the content of index with the torrents of the
+// database, opened read-only for the time of the rebuild.
+func rebuildIndex(index *search.Index) error {
+	store, err := storage.OpenFileStoreReadOnly(dbPath)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	return index.Rebuild(store)
+}
+
+func reloadIndex(index *search.Index, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if err := rebuildIndex(index); err != nil {
+			logrus.Warningf("rebuild search index failed: %v", err)
+			continue
+		}
+		logrus.Debugf("%d torrents indexed", index.Len())
+	}
+}
+
+func init() {
+	searchCmd.Flags().StringVar(&dbPath, "db", "terra.db", "the database file")
+	searchCmd.Flags().Int64Var(&searchQuery.MinSize, "min-size", 0, "the minimum size in bytes")
+	searchCmd.Flags().Int64Var(&searchQuery.MaxSize, "max-size", 0, "the maximum size in bytes")
+	searchCmd.Flags().IntVar(&searchQuery.MinFiles, "min-files", 0, "the minimum number of files")
+	searchCmd.Flags().IntVar(&searchQuery.MaxFiles, "max-files", 0, "the maximum number of files")
+	searchCmd.Flags().StringVar(&searchSince, "since", "", "only torrents first seen after this RFC 3339 time or within this duration")
+	searchCmd.Flags().IntVar(&searchQuery.Limit, "limit", 20, "the maximum number of results, 0 means no limit")
+	searchCmd.Flags().BoolVar(&searchJSON, "json", false, "print the results as JSON lines")
+	searchCmd.Flags().StringVar(&searchHTTP, "http", "", "serve the search over HTTP on this address")
+	searchCmd.Flags().DurationVar(&searchReload, "reload", time.Minute, "how often the served index is rebuilt, 0 means never")
+
+	RootCmd.AddCommand(searchCmd)
+}
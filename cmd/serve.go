@@ -0,0 +1,183 @@
+package cmd
+
+import (
+	"github.com/johnnyeven/terra/admin"
+	"github.com/johnnyeven/terra/bt"
+	"github.com/johnnyeven/terra/dht"
+	"github.com/johnnyeven/terra/harvest"
+	"github.com/johnnyeven/terra/metrics"
+	"github.com/johnnyeven/terra/storage"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"net/http"
+	"time"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// defaultSeedNodes are the well-known bootstrap nodes of the mainline DHT.
+var defaultSeedNodes = []string{
+	"router.bittorrent.com:6881",
+	"router.utorrent.com:6881",
+	"dht.transmissionbt.com:6881",
+}
+
+var (
+	harvestFile     string
+	harvestStdout   bool
+	harvestDB       string
+	harvestWindow   time.Duration
+	harvestSampling time.Duration
+	harvestStorage  string
+)
+
+var serveCmd = &cobra.Command{
+	Use:   "serve",
+	Short: "Run a DHT node, this is what terra does without a command",
+	Args:  cobra.NoArgs,
+	Run:   runServe,
+}
+
+// newConfig returns the config of a node in mode speaking the BitTorrent DHT
+// protocol.
+func newConfig(mode string) *dht.Config {
+	config := dht.GetNormalConfig()
+	if mode == dht.CrawlerMode {
+		config = dht.GetCrawlerConfig()
+	}
+	config.Mode = mode
+	config.TransportConstructor = dht.NewKRPCTransport
+	config.Handler = bt.BTHandlePacket
+	config.HandshakeFunc = bt.FindNode
+	config.PingFunc = bt.Ping
+	config.RefreshFunc = bt.RefreshNode
+	return config
+}
+
+func runServe(cmd *cobra.Command, args []string) {
+	config, err := loadConfig(cmd.Flags())
+	if err != nil {
+		logrus.Fatalf("%v", err)
+	}
+
+	table := dht.NewDHT(config)
+	go serveHTTP(table)
+
+	sinks, err := harvestSinks()
+	if err != nil {
+		logrus.Fatalf("open harvest sinks err: %v", err)
+	}
+	if len(sinks) > 0 {
+		harvestConfig := harvest.GetDefaultConfig()
+		harvestConfig.Window = harvestWindow
+		harvestConfig.SampleInterval = harvestSampling
+		harvestConfig.SampleFunc = bt.SampleInfohashes
+		harvestConfig.Sinks = sinks
+
+		harvester := harvest.NewHarvester(table, harvestConfig)
+		go harvester.Run()
+		defer func() {
+			if err := harvester.Close(); err != nil {
+				logrus.Errorf("close harvester err: %v", err)
+			}
+		}()
+	}
+
+	go closeOnSignal(table)
+	table.Run()
+}
+
+// closeOnSignal closes table on SIGINT or SIGTERM, so that Run returns and
+// the sinks are flushed and closed. Another signal kills the process.
+func closeOnSignal(table *dht.DistributedHashTable) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	sig := <-signals
+	signal.Stop(signals)
+
+	logrus.Infof("received %v, shutting down", sig)
+	<-table.Ready()
+	table.Close()
+}
+
+// serveHTTP serves the admin API and the metrics once table is running. The
+// metrics are served by the admin server if they share the address.
+func serveHTTP(table *dht.DistributedHashTable) {
+	<-table.Ready()
+
+	if table.MetricsAddr != "" {
+		if err := table.RegisterMetrics(metrics.DefaultRegistry); err != nil {
+			logrus.Errorf("register metrics err: %v", err)
+		}
+	}
+
+	if table.AdminAddr != "" {
+		server := admin.NewServer(table, admin.DefaultTimeout)
+		if table.MetricsAddr == table.AdminAddr {
+			server.Handle("/metrics", metrics.DefaultRegistry.Handler())
+		}
+		go func() {
+			if err := server.ListenAndServe(table.AdminAddr); err != nil {
+				logrus.Errorf("admin server err: %v", err)
+			}
+		}()
+	}
+
+	if table.MetricsAddr != "" && table.MetricsAddr != table.AdminAddr {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", metrics.DefaultRegistry.Handler())
+		logrus.Infof("metrics listening on %s", table.MetricsAddr)
+		if err := http.ListenAndServe(table.MetricsAddr, mux); err != nil {
+			logrus.Errorf("metrics server err: %v", err)
+		}
+	}
+}
+
+// harvestSinks returns the harvest sinks enabled by the flags.
+func harvestSinks() ([]harvest.Sink, error) {
+	sinks := make([]harvest.Sink, 0)
+	if harvestStdout {
+		sinks = append(sinks, harvest.NewStdoutSink())
+	}
+	if harvestFile != "" {
+		sink, err := harvest.NewFileSink(harvestFile)
+		if err != nil {
+			return nil, err
+		}
+		sinks = append(sinks, sink)
+	}
+	if harvestStorage != "" {
+		store, err := storage.OpenFileStore(harvestStorage)
+		if err != nil {
+			return nil, err
+		}
+		sinks = append(sinks, harvest.NewStorageSink(store))
+	}
+	if harvestDB != "" {
+		sink, err := harvest.NewKVSink(harvestDB)
+		if err != nil {
+			return nil, err
+		}
+		sinks = append(sinks, sink)
+	}
+	return sinks, nil
+}
+
+// addServeFlags adds the flags of a running node to flags.
+func addServeFlags(flags *pflag.FlagSet) {
+	addConfigFlags(flags)
+
+	flags.StringVar(&harvestFile, "harvest-file", "", "append the harvested info_hashes to this file as JSON lines")
+	flags.BoolVar(&harvestStdout, "harvest-stdout", false, "write the harvested info_hashes to stdout as JSON lines")
+	flags.StringVar(&harvestDB, "harvest-db", "", "store the harvested info_hashes in this key-value store")
+	flags.StringVar(&harvestStorage, "harvest-storage", "", "record the harvested torrents and peers in this database, see terra db")
+	flags.DurationVar(&harvestWindow, "harvest-window", time.Hour, "how long a harvested info_hash is not written again")
+	flags.DurationVar(&harvestSampling, "harvest-sample-interval", time.Minute, "how often sample_infohashes queries are sent, 0 disables them")
+}
+
+func init() {
+	addServeFlags(serveCmd.Flags())
+	RootCmd.AddCommand(serveCmd)
+}
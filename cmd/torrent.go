@@ -0,0 +1,181 @@
+package cmd
+
+import (
+	"encoding/hex"
+	"fmt"
+	"github.com/johnnyeven/terra/torrent"
+	"github.com/spf13/cobra"
+	"path"
+	"strings"
+	"time"
+)
+
+var (
+	torrentJSON bool
+
+	torrentOutput      string
+	torrentName        string
+	torrentPieceLength int64
+	torrentTrackers    []string
+	torrentWebSeeds    []string
+	torrentComment     string
+	torrentPrivate     bool
+)
+
+var torrentCmd = &cobra.Command{
+	Use:   "torrent",
+	Short: "Inspect and create .torrent files",
+}
+
+var torrentInfoCmd = &cobra.Command{
+	Use:   "info <file.torrent>",
+	Short: "Print the content of a .torrent file",
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cmd.SilenceUsage = true
+
+		metainfo, err := torrent.Load(args[0])
+		if err != nil {
+			return err
+		}
+		return printMetaInfo(metainfo)
+	},
+}
+
+var torrentCreateCmd = &cobra.Command{
+	Use:   "create <file or directory>",
+	Short: "Create a .torrent file",
+	Long: `Create a v1 .torrent file of a file or of the regular files of a
+directory, and print its info_hash.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		cmd.SilenceUsage = true
+
+		metainfo, err := torrent.Create(args[0], torrent.CreateOptions{
+			Name:        torrentName,
+			PieceLength: torrentPieceLength,
+			Trackers:    torrentTrackers,
+			URLList:     torrentWebSeeds,
+			Comment:     torrentComment,
+			CreatedBy:   "terra",
+			Private:     torrentPrivate,
+		})
+		if err != nil {
+			return err
+		}
+
+		output := torrentOutput
+		if output == "" {
+			output = metainfo.Info.Name + ".torrent"
+		}
+		if err := metainfo.WriteFile(output); err != nil {
+			return err
+		}
+
+		if torrentJSON {
+			return printJSON(metainfoView(metainfo))
+		}
+		fmt.Printf("%s\t%s\n", metainfo.InfoHash, output)
+		return nil
+	},
+}
+
+// metainfoView adds what the JSON of torrent.MetaInfo leaves out.
+func metainfoView(metainfo *torrent.MetaInfo) interface{} {
+	view := struct {
+		*torrent.MetaInfo
+		CreationDate *time.Time `json:"creationDate,omitempty"`
+		InfoHashV2   string     `json:"infoHashV2,omitempty"`
+		TotalLength  int64      `json:"totalLength"`
+		Pieces       int        `json:"pieces"`
+		Magnet       string     `json:"magnet"`
+	}{
+		MetaInfo:    metainfo,
+		TotalLength: metainfo.Info.TotalLength(),
+		Pieces:      metainfo.Info.NumPieces(),
+		Magnet:      metainfo.Magnet(),
+	}
+	if !metainfo.CreationDate.IsZero() {
+		view.CreationDate = &metainfo.CreationDate
+	}
+	if metainfo.InfoHashV2 != nil {
+		view.InfoHashV2 = hex.EncodeToString(metainfo.InfoHashV2)
+	}
+	return view
+}
+
+func printMetaInfo(metainfo *torrent.MetaInfo) error {
+	if torrentJSON {
+		return printJSON(metainfoView(metainfo))
+	}
+
+	info := metainfo.Info
+	version := "v1"
+	switch {
+	case info.V1() && info.V2():
+		version = "hybrid"
+	case info.V2():
+		version = "v2"
+	}
+
+	fmt.Printf("name:         %s\n", info.Name)
+	fmt.Printf("info_hash:    %s\n", metainfo.InfoHash)
+	if metainfo.InfoHashV2 != nil {
+		fmt.Printf("info_hash v2: %s\n", hex.EncodeToString(metainfo.InfoHashV2))
+	}
+	fmt.Printf("version:      %s\n", version)
+	fmt.Printf("size:         %d bytes\n", info.TotalLength())
+	if info.V1() {
+		fmt.Printf("pieces:       %d of %d bytes\n", info.NumPieces(), info.PieceLength)
+	} else {
+		fmt.Printf("piece length: %d bytes\n", info.PieceLength)
+	}
+	fmt.Printf("private:      %t\n", info.Private)
+	if !metainfo.CreationDate.IsZero() {
+		fmt.Printf("created:      %s\n", metainfo.CreationDate.Format(time.RFC3339))
+	}
+	if metainfo.CreatedBy != "" {
+		fmt.Printf("created by:   %s\n", metainfo.CreatedBy)
+	}
+	if metainfo.Comment != "" {
+		fmt.Printf("comment:      %s\n", metainfo.Comment)
+	}
+	for i, tier := range metainfo.AnnounceList {
+		fmt.Printf("tier %d:       %s\n", i, strings.Join(tier, " "))
+	}
+	if len(metainfo.AnnounceList) == 0 && metainfo.Announce != "" {
+		fmt.Printf("tracker:      %s\n", metainfo.Announce)
+	}
+	for _, seed := range metainfo.URLList {
+		fmt.Printf("web seed:     %s\n", seed)
+	}
+	fmt.Printf("magnet:       %s\n", metainfo.Magnet())
+
+	if info.MultiFile() {
+		fmt.Printf("files:\n")
+		for _, file := range info.Files {
+			if file.Padding() {
+				continue
+			}
+			fmt.Printf("  %12d  %s\n", file.Length, path.Join(file.Path...))
+		}
+	}
+	return nil
+}
+
+func init() {
+	torrentInfoCmd.Flags().BoolVar(&torrentJSON, "json", false, "print the torrent as JSON")
+
+	torrentCreateCmd.Flags().BoolVar(&torrentJSON, "json", false, "print the torrent as JSON")
+	torrentCreateCmd.Flags().StringVarP(&torrentOutput, "output", "o", "", "the .torrent file to write, <name>.torrent if not set")
+	torrentCreateCmd.Flags().StringVar(&torrentName, "name", "", "the name of the torrent, the base name of the file or directory if not set")
+	torrentCreateCmd.Flags().Int64Var(&torrentPieceLength, "piece-length", 0, "the piece length in bytes, a power of two of at least 16384, chosen from the size if 0")
+	torrentCreateCmd.Flags().StringSliceVarP(&torrentTrackers, "tracker", "t", nil, "a tracker URL, can be repeated")
+	torrentCreateCmd.Flags().StringSliceVar(&torrentWebSeeds, "web-seed", nil, "a web seed URL, can be repeated")
+	torrentCreateCmd.Flags().StringVar(&torrentComment, "comment", "", "the comment of the torrent")
+	torrentCreateCmd.Flags().BoolVar(&torrentPrivate, "private", false, "set the private flag, peers are then only found by the trackers")
+
+	torrentCmd.AddCommand(torrentInfoCmd)
+	torrentCmd.AddCommand(torrentCreateCmd)
+	RootCmd.AddCommand(torrentCmd)
+}
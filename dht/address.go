@@ -0,0 +1,101 @@
+package dht
+
+import (
+	"net"
+	"sync"
+)
+
+// reservedRanges are the addresses which can not be reached on the public
+// internet.
+var reservedRanges = func() *Blocklist {
+	b := NewBlocklist()
+	for _, cidr := range []string{
+		"0.0.0.0/8",
+		"10.0.0.0/8",
+		"100.64.0.0/10",
+		"127.0.0.0/8",
+		"169.254.0.0/16",
+		"172.16.0.0/12",
+		"192.0.0.0/24",
+		"192.0.2.0/24",
+		"192.168.0.0/16",
+		"198.18.0.0/15",
+		"198.51.100.0/24",
+		"203.0.113.0/24",
+		"224.0.0.0/4",
+		"240.0.0.0/4",
+		"::/128",
+		"::1/128",
+		"100::/64",
+		"2001:db8::/32",
+		"fc00::/7",
+		"fe80::/10",
+		"ff00::/8",
+	} {
+		if err := b.AddRule(cidr); err != nil {
+			panic(err)
+		}
+	}
+	b.merge()
+	return b
+}()
+
+// IsPublicAddr reports whether addr can be reached on the public internet.
+func IsPublicAddr(addr *net.UDPAddr) bool {
+	return addr.Port > 0 && addr.IP.To16() != nil && !reservedRanges.Contains(addr.IP)
+}
+
+// subnetKey returns the /24 network of an IPv4 address or the /64 network of
+// an IPv6 address.
+func subnetKey(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(24, 32)).String()
+	}
+	return ip.Mask(net.CIDRMask(64, 128)).String()
+}
+
+// addressCounter counts nodes per ip and per subnet.
+type addressCounter struct {
+	sync.Mutex
+	ips     map[string]int
+	subnets map[string]int
+}
+
+func newAddressCounter() *addressCounter {
+	return &addressCounter{
+		ips:     make(map[string]int),
+		subnets: make(map[string]int),
+	}
+}
+
+func (c *addressCounter) Add(ip net.IP) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.ips[ip.String()]++
+	c.subnets[subnetKey(ip)]++
+}
+
+func (c *addressCounter) Remove(ip net.IP) {
+	c.Lock()
+	defer c.Unlock()
+
+	decrease(c.ips, ip.String())
+	decrease(c.subnets, subnetKey(ip))
+}
+
+// Count returns how many nodes share the ip and the subnet of ip.
+func (c *addressCounter) Count(ip net.IP) (ips int, subnets int) {
+	c.Lock()
+	defer c.Unlock()
+
+	return c.ips[ip.String()], c.subnets[subnetKey(ip)]
+}
+
+func decrease(counts map[string]int, key string) {
+	if counts[key] <= 1 {
+		delete(counts, key)
+	} else {
+		counts[key]--
+	}
+}
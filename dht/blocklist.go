@@ -0,0 +1,286 @@
+package dht
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// maxUnsortedRanges is how many ranges added one by one since the last merge
+// Contains searches linearly, they are merged with the others beyond it.
+const maxUnsortedRanges = 64
+
+type ipRange struct {
+	start net.IP
+	end   net.IP
+}
+
+// Blocklist is a set of IP ranges. It understands CIDR ranges, single
+// addresses, "start-end" ranges and the common P2P ("description:start-end")
+// and DAT ("start - end , level , description") blocklist formats.
+type Blocklist struct {
+	sync.RWMutex
+	// sorted and merged
+	ranges []ipRange
+	// added since the last merge
+	unsorted []ipRange
+}
+
+// NewBlocklist returns an empty Blocklist.
+func NewBlocklist() *Blocklist {
+	return &Blocklist{}
+}
+
+// LoadBlocklist reads a blocklist file, one range per line. Empty lines and
+// lines starting with '#' are ignored.
+func LoadBlocklist(path string) (*Blocklist, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	b := NewBlocklist()
+	if err := b.Read(f); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return b, nil
+}
+
+// Read adds the ranges read from r, they are merged with the others once all
+// are read.
+func (b *Blocklist) Read(r io.Reader) error {
+	var ranges []ipRange
+	defer func() {
+		b.add(ranges, true)
+	}()
+
+	scanner := bufio.NewScanner(r)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		r, err := parseRule(text)
+		if err != nil {
+			return fmt.Errorf("line %d: %v", line, err)
+		}
+		ranges = append(ranges, r)
+	}
+	return scanner.Err()
+}
+
+// AddRule adds a range written in any of the supported formats.
+func (b *Blocklist) AddRule(rule string) error {
+	r, err := parseRule(rule)
+	if err != nil {
+		return err
+	}
+	b.add([]ipRange{r}, false)
+	return nil
+}
+
+// parseRule returns the range of a rule in any of the supported formats.
+func parseRule(rule string) (ipRange, error) {
+	if strings.Contains(rule, ",") {
+		// DAT format, the range is the first field
+		rule = strings.TrimSpace(strings.SplitN(rule, ",", 2)[0])
+	} else if i := strings.LastIndex(rule, ":"); i >= 0 && strings.Count(rule, ".") >= 6 {
+		// P2P format, the description may contain colons
+		rule = rule[i+1:]
+	}
+
+	if strings.Contains(rule, "/") {
+		_, network, err := net.ParseCIDR(rule)
+		if err != nil {
+			return ipRange{}, err
+		}
+		return netRange(network), nil
+	}
+
+	parts := strings.SplitN(rule, "-", 2)
+	start := parseBlocklistIP(parts[0])
+	end := start
+	if len(parts) == 2 {
+		end = parseBlocklistIP(parts[1])
+	}
+	if start == nil || end == nil {
+		return ipRange{}, errors.New("invalid ip range " + rule)
+	}
+	return newIPRange(start, end)
+}
+
+// AddNet adds the addresses of a network.
+func (b *Blocklist) AddNet(network *net.IPNet) {
+	b.add([]ipRange{netRange(network)}, false)
+}
+
+// netRange returns the range of the addresses of a network.
+func netRange(network *net.IPNet) ipRange {
+	start := network.IP.To16()
+	end := make(net.IP, len(start))
+	mask := network.Mask
+	if len(mask) == net.IPv4len {
+		mask = append(net.CIDRMask(96, 128)[:12], mask...)
+	}
+	for i := range start {
+		end[i] = start[i] | ^mask[i]
+	}
+	return ipRange{start, end}
+}
+
+// AddRange adds the addresses from start to end, both included.
+func (b *Blocklist) AddRange(start, end net.IP) error {
+	r, err := newIPRange(start, end)
+	if err != nil {
+		return err
+	}
+	b.add([]ipRange{r}, false)
+	return nil
+}
+
+// newIPRange returns the range from start to end, in either order.
+func newIPRange(start, end net.IP) (ipRange, error) {
+	start, end = start.To16(), end.To16()
+	if start == nil || end == nil {
+		return ipRange{}, errors.New("invalid ip")
+	}
+	if (start.To4() == nil) != (end.To4() == nil) {
+		return ipRange{}, errors.New("ip range mixes ipv4 and ipv6")
+	}
+	if bytes.Compare(start, end) > 0 {
+		start, end = end, start
+	}
+	return ipRange{start, end}, nil
+}
+
+// add adds ranges to the unsorted ones, which are merged with the others if
+// merge is set or once there are more than maxUnsortedRanges of them.
+func (b *Blocklist) add(ranges []ipRange, merge bool) {
+	b.Lock()
+	defer b.Unlock()
+
+	b.unsorted = append(b.unsorted, ranges...)
+	if merge || len(b.unsorted) > maxUnsortedRanges {
+		b.mergeUnsorted()
+	}
+}
+
+// merge merges the unsorted ranges with the others, so that Contains can
+// search them all.
+func (b *Blocklist) merge() {
+	b.add(nil, true)
+}
+
+// mergeUnsorted sorts the unsorted ranges, joins them with the sorted ones in
+// a single pass and merges the overlapping ones.
+func (b *Blocklist) mergeUnsorted() {
+	if len(b.unsorted) == 0 {
+		return
+	}
+
+	sort.Slice(b.unsorted, func(i, j int) bool {
+		return bytes.Compare(b.unsorted[i].start, b.unsorted[j].start) < 0
+	})
+
+	merged := make([]ipRange, 0, len(b.ranges)+len(b.unsorted))
+	i, j := 0, 0
+	for i < len(b.ranges) || j < len(b.unsorted) {
+		var r ipRange
+		if j == len(b.unsorted) || (i < len(b.ranges) && bytes.Compare(b.ranges[i].start, b.unsorted[j].start) <= 0) {
+			r = b.ranges[i]
+			i++
+		} else {
+			r = b.unsorted[j]
+			j++
+		}
+
+		if n := len(merged); n > 0 && bytes.Compare(r.start, nextIP(merged[n-1].end)) <= 0 {
+			if bytes.Compare(r.end, merged[n-1].end) > 0 {
+				merged[n-1].end = r.end
+			}
+			continue
+		}
+		merged = append(merged, r)
+	}
+	b.ranges, b.unsorted = merged, nil
+}
+
+// Contains reports whether ip is in any of the ranges.
+func (b *Blocklist) Contains(ip net.IP) bool {
+	if b == nil {
+		return false
+	}
+	if ip = ip.To16(); ip == nil {
+		return false
+	}
+
+	b.RLock()
+	defer b.RUnlock()
+
+	i := sort.Search(len(b.ranges), func(i int) bool {
+		return bytes.Compare(b.ranges[i].end, ip) >= 0
+	})
+	if i < len(b.ranges) && bytes.Compare(b.ranges[i].start, ip) <= 0 {
+		return true
+	}
+
+	// the few ranges added one by one since the last merge
+	for _, r := range b.unsorted {
+		if bytes.Compare(r.start, ip) <= 0 && bytes.Compare(r.end, ip) >= 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Len returns the number of ranges, merged if they were loaded.
+func (b *Blocklist) Len() int {
+	b.RLock()
+	defer b.RUnlock()
+
+	return len(b.ranges) + len(b.unsorted)
+}
+
+// parseBlocklistIP parses an address, IPv4 octets may be zero-padded.
+func parseBlocklistIP(s string) net.IP {
+	s = strings.TrimSpace(s)
+	if strings.Contains(s, ":") {
+		return net.ParseIP(s).To16()
+	}
+
+	octets := strings.Split(s, ".")
+	if len(octets) != 4 {
+		return nil
+	}
+	for i, octet := range octets {
+		octet = strings.TrimLeft(octet, "0")
+		if octet == "" {
+			octet = "0"
+		}
+		octets[i] = octet
+	}
+	return net.ParseIP(strings.Join(octets, ".")).To16()
+}
+
+func nextIP(ip net.IP) net.IP {
+	next := make(net.IP, len(ip))
+	copy(next, ip)
+	for i := len(next) - 1; i >= 0; i-- {
+		next[i]++
+		if next[i] != 0 {
+			break
+		}
+	}
+	return next
+}
@@ -0,0 +1,86 @@
+package dht
+
+import (
+	"crypto/sha1"
+	"math"
+	"net"
+)
+
+// BloomFilterSize is the size in bytes of the BEP 33 bloom filters.
+const BloomFilterSize = 256
+
+// bloomFilterBits is the number of bits of a filter, 2 are set per IP.
+const bloomFilterBits = BloomFilterSize * 8
+
+// BloomFilter is a BEP 33 bloom filter of peer IPs, BFsd for the seeds and
+// BFpe for the other peers of an info_hash.
+type BloomFilter [BloomFilterSize]byte
+
+// BloomFilterFromString returns the filter of a BFsd or BFpe value, false if
+// it does not have the right size.
+func BloomFilterFromString(s string) (*BloomFilter, bool) {
+	if len(s) != BloomFilterSize {
+		return nil, false
+	}
+	filter := &BloomFilter{}
+	copy(filter[:], s)
+	return filter, true
+}
+
+func bloomIndexes(ip net.IP) (int, int) {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	} else {
+		ip = ip.To16()
+	}
+	hash := sha1.Sum(ip)
+	index1 := (int(hash[0]) | int(hash[1])<<8) % bloomFilterBits
+	index2 := (int(hash[2]) | int(hash[3])<<8) % bloomFilterBits
+	return index1, index2
+}
+
+// Add inserts ip.
+func (f *BloomFilter) Add(ip net.IP) {
+	index1, index2 := bloomIndexes(ip)
+	f[index1/8] |= 1 << uint(index1%8)
+	f[index2/8] |= 1 << uint(index2%8)
+}
+
+// Test reports whether ip may have been inserted.
+func (f *BloomFilter) Test(ip net.IP) bool {
+	index1, index2 := bloomIndexes(ip)
+	return f[index1/8]&(1<<uint(index1%8)) != 0 && f[index2/8]&(1<<uint(index2%8)) != 0
+}
+
+// Merge adds the IPs of other.
+func (f *BloomFilter) Merge(other *BloomFilter) {
+	for i := range f {
+		f[i] |= other[i]
+	}
+}
+
+// Estimate returns the approximate number of IPs inserted, as given by
+// BEP 33.
+func (f *BloomFilter) Estimate() int {
+	zeros := 0
+	for _, b := range f {
+		for ; b != 0xff; b |= b + 1 {
+			zeros++
+		}
+	}
+	// the clamp of BEP 33 would count an empty filter as one IP
+	if zeros == bloomFilterBits {
+		return 0
+	}
+	if zeros == 0 {
+		zeros = 1
+	}
+
+	m := float64(bloomFilterBits)
+	return int(math.Round(math.Log(float64(zeros)/m) / (2 * math.Log(1-1/m))))
+}
+
+// String returns the filter as the value of BFsd or BFpe.
+func (f *BloomFilter) String() string {
+	return string(f[:])
+}
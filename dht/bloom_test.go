@@ -0,0 +1,125 @@
+package dht
+
+import (
+	"encoding/hex"
+	"math/big"
+	"net"
+	"testing"
+)
+
+// bep33Filter is the filter of the example of BEP 33.
+const bep33Filter = "f6c3f5eaa07ffd91bde89f777f26fb2bff37bdb8fb2bbaa2fd3ddde7bacfff75" +
+	"ee7ccbaefe5eedb1fbfaff67f6abff5e43ddbca3fd9b9ffdf4ffd3e9dff12d1b" +
+	"df59db53dbe9fa5b7ff3b8fdfcde1afb8bedd7be2f3ee71ebbbfe93bcdeefe14" +
+	"8246c2bc5dbff7e7efdcf24fd8dc7adffd8fffdfddfff7a4bbeedf5cb95ce81f" +
+	"c7fcff1ff4ffffdfe5f7fdcbb7fd79b3fa1fc77bfe07fff905b7b7ffc7fefeff" +
+	"e0b8370bb0cd3f5b7f2bd93feb4386cfdd6f7fd5bfaf2e9ebffffeecd67adbf7" +
+	"c67f17efd5d75eba6ffeba7fff47a91eb1bfbb53e8abfb5762abe8ff237279bf" +
+	"efbfeef5ffc5febfdfe5adffadfee1fb737ffffbfd9f6aeffeee76b6fd8f72ef"
+
+// bep33IPs returns 192.0.2.0 to 192.0.2.255 and 2001:db8:: to 2001:db8::3e7.
+func bep33IPs() []net.IP {
+	ips := make([]net.IP, 0, 1256)
+	for i := 0; i < 256; i++ {
+		ips = append(ips, net.IPv4(192, 0, 2, byte(i)))
+	}
+	base := new(big.Int).SetBytes(net.ParseIP("2001:db8::"))
+	for i := 0; i < 1000; i++ {
+		ip := new(big.Int).Add(base, big.NewInt(int64(i))).Bytes()
+		ips = append(ips, net.IP(ip))
+	}
+	return ips
+}
+
+func TestBloomFilter(t *testing.T) {
+	filter := &BloomFilter{}
+	ips := bep33IPs()
+	for _, ip := range ips {
+		filter.Add(ip)
+	}
+
+	if got := hex.EncodeToString(filter[:]); got != bep33Filter {
+		t.Errorf("filter %s, want %s", got, bep33Filter)
+	}
+	// 1224.93 in BEP 33
+	if n := filter.Estimate(); n != 1225 {
+		t.Errorf("Estimate() = %d, want 1225", n)
+	}
+	for _, ip := range ips {
+		if !filter.Test(ip) {
+			t.Errorf("%s not in the filter", ip)
+		}
+	}
+
+	parsed, ok := BloomFilterFromString(filter.String())
+	if !ok || *parsed != *filter {
+		t.Error("the filter changed through its string")
+	}
+}
+
+func TestBloomFilterEstimate(t *testing.T) {
+	tests := []struct {
+		name string
+		ips  []string
+		want int
+	}{
+		{"empty", nil, 0},
+		{"one", []string{"1.2.3.4"}, 1},
+		// the IPv4 mapped form is the IPv4 address
+		{"mapped", []string{"1.2.3.4", "::ffff:1.2.3.4"}, 1},
+		{"both families", []string{"1.2.3.4", "2001:db8::1", "2001:db8::2"}, 3},
+	}
+
+	for _, test := range tests {
+		filter := &BloomFilter{}
+		for _, ip := range test.ips {
+			filter.Add(net.ParseIP(ip))
+		}
+		if n := filter.Estimate(); n != test.want {
+			t.Errorf("%s: Estimate() = %d, want %d", test.name, n, test.want)
+		}
+	}
+
+	full := &BloomFilter{}
+	for i := range full {
+		full[i] = 0xff
+	}
+	if n := full.Estimate(); n < 7000 {
+		t.Errorf("full filter estimated at %d", n)
+	}
+}
+
+func TestBloomFilterMerge(t *testing.T) {
+	a, b := &BloomFilter{}, &BloomFilter{}
+	a.Add(net.ParseIP("1.2.3.4"))
+	b.Add(net.ParseIP("2001:db8::1"))
+	a.Merge(b)
+	if !a.Test(net.ParseIP("1.2.3.4")) || !a.Test(net.ParseIP("2001:db8::1")) || a.Estimate() != 2 {
+		t.Errorf("merged filter estimated at %d", a.Estimate())
+	}
+	if b.Test(net.ParseIP("1.2.3.4")) {
+		t.Error("the merged filter changed")
+	}
+
+	for _, s := range []string{"", "short", string(make([]byte, BloomFilterSize+1))} {
+		if _, ok := BloomFilterFromString(s); ok {
+			t.Errorf("filter of %d bytes accepted", len(s))
+		}
+	}
+}
+
+func TestPeerStoreBloomFilters(t *testing.T) {
+	store := NewPeerStore(0, 0, 0)
+	infoHash := RandomNodeID()
+	store.Add(infoHash, &Peer{IP: net.ParseIP("1.1.1.1"), Port: 1, Seed: true})
+	store.Add(infoHash, &Peer{IP: net.ParseIP("2.2.2.2"), Port: 2})
+	store.Add(infoHash, &Peer{IP: net.ParseIP("2001:db8::3"), Port: 3})
+
+	seeds, peers := store.BloomFilters(infoHash)
+	if seeds.Estimate() != 1 || !seeds.Test(net.ParseIP("1.1.1.1")) {
+		t.Errorf("%d seeds", seeds.Estimate())
+	}
+	if peers.Estimate() != 2 || peers.Test(net.ParseIP("1.1.1.1")) {
+		t.Errorf("%d peers", peers.Estimate())
+	}
+}
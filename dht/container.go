@@ -202,6 +202,19 @@ func (slist *SyncedList) Iter() <-chan *list.Element {
 	return ch
 }
 
+// Each calls fn with every element in order until fn returns false. The list
+// is locked for reading meanwhile, so fn must not modify it.
+func (slist *SyncedList) Each(fn func(e *list.Element) bool) {
+	slist.RLock()
+	defer slist.RUnlock()
+
+	for e := slist.queue.Front(); e != nil; e = e.Next() {
+		if !fn(e) {
+			return
+		}
+	}
+}
+
 // KeyedDeque represents a keyed deque.
 type KeyedDeque struct {
 	*sync.RWMutex
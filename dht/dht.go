@@ -7,9 +7,26 @@ import (
 	"time"
 	"github.com/johnnyeven/terra/dht/util"
 	"math"
+	"fmt"
+	"strconv"
+	"errors"
+	"sync"
 )
 
+const (
+	// standard mainline dht node, buckets hold K nodes and only the bucket
+	// containing our own ID is split
+	ClientMode = "client"
+	// crawling node, all nodes are put in one bucket and the ID sent to other
+	// nodes is made up to look close to their targets
+	CrawlerMode = "crawler"
+)
+
+var errNotRunning = errors.New("dht is not running")
+
 type DistributedHashTable struct {
+	// client or crawler
+	Mode string
 	// the kbucket expired duration
 	BucketExpiredAfter time.Duration
 	// the node expired duration
@@ -31,87 +48,408 @@ type DistributedHashTable struct {
 	Network string
 	// local network address
 	LocalAddr string
+	// more local addresses to listen on (BEP 45), an IPv4 address is
+	// listened on with udp4, an IPv6 one with udp6 and a host name with
+	// Network. All of them share the node ID and the routing table.
+	ExtraLocalAddrs []string
 	// initialized node list
 	SeedNodes []string
+	// the node ID in hex or base32, random if empty
+	NodeID string
+	// how many packets can be sent per second, 0 means unlimited
+	MaxPacketsPerSecond int
+	// how many bytes can be sent per second, 0 means unlimited
+	MaxBytesPerSecond int
+	// how many packets can be sent to the same address per second, 0 means
+	// unlimited
+	MaxPacketsPerSecondPerNode int
+	// how many requests can wait for the response at the same time, 0 means
+	// unlimited
+	MaxPendingRequests int
+	// how many requests can be queued before sending, 0 means unlimited
+	RequestQueueSize int
+	// the file of blocked ip ranges
+	BlocklistFile string
+	// how many queries a source ip can send per second, 0 means unlimited
+	MaxQueriesPerSecondPerIP int
+	// how many queries a source ip can send in a burst
+	QueryBurstPerIP int
+	// how many strikes a source ip can get before it is banned, 0 means never
+	MaxStrikes int
+	// how long a source ip is banned
+	BanDuration time.Duration
+	// how many nodes with the same ip a bucket can hold, 0 means unlimited
+	MaxNodesPerIPPerBucket int
+	// how many nodes in the same /24 (ipv4) or /64 (ipv6) network a bucket
+	// can hold, 0 means unlimited
+	MaxNodesPerSubnetPerBucket int
+	// how many nodes with the same ip the routing table can hold, 0 means
+	// unlimited
+	MaxNodesPerIP int
+	// how many nodes in the same /24 (ipv4) or /64 (ipv6) network the
+	// routing table can hold, 0 means unlimited
+	MaxNodesPerSubnet int
+	// whether the dht runs on the public internet, nodes with private,
+	// reserved or loopback addresses are rejected if true
+	PublicNetwork bool
+	// read-only mode of BEP 43, the queries are sent with ro=1 and no query
+	// is answered
+	ReadOnly bool
+	// how many torrents the peer store can hold, 0 means unlimited
+	MaxTorrents int
+	// how many peers of a torrent the peer store can hold, 0 means unlimited
+	MaxPeersPerTorrent int
+	// how long a peer is kept after it has been seen
+	PeerExpiredAfter time.Duration
+	// how many BEP 44 items the item store can hold, 0 means unlimited
+	MaxItems int
+	// how long an item is kept after it has been put
+	ItemExpiredAfter time.Duration
+	// the listen address of the admin HTTP server, it is disabled if empty
+	AdminAddr string
+	// the listen address of the /metrics endpoint, it is disabled if empty
+	MetricsAddr string
+	// how many received packets can wait for the handler
+	PacketQueueSize int
+	// the pcap file every sent and received packet is written to, it is
+	// disabled if empty
+	CaptureFile string
 	// the constructor func for transport
-	TransportConstructor func(dht *DistributedHashTable, conn net.Conn, maxCursor uint64) *Transport
+	TransportConstructor func(dht *DistributedHashTable, conn net.PacketConn, maxCursor uint64) *Transport
+	// opens the socket, net.ListenPacket with NAT port mapping if not set
+	ListenFunc func(network, address string) (net.PacketConn, error)
 	// the Transport communicating component
 	transport *Transport
 	// node storage engin
 	routingTable *routingTable
+	// inbound abuse protection
+	firewall *firewall
+	// closed once the node is listening
+	readyChannel chan struct{}
+	// announced peers
+	peerStore *PeerStore
+	// BEP 44 items
+	itemStore *ItemStore
+	// get_peers tokens
+	tokens *tokenManager
+	// capture file, nil if disabled
+	pcap *pcapFile
 	// NAT
 	nat nat.Interface
-	// self node
+	// the sockets, a multiConn if there are several
+	conn net.PacketConn
+	// the addresses of the sockets
+	localAddrs []*net.UDPAddr
+	// our external IPs as seen by the other nodes
+	externalIPs *externalIPVoter
+	// self node, its ID is the one given or a random one
 	Self *Node
+	// the IDs derived from the external IP of each family (BEP 42), IPv4
+	// first, nil until it is elected
+	familyIDs [2]*NodeID
+	idLock    sync.RWMutex
 	// received packet channel
 	packetChannel chan Packet
+	// closed once the transport stops receiving
+	receiveDone chan struct{}
 	// system shutdown channel
 	quitChannel chan struct{}
+	closeOnce   sync.Once
+	// activity events
+	events *EventBus
 	// new node handler
 	NewNodeHandler func(peerID []byte, node *Node)
 	// packet handler
 	Handler func(table *DistributedHashTable, packet Packet)
+	// gets the packets which are not KRPC messages instead of Handler, the
+	// ones not starting with 'd' like the uTP ones, so another protocol can
+	// share the socket. It is called by the goroutine reading the socket and
+	// must not block.
+	OtherPacketHandler func(table *DistributedHashTable, packet Packet)
 	// join method
 	HandshakeFunc func(node *Node, t *Transport, target []byte)
 	// ping method
 	PingFunc func(node *Node, t *Transport)
+	// bucket refresh method, HandshakeFunc is used if not set
+	RefreshFunc func(node *Node, t *Transport, target []byte)
 }
 
 type Config struct {
-	BucketExpiredAfter   time.Duration
-	NodeExpiredAfter     time.Duration
-	CheckBucketPeriod    time.Duration
-	MaxTransactionCursor uint64
-	MaxNodes             int
-	K                    int
-	BucketSize           int
-	RefreshNodeCount     int
-	Network              string
-	LocalAddr            string
-	SeedNodes            []string
-	TransportConstructor func(dht *DistributedHashTable, conn net.Conn, maxCursor uint64) *Transport
-	NewNodeHandler       func(peerID []byte, node *Node)
-	Handler              func(table *DistributedHashTable, packet Packet)
-	HandshakeFunc        func(node *Node, t *Transport, target []byte)
-	PingFunc             func(node *Node, t *Transport)
+	Mode                       string
+	BucketExpiredAfter         time.Duration
+	NodeExpiredAfter           time.Duration
+	CheckBucketPeriod          time.Duration
+	MaxTransactionCursor       uint64
+	MaxNodes                   int
+	K                          int
+	BucketSize                 int
+	RefreshNodeCount           int
+	Network                    string
+	LocalAddr                  string
+	ExtraLocalAddrs            []string
+	SeedNodes                  []string
+	NodeID                     string
+	MaxPacketsPerSecond        int
+	MaxBytesPerSecond          int
+	MaxPacketsPerSecondPerNode int
+	MaxPendingRequests         int
+	RequestQueueSize           int
+	BlocklistFile              string
+	MaxQueriesPerSecondPerIP   int
+	QueryBurstPerIP            int
+	MaxStrikes                 int
+	BanDuration                time.Duration
+	MaxNodesPerIPPerBucket     int
+	MaxNodesPerSubnetPerBucket int
+	MaxNodesPerIP              int
+	MaxNodesPerSubnet          int
+	PublicNetwork              bool
+	ReadOnly                   bool
+	MaxTorrents                int
+	MaxPeersPerTorrent         int
+	PeerExpiredAfter           time.Duration
+	MaxItems                   int
+	ItemExpiredAfter           time.Duration
+	AdminAddr                  string
+	MetricsAddr                string
+	PacketQueueSize            int
+	CaptureFile                string
+	TransportConstructor       func(dht *DistributedHashTable, conn net.PacketConn, maxCursor uint64) *Transport
+	ListenFunc                 func(network, address string) (net.PacketConn, error)
+	NewNodeHandler             func(peerID []byte, node *Node)
+	Handler                    func(table *DistributedHashTable, packet Packet)
+	OtherPacketHandler         func(table *DistributedHashTable, packet Packet)
+	HandshakeFunc              func(node *Node, t *Transport, target []byte)
+	PingFunc                   func(node *Node, t *Transport)
+	RefreshFunc                func(node *Node, t *Transport, target []byte)
 }
 
+// GetNormalConfig returns the config of a standard node in client mode.
 func GetNormalConfig() *Config {
 	return &Config{
-		BucketExpiredAfter:   0,
-		NodeExpiredAfter:     0,
-		CheckBucketPeriod:    5 * time.Second,
-		MaxTransactionCursor: math.MaxUint32,
-		MaxNodes:             5000,
-		K:                    8,
-		BucketSize:           math.MaxInt32,
-		RefreshNodeCount:     256,
-		Network:              "udp4",
-		LocalAddr:            ":6881",
+		Mode:                       ClientMode,
+		BucketExpiredAfter:         15 * time.Minute,
+		NodeExpiredAfter:           15 * time.Minute,
+		CheckBucketPeriod:          time.Minute,
+		MaxTransactionCursor:       math.MaxUint32,
+		MaxNodes:                   5000,
+		K:                          8,
+		BucketSize:                 8,
+		RefreshNodeCount:           8,
+		Network:                    "udp4",
+		LocalAddr:                  ":6881",
+		MaxPacketsPerSecond:        1000,
+		MaxBytesPerSecond:          512 * 1024,
+		MaxPacketsPerSecondPerNode: 10,
+		MaxPendingRequests:         1024,
+		RequestQueueSize:           4096,
+		MaxQueriesPerSecondPerIP:   20,
+		QueryBurstPerIP:            50,
+		MaxStrikes:                 50,
+		BanDuration:                10 * time.Minute,
+		MaxNodesPerIPPerBucket:     1,
+		MaxNodesPerSubnetPerBucket: 4,
+		MaxNodesPerIP:              2,
+		MaxNodesPerSubnet:          16,
+		PublicNetwork:              true,
+		MaxTorrents:                10000,
+		MaxPeersPerTorrent:         100,
+		PeerExpiredAfter:           30 * time.Minute,
+		MaxItems:                   10000,
+		ItemExpiredAfter:           2 * time.Hour,
+		PacketQueueSize:            1024,
 	}
 }
 
+// GetCrawlerConfig returns the config of a node in crawler mode, all nodes
+// are put in one bucket which is refreshed as often as possible.
+func GetCrawlerConfig() *Config {
+	config := GetNormalConfig()
+	config.Mode = CrawlerMode
+	config.BucketExpiredAfter = 0
+	config.NodeExpiredAfter = 0
+	config.CheckBucketPeriod = 5 * time.Second
+	config.BucketSize = math.MaxInt32
+	config.RefreshNodeCount = 256
+	config.MaxNodesPerIPPerBucket = 0
+	config.MaxNodesPerSubnetPerBucket = 0
+
+	return config
+}
+
+// Validate reports the first invalid field of the config, the functions are
+// not checked.
+func (config *Config) Validate() error {
+	if config.Mode != ClientMode && config.Mode != CrawlerMode {
+		return fmt.Errorf("invalid mode %q: should be %s or %s", config.Mode, ClientMode, CrawlerMode)
+	}
+	switch config.Network {
+	case "udp", "udp4", "udp6":
+	default:
+		return fmt.Errorf("invalid network %q: should be udp, udp4 or udp6", config.Network)
+	}
+	if err := validateHostPort(config.LocalAddr); err != nil {
+		return fmt.Errorf("invalid local address %q: %v", config.LocalAddr, err)
+	}
+	for _, addr := range config.ExtraLocalAddrs {
+		if err := validateHostPort(addr); err != nil {
+			return fmt.Errorf("invalid extra local address %q: %v", addr, err)
+		}
+	}
+	for _, addr := range config.SeedNodes {
+		if err := validateHostPort(addr); err != nil {
+			return fmt.Errorf("invalid seed node %q: %v", addr, err)
+		}
+	}
+	if config.NodeID != "" {
+		if _, err := ParseNodeID(config.NodeID); err != nil {
+			return fmt.Errorf("invalid node ID %q: %v", config.NodeID, err)
+		}
+	}
+	for name, addr := range map[string]string{"admin address": config.AdminAddr, "metrics address": config.MetricsAddr} {
+		if addr == "" {
+			continue
+		}
+		if err := validateHostPort(addr); err != nil {
+			return fmt.Errorf("invalid %s %q: %v", name, addr, err)
+		}
+	}
+
+	positive := []struct {
+		name  string
+		value int
+	}{
+		{"K", config.K},
+		{"bucket size", config.BucketSize},
+		{"max nodes", config.MaxNodes},
+		{"refresh node count", config.RefreshNodeCount},
+		{"request queue size", config.RequestQueueSize},
+	}
+	for _, field := range positive {
+		if field.value <= 0 {
+			return fmt.Errorf("invalid %s %d: should be greater than 0", field.name, field.value)
+		}
+	}
+	if config.MaxTransactionCursor == 0 {
+		return errors.New("invalid max transaction cursor 0: should be greater than 0")
+	}
+	if config.CheckBucketPeriod <= 0 {
+		return fmt.Errorf("invalid check bucket period %s: should be greater than 0", config.CheckBucketPeriod)
+	}
+
+	// 0 means unlimited or disabled
+	nonNegative := []struct {
+		name  string
+		value int
+	}{
+		{"max packets per second", config.MaxPacketsPerSecond},
+		{"max bytes per second", config.MaxBytesPerSecond},
+		{"max packets per second per node", config.MaxPacketsPerSecondPerNode},
+		{"max pending requests", config.MaxPendingRequests},
+		{"packet queue size", config.PacketQueueSize},
+		{"max queries per second per IP", config.MaxQueriesPerSecondPerIP},
+		{"query burst per IP", config.QueryBurstPerIP},
+		{"max strikes", config.MaxStrikes},
+		{"max nodes per IP per bucket", config.MaxNodesPerIPPerBucket},
+		{"max nodes per subnet per bucket", config.MaxNodesPerSubnetPerBucket},
+		{"max nodes per IP", config.MaxNodesPerIP},
+		{"max nodes per subnet", config.MaxNodesPerSubnet},
+		{"max torrents", config.MaxTorrents},
+		{"max peers per torrent", config.MaxPeersPerTorrent},
+		{"max items", config.MaxItems},
+	}
+	for _, field := range nonNegative {
+		if field.value < 0 {
+			return fmt.Errorf("invalid %s %d: should not be negative", field.name, field.value)
+		}
+	}
+
+	durations := []struct {
+		name  string
+		value time.Duration
+	}{
+		{"bucket expired after", config.BucketExpiredAfter},
+		{"node expired after", config.NodeExpiredAfter},
+		{"ban duration", config.BanDuration},
+		{"peer expired after", config.PeerExpiredAfter},
+		{"item expired after", config.ItemExpiredAfter},
+	}
+	for _, field := range durations {
+		if field.value < 0 {
+			return fmt.Errorf("invalid %s %s: should not be negative", field.name, field.value)
+		}
+	}
+
+	return nil
+}
+
+func validateHostPort(addr string) error {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 0 || n > 65535 {
+		return fmt.Errorf("invalid port %q", port)
+	}
+	return nil
+}
+
 func NewDHT(config *Config) *DistributedHashTable {
 	if config == nil {
 		logrus.Panic("config is empty")
 	}
 	table := &DistributedHashTable{
-		BucketExpiredAfter:   config.BucketExpiredAfter,
-		NodeExpiredAfter:     config.NodeExpiredAfter,
-		CheckBucketPeriod:    config.CheckBucketPeriod,
-		MaxTransactionCursor: config.MaxTransactionCursor,
-		MaxNodes:             config.MaxNodes,
-		K:                    config.K,
-		BucketSize:           config.BucketSize,
-		RefreshNodeCount:     config.RefreshNodeCount,
-		Network:              config.Network,
-		LocalAddr:            config.LocalAddr,
-		SeedNodes:            config.SeedNodes,
-		TransportConstructor: config.TransportConstructor,
-		NewNodeHandler:       config.NewNodeHandler,
-		Handler:              config.Handler,
-		HandshakeFunc:        config.HandshakeFunc,
-		PingFunc:             config.PingFunc,
+		Mode:                       config.Mode,
+		BucketExpiredAfter:         config.BucketExpiredAfter,
+		NodeExpiredAfter:           config.NodeExpiredAfter,
+		CheckBucketPeriod:          config.CheckBucketPeriod,
+		MaxTransactionCursor:       config.MaxTransactionCursor,
+		MaxNodes:                   config.MaxNodes,
+		K:                          config.K,
+		BucketSize:                 config.BucketSize,
+		RefreshNodeCount:           config.RefreshNodeCount,
+		Network:                    config.Network,
+		LocalAddr:                  config.LocalAddr,
+		ExtraLocalAddrs:            config.ExtraLocalAddrs,
+		SeedNodes:                  config.SeedNodes,
+		NodeID:                     config.NodeID,
+		MaxPacketsPerSecond:        config.MaxPacketsPerSecond,
+		MaxBytesPerSecond:          config.MaxBytesPerSecond,
+		MaxPacketsPerSecondPerNode: config.MaxPacketsPerSecondPerNode,
+		MaxPendingRequests:         config.MaxPendingRequests,
+		RequestQueueSize:           config.RequestQueueSize,
+		BlocklistFile:              config.BlocklistFile,
+		MaxQueriesPerSecondPerIP:   config.MaxQueriesPerSecondPerIP,
+		QueryBurstPerIP:            config.QueryBurstPerIP,
+		MaxStrikes:                 config.MaxStrikes,
+		BanDuration:                config.BanDuration,
+		MaxNodesPerIPPerBucket:     config.MaxNodesPerIPPerBucket,
+		MaxNodesPerSubnetPerBucket: config.MaxNodesPerSubnetPerBucket,
+		MaxNodesPerIP:              config.MaxNodesPerIP,
+		MaxNodesPerSubnet:          config.MaxNodesPerSubnet,
+		PublicNetwork:              config.PublicNetwork,
+		ReadOnly:                   config.ReadOnly,
+		MaxTorrents:                config.MaxTorrents,
+		MaxPeersPerTorrent:         config.MaxPeersPerTorrent,
+		PeerExpiredAfter:           config.PeerExpiredAfter,
+		MaxItems:                   config.MaxItems,
+		ItemExpiredAfter:           config.ItemExpiredAfter,
+		AdminAddr:                  config.AdminAddr,
+		MetricsAddr:                config.MetricsAddr,
+		PacketQueueSize:            config.PacketQueueSize,
+		CaptureFile:                config.CaptureFile,
+		TransportConstructor:       config.TransportConstructor,
+		ListenFunc:                 config.ListenFunc,
+		NewNodeHandler:             config.NewNodeHandler,
+		Handler:                    config.Handler,
+		OtherPacketHandler:         config.OtherPacketHandler,
+		HandshakeFunc:              config.HandshakeFunc,
+		PingFunc:                   config.PingFunc,
+		RefreshFunc:                config.RefreshFunc,
+		events:                     NewEventBus(),
+		readyChannel:               make(chan struct{}),
+		peerStore:                  NewPeerStore(config.MaxTorrents, config.MaxPeersPerTorrent, config.PeerExpiredAfter),
+		itemStore:                  NewItemStore(config.MaxItems, config.ItemExpiredAfter),
 	}
 
 	return table
@@ -120,6 +458,7 @@ func NewDHT(config *Config) *DistributedHashTable {
 func (dht *DistributedHashTable) Run() {
 	dht.init()
 	dht.listen()
+	close(dht.readyChannel)
 	dht.join()
 
 	tick := time.Tick(dht.CheckBucketPeriod)
@@ -132,15 +471,56 @@ Run:
 		case <-tick:
 			if dht.routingTable.Len() == 0 {
 				dht.join()
-			} else if dht.transport.TransactionLength() == 0 {
+			} else if dht.Mode == ClientMode || dht.transport.TransactionLength() == 0 {
 				go dht.routingTable.Fresh()
 			}
+			dht.firewall.Sweep()
+			dht.peerStore.Expire()
+			dht.itemStore.Expire()
 		case <-dht.quitChannel:
 			break Run
 		}
 	}
 }
 
+// Ready returns a channel which is closed once Run has set up the transport
+// and the routing table.
+func (dht *DistributedHashTable) Ready() <-chan struct{} {
+	return dht.readyChannel
+}
+
+// Events returns the bus on which the activity of the node is published.
+func (dht *DistributedHashTable) Events() *EventBus {
+	return dht.events
+}
+
+// PeerStore returns the store of announced peers.
+func (dht *DistributedHashTable) PeerStore() *PeerStore {
+	return dht.peerStore
+}
+
+// ItemStore returns the store of BEP 44 items.
+func (dht *DistributedHashTable) ItemStore() *ItemStore {
+	return dht.itemStore
+}
+
+// Token returns the token to send to addr in a get_peers response.
+func (dht *DistributedHashTable) Token(addr *net.UDPAddr) string {
+	return dht.tokens.Token(addr)
+}
+
+// ValidateToken reports whether token has been sent to addr recently.
+func (dht *DistributedHashTable) ValidateToken(token string, addr *net.UDPAddr) bool {
+	return dht.tokens.Validate(token, addr)
+}
+
+func (dht *DistributedHashTable) nodeAdded(node *Node) {
+	dht.events.Publish(Event{Type: EventNodeAdded, Node: node, Addr: node.Addr})
+	if dht.NewNodeHandler != nil {
+		dht.NewNodeHandler(node.ID.Bytes(), node)
+	}
+}
+
 func (dht *DistributedHashTable) GetTransport() *Transport {
 	return dht.transport
 }
@@ -149,7 +529,31 @@ func (dht *DistributedHashTable) GetRoutingTable() *routingTable {
 	return dht.routingTable
 }
 
+// Blocked reports whether packets from ip are dropped, either because it is
+// in the blocklist or because it is banned.
+func (dht *DistributedHashTable) Blocked(ip net.IP) bool {
+	return dht.firewall.Blocked(ip)
+}
+
+// AllowQuery reports whether a query from ip should be answered. Queries
+// over the per ip limit count as strikes.
+func (dht *DistributedHashTable) AllowQuery(ip net.IP) bool {
+	return dht.firewall.AllowQuery(ip)
+}
+
+// ReportMalformed records a malformed packet from ip as a strike.
+func (dht *DistributedHashTable) ReportMalformed(ip net.IP) {
+	dht.firewall.Strike(ip)
+}
+
 func (dht *DistributedHashTable) init() {
+	switch dht.Mode {
+	case "":
+		dht.Mode = ClientMode
+	case ClientMode, CrawlerMode:
+	default:
+		logrus.Panicf("dht unknown mode: %s", dht.Mode)
+	}
 	if dht.TransportConstructor == nil {
 		logrus.Panic("dht TransportConstructor not set")
 	}
@@ -162,12 +566,59 @@ func (dht *DistributedHashTable) init() {
 	if dht.Handler == nil {
 		logrus.Panic("dht Handler not set")
 	}
-	listener, err := net.ListenPacket(dht.Network, dht.LocalAddr)
-	if err != nil {
-		logrus.Panicf("[DistributedHashTable].init net.ListenPacket err: %v", err)
+	if dht.RefreshFunc == nil {
+		dht.RefreshFunc = dht.HandshakeFunc
+	}
+
+	blocklist := NewBlocklist()
+	if dht.BlocklistFile != "" {
+		var err error
+		blocklist, err = LoadBlocklist(dht.BlocklistFile)
+		if err != nil {
+			logrus.Panicf("[DistributedHashTable].init LoadBlocklist err: %v", err)
+		}
+		logrus.Infof("[DistributedHashTable].init %d ip ranges blocked", blocklist.Len())
 	}
+	dht.firewall = newFirewall(blocklist, dht.MaxQueriesPerSecondPerIP, dht.QueryBurstPerIP, dht.MaxStrikes, dht.BanDuration)
+	dht.tokens = newTokenManager()
 
-	dht.transport = dht.TransportConstructor(dht, listener.(net.Conn), dht.MaxTransactionCursor)
+	listen := dht.ListenFunc
+	if listen == nil {
+		listen = net.ListenPacket
+		dht.nat = nat.Any()
+	}
+	addrs := append([]string{dht.LocalAddr}, dht.ExtraLocalAddrs...)
+	conns := make([]net.PacketConn, len(addrs))
+	networks := make([]string, len(addrs))
+	for i, addr := range addrs {
+		networks[i] = dht.Network
+		if i > 0 {
+			networks[i] = listenNetwork(addr, dht.Network)
+		}
+		conn, err := listen(networks[i], addr)
+		if err != nil {
+			logrus.Panicf("[DistributedHashTable].init listen %s err: %v", addr, err)
+		}
+		conns[i] = conn
+		dht.localAddrs = append(dht.localAddrs, conn.LocalAddr().(*net.UDPAddr))
+	}
+	listener := conns[0]
+	if len(conns) > 1 {
+		listener = newMultiConn(conns, networks)
+	}
+	dht.conn = listener
+	dht.externalIPs = newExternalIPVoter()
+
+	var err error
+
+	if dht.CaptureFile != "" {
+		dht.pcap, err = createPcapFile(dht.CaptureFile)
+		if err != nil {
+			logrus.Panicf("[DistributedHashTable].init createPcapFile err: %v", err)
+		}
+	}
+
+	dht.transport = dht.TransportConstructor(dht, listener, dht.MaxTransactionCursor)
 	if dht.transport != nil {
 		go dht.transport.Run()
 	} else {
@@ -175,48 +626,236 @@ func (dht *DistributedHashTable) init() {
 	}
 
 	dht.routingTable = newRoutingTable(dht.BucketSize, dht)
-	dht.nat = nat.Any()
-	dht.packetChannel = make(chan Packet)
+	dht.packetChannel = make(chan Packet, dht.PacketQueueSize)
+	dht.receiveDone = make(chan struct{})
 	dht.quitChannel = make(chan struct{})
 
-	dht.Self, err = NewNode(util.RandomString(20), dht.Network, dht.LocalAddr)
+	id := util.RandomString(20)
+	if dht.NodeID != "" {
+		nodeID, err := ParseNodeID(dht.NodeID)
+		if err != nil {
+			logrus.Panicf("[DistributedHashTable].init ParseNodeID err: %v", err)
+		}
+		id = nodeID.RawString()
+	}
+	dht.Self, err = NewNode(id, dht.Network, dht.LocalAddr)
 	if err != nil {
 		logrus.Panicf("[DistributedHashTable].init NewNode err: %v", err)
 	}
 }
 
+// listenNetwork returns the network an extra local address is listened on.
+func listenNetwork(addr, network string) string {
+	host, _, _ := net.SplitHostPort(addr)
+	ip := net.ParseIP(host)
+	switch {
+	case ip == nil:
+		return network
+	case ip.To4() != nil:
+		return "udp4"
+	default:
+		return "udp6"
+	}
+}
+
+// DualStack reports whether the node has IPv4 and IPv6 sockets, it then
+// asks for the nodes of both families.
+func (dht *DistributedHashTable) DualStack() bool {
+	ipv4, ipv6 := false, false
+	for _, addr := range dht.localAddrs {
+		if addr.IP.To4() != nil {
+			ipv4 = true
+		} else {
+			ipv6 = true
+		}
+	}
+	return ipv4 && ipv6
+}
+
+// resolveNetwork returns the network the addresses of nodes are resolved
+// with, udp if the sockets are of both families.
+func (dht *DistributedHashTable) resolveNetwork() string {
+	if dht.DualStack() {
+		return "udp"
+	}
+	return dht.Network
+}
+
 func (dht *DistributedHashTable) join() {
 	for _, addr := range dht.SeedNodes {
-		udpAddr, err := net.ResolveUDPAddr(dht.Network, addr)
+		udpAddr, err := net.ResolveUDPAddr(dht.resolveNetwork(), addr)
 		if err != nil {
 			logrus.Warningf("[DistributedHashTable].join net.ResolveUDPAddr err: %v", err)
 			continue
 		}
 
-		dht.HandshakeFunc(&Node{Addr: udpAddr}, dht.transport, dht.Self.ID.RawData())
+		dht.HandshakeFunc(&Node{Addr: udpAddr}, dht.transport, dht.SelfID(udpAddr.IP.To4() == nil).Bytes())
 	}
 }
 
+// AddBootstrapNode sends a handshake to addr, the node gets into the routing
+// table once it answers.
+func (dht *DistributedHashTable) AddBootstrapNode(addr string) error {
+	udpAddr, err := net.ResolveUDPAddr(dht.resolveNetwork(), addr)
+	if err != nil {
+		return err
+	}
+
+	dht.HandshakeFunc(&Node{Addr: udpAddr}, dht.transport, dht.SelfID(udpAddr.IP.To4() == nil).Bytes())
+	return nil
+}
+
 func (dht *DistributedHashTable) listen() {
-	realAddr := dht.transport.LocalAddr().(*net.UDPAddr)
 	if dht.nat != nil {
-		if !realAddr.IP.IsLoopback() {
-			go nat.Map(dht.nat, dht.quitChannel, "udp4", realAddr.Port, realAddr.Port, "terra discovery")
+		// NAT is for the IPv4 sockets, each port is mapped once
+		mapped := make(map[int]bool)
+		for _, realAddr := range dht.localAddrs {
+			ipv4 := realAddr.IP.To4() != nil || realAddr.IP.IsUnspecified()
+			if ipv4 && !realAddr.IP.IsLoopback() && !mapped[realAddr.Port] {
+				mapped[realAddr.Port] = true
+				go nat.Map(dht.nat, dht.quitChannel, "udp4", realAddr.Port, realAddr.Port, "terra discovery")
+			}
+		}
+	}
+	go func() {
+		dht.transport.Receive(dht.packetChannel)
+		close(dht.receiveDone)
+	}()
+}
+
+// LocalAddrs returns the addresses the node listens on, LocalAddr first.
+func (dht *DistributedHashTable) LocalAddrs() []*net.UDPAddr {
+	return dht.localAddrs
+}
+
+// WriteTo sends a packet of another protocol, the one OtherPacketHandler
+// gets the packets of, from the socket of the node. It is not throttled.
+func (dht *DistributedHashTable) WriteTo(data []byte, addr net.Addr) (int, error) {
+	select {
+	case <-dht.readyChannel:
+	default:
+		return 0, errNotRunning
+	}
+
+	n, err := dht.conn.WriteTo(data, addr)
+	if err != nil {
+		return n, err
+	}
+	dht.transport.countOut(n)
+	dht.capture(localAddrOf(dht.conn, addr), addr, data)
+	BytesTotal.WithLabelValues(DirectionOut).Add(float64(n))
+	return n, nil
+}
+
+// VoteExternalIP records that the node at voter sees our address as ip,
+// as the ip key of its response tells.
+func (dht *DistributedHashTable) VoteExternalIP(voter *net.UDPAddr, ip net.IP) {
+	dht.externalIPs.Vote(voter.IP, ip)
+	dht.updateFamilyIDs()
+}
+
+// updateFamilyIDs derives the ID of a family from its most voted external
+// IP (BEP 42) if the current one does not match it. A node ID given in the
+// config is kept, and so is the ID of a crawler which makes up its IDs.
+func (dht *DistributedHashTable) updateFamilyIDs() {
+	if dht.NodeID != "" || dht.Mode != ClientMode {
+		return
+	}
+
+	var done [2]bool
+	for _, ip := range dht.ExternalIPs() {
+		ipv6 := ip.To4() == nil
+		if done[familyIndex(ipv6)] {
+			continue
 		}
+		done[familyIndex(ipv6)] = true
+		if IsSecureNodeID(dht.SelfID(ipv6), ip) {
+			continue
+		}
+
+		id := SecureNodeID(ip)
+		dht.idLock.Lock()
+		dht.familyIDs[familyIndex(ipv6)] = &id
+		dht.idLock.Unlock()
+		logrus.Infof("[DistributedHashTable] node ID %s for the external IP %s", id, ip)
 	}
-	go dht.transport.Receive(dht.packetChannel)
 }
 
-func (dht *DistributedHashTable) ID(target string) string {
-	if target == "" {
-		return dht.Self.ID.RawString()
+func familyIndex(ipv6 bool) int {
+	if ipv6 {
+		return 1
+	}
+	return 0
+}
+
+// SelfID returns our ID for the nodes of a family, the one derived from our
+// external IP once the family has one, Self.ID before.
+func (dht *DistributedHashTable) SelfID(ipv6 bool) NodeID {
+	dht.idLock.RLock()
+	defer dht.idLock.RUnlock()
+
+	if id := dht.familyIDs[familyIndex(ipv6)]; id != nil {
+		return *id
 	}
-	return target[:15] + dht.Self.ID.RawString()[15:]
+	return dht.Self.ID
 }
 
+// IsSelf reports whether id is one of our IDs.
+func (dht *DistributedHashTable) IsSelf(id NodeID) bool {
+	return id == dht.SelfID(false) || id == dht.SelfID(true)
+}
+
+// ExternalIPs returns our external IPs the other nodes agree on, the IPv4
+// ones first.
+func (dht *DistributedHashTable) ExternalIPs() []net.IP {
+	return dht.externalIPs.ExternalIPs()
+}
+
+// ID returns the node ID sent to the node at addr which is asked about
+// target, the ID of the family of addr. In crawler mode it is made up to
+// look close to target.
+func (dht *DistributedHashTable) ID(addr *net.UDPAddr, target string) string {
+	id := dht.SelfID(addr != nil && addr.IP.To4() == nil).RawString()
+	if target == "" || dht.Mode != CrawlerMode {
+		return id
+	}
+	return target[:15] + id[15:]
+}
+
+// capture writes a packet to the capture file if it is enabled.
+func (dht *DistributedHashTable) capture(src, dst net.Addr, data []byte) {
+	if dht.pcap == nil {
+		return
+	}
+
+	srcAddr, _ := src.(*net.UDPAddr)
+	dstAddr, _ := dst.(*net.UDPAddr)
+	if srcAddr == nil || dstAddr == nil {
+		return
+	}
+	if err := dht.pcap.WritePacket(time.Now(), srcAddr, dstAddr, data); err != nil {
+		logrus.Warningf("[DistributedHashTable].capture WritePacket err: %v", err)
+	}
+}
+
+// Close stops Run and closes the sockets, it can be called more than once.
 func (dht *DistributedHashTable) Close() {
-	dht.quitChannel <- struct{}{}
-	dht.transport.Close()
-	close(dht.packetChannel)
-	close(dht.quitChannel)
+	dht.closeOnce.Do(func() {
+		close(dht.quitChannel)
+		dht.transport.Close()
+
+		// the packets nobody handles anymore are drained, so that the
+		// transport is not stuck on a full channel and sees the closed socket
+		for {
+			select {
+			case <-dht.packetChannel:
+				continue
+			case <-dht.receiveDone:
+			}
+			break
+		}
+		if dht.pcap != nil {
+			dht.pcap.Close()
+		}
+	})
 }
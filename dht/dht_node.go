@@ -5,11 +5,18 @@ import (
 	"errors"
 	"time"
 	"strings"
+	"strconv"
 	"github.com/johnnyeven/terra/dht/util"
 )
 
+// the sizes of the entries of nodes and nodes6
+const (
+	compactNodeInfoSize  = 26
+	compactNodeInfo6Size = 38
+)
+
 type Node struct {
-	ID             *Identity    `json:"id"`
+	ID             NodeID       `json:"id"`
 	Addr           *net.UDPAddr `json:"addr"`
 	LastActiveTime time.Time    `json:"lastActiveTime"`
 }
@@ -20,7 +27,12 @@ func (node *Node) CompactNodeInfo() string {
 	}, "")
 }
 
+// CompactIPPortInfo returns the compact form of the node address, 6 bytes
+// for an IPv4 node and 18 bytes for an IPv6 one.
 func (node *Node) CompactIPPortInfo() string {
+	if node.Addr.IP.To4() == nil {
+		return string(node.Addr.IP.To16()) + string([]byte{byte(node.Addr.Port >> 8), byte(node.Addr.Port)})
+	}
 	info, _ := util.EncodeCompactIPPortInfo(node.Addr.IP, node.Addr.Port)
 	return info
 }
@@ -30,16 +42,28 @@ func NewNode(id, network, address string) (*Node, error) {
 		return nil, errors.New("node ID should be a 20-length string")
 	}
 
+	nodeID, err := NodeIDFromString(id)
+	if err != nil {
+		return nil, err
+	}
+
 	addr, err := net.ResolveUDPAddr(network, address)
 	if err != nil {
 		return nil, err
 	}
 
-	return &Node{NewIdentityFromString(id), addr, time.Now()}, nil
+	return &Node{nodeID, addr, time.Now()}, nil
 }
 
+// NewNodeFromCompactInfo returns the node of a 26 bytes entry of nodes, or
+// of a 38 bytes entry of nodes6 which is always resolved as udp6.
 func NewNodeFromCompactInfo(compactNodeInfo string, network string) (*Node, error) {
-	if len(compactNodeInfo) != 26 {
+	if len(compactNodeInfo) == compactNodeInfo6Size {
+		ip := net.IP(compactNodeInfo[20:36])
+		port := int(compactNodeInfo[36])<<8 | int(compactNodeInfo[37])
+		return NewNode(compactNodeInfo[:20], "udp6", net.JoinHostPort(ip.String(), strconv.Itoa(port)))
+	}
+	if len(compactNodeInfo) != compactNodeInfoSize {
 		return nil, errors.New("compactNodeInfo should be a 26-length string")
 	}
 
@@ -51,3 +75,23 @@ func NewNodeFromCompactInfo(compactNodeInfo string, network string) (*Node, erro
 
 	return NewNode(id, network, util.GenerateAddress(ip.String(), port))
 }
+
+// ParseNodes returns the nodes of the nodes and nodes6 values of a
+// response, the invalid entries are skipped.
+func ParseNodes(r map[string]interface{}, network string) []*Node {
+	nodes := make([]*Node, 0)
+	for _, key := range []struct {
+		name string
+		size int
+	}{{"nodes", compactNodeInfoSize}, {"nodes6", compactNodeInfo6Size}} {
+		infos, _ := r[key.name].(string)
+		for i := 0; i+key.size <= len(infos); i += key.size {
+			node, err := NewNodeFromCompactInfo(infos[i:i+key.size], network)
+			if err != nil {
+				continue
+			}
+			nodes = append(nodes, node)
+		}
+	}
+	return nodes
+}
@@ -0,0 +1,62 @@
+package dht
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// newTestConfig returns the config of a node listening on addr of network,
+// with handlers which do nothing.
+func newTestConfig(network *MemoryNetwork, addr string) *Config {
+	config := GetNormalConfig()
+	config.TransportConstructor = NewKRPCTransport
+	config.Handler = func(table *DistributedHashTable, packet Packet) {}
+	config.HandshakeFunc = func(node *Node, t *Transport, target []byte) {}
+	config.PingFunc = func(node *Node, t *Transport) {}
+	config.ListenFunc = network.ListenPacket
+	config.LocalAddr = addr
+	return config
+}
+
+func TestClose(t *testing.T) {
+	network := NewMemoryNetwork()
+	config := newTestConfig(network, "93.184.0.1:6881")
+	config.PacketQueueSize = 4
+	// the handler is slower than the packets come, the channel stays full
+	config.Handler = func(table *DistributedHashTable, packet Packet) {
+		time.Sleep(time.Millisecond)
+	}
+
+	table := NewDHT(config)
+	stopped := make(chan struct{})
+	go func() {
+		table.Run()
+		close(stopped)
+	}()
+	<-table.Ready()
+
+	from := &net.UDPAddr{IP: net.IPv4(93, 184, 0, 2), Port: 6881}
+	to := table.LocalAddrs()[0]
+	flooding := make(chan struct{})
+	go func() {
+		defer close(flooding)
+		for network.DeliverWait([]byte("d1:y1:qe"), from, to) {
+		}
+	}()
+	time.Sleep(20 * time.Millisecond)
+
+	closed := make(chan struct{})
+	go func() {
+		table.Close()
+		table.Close()
+		close(closed)
+	}()
+	for name, done := range map[string]chan struct{}{"Close": closed, "Run": stopped, "the receiving": table.receiveDone, "the delivery": flooding} {
+		select {
+		case <-done:
+		case <-time.After(2 * time.Second):
+			t.Fatalf("%s did not return", name)
+		}
+	}
+}
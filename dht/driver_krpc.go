@@ -6,6 +6,7 @@ import (
 	"github.com/sirupsen/logrus"
 	"time"
 	"github.com/johnnyeven/terra/dht/util"
+	"fmt"
 )
 
 const (
@@ -13,6 +14,13 @@ const (
 	FindNodeType     = "find_node"
 	GetPeersType     = "get_peers"
 	AnnouncePeerType = "announce_peer"
+
+	// BEP51
+	SampleInfohashesType = "sample_infohashes"
+
+	// BEP44
+	GetType = "get"
+	PutType = "put"
 )
 
 const (
@@ -22,20 +30,45 @@ const (
 	UnknownError
 )
 
+var (
+	// ErrTimeout is the error of a query which got no response.
+	ErrTimeout = errors.New("query timed out")
+	// ErrQueueFull is the error of a query dropped because the request
+	// queue is full.
+	ErrQueueFull = errors.New("request queue is full")
+	// ErrRateLimited is the error of a response dropped because the
+	// outgoing rate limits are reached.
+	ErrRateLimited = errors.New("rate limit exceeded")
+)
+
+// KRPCError is an error response of a query.
+type KRPCError struct {
+	Code    int
+	Message string
+}
+
+func (e *KRPCError) Error() string {
+	return fmt.Sprintf("krpc error %d: %s", e.Code, e.Message)
+}
+
 var _ interface {
 	TransportDriver
 } = (*KRPCClient)(nil)
 
+// errNotConnected is returned by the net.Conn methods of KRPCClient which
+// need a remote address, the socket is not connected.
+var errNotConnected = errors.New("krpc socket is not connected")
+
 type KRPCClient struct {
-	conn *net.UDPConn
+	conn net.PacketConn
 	dht  *DistributedHashTable
 }
 
-func NewKRPCTransport(dht *DistributedHashTable, conn net.Conn, maxCursor uint64) *Transport {
+func NewKRPCTransport(dht *DistributedHashTable, conn net.PacketConn, maxCursor uint64) *Transport {
 	trans := &Transport{}
 	trans.Init(dht, &KRPCClient{
 		dht:  dht,
-		conn: conn.(*net.UDPConn),
+		conn: conn,
 	}, maxCursor)
 
 	return trans
@@ -43,19 +76,28 @@ func NewKRPCTransport(dht *DistributedHashTable, conn net.Conn, maxCursor uint64
 
 func (c *KRPCClient) MakeRequest(id interface{}, remoteAddr net.Addr, requestType string, data interface{}) *Request {
 	params := MakeQuery(c.dht.transport.GenerateTranID(), requestType, data.(map[string]interface{}))
+	if c.dht.ReadOnly {
+		params["ro"] = 1
+	}
 	return &Request{
 		ClientID:   id,
 		CMD:        requestType,
 		Data:       params,
 		RemoteAddr: remoteAddr,
+		Priority:   PriorityQuery,
 	}
 }
 
 func (c *KRPCClient) MakeResponse(id interface{}, remoteAddr net.Addr, tranID interface{}, data interface{}) *Request {
 	params := MakeResponse(tranID.(string), data.(map[string]interface{}))
+	// the address we see the querier as, for its external IP voting (BEP 42)
+	if addr, ok := remoteAddr.(*net.UDPAddr); ok {
+		params["ip"] = (&Node{Addr: addr}).CompactIPPortInfo()
+	}
 	return &Request{
 		Data:       params,
 		RemoteAddr: remoteAddr,
+		Priority:   PriorityResponse,
 	}
 }
 
@@ -64,6 +106,7 @@ func (c *KRPCClient) MakeError(id interface{}, remoteAddr net.Addr, tranID inter
 	return &Request{
 		Data:       params,
 		RemoteAddr: remoteAddr,
+		Priority:   PriorityResponse,
 	}
 }
 
@@ -78,15 +121,25 @@ func (c *KRPCClient) SendRequest(request *Request, retry int) {
 	success := false
 Run:
 	for i := 0; i < retry; i++ {
+		if i > 0 {
+			transactionRetriesTotal.WithLabelValues(methodLabel(request.CMD)).Inc()
+		}
+
 		logrus.Debugf("[KRPCClient].Request c.conn.WriteToUDP try %d", i+1)
+		start := time.Now()
 		err := c.Send(request)
 		if err != nil {
+			// a local failure, not a sign the node is gone
 			logrus.Warningf("[KRPCClient].Request c.conn.WriteToUDP err: %v", err)
-			break
+			if request.Callback != nil {
+				request.Callback(nil, err)
+			}
+			return
 		}
 
 		select {
 		case <-tran.ResponseChannel:
+			rttSeconds.WithLabelValues(methodLabel(request.CMD)).ObserveDuration(time.Since(start))
 			success = true
 			break Run
 		case <-time.After(time.Second * 15):
@@ -94,15 +147,37 @@ Run:
 	}
 
 	if !success {
-		c.dht.GetRoutingTable().RemoveByAddr(request.RemoteAddr.String())
+		transactionTimeoutsTotal.WithLabelValues(methodLabel(request.CMD)).Inc()
+		c.dht.GetRoutingTable().EvictByAddr(request.RemoteAddr.String())
+
+		addr, _ := request.RemoteAddr.(*net.UDPAddr)
+		c.dht.Events().Publish(Event{Type: EventTransactionTimeout, Addr: addr, Method: request.CMD})
+
+		if request.Callback != nil {
+			request.Callback(nil, ErrTimeout)
+		}
 	}
 }
 
 func (c *KRPCClient) Send(request *Request) error {
-	count, err := c.conn.WriteToUDP([]byte(util.Encode(request.Data)), request.RemoteAddr.(*net.UDPAddr))
+	data := []byte(util.Encode(request.Data))
+	y, _ := request.Data.(map[string]interface{})["y"].(string)
+	if y == "q" {
+		c.dht.transport.Throttle(request.Priority, request.RemoteAddr, len(data))
+	} else if !c.dht.transport.Allow(request.Priority, request.RemoteAddr, len(data)) {
+		// responses are sent by the handler, which must not wait
+		responsesDroppedTotal.Inc()
+		return ErrRateLimited
+	}
+
+	count, err := c.conn.WriteTo(data, request.RemoteAddr)
 	if err != nil {
 		return err
 	}
+	c.dht.transport.countOut(count)
+	c.dht.capture(localAddrOf(c.conn, request.RemoteAddr), request.RemoteAddr, data)
+	CountPacket(DirectionOut, y, request.CMD)
+	BytesTotal.WithLabelValues(DirectionOut).Add(float64(count))
 
 	logrus.Debugf("[KRPCClient].Sent %d bytes", count)
 
@@ -112,21 +187,43 @@ func (c *KRPCClient) Send(request *Request) error {
 func (c *KRPCClient) Receive(receiveChannel chan Packet) {
 	buff := make([]byte, 8192)
 	for {
-		n, raddr, err := c.conn.ReadFromUDP(buff)
+		n, addr, err := c.conn.ReadFrom(buff)
 		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			// the socket is closed
+			return
+		}
+		raddr, ok := addr.(*net.UDPAddr)
+		if !ok {
 			continue
 		}
 
-		receiveChannel <- Packet{buff[:n], raddr}
+		c.dht.transport.countIn(n)
+		c.dht.capture(raddr, localAddrOf(c.conn, raddr), buff[:n])
+		BytesTotal.WithLabelValues(DirectionIn).Add(float64(n))
+		if c.dht.Blocked(raddr.IP) {
+			continue
+		}
+
+		data := make([]byte, n)
+		copy(data, buff[:n])
+		if n > 0 && data[0] != 'd' && c.dht.OtherPacketHandler != nil {
+			c.dht.OtherPacketHandler(c.dht, Packet{data, raddr})
+			continue
+		}
+		receiveChannel <- Packet{data, raddr}
 	}
 }
 
 func (c *KRPCClient) Read(b []byte) (n int, err error) {
-	return c.conn.Read(b)
+	n, _, err = c.conn.ReadFrom(b)
+	return
 }
 
 func (c *KRPCClient) Write(b []byte) (n int, err error) {
-	return c.conn.Write(b)
+	return 0, errNotConnected
 }
 
 func (c *KRPCClient) Close() error {
@@ -138,7 +235,7 @@ func (c *KRPCClient) LocalAddr() net.Addr {
 }
 
 func (c *KRPCClient) RemoteAddr() net.Addr {
-	return c.conn.RemoteAddr()
+	return nil
 }
 
 func (c *KRPCClient) SetDeadline(time time.Time) error {
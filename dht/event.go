@@ -0,0 +1,189 @@
+package dht
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type EventType int
+
+const (
+	// a node is added to the routing table
+	EventNodeAdded EventType = iota
+	// a node is removed from the routing table
+	EventNodeRemoved
+	// a node is removed from the routing table because it stopped responding
+	EventNodeEvicted
+	// a valid query is received, Method is the query type
+	EventQueryReceived
+	// an info_hash is seen in a get_peers or announce_peer query
+	EventInfoHashObserved
+	// a lookup of Target is over, Found tells whether the target was found.
+	// It is published once per lookup
+	EventLookupCompleted
+	// a query got no response after all retries
+	EventTransactionTimeout
+
+	eventTypes
+)
+
+var eventTypeNames = [eventTypes]string{
+	"node_added",
+	"node_removed",
+	"node_evicted",
+	"query_received",
+	"info_hash_observed",
+	"lookup_completed",
+	"transaction_timeout",
+}
+
+func (t EventType) String() string {
+	if t < 0 || t >= eventTypes {
+		return "unknown"
+	}
+	return eventTypeNames[t]
+}
+
+// MarshalText implements encoding.TextMarshaler.
+func (t EventType) MarshalText() ([]byte, error) {
+	return []byte(t.String()), nil
+}
+
+// Event is something the node has seen. Only the fields relevant to its type
+// are set.
+type Event struct {
+	Type EventType `json:"type"`
+	Time time.Time `json:"time"`
+	// the node concerned
+	Node *Node `json:"node,omitempty"`
+	// the remote address
+	Addr *net.UDPAddr `json:"addr,omitempty"`
+	// the KRPC method
+	Method string `json:"method,omitempty"`
+	// the info_hash or the lookup target
+	Target NodeID `json:"target"`
+	// whether the lookup found its target
+	Found bool `json:"found,omitempty"`
+	// the port announced in announce_peer
+	Port int `json:"port,omitempty"`
+}
+
+// Subscription receives the published events of the subscribed types on C.
+// Events are dropped when the buffer of C is full.
+type Subscription struct {
+	// accessed atomically, keep it first for the 64-bit alignment
+	dropped uint64
+	C       <-chan Event
+	ch      chan Event
+	types   uint
+	bus     *EventBus
+}
+
+// Dropped returns how many events have been dropped because the subscriber
+// was too slow.
+func (sub *Subscription) Dropped() uint64 {
+	return atomic.LoadUint64(&sub.dropped)
+}
+
+// Unsubscribe stops the delivery and closes C.
+func (sub *Subscription) Unsubscribe() {
+	sub.bus.Unsubscribe(sub)
+}
+
+// EventBus delivers events to subscribers without ever blocking the
+// publisher.
+type EventBus struct {
+	// accessed atomically, keep them first for the 64-bit alignment
+	published uint64
+	dropped   uint64
+	sync.RWMutex
+	subscriptions map[*Subscription]struct{}
+}
+
+// NewEventBus returns an EventBus pointer.
+func NewEventBus() *EventBus {
+	return &EventBus{
+		subscriptions: make(map[*Subscription]struct{}),
+	}
+}
+
+// Subscribe returns a subscription to the given event types, or to all types
+// if none is given. bufferSize is the capacity of its channel.
+func (bus *EventBus) Subscribe(bufferSize int, types ...EventType) *Subscription {
+	ch := make(chan Event, bufferSize)
+	sub := &Subscription{
+		C:   ch,
+		ch:  ch,
+		bus: bus,
+	}
+
+	if len(types) == 0 {
+		sub.types = 1<<uint(eventTypes) - 1
+	}
+	for _, t := range types {
+		sub.types |= 1 << uint(t)
+	}
+
+	bus.Lock()
+	defer bus.Unlock()
+
+	bus.subscriptions[sub] = struct{}{}
+	return sub
+}
+
+// Unsubscribe stops the delivery to sub and closes its channel.
+func (bus *EventBus) Unsubscribe(sub *Subscription) {
+	bus.Lock()
+	defer bus.Unlock()
+
+	if _, ok := bus.subscriptions[sub]; ok {
+		delete(bus.subscriptions, sub)
+		close(sub.ch)
+	}
+}
+
+// Publish delivers event to the subscribers of its type. The time of the
+// event is set if it is zero.
+func (bus *EventBus) Publish(event Event) {
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	atomic.AddUint64(&bus.published, 1)
+
+	bus.RLock()
+	defer bus.RUnlock()
+
+	for sub := range bus.subscriptions {
+		if sub.types&(1<<uint(event.Type)) == 0 {
+			continue
+		}
+
+		select {
+		case sub.ch <- event:
+		default:
+			atomic.AddUint64(&sub.dropped, 1)
+			atomic.AddUint64(&bus.dropped, 1)
+		}
+	}
+}
+
+// Published returns how many events have been published.
+func (bus *EventBus) Published() uint64 {
+	return atomic.LoadUint64(&bus.published)
+}
+
+// Dropped returns how many deliveries have been dropped over all
+// subscriptions.
+func (bus *EventBus) Dropped() uint64 {
+	return atomic.LoadUint64(&bus.dropped)
+}
+
+// Len returns the number of subscriptions.
+func (bus *EventBus) Len() int {
+	bus.RLock()
+	defer bus.RUnlock()
+
+	return len(bus.subscriptions)
+}
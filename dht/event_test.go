@@ -0,0 +1,108 @@
+package dht
+
+import (
+	"testing"
+)
+
+func TestEventBus(t *testing.T) {
+	bus := NewEventBus()
+	all := bus.Subscribe(8)
+	lookups := bus.Subscribe(8, EventLookupCompleted, EventTransactionTimeout)
+	if bus.Len() != 2 {
+		t.Fatalf("%d subscriptions, want 2", bus.Len())
+	}
+
+	for _, eventType := range []EventType{EventNodeAdded, EventLookupCompleted, EventQueryReceived, EventTransactionTimeout} {
+		bus.Publish(Event{Type: eventType})
+	}
+
+	tests := []struct {
+		name string
+		sub  *Subscription
+		want []EventType
+	}{
+		{"all", all, []EventType{EventNodeAdded, EventLookupCompleted, EventQueryReceived, EventTransactionTimeout}},
+		{"lookups", lookups, []EventType{EventLookupCompleted, EventTransactionTimeout}},
+	}
+	for _, test := range tests {
+		for _, want := range test.want {
+			select {
+			case e := <-test.sub.C:
+				if e.Type != want {
+					t.Errorf("%s: received %s, want %s", test.name, e.Type, want)
+				}
+				if e.Time.IsZero() {
+					t.Errorf("%s: %s has no time", test.name, e.Type)
+				}
+			default:
+				t.Errorf("%s: %s not received", test.name, want)
+			}
+		}
+		select {
+		case e := <-test.sub.C:
+			t.Errorf("%s: received %s of another type", test.name, e.Type)
+		default:
+		}
+	}
+	if bus.Published() != 4 {
+		t.Errorf("%d events published, want 4", bus.Published())
+	}
+
+	// the channel is closed once unsubscribed, and no longer delivered to
+	lookups.Unsubscribe()
+	lookups.Unsubscribe()
+	if _, ok := <-lookups.C; ok {
+		t.Error("channel of an unsubscribed subscription is open")
+	}
+	bus.Publish(Event{Type: EventLookupCompleted})
+	if bus.Len() != 1 || len(all.C) != 1 {
+		t.Errorf("%d subscriptions and %d events queued, want 1 and 1", bus.Len(), len(all.C))
+	}
+	bus.Unsubscribe(all)
+}
+
+func TestEventBusDrops(t *testing.T) {
+	bus := NewEventBus()
+	slow := bus.Subscribe(2)
+	other := bus.Subscribe(8)
+	unbuffered := bus.Subscribe(0, EventNodeAdded)
+
+	// the publisher never waits for a full subscriber
+	for i := 0; i < 5; i++ {
+		bus.Publish(Event{Type: EventNodeAdded})
+	}
+
+	if len(slow.C) != 2 || slow.Dropped() != 3 {
+		t.Errorf("slow subscriber: %d queued and %d dropped, want 2 and 3", len(slow.C), slow.Dropped())
+	}
+	if len(other.C) != 5 || other.Dropped() != 0 {
+		t.Errorf("other subscriber: %d queued and %d dropped, want 5 and 0", len(other.C), other.Dropped())
+	}
+	if unbuffered.Dropped() != 5 {
+		t.Errorf("unbuffered subscriber: %d dropped, want 5", unbuffered.Dropped())
+	}
+	if bus.Dropped() != 8 || bus.Published() != 5 {
+		t.Errorf("bus: %d dropped and %d published, want 8 and 5", bus.Dropped(), bus.Published())
+	}
+
+	// the events published while it was full are lost, the next ones are
+	// delivered
+	<-slow.C
+	bus.Publish(Event{Type: EventNodeRemoved})
+	<-slow.C
+	if e := <-slow.C; e.Type != EventNodeRemoved {
+		t.Errorf("received %s, want %s", e.Type, EventNodeRemoved)
+	}
+}
+
+func TestEventTypeString(t *testing.T) {
+	if s := EventLookupCompleted.String(); s != "lookup_completed" {
+		t.Errorf("EventLookupCompleted is %q", s)
+	}
+	if s := EventType(-1).String(); s != "unknown" {
+		t.Errorf("EventType(-1) is %q", s)
+	}
+	if text, _ := eventTypes.MarshalText(); string(text) != "unknown" {
+		t.Errorf("eventTypes marshaled as %q", text)
+	}
+}
@@ -0,0 +1,101 @@
+package dht
+
+import (
+	"net"
+	"sort"
+	"sync"
+)
+
+const (
+	// how many of the last votes are counted
+	maxExternalIPVotes = 256
+	// how many nodes must agree on an external IP
+	minExternalIPVotes = 3
+)
+
+type externalIPVote struct {
+	// the subnet of the voter
+	voter string
+	ip    net.IP
+}
+
+// externalIPVoter finds the external IPs of the node from the ip key of the
+// responses (BEP 42). The votes of all the sockets are counted together, a
+// node bound to several addresses can have several external IPs of a
+// family. Each /24 of remote IPv4 addresses and each /64 of remote IPv6
+// addresses has one vote, its last one, so that nodes on one network cannot
+// elect an IP alone.
+type externalIPVoter struct {
+	sync.Mutex
+	votes []externalIPVote
+	next  int
+}
+
+func newExternalIPVoter() *externalIPVoter {
+	return &externalIPVoter{votes: make([]externalIPVote, 0, maxExternalIPVotes)}
+}
+
+// Vote records that voter sees us as ip.
+func (v *externalIPVoter) Vote(voter, ip net.IP) {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	if ip.IsUnspecified() {
+		return
+	}
+	vote := externalIPVote{voter: voterSubnet(voter), ip: ip}
+
+	v.Lock()
+	defer v.Unlock()
+
+	for i := range v.votes {
+		if v.votes[i].voter == vote.voter {
+			v.votes[i] = vote
+			return
+		}
+	}
+	if len(v.votes) < maxExternalIPVotes {
+		v.votes = append(v.votes, vote)
+		return
+	}
+	v.votes[v.next] = vote
+	v.next = (v.next + 1) % maxExternalIPVotes
+}
+
+// voterSubnet returns the /24 of an IPv4 voter or the /64 of an IPv6 one.
+func voterSubnet(voter net.IP) string {
+	if ip4 := voter.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(24, 32)).String()
+	}
+	return voter.Mask(net.CIDRMask(64, 128)).String()
+}
+
+// ExternalIPs returns the IPs at least minExternalIPVotes nodes agree on,
+// the IPv4 ones first and then the most voted first.
+func (v *externalIPVoter) ExternalIPs() []net.IP {
+	v.Lock()
+	counts := make(map[string]int)
+	ips := make([]net.IP, 0)
+	for _, vote := range v.votes {
+		key := vote.ip.String()
+		if counts[key] == 0 {
+			ips = append(ips, vote.ip)
+		}
+		counts[key]++
+	}
+	v.Unlock()
+
+	elected := make([]net.IP, 0, len(ips))
+	for _, ip := range ips {
+		if counts[ip.String()] >= minExternalIPVotes {
+			elected = append(elected, ip)
+		}
+	}
+	sort.SliceStable(elected, func(i, j int) bool {
+		if ipv4 := elected[i].To4() != nil; ipv4 != (elected[j].To4() != nil) {
+			return ipv4
+		}
+		return counts[elected[i].String()] > counts[elected[j].String()]
+	})
+	return elected
+}
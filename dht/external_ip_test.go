@@ -0,0 +1,114 @@
+package dht
+
+import (
+	"fmt"
+	"net"
+	"testing"
+)
+
+func TestExternalIPVoter(t *testing.T) {
+	type vote struct {
+		voter, ip string
+	}
+	tests := []struct {
+		name  string
+		votes []vote
+		want  string
+	}{
+		{"too few", []vote{{"1.0.0.1", "5.5.5.5"}, {"2.0.0.1", "5.5.5.5"}}, "[]"},
+		{"three", []vote{{"1.0.0.1", "5.5.5.5"}, {"2.0.0.1", "5.5.5.5"}, {"3.0.0.1", "5.5.5.5"}}, "[5.5.5.5]"},
+		{"one /24", []vote{{"1.0.0.1", "5.5.5.5"}, {"1.0.0.2", "5.5.5.5"}, {"1.0.0.3", "5.5.5.5"}, {"2.0.0.1", "5.5.5.5"}}, "[]"},
+		{"one /64", []vote{{"2001:db8::1", "2001:db8:5::5"}, {"2001:db8::2", "2001:db8:5::5"}, {"2001:db8:0:1::1", "2001:db8:5::5"}}, "[]"},
+		{"three /64", []vote{{"2001:db8::1", "2001:db8:5::5"}, {"2001:db8:0:1::1", "2001:db8:5::5"}, {"2001:db8:0:2::1", "2001:db8:5::5"}}, "[2001:db8:5::5]"},
+		{"last vote", []vote{
+			{"1.0.0.1", "5.5.5.5"}, {"2.0.0.1", "5.5.5.5"}, {"3.0.0.1", "5.5.5.5"},
+			{"3.0.0.2", "6.6.6.6"},
+		}, "[]"},
+		{"ipv4 first", []vote{
+			{"2001:db8::1", "2001:db8:5::5"}, {"2001:db8:0:1::1", "2001:db8:5::5"}, {"2001:db8:0:2::1", "2001:db8:5::5"},
+			{"1.0.0.1", "::ffff:5.5.5.5"}, {"2.0.0.1", "5.5.5.5"}, {"3.0.0.1", "5.5.5.5"},
+		}, "[5.5.5.5 2001:db8:5::5]"},
+		{"most voted first", []vote{
+			{"1.0.0.1", "5.5.5.5"}, {"2.0.0.1", "5.5.5.5"}, {"3.0.0.1", "5.5.5.5"},
+			{"4.0.0.1", "6.6.6.6"}, {"5.0.0.1", "6.6.6.6"}, {"6.0.0.1", "6.6.6.6"}, {"7.0.0.1", "6.6.6.6"},
+		}, "[6.6.6.6 5.5.5.5]"},
+		{"unspecified", []vote{{"1.0.0.1", "0.0.0.0"}, {"2.0.0.1", "0.0.0.0"}, {"3.0.0.1", "0.0.0.0"}}, "[]"},
+	}
+
+	for _, test := range tests {
+		voter := newExternalIPVoter()
+		for _, vote := range test.votes {
+			voter.Vote(net.ParseIP(vote.voter), net.ParseIP(vote.ip))
+		}
+		if got := fmt.Sprint(voter.ExternalIPs()); got != test.want {
+			t.Errorf("%s: %s, want %s", test.name, got, test.want)
+		}
+	}
+
+	// the oldest votes are forgotten
+	voter := newExternalIPVoter()
+	for i := 0; i < 3; i++ {
+		voter.Vote(net.IPv4(1, byte(i), 0, 1), net.IPv4(5, 5, 5, 5))
+	}
+	for i := 0; i < maxExternalIPVotes; i++ {
+		voter.Vote(net.IPv4(2, byte(i), 0, 1), net.IPv4(6, 6, 6, 6))
+	}
+	if got := fmt.Sprint(voter.ExternalIPs()); got != "[6.6.6.6]" {
+		t.Errorf("after %d more votes: %s", maxExternalIPVotes, got)
+	}
+}
+
+func TestFamilyIDs(t *testing.T) {
+	newTable := func(mode, nodeID string) *DistributedHashTable {
+		config := GetNormalConfig()
+		config.Mode = mode
+		config.NodeID = nodeID
+		table := NewDHT(config)
+		table.Self = &Node{ID: RandomNodeID()}
+		table.externalIPs = newExternalIPVoter()
+		return table
+	}
+	elect := func(table *DistributedHashTable, ip string) {
+		for i := 0; i < minExternalIPVotes; i++ {
+			voter := &net.UDPAddr{IP: net.IPv4(byte(i+1), 0, 0, 1), Port: 6881}
+			if net.ParseIP(ip).To4() == nil {
+				voter = &net.UDPAddr{IP: net.ParseIP(fmt.Sprintf("2001:db8:0:%d::1", i)), Port: 6881}
+			}
+			table.VoteExternalIP(voter, net.ParseIP(ip))
+		}
+	}
+	ipv4 := &net.UDPAddr{IP: net.IPv4(7, 7, 7, 7), Port: 6881}
+	ipv6 := &net.UDPAddr{IP: net.ParseIP("2001:db8:7::7"), Port: 6881}
+
+	table := newTable(ClientMode, "")
+	start := table.Self.ID
+	if table.ID(ipv4, "") != start.RawString() || table.ID(ipv6, "") != start.RawString() {
+		t.Fatal("the IDs differ before any external IP is elected")
+	}
+
+	elect(table, "5.5.5.5")
+	id4 := table.SelfID(false)
+	if !IsSecureNodeID(id4, net.ParseIP("5.5.5.5")) || table.ID(ipv4, "") != id4.RawString() {
+		t.Errorf("IPv4 ID %s not derived from 5.5.5.5", id4)
+	}
+	if table.SelfID(true) != start || !table.IsSelf(start) || !table.IsSelf(id4) {
+		t.Errorf("IPv6 ID %s, want %s", table.SelfID(true), start)
+	}
+
+	elect(table, "2001:db8:5::5")
+	id6 := table.SelfID(true)
+	if !IsSecureNodeID(id6, net.ParseIP("2001:db8:5::5")) || table.ID(ipv6, "") != id6.RawString() {
+		t.Errorf("IPv6 ID %s not derived from 2001:db8:5::5", id6)
+	}
+	// a secure ID is kept
+	if table.SelfID(false) != id4 {
+		t.Errorf("IPv4 ID changed to %s", table.SelfID(false))
+	}
+
+	for _, table := range []*DistributedHashTable{newTable(ClientMode, start.String()), newTable(CrawlerMode, "")} {
+		elect(table, "5.5.5.5")
+		if table.SelfID(false) != table.Self.ID {
+			t.Errorf("%s mode with node ID %q: ID changed", table.Mode, table.NodeID)
+		}
+	}
+}
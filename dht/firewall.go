@@ -0,0 +1,160 @@
+package dht
+
+import (
+	"container/list"
+	"github.com/johnnyeven/terra/dht/util"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// how long a source is remembered after its last packet
+	firewallSourceTTL = 10 * time.Minute
+	// how many sources are remembered, the least recently seen one is
+	// forgotten beyond so that spoofed addresses cannot fill the memory
+	firewallMaxSources = 1 << 16
+)
+
+type source struct {
+	key         string
+	queries     *util.TokenBucket
+	strikes     int
+	lastStrike  time.Time
+	bannedUntil time.Time
+	lastSeen    time.Time
+}
+
+// firewall protects the node against abusive sources. It drops the packets
+// of blocklisted and banned addresses, limits the inbound queries per source
+// IP and bans a source temporarily after too many strikes. A strike is a
+// query over the limit or a malformed packet.
+type firewall struct {
+	sync.Mutex
+	blocklist   *Blocklist
+	queryRate   float64
+	queryBurst  float64
+	maxStrikes  int
+	banDuration time.Duration
+	maxSources  int
+	// the sources by IP, and from the most to the least recently seen
+	sources map[string]*list.Element
+	lru     *list.List
+}
+
+func newFirewall(blocklist *Blocklist, queriesPerSecond, burst, maxStrikes int, banDuration time.Duration) *firewall {
+	if burst < queriesPerSecond {
+		burst = queriesPerSecond
+	}
+
+	return &firewall{
+		blocklist:   blocklist,
+		queryRate:   float64(queriesPerSecond),
+		queryBurst:  float64(burst),
+		maxStrikes:  maxStrikes,
+		banDuration: banDuration,
+		maxSources:  firewallMaxSources,
+		sources:     make(map[string]*list.Element),
+		lru:         list.New(),
+	}
+}
+
+func (f *firewall) source(ip net.IP) *source {
+	key := ip.String()
+	if e, ok := f.sources[key]; ok {
+		f.lru.MoveToFront(e)
+		s := e.Value.(*source)
+		s.lastSeen = time.Now()
+		return s
+	}
+
+	if f.lru.Len() >= f.maxSources {
+		oldest := f.lru.Back()
+		f.lru.Remove(oldest)
+		delete(f.sources, oldest.Value.(*source).key)
+	}
+	s := &source{
+		key:      key,
+		queries:  util.NewTokenBucket(f.queryRate, f.queryBurst),
+		lastSeen: time.Now(),
+	}
+	f.sources[key] = f.lru.PushFront(s)
+	return s
+}
+
+// Blocked reports whether ip is blocklisted or banned.
+func (f *firewall) Blocked(ip net.IP) bool {
+	if f.blocklist.Contains(ip) {
+		return true
+	}
+
+	f.Lock()
+	defer f.Unlock()
+
+	e, ok := f.sources[ip.String()]
+	if !ok || !time.Now().Before(e.Value.(*source).bannedUntil) {
+		return false
+	}
+	// a banned source which keeps sending is not the one forgotten
+	f.lru.MoveToFront(e)
+	return true
+}
+
+// AllowQuery reports whether a query from ip can be answered.
+func (f *firewall) AllowQuery(ip net.IP) bool {
+	f.Lock()
+	defer f.Unlock()
+
+	s := f.source(ip)
+	if time.Now().Before(s.bannedUntil) {
+		return false
+	}
+	if s.queries.Take(1) {
+		return true
+	}
+
+	f.strike(s)
+	return false
+}
+
+// Strike records a misbehaviour of ip.
+func (f *firewall) Strike(ip net.IP) {
+	f.Lock()
+	defer f.Unlock()
+
+	f.strike(f.source(ip))
+}
+
+func (f *firewall) strike(s *source) {
+	if f.maxStrikes <= 0 {
+		return
+	}
+
+	now := time.Now()
+	if now.Sub(s.lastStrike) > f.banDuration {
+		s.strikes = 0
+	}
+	s.strikes++
+	s.lastStrike = now
+
+	if s.strikes >= f.maxStrikes {
+		s.strikes = 0
+		s.bannedUntil = now.Add(f.banDuration)
+	}
+}
+
+// Sweep forgets the sources which are neither active nor banned.
+func (f *firewall) Sweep() {
+	f.Lock()
+	defer f.Unlock()
+
+	now := time.Now()
+	for e := f.lru.Front(); e != nil; {
+		next := e.Next()
+		if s := e.Value.(*source); now.Sub(s.lastSeen) > firewallSourceTTL && now.After(s.bannedUntil) {
+			f.lru.Remove(e)
+			delete(f.sources, s.key)
+		}
+		e = next
+	}
+}
@@ -0,0 +1,161 @@
+package dht
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBlocklist(t *testing.T) {
+	b := NewBlocklist()
+	err := b.Read(strings.NewReader(`# comment
+10.0.0.0/8
+Some range:1.2.3.0-1.2.3.255
+001.002.004.000 - 001.002.004.255 , 000 , DAT
+5.5.5.5
+1.2.3.128-1.2.4.10
+2001:db8::/32
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 1.2.3.0 to 1.2.4.255 are merged
+	if n := b.Len(); n != 4 {
+		t.Errorf("Len() = %d, want 4", n)
+	}
+
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{"10.1.2.3", true},
+		{"11.0.0.0", false},
+		{"1.2.3.0", true},
+		{"1.2.4.255", true},
+		{"1.2.5.0", false},
+		{"5.5.5.5", true},
+		{"5.5.5.6", false},
+		{"2001:db8::1", true},
+		{"2001:db9::1", false},
+	}
+	for _, test := range tests {
+		if got := b.Contains(net.ParseIP(test.ip)); got != test.want {
+			t.Errorf("Contains(%s) = %v, want %v", test.ip, got, test.want)
+		}
+	}
+
+	// added after the merge
+	b.AddRule("6.0.0.0/24")
+	if !b.Contains(net.ParseIP("6.0.0.1")) || b.Contains(net.ParseIP("6.0.1.1")) {
+		t.Error("range added after the merge not searched")
+	}
+}
+
+func TestBlocklistAdd(t *testing.T) {
+	// every other /24 from 1.0.0.0
+	var list bytes.Buffer
+	for i := 0; i < 10000; i++ {
+		fmt.Fprintf(&list, "1.%d.%d.0/24\n", (2*i)>>8, (2*i)&0xff)
+	}
+	b := NewBlocklist()
+	if err := b.Read(&list); err != nil {
+		t.Fatal(err)
+	}
+	if len(b.ranges) != 10000 || len(b.unsorted) != 0 {
+		t.Fatalf("%d ranges and %d unsorted, want 10000 and 0", len(b.ranges), len(b.unsorted))
+	}
+
+	// the ranges added one by one are merged once there are too many to
+	// search linearly
+	for i := 0; i < 200; i++ {
+		rule := fmt.Sprintf("2.0.%d.0/24", 199-i)
+		if err := b.AddRule(rule); err != nil {
+			t.Fatal(err)
+		}
+		if len(b.unsorted) > maxUnsortedRanges {
+			t.Fatalf("%d unsorted ranges", len(b.unsorted))
+		}
+		if !b.Contains(net.IPv4(2, 0, byte(199-i), 1)) {
+			t.Fatalf("%s not searched", rule)
+		}
+	}
+	// 2.0.0.0 to 2.0.199.255 are merged
+	if n := b.Len(); n > 10001+maxUnsortedRanges {
+		t.Errorf("Len() = %d, want at most %d", n, 10001+maxUnsortedRanges)
+	}
+	b.merge()
+	if n := b.Len(); n != 10001 {
+		t.Errorf("Len() = %d once merged, want 10001", n)
+	}
+
+	// a range joining two others
+	b.AddRule("1.0.1.0/24")
+	b.merge()
+	if n := b.Len(); n != 10000 {
+		t.Errorf("Len() = %d, want 10000", n)
+	}
+	for _, test := range []struct {
+		ip   string
+		want bool
+	}{
+		{"1.0.0.0", true},
+		{"1.0.1.128", true},
+		{"1.0.2.255", true},
+		{"1.0.3.0", false},
+		{"1.78.30.1", true},
+		{"1.78.31.1", false},
+		{"2.0.200.0", false},
+	} {
+		if got := b.Contains(net.ParseIP(test.ip)); got != test.want {
+			t.Errorf("Contains(%s) = %v, want %v", test.ip, got, test.want)
+		}
+	}
+}
+
+func TestFirewallBan(t *testing.T) {
+	f := newFirewall(nil, 1, 2, 3, time.Minute)
+	ip := net.IPv4(93, 184, 0, 1)
+
+	for i := 0; i < 2; i++ {
+		if !f.AllowQuery(ip) {
+			t.Fatalf("query %d within the burst refused", i)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		if f.AllowQuery(ip) {
+			t.Fatalf("query %d over the limit allowed", i)
+		}
+	}
+	if !f.Blocked(ip) {
+		t.Error("source not banned after 3 strikes")
+	}
+	if f.Blocked(net.IPv4(93, 184, 0, 2)) {
+		t.Error("other source banned")
+	}
+}
+
+func TestFirewallMaxSources(t *testing.T) {
+	f := newFirewall(nil, 10, 10, 1, time.Minute)
+	f.maxSources = 3
+
+	banned := net.IPv4(93, 184, 0, 1)
+	f.Strike(banned)
+	for i := 2; i < 10; i++ {
+		f.AllowQuery(net.IPv4(93, 184, 0, byte(i)))
+		// the banned source keeps sending
+		f.Blocked(banned)
+	}
+
+	if n := len(f.sources); n != 3 || f.lru.Len() != 3 {
+		t.Errorf("%d sources remembered, want 3", n)
+	}
+	if !f.Blocked(banned) {
+		t.Error("active banned source forgotten")
+	}
+	if _, ok := f.sources[net.IPv4(93, 184, 0, 2).String()]; ok {
+		t.Error("least recently seen source kept")
+	}
+}
@@ -91,6 +91,33 @@ func (id *Identity) Xor(source *Identity) *Identity {
 	return distance
 }
 
+// NodeID returns the first 160 bits of id, padded with 0.
+func (id *Identity) NodeID() (nodeID NodeID) {
+	copy(nodeID[:], id.data)
+	return
+}
+
+// MatchNodeID reports whether the first prefixLen bits of id and nodeID are
+// the same.
+func (id *Identity) MatchNodeID(nodeID NodeID, prefixLen int) bool {
+	if prefixLen > id.Size {
+		logrus.Panic("[Identity].MatchNodeID err: index out of range")
+	}
+
+	return id.NodeID().CommonPrefixLen(nodeID) >= prefixLen
+}
+
+// identityKey is a comparable form of an Identity up to 160 bits, it is used
+// as a map key.
+type identityKey struct {
+	size int
+	data NodeID
+}
+
+func (id *Identity) key() identityKey {
+	return identityKey{id.Size, id.NodeID()}
+}
+
 func (id *Identity) String() string {
 	div, mod := id.Size/8, id.Size%8
 	buff := make([]string, div+mod)
@@ -0,0 +1,114 @@
+package dht
+
+import (
+	"sync"
+)
+
+// idTree indexes the nodes of a bucket by ID in a crit-bit tree, so that the
+// closest ones to an ID are found without looking at the others. An inner
+// node branches on the first bit its two subtrees differ in.
+type idTree struct {
+	sync.RWMutex
+	root *idTreeNode
+}
+
+type idTreeNode struct {
+	// the bit branched on, for an inner node
+	bit   int
+	child [2]*idTreeNode
+	// the node of a leaf
+	node *Node
+}
+
+func newIDTree() *idTree {
+	return &idTree{}
+}
+
+// Insert adds node, or replaces the node with its ID.
+func (t *idTree) Insert(node *Node) {
+	t.Lock()
+	defer t.Unlock()
+
+	leaf := &idTreeNode{node: node}
+	if t.root == nil {
+		t.root = leaf
+		return
+	}
+
+	// the leaf sharing the longest prefix with node
+	closest := t.root
+	for closest.node == nil {
+		closest = closest.child[node.ID.Bit(closest.bit)]
+	}
+	bit := node.ID.CommonPrefixLen(closest.node.ID)
+	if bit == maxPrefixLength {
+		closest.node = node
+		return
+	}
+
+	// the new inner node goes above the first one branching on a later bit
+	link := &t.root
+	for (*link).node == nil && (*link).bit < bit {
+		link = &(*link).child[node.ID.Bit((*link).bit)]
+	}
+	inner := &idTreeNode{bit: bit}
+	inner.child[node.ID.Bit(bit)] = leaf
+	inner.child[1-node.ID.Bit(bit)] = *link
+	*link = inner
+}
+
+// Remove removes the node with id.
+func (t *idTree) Remove(id NodeID) {
+	t.Lock()
+	defer t.Unlock()
+
+	if t.root == nil {
+		return
+	}
+
+	var parent **idTreeNode
+	link := &t.root
+	for (*link).node == nil {
+		parent = link
+		link = &(*link).child[id.Bit((*link).bit)]
+	}
+	if (*link).node.ID != id {
+		return
+	}
+
+	if parent == nil {
+		t.root = nil
+		return
+	}
+	// the sibling takes the place of the parent
+	*parent = (*parent).child[1-id.Bit((*parent).bit)]
+}
+
+// AppendClosest appends to nodes the size nodes closest to id for which keep
+// returns true, all if keep is nil, sorted by distance.
+func (t *idTree) AppendClosest(nodes []*Node, id NodeID, size int, keep func(node *Node) bool) []*Node {
+	t.RLock()
+	defer t.RUnlock()
+
+	end := len(nodes) + size
+	return t.root.appendClosest(nodes, id, end, keep)
+}
+
+// appendClosest walks the subtree of id first at each inner node: the nodes
+// which agree with id on the bit are closer than the ones which don't, so
+// the leaves are met by increasing distance.
+func (n *idTreeNode) appendClosest(nodes []*Node, id NodeID, end int, keep func(node *Node) bool) []*Node {
+	if n == nil || len(nodes) >= end {
+		return nodes
+	}
+	if n.node != nil {
+		if keep == nil || keep(n.node) {
+			nodes = append(nodes, n.node)
+		}
+		return nodes
+	}
+
+	bit := id.Bit(n.bit)
+	nodes = n.child[bit].appendClosest(nodes, id, end, keep)
+	return n.child[1-bit].appendClosest(nodes, id, end, keep)
+}
@@ -0,0 +1,139 @@
+package dht
+
+import (
+	"crypto/ed25519"
+	"crypto/sha1"
+	"errors"
+	"github.com/johnnyeven/terra/dht/util"
+	"strconv"
+)
+
+// BEP 44 limits
+const (
+	// the max size of the bencoded value of an item
+	MaxItemValueSize = 1000
+	// the max size of the salt of a mutable item
+	MaxItemSaltSize = 64
+)
+
+// the errors of a put, with the BEP 44 error codes
+var (
+	ErrItemTooBig       = &KRPCError{Code: 205, Message: "message (v field) too big"}
+	ErrInvalidSignature = &KRPCError{Code: 206, Message: "invalid signature"}
+	ErrSaltTooBig       = &KRPCError{Code: 207, Message: "salt (salt field) too big"}
+	ErrCASMismatch      = &KRPCError{Code: 301, Message: "the CAS hash mismatched, re-read value and try again"}
+	ErrSeqTooLow        = &KRPCError{Code: 302, Message: "sequence number less than current"}
+)
+
+// Item is a BEP 44 item. An immutable item only has a value and is stored
+// under the SHA-1 of it. A mutable item is signed with an ed25519 key and
+// stored under the SHA-1 of the public key and the salt, a higher Seq
+// replaces it.
+type Item struct {
+	// the bencoded value
+	V []byte `json:"v"`
+	// the public key, nil for an immutable item
+	K    []byte `json:"k,omitempty"`
+	Salt []byte `json:"salt,omitempty"`
+	Seq  int64  `json:"seq"`
+	Sig  []byte `json:"sig,omitempty"`
+}
+
+// NewImmutableItem returns the immutable item of v, a string, int, list or
+// dict as util.Encode takes.
+func NewImmutableItem(v interface{}) (*Item, error) {
+	item := &Item{V: []byte(util.Encode(v))}
+	if len(item.V) > MaxItemValueSize {
+		return nil, ErrItemTooBig
+	}
+	return item, nil
+}
+
+// NewMutableItem returns the item of v signed with key.
+func NewMutableItem(key ed25519.PrivateKey, salt []byte, seq int64, v interface{}) (*Item, error) {
+	item := &Item{
+		V:    []byte(util.Encode(v)),
+		K:    []byte(key.Public().(ed25519.PublicKey)),
+		Salt: salt,
+		Seq:  seq,
+	}
+	if len(item.V) > MaxItemValueSize {
+		return nil, ErrItemTooBig
+	}
+	if len(item.Salt) > MaxItemSaltSize {
+		return nil, ErrSaltTooBig
+	}
+	item.Sig = ed25519.Sign(key, item.signatureData())
+	return item, nil
+}
+
+// ImmutableTarget returns the target of the immutable item of the bencoded
+// value v.
+func ImmutableTarget(v []byte) NodeID {
+	return NodeID(sha1.Sum(v))
+}
+
+// MutableTarget returns the target of the mutable items of the public key k
+// and salt.
+func MutableTarget(k, salt []byte) NodeID {
+	return NodeID(sha1.Sum(append(append([]byte{}, k...), salt...)))
+}
+
+// Mutable reports whether the item is mutable.
+func (item *Item) Mutable() bool {
+	return item.K != nil
+}
+
+// Target returns the key the item is stored under.
+func (item *Item) Target() NodeID {
+	if item.Mutable() {
+		return MutableTarget(item.K, item.Salt)
+	}
+	return ImmutableTarget(item.V)
+}
+
+// Value returns the decoded value.
+func (item *Item) Value() (interface{}, error) {
+	return util.Decode(item.V)
+}
+
+// signatureData returns what the signature of a mutable item covers.
+func (item *Item) signatureData() []byte {
+	data := ""
+	if len(item.Salt) > 0 {
+		data = "4:salt" + util.EncodeString(string(item.Salt))
+	}
+	data += "3:seqi" + strconv.FormatInt(item.Seq, 10) + "e1:v"
+	return append([]byte(data), item.V...)
+}
+
+// Verify checks the sizes of the item, that its value is in canonical
+// bencoding and, if it is mutable, its signature.
+func (item *Item) Verify() error {
+	if len(item.V) > MaxItemValueSize {
+		return ErrItemTooBig
+	}
+	value, err := item.Value()
+	if err != nil {
+		return errors.New("invalid value: " + err.Error())
+	}
+	// the value is sent decoded and encoded again, other bytes would no
+	// longer match the target or the signature
+	if util.Encode(value) != string(item.V) {
+		return errors.New("invalid value: not in canonical bencoding")
+	}
+	if !item.Mutable() {
+		return nil
+	}
+
+	if len(item.Salt) > MaxItemSaltSize {
+		return ErrSaltTooBig
+	}
+	if len(item.K) != ed25519.PublicKeySize || len(item.Sig) != ed25519.SignatureSize {
+		return ErrInvalidSignature
+	}
+	if !ed25519.Verify(ed25519.PublicKey(item.K), item.signatureData(), item.Sig) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
@@ -0,0 +1,114 @@
+package dht
+
+import (
+	"bytes"
+	"container/list"
+	"sync"
+	"time"
+)
+
+type storedItem struct {
+	target  NodeID
+	item    *Item
+	lastPut time.Time
+}
+
+// ItemStore keeps the BEP 44 items put by other nodes in memory. Items are
+// forgotten when they have not been put again for a while, as BEP 44 wants
+// them to be republished.
+type ItemStore struct {
+	sync.RWMutex
+	// the items by target, and from the most to the least recently put
+	items        map[NodeID]*list.Element
+	lru          *list.List
+	maxItems     int
+	expiredAfter time.Duration
+}
+
+// NewItemStore returns an ItemStore pointer, a limit of 0 means unlimited.
+func NewItemStore(maxItems int, expiredAfter time.Duration) *ItemStore {
+	return &ItemStore{
+		items:        make(map[NodeID]*list.Element),
+		lru:          list.New(),
+		maxItems:     maxItems,
+		expiredAfter: expiredAfter,
+	}
+}
+
+// Put verifies and stores item. A mutable item replaces the stored one only
+// if its seq is higher, or the same with the same value, and if cas is not
+// nil only if the seq of the stored one is *cas.
+func (s *ItemStore) Put(item *Item, cas *int64) error {
+	if err := item.Verify(); err != nil {
+		return err
+	}
+	target := item.Target()
+
+	s.Lock()
+	defer s.Unlock()
+
+	e, ok := s.items[target]
+	if ok && item.Mutable() {
+		stored := e.Value.(*storedItem)
+		if cas != nil && stored.item.Seq != *cas {
+			return ErrCASMismatch
+		}
+		if item.Seq < stored.item.Seq || (item.Seq == stored.item.Seq && !bytes.Equal(item.V, stored.item.V)) {
+			return ErrSeqTooLow
+		}
+	}
+	if ok {
+		stored := e.Value.(*storedItem)
+		stored.item, stored.lastPut = item, time.Now()
+		s.lru.MoveToFront(e)
+		return nil
+	}
+
+	if s.maxItems > 0 && s.lru.Len() >= s.maxItems {
+		s.remove(s.lru.Back())
+	}
+	s.items[target] = s.lru.PushFront(&storedItem{target: target, item: item, lastPut: time.Now()})
+	return nil
+}
+
+func (s *ItemStore) remove(e *list.Element) {
+	s.lru.Remove(e)
+	delete(s.items, e.Value.(*storedItem).target)
+}
+
+// Get returns the item stored under target, nil if there is none.
+func (s *ItemStore) Get(target NodeID) *Item {
+	s.RLock()
+	defer s.RUnlock()
+
+	if e, ok := s.items[target]; ok {
+		return e.Value.(*storedItem).item
+	}
+	return nil
+}
+
+// Len returns the number of items.
+func (s *ItemStore) Len() int {
+	s.RLock()
+	defer s.RUnlock()
+
+	return len(s.items)
+}
+
+// Expire forgets the items not put for expiredAfter.
+func (s *ItemStore) Expire() {
+	if s.expiredAfter <= 0 {
+		return
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	now := time.Now()
+	for e := s.lru.Back(); e != nil; e = s.lru.Back() {
+		if now.Sub(e.Value.(*storedItem).lastPut) <= s.expiredAfter {
+			break
+		}
+		s.remove(e)
+	}
+}
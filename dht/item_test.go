@@ -0,0 +1,181 @@
+package dht
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"strings"
+	"testing"
+	"time"
+)
+
+func unhex(s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// the mutable items of the examples of BEP 44
+var bep44Key = unhex("77ff84905a91936367c01360803104f92432fcd904a43511876df5cdf3e7e548")
+
+func bep44Item(salt string) *Item {
+	item := &Item{V: []byte("12:Hello World!"), K: bep44Key, Seq: 1}
+	if salt == "" {
+		item.Sig = unhex("305ac8aeb6c9c151fa120f120ea2cfb923564e11552d06a5d856091e5e853cff" +
+			"1260d3f39e4999684aa92eb73ffd136e6f4f3ecbfda0ce53a1608ecd7ae21f01")
+	} else {
+		item.Salt = []byte(salt)
+		item.Sig = unhex("6834284b6b24c3204eb2fea824d82f88883a3d95e8b4a21b8c0ded553d17d17d" +
+			"df9a8a7104b1258f30bed3787e6cb896fca78c58f8e03b5f18f14951a87d9a08")
+	}
+	return item
+}
+
+func TestItemSignature(t *testing.T) {
+	tests := []struct {
+		name   string
+		item   *Item
+		data   string
+		target string
+	}{
+		{"mutable", bep44Item(""), "3:seqi1e1:v12:Hello World!", "4a533d47ec9c7d95b1ad75f576cffc641853b750"},
+		{"salt", bep44Item("foobar"), "4:salt6:foobar3:seqi1e1:v12:Hello World!", "411eba73b6f087ca51a3795d9c8c938d365e32c1"},
+		{"immutable", &Item{V: []byte("12:Hello World!")}, "", "e5f96f6f38320f0f33959cb4d3d656452117aadb"},
+	}
+
+	for _, test := range tests {
+		if err := test.item.Verify(); err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		}
+		if target := test.item.Target().String(); target != test.target {
+			t.Errorf("%s: target %s, want %s", test.name, target, test.target)
+		}
+		if !test.item.Mutable() {
+			continue
+		}
+		if data := string(test.item.signatureData()); data != test.data {
+			t.Errorf("%s: signature data %q, want %q", test.name, data, test.data)
+		}
+	}
+}
+
+func TestItemVerify(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(item *Item)
+		err    error
+	}{
+		{"seq", func(item *Item) { item.Seq = 2 }, ErrInvalidSignature},
+		{"value", func(item *Item) { item.V = []byte("12:Hello World?") }, ErrInvalidSignature},
+		{"salt", func(item *Item) { item.Salt = []byte("foobaz") }, ErrInvalidSignature},
+		{"short signature", func(item *Item) { item.Sig = item.Sig[:63] }, ErrInvalidSignature},
+		{"short key", func(item *Item) { item.K = item.K[1:] }, ErrInvalidSignature},
+		{"big salt", func(item *Item) { item.Salt = make([]byte, MaxItemSaltSize+1) }, ErrSaltTooBig},
+		{"big value", func(item *Item) { item.V = []byte("1001:" + strings.Repeat("a", 1001)) }, ErrItemTooBig},
+	}
+
+	for _, test := range tests {
+		item := bep44Item("foobar")
+		test.change(item)
+		if err := item.Verify(); err != test.err {
+			t.Errorf("%s: %v, want %v", test.name, err, test.err)
+		}
+	}
+
+	for _, v := range []string{"not bencode", "d1:bi1e1:ai2ee", "i01e", "12:Hello World!i1e"} {
+		if err := (&Item{V: []byte(v)}).Verify(); err == nil {
+			t.Errorf("invalid value %q verified", v)
+		}
+	}
+}
+
+func TestNewItem(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	item, err := NewMutableItem(key, []byte("salt"), 7, map[string]interface{}{"a": 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := item.Verify(); err != nil || string(item.V) != "d1:ai1ee" {
+		t.Errorf("item %q: %v", item.V, err)
+	}
+
+	big := strings.Repeat("a", MaxItemValueSize)
+	if _, err := NewImmutableItem(big); err != ErrItemTooBig {
+		t.Errorf("NewImmutableItem returned %v, want ErrItemTooBig", err)
+	}
+	if _, err := NewMutableItem(key, make([]byte, MaxItemSaltSize+1), 1, "v"); err != ErrSaltTooBig {
+		t.Errorf("NewMutableItem returned %v, want ErrSaltTooBig", err)
+	}
+}
+
+func TestItemStore(t *testing.T) {
+	_, key, _ := ed25519.GenerateKey(nil)
+	mutable := func(seq int64, v string) *Item {
+		item, _ := NewMutableItem(key, nil, seq, v)
+		return item
+	}
+	cas := func(seq int64) *int64 {
+		return &seq
+	}
+
+	steps := []struct {
+		name string
+		item *Item
+		cas  *int64
+		err  error
+		// the value stored after the put
+		want string
+	}{
+		{"first", mutable(1, "a"), nil, nil, "1:a"},
+		{"same", mutable(1, "a"), nil, nil, "1:a"},
+		{"same seq", mutable(1, "b"), nil, ErrSeqTooLow, "1:a"},
+		{"lower seq", mutable(0, "b"), nil, ErrSeqTooLow, "1:a"},
+		{"cas mismatch", mutable(2, "b"), cas(0), ErrCASMismatch, "1:a"},
+		{"cas", mutable(2, "b"), cas(1), nil, "1:b"},
+		{"higher seq", mutable(5, "c"), nil, nil, "1:c"},
+		{"bad signature", &Item{V: []byte("1:d"), K: key.Public().(ed25519.PublicKey), Seq: 6, Sig: make([]byte, 64)}, nil, ErrInvalidSignature, "1:c"},
+	}
+
+	store := NewItemStore(0, time.Hour)
+	target := mutable(0, "").Target()
+	for _, step := range steps {
+		if err := store.Put(step.item, step.cas); err != step.err {
+			t.Errorf("%s: %v, want %v", step.name, err, step.err)
+		}
+		if got := store.Get(target); got == nil || string(got.V) != step.want {
+			t.Errorf("%s: stored %+v, want %s", step.name, got, step.want)
+		}
+	}
+	if store.Len() != 1 {
+		t.Errorf("%d items, want 1", store.Len())
+	}
+}
+
+func TestItemStoreEviction(t *testing.T) {
+	store := NewItemStore(2, time.Hour)
+	a, _ := NewImmutableItem("a")
+	b, _ := NewImmutableItem("b")
+	c, _ := NewImmutableItem("c")
+
+	store.Put(a, nil)
+	store.Put(b, nil)
+	// a is put again, b is the least recently put
+	store.Put(a, nil)
+	store.Put(c, nil)
+	if store.Len() != 2 || store.Get(a.Target()) == nil || store.Get(b.Target()) != nil || store.Get(c.Target()) == nil {
+		t.Errorf("a %v, b %v, c %v stored", store.Get(a.Target()), store.Get(b.Target()), store.Get(c.Target()))
+	}
+
+	store = NewItemStore(0, 50*time.Millisecond)
+	store.Put(a, nil)
+	time.Sleep(60 * time.Millisecond)
+	store.Put(b, nil)
+	store.Expire()
+	if store.Get(a.Target()) != nil || store.Get(b.Target()) == nil {
+		t.Error("Expire did not forget only the item not put again")
+	}
+}
@@ -0,0 +1,53 @@
+package dht_test
+
+import (
+	"context"
+	"github.com/johnnyeven/terra/bt"
+	"github.com/johnnyeven/terra/dht"
+	"testing"
+	"time"
+)
+
+func TestLookupCompletedOnce(t *testing.T) {
+	network := dht.NewMemoryNetwork()
+	tables := make([]*dht.DistributedHashTable, 3)
+	for i, addr := range []string{"93.184.0.1:6881", "93.184.0.2:6881", "93.184.0.3:6881"} {
+		tables[i] = newMemoryNode(t, network, addr, false)
+		defer tables[i].Close()
+	}
+	// the first node knows the second, which knows the third
+	for i := 0; i < 2; i++ {
+		next := tables[i+1]
+		tables[i].GetRoutingTable().Insert(&dht.Node{ID: next.Self.ID, Addr: next.LocalAddrs()[0], LastActiveTime: time.Now()})
+	}
+
+	sub := tables[0].Events().Subscribe(16, dht.EventLookupCompleted)
+	defer sub.Unsubscribe()
+	target := tables[2].Self.ID
+
+	// the find_node crawl of the handler is no lookup
+	bt.FindNode(&dht.Node{Addr: tables[1].LocalAddrs()[0]}, tables[0].GetTransport(), target.Bytes())
+	time.Sleep(100 * time.Millisecond)
+	if n := len(sub.C); n != 0 {
+		t.Fatalf("%d lookup_completed events of the crawl", n)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	result, err := bt.Lookup(ctx, tables[0], target, dht.FindNodeType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Nodes) != 2 {
+		t.Errorf("%d nodes found, want 2", len(result.Nodes))
+	}
+
+	// the responses handled after the lookup publish nothing more
+	time.Sleep(100 * time.Millisecond)
+	if n := len(sub.C); n != 1 {
+		t.Fatalf("%d lookup_completed events, want 1", n)
+	}
+	if e := <-sub.C; e.Target != target || !e.Found || e.Method != dht.FindNodeType {
+		t.Errorf("event %+v", e)
+	}
+}
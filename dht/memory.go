@@ -0,0 +1,206 @@
+package dht
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// memoryQueueSize is how many datagrams a memory socket can buffer, the
+// next ones are dropped like UDP does.
+const memoryQueueSize = 1024
+
+var errMemoryConnClosed = errors.New("memory network: use of closed connection")
+
+type memoryTimeoutError struct{}
+
+func (memoryTimeoutError) Error() string   { return "memory network: i/o timeout" }
+func (memoryTimeoutError) Timeout() bool   { return true }
+func (memoryTimeoutError) Temporary() bool { return true }
+
+// MemoryNetwork is an in-memory UDP network. Its ListenPacket can be used as
+// Config.ListenFunc to run nodes without sockets, e.g. to replay a capture
+// file or to test a few nodes talking to each other.
+type MemoryNetwork struct {
+	sync.Mutex
+	conns    map[string]*memoryConn
+	nextPort int
+}
+
+func NewMemoryNetwork() *MemoryNetwork {
+	return &MemoryNetwork{
+		conns:    make(map[string]*memoryConn),
+		nextPort: 49152,
+	}
+}
+
+// ListenPacket returns a socket of the network bound to address. Port 0
+// gets a free port and an unspecified IP becomes 127.0.0.1.
+func (n *MemoryNetwork) ListenPacket(network, address string) (net.PacketConn, error) {
+	addr, err := net.ResolveUDPAddr(network, address)
+	if err != nil {
+		return nil, err
+	}
+	if addr.IP == nil || addr.IP.IsUnspecified() {
+		addr.IP = net.IPv4(127, 0, 0, 1)
+	}
+
+	n.Lock()
+	defer n.Unlock()
+
+	if addr.Port == 0 {
+		for n.conns[(&net.UDPAddr{IP: addr.IP, Port: n.nextPort}).String()] != nil {
+			n.nextPort++
+		}
+		addr.Port = n.nextPort
+		n.nextPort++
+	}
+	if n.conns[addr.String()] != nil {
+		return nil, errors.New("memory network: address already in use: " + addr.String())
+	}
+
+	conn := &memoryConn{
+		network:     n,
+		addr:        addr,
+		inbox:       make(chan Packet, memoryQueueSize),
+		quitChannel: make(chan struct{}),
+	}
+	n.conns[addr.String()] = conn
+	return conn, nil
+}
+
+// Deliver sends data to the socket bound to to as if it came from from. It
+// reports false if the datagram is dropped.
+func (n *MemoryNetwork) Deliver(data []byte, from, to *net.UDPAddr) bool {
+	n.Lock()
+	conn := n.conns[to.String()]
+	n.Unlock()
+
+	if conn == nil {
+		return false
+	}
+	return conn.deliver(Packet{append([]byte(nil), data...), from})
+}
+
+// DeliverWait is Deliver waiting for room in the socket buffer instead of
+// dropping the datagram. It reports false if there is no socket bound to to
+// or if it is closed meanwhile.
+func (n *MemoryNetwork) DeliverWait(data []byte, from, to *net.UDPAddr) bool {
+	n.Lock()
+	conn := n.conns[to.String()]
+	n.Unlock()
+
+	if conn == nil {
+		return false
+	}
+	select {
+	case conn.inbox <- Packet{append([]byte(nil), data...), from}:
+		return true
+	case <-conn.quitChannel:
+		return false
+	}
+}
+
+func (n *MemoryNetwork) remove(conn *memoryConn) {
+	n.Lock()
+	defer n.Unlock()
+
+	if n.conns[conn.addr.String()] == conn {
+		delete(n.conns, conn.addr.String())
+	}
+}
+
+type memoryConn struct {
+	sync.Mutex
+	network      *MemoryNetwork
+	addr         *net.UDPAddr
+	inbox        chan Packet
+	readDeadline time.Time
+	closed       bool
+	quitChannel  chan struct{}
+}
+
+func (c *memoryConn) deliver(packet Packet) bool {
+	select {
+	case c.inbox <- packet:
+		return true
+	case <-c.quitChannel:
+		return false
+	default:
+		return false
+	}
+}
+
+func (c *memoryConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	c.Lock()
+	deadline := c.readDeadline
+	c.Unlock()
+
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case packet := <-c.inbox:
+		return copy(b, packet.Data), packet.RemoteAddr, nil
+	case <-c.quitChannel:
+		return 0, nil, errMemoryConnClosed
+	case <-timeout:
+		return 0, nil, memoryTimeoutError{}
+	}
+}
+
+func (c *memoryConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	to, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return 0, errors.New("memory network: not a UDP address")
+	}
+
+	c.Lock()
+	closed := c.closed
+	c.Unlock()
+	if closed {
+		return 0, errMemoryConnClosed
+	}
+
+	// like UDP, a datagram nobody receives is lost silently
+	c.network.Deliver(b, c.addr, to)
+	return len(b), nil
+}
+
+func (c *memoryConn) Close() error {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.closed {
+		return errMemoryConnClosed
+	}
+	c.closed = true
+	close(c.quitChannel)
+	c.network.remove(c)
+	return nil
+}
+
+func (c *memoryConn) LocalAddr() net.Addr {
+	return c.addr
+}
+
+func (c *memoryConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+func (c *memoryConn) SetReadDeadline(t time.Time) error {
+	c.Lock()
+	defer c.Unlock()
+
+	c.readDeadline = t
+	return nil
+}
+
+func (c *memoryConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
@@ -0,0 +1,132 @@
+package dht
+
+import (
+	"github.com/johnnyeven/terra/metrics"
+)
+
+// Directions of the packet metrics.
+const (
+	DirectionIn  = "in"
+	DirectionOut = "out"
+)
+
+// metrics shared by all the nodes of the process, registered in
+// metrics.DefaultRegistry
+var (
+	// KRPC packets by direction, message type (q, r or e) and method
+	PacketsTotal = metrics.NewCounterVec(
+		"terra_dht_packets_total",
+		"KRPC packets by direction, message type and method.",
+		"direction", "type", "method",
+	)
+	BytesTotal = metrics.NewCounterVec(
+		"terra_dht_bytes_total",
+		"UDP payload bytes by direction.",
+		"direction",
+	)
+	DecodeErrorsTotal = metrics.NewCounter(
+		"terra_dht_decode_errors_total",
+		"Received packets which are not valid KRPC messages.",
+	)
+	transactionTimeoutsTotal = metrics.NewCounterVec(
+		"terra_dht_transaction_timeouts_total",
+		"Queries which got no response after all the retries, by method.",
+		"method",
+	)
+	transactionRetriesTotal = metrics.NewCounterVec(
+		"terra_dht_transaction_retries_total",
+		"Queries sent again because the previous try got no response, by method.",
+		"method",
+	)
+	requestsDroppedTotal = metrics.NewCounterVec(
+		"terra_dht_requests_dropped_total",
+		"Queries dropped because the request queue was full, by method.",
+		"method",
+	)
+	responsesDroppedTotal = metrics.NewCounter(
+		"terra_dht_responses_dropped_total",
+		"Responses and errors dropped because of the outgoing rate limits.",
+	)
+	rttSeconds = metrics.NewHistogramVec(
+		"terra_dht_rtt_seconds",
+		"Round trip time of the answered queries, by method.",
+		metrics.DefaultBuckets,
+		"method",
+	)
+)
+
+func init() {
+	metrics.DefaultRegistry.MustRegister(
+		PacketsTotal,
+		BytesTotal,
+		DecodeErrorsTotal,
+		transactionTimeoutsTotal,
+		transactionRetriesTotal,
+		requestsDroppedTotal,
+		responsesDroppedTotal,
+		rttSeconds,
+	)
+}
+
+// methods are the KRPC methods used as metric labels, the others are
+// counted as other so that remote nodes cannot create labels at will.
+var methods = map[string]bool{
+	PingType:             true,
+	FindNodeType:         true,
+	GetPeersType:         true,
+	AnnouncePeerType:     true,
+	SampleInfohashesType: true,
+	GetType:              true,
+	PutType:              true,
+}
+
+// methodLabel returns the metric label of a KRPC method.
+func methodLabel(method string) string {
+	if method == "" {
+		return "unknown"
+	}
+	if !methods[method] {
+		return "other"
+	}
+	return method
+}
+
+// CountPacket counts a KRPC message of type y and method q.
+func CountPacket(direction, y, q string) {
+	PacketsTotal.WithLabelValues(direction, y, methodLabel(q)).Inc()
+}
+
+// RegisterMetrics registers the gauges of the node in registry, they are
+// read at collection time.
+func (dht *DistributedHashTable) RegisterMetrics(registry *metrics.Registry) error {
+	gauges := []*metrics.GaugeFunc{
+		metrics.NewGaugeFunc("terra_dht_routing_table_nodes", "Nodes in the routing table.", func() float64 {
+			return float64(dht.routingTable.Len())
+		}),
+		metrics.NewGaugeFunc("terra_dht_routing_table_buckets", "Buckets of the routing table.", func() float64 {
+			return float64(dht.routingTable.BucketCount())
+		}),
+		metrics.NewGaugeFunc("terra_dht_peer_store_torrents", "Torrents in the peer store.", func() float64 {
+			return float64(dht.peerStore.Len())
+		}),
+		metrics.NewGaugeFunc("terra_dht_peer_store_peers", "Peers in the peer store.", func() float64 {
+			return float64(dht.peerStore.PeerCount())
+		}),
+		metrics.NewGaugeFunc("terra_dht_handler_queue_depth", "Received packets waiting for the handler.", func() float64 {
+			return float64(len(dht.packetChannel))
+		}),
+		metrics.NewGaugeFunc("terra_dht_request_queue_length", "Outgoing requests waiting to be sent.", func() float64 {
+			return float64(dht.transport.QueueLength())
+		}),
+		metrics.NewGaugeFunc("terra_dht_pending_transactions", "Queries waiting for a response.", func() float64 {
+			return float64(dht.transport.TransactionLength())
+		}),
+	}
+
+	for _, gauge := range gauges {
+		if err := registry.Register(gauge); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,276 @@
+package dht
+
+import (
+	"errors"
+	"hash/fnv"
+	"net"
+	"sync"
+	"time"
+)
+
+// maxRoutes is how many remote addresses multiConn remembers the socket of,
+// the routes are forgotten all at once beyond it.
+const maxRoutes = 65536
+
+var (
+	errDeadline        = &deadlineError{}
+	errMultiConnClosed = errors.New("use of closed network connection")
+	// returned by readUntil when the read deadline changes
+	errDeadlineChanged = errors.New("read deadline changed")
+)
+
+type deadlineError struct{}
+
+func (e *deadlineError) Error() string   { return "i/o timeout" }
+func (e *deadlineError) Timeout() bool   { return true }
+func (e *deadlineError) Temporary() bool { return true }
+
+type multiConnPacket struct {
+	data []byte
+	addr net.Addr
+	err  error
+}
+
+// multiConn is the net.PacketConn of the sockets of a node bound to several
+// addresses, as BEP 45 describes. The packets of all the sockets are read
+// together. A packet to a remote address is sent from the socket which last
+// received from it, so a query is answered from the address it was sent to.
+// Otherwise the socket is picked among the ones of the address family of the
+// remote by a hash of its IP, which spreads the nodes over our addresses
+// while each of them always sees the same one.
+type multiConn struct {
+	conns []net.PacketConn
+	// whether each socket takes IPv4 and IPv6 packets
+	ipv4, ipv6 []bool
+	packets    chan multiConnPacket
+
+	mutex        sync.Mutex
+	routes       map[string]int
+	readDeadline time.Time
+	// closed and replaced when the read deadline changes, to wake the
+	// ReadFrom calls waiting
+	deadlineChanged chan struct{}
+
+	closeOnce   sync.Once
+	quitChannel chan struct{}
+}
+
+// newMultiConn returns the multiConn of conns, networks are the ones they
+// were opened with.
+func newMultiConn(conns []net.PacketConn, networks []string) *multiConn {
+	m := &multiConn{
+		conns:       conns,
+		ipv4:        make([]bool, len(conns)),
+		ipv6:        make([]bool, len(conns)),
+		packets:     make(chan multiConnPacket, 64),
+		routes:      make(map[string]int),
+		quitChannel: make(chan struct{}),
+
+		deadlineChanged: make(chan struct{}),
+	}
+	for i, conn := range conns {
+		ip := conn.LocalAddr().(*net.UDPAddr).IP
+		switch {
+		case networks[i] == "udp4" || ip.To4() != nil:
+			m.ipv4[i] = true
+		case networks[i] == "udp6" || !ip.IsUnspecified():
+			m.ipv6[i] = true
+		default:
+			m.ipv4[i], m.ipv6[i] = true, true
+		}
+		go m.read(i)
+	}
+	return m
+}
+
+func (m *multiConn) read(i int) {
+	buff := make([]byte, 65536)
+	for {
+		n, addr, err := m.conns[i].ReadFrom(buff)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			select {
+			case m.packets <- multiConnPacket{err: err}:
+			case <-m.quitChannel:
+			}
+			return
+		}
+
+		m.route(addr, i)
+		data := make([]byte, n)
+		copy(data, buff[:n])
+		select {
+		case m.packets <- multiConnPacket{data: data, addr: addr}:
+		case <-m.quitChannel:
+			return
+		}
+	}
+}
+
+// route remembers that addr sent to the socket i, only if it is not the one
+// it would be picked anyway.
+func (m *multiConn) route(addr net.Addr, i int) {
+	key := addr.String()
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.pick(addr) == i {
+		delete(m.routes, key)
+		return
+	}
+	if len(m.routes) >= maxRoutes {
+		m.routes = make(map[string]int)
+	}
+	m.routes[key] = i
+}
+
+// pick returns the socket of a remote address which never sent anything.
+func (m *multiConn) pick(addr net.Addr) int {
+	udpAddr, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return 0
+	}
+
+	family := m.ipv4
+	if udpAddr.IP.To4() == nil {
+		family = m.ipv6
+	}
+	candidates := make([]int, 0, len(m.conns))
+	for i := range m.conns {
+		if family[i] {
+			candidates = append(candidates, i)
+		}
+	}
+	if len(candidates) == 0 {
+		return 0
+	}
+
+	h := fnv.New32a()
+	h.Write(udpAddr.IP.To16())
+	return candidates[int(h.Sum32()%uint32(len(candidates)))]
+}
+
+// conn returns the socket to send to addr from.
+func (m *multiConn) conn(addr net.Addr) net.PacketConn {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if i, ok := m.routes[addr.String()]; ok {
+		return m.conns[i]
+	}
+	return m.conns[m.pick(addr)]
+}
+
+// localAddrFor returns the local address the packets of addr go through.
+func (m *multiConn) localAddrFor(addr net.Addr) net.Addr {
+	return m.conn(addr).LocalAddr()
+}
+
+func (m *multiConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		m.mutex.Lock()
+		deadline, changed := m.readDeadline, m.deadlineChanged
+		m.mutex.Unlock()
+
+		n, addr, err := m.readUntil(b, deadline, changed)
+		if err != errDeadlineChanged {
+			return n, addr, err
+		}
+	}
+}
+
+// readUntil reads a packet before deadline, unless changed is closed
+// meanwhile.
+func (m *multiConn) readUntil(b []byte, deadline time.Time, changed <-chan struct{}) (int, net.Addr, error) {
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case packet := <-m.packets:
+		if packet.err != nil {
+			return 0, nil, packet.err
+		}
+		return copy(b, packet.data), packet.addr, nil
+	case <-timeout:
+		return 0, nil, errDeadline
+	case <-m.quitChannel:
+		return 0, nil, errMultiConnClosed
+	case <-changed:
+		return 0, nil, errDeadlineChanged
+	}
+}
+
+func (m *multiConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	return m.conn(addr).WriteTo(b, addr)
+}
+
+// LocalAddr returns the address of the first socket.
+func (m *multiConn) LocalAddr() net.Addr {
+	return m.conns[0].LocalAddr()
+}
+
+// LocalAddrs returns the addresses of all the sockets.
+func (m *multiConn) LocalAddrs() []net.Addr {
+	addrs := make([]net.Addr, len(m.conns))
+	for i, conn := range m.conns {
+		addrs[i] = conn.LocalAddr()
+	}
+	return addrs
+}
+
+func (m *multiConn) Close() error {
+	var err error
+	m.closeOnce.Do(func() {
+		close(m.quitChannel)
+		for _, conn := range m.conns {
+			if e := conn.Close(); e != nil && err == nil {
+				err = e
+			}
+		}
+	})
+	return err
+}
+
+func (m *multiConn) SetDeadline(t time.Time) error {
+	if err := m.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return m.SetWriteDeadline(t)
+}
+
+// SetReadDeadline sets the deadline of the ReadFrom calls, the ones waiting
+// included.
+func (m *multiConn) SetReadDeadline(t time.Time) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.readDeadline = t
+	close(m.deadlineChanged)
+	m.deadlineChanged = make(chan struct{})
+	return nil
+}
+
+func (m *multiConn) SetWriteDeadline(t time.Time) error {
+	for _, conn := range m.conns {
+		if err := conn.SetWriteDeadline(t); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// localAddrOf returns the local address of the packets of conn to or from
+// remote.
+func localAddrOf(conn net.PacketConn, remote net.Addr) net.Addr {
+	if m, ok := conn.(*multiConn); ok {
+		return m.localAddrFor(remote)
+	}
+	return conn.LocalAddr()
+}
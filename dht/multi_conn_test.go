@@ -0,0 +1,215 @@
+package dht
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// boundConn is a socket which reports addr as its local address.
+type boundConn struct {
+	net.PacketConn
+	addr *net.UDPAddr
+}
+
+func (c *boundConn) LocalAddr() net.Addr {
+	return c.addr
+}
+
+func listenMemory(t *testing.T, network *MemoryNetwork, addr string) net.PacketConn {
+	conn, err := network.ListenPacket("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+// readFrom returns the next packet received on conn and its source.
+func readFrom(t *testing.T, conn net.PacketConn) (string, net.Addr) {
+	buff := make([]byte, 2048)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, addr, err := conn.ReadFrom(buff)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(buff[:n]), addr
+}
+
+func TestMultiConnFamilies(t *testing.T) {
+	network := NewMemoryNetwork()
+	ipv4 := listenMemory(t, network, "93.184.0.1:6881")
+	ipv6 := listenMemory(t, network, "[2001:db8::1]:6881")
+	dual := &boundConn{
+		PacketConn: listenMemory(t, network, "93.184.0.2:6881"),
+		addr:       &net.UDPAddr{IP: net.IPv6unspecified, Port: 6881},
+	}
+	m := newMultiConn([]net.PacketConn{ipv4, ipv6, dual}, []string{"udp4", "udp6", "udp"})
+	defer m.Close()
+
+	for i, want := range [][2]bool{{true, false}, {false, true}, {true, true}} {
+		if m.ipv4[i] != want[0] || m.ipv6[i] != want[1] {
+			t.Errorf("socket %d takes IPv4 %v and IPv6 %v, want %v", i, m.ipv4[i], m.ipv6[i], want)
+		}
+	}
+
+	picked := make(map[int]int)
+	for i := 0; i < 256; i++ {
+		addr4 := &net.UDPAddr{IP: net.IPv4(198, 51, 100, byte(i)), Port: 6881}
+		addr6 := &net.UDPAddr{IP: net.ParseIP("2001:db8:1::1"), Port: 6881}
+		addr6.IP[15] = byte(i)
+
+		i4, i6 := m.pick(addr4), m.pick(addr6)
+		if i4 != 0 && i4 != 2 {
+			t.Fatalf("%v sent from the socket %d", addr4, i4)
+		}
+		if i6 != 1 && i6 != 2 {
+			t.Fatalf("%v sent from the socket %d", addr6, i6)
+		}
+		if m.pick(&net.UDPAddr{IP: addr4.IP, Port: 1}) != i4 {
+			t.Fatalf("the port of %v changes its socket", addr4)
+		}
+		picked[i4]++
+		picked[i6]++
+	}
+	for i := range m.conns {
+		if picked[i] == 0 {
+			t.Errorf("socket %d never picked", i)
+		}
+	}
+}
+
+func TestMultiConnRoutes(t *testing.T) {
+	network := NewMemoryNetwork()
+	conns := []net.PacketConn{
+		listenMemory(t, network, "93.184.0.1:6881"),
+		listenMemory(t, network, "93.184.0.2:6881"),
+	}
+	m := newMultiConn(conns, []string{"udp", "udp"})
+	defer m.Close()
+	remote := listenMemory(t, network, "198.51.100.1:6881")
+	defer remote.Close()
+
+	picked := m.pick(remote.LocalAddr())
+	other := 1 - picked
+	exchange := func(to int) {
+		if _, err := remote.WriteTo([]byte("q"), conns[to].LocalAddr()); err != nil {
+			t.Fatal(err)
+		}
+		if data, addr := readFrom(t, m); data != "q" || addr.String() != remote.LocalAddr().String() {
+			t.Fatalf("received %q from %v", data, addr)
+		}
+		if _, err := m.WriteTo([]byte("r"), remote.LocalAddr()); err != nil {
+			t.Fatal(err)
+		}
+		if data, addr := readFrom(t, remote); data != "r" || addr.String() != conns[to].LocalAddr().String() {
+			t.Errorf("answered %q from %v, want %v", data, addr, conns[to].LocalAddr())
+		}
+	}
+
+	// a query is answered from the address it was sent to
+	exchange(other)
+	if i, ok := m.routes[remote.LocalAddr().String()]; !ok || i != other {
+		t.Errorf("route %d, %v", i, ok)
+	}
+	exchange(other)
+
+	// the route goes away once it is the picked socket again
+	exchange(picked)
+	if _, ok := m.routes[remote.LocalAddr().String()]; ok {
+		t.Error("route to the picked socket remembered")
+	}
+	if addr := localAddrOf(m, remote.LocalAddr()); addr.String() != conns[picked].LocalAddr().String() {
+		t.Errorf("local address %v, want %v", addr, conns[picked].LocalAddr())
+	}
+}
+
+func TestMultiConnDeadline(t *testing.T) {
+	network := NewMemoryNetwork()
+	m := newMultiConn([]net.PacketConn{listenMemory(t, network, "93.184.0.1:6881")}, []string{"udp"})
+	defer m.Close()
+	buff := make([]byte, 16)
+
+	m.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+	_, _, err := m.ReadFrom(buff)
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		t.Fatalf("read returned %v, want a timeout", err)
+	}
+
+	// a new deadline wakes the ReadFrom waiting, with or without one
+	for _, deadline := range []time.Time{{}, time.Now().Add(time.Hour)} {
+		m.SetReadDeadline(deadline)
+		errs := make(chan error, 1)
+		go func() {
+			_, _, err := m.ReadFrom(buff)
+			errs <- err
+		}()
+		time.Sleep(20 * time.Millisecond)
+
+		m.SetReadDeadline(time.Now())
+		select {
+		case err := <-errs:
+			if err != errDeadline {
+				t.Errorf("read returned %v, want %v", err, errDeadline)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("read still blocked past its deadline, set from %v", deadline)
+		}
+	}
+
+	// and one in the future lets it go on reading
+	m.SetReadDeadline(time.Time{})
+	errs := make(chan error, 1)
+	go func() {
+		_, _, err := m.ReadFrom(buff)
+		errs <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	m.SetReadDeadline(time.Now().Add(time.Hour))
+	select {
+	case err := <-errs:
+		t.Fatalf("read returned %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	network.Deliver([]byte("q"), &net.UDPAddr{IP: net.IPv4(198, 51, 100, 1), Port: 6881}, m.LocalAddr().(*net.UDPAddr))
+	select {
+	case err := <-errs:
+		if err != nil {
+			t.Errorf("read returned %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("packet not read")
+	}
+}
+
+func TestMultiConnClose(t *testing.T) {
+	network := NewMemoryNetwork()
+	m := newMultiConn([]net.PacketConn{
+		listenMemory(t, network, "93.184.0.1:6881"),
+		listenMemory(t, network, "93.184.0.2:6881"),
+	}, []string{"udp", "udp"})
+
+	errs := make(chan error, 1)
+	go func() {
+		_, _, err := m.ReadFrom(make([]byte, 16))
+		errs <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+
+	if err := m.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Close(); err != nil {
+		t.Errorf("second close returned %v", err)
+	}
+	select {
+	case err := <-errs:
+		if err == nil {
+			t.Error("read of a closed connection succeeded")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("read still blocked once closed")
+	}
+	if _, _, err := m.ReadFrom(make([]byte, 16)); err == nil {
+		t.Error("read of a closed connection succeeded")
+	}
+}
@@ -0,0 +1,242 @@
+package dht
+
+import (
+	"crypto/rand"
+	"encoding/base32"
+	"encoding/hex"
+	"errors"
+	"hash/crc32"
+	"math/bits"
+	"net"
+	"strings"
+)
+
+// NodeIDLength is the length of a node ID in bytes.
+const NodeIDLength = 20
+
+// NodeID is a 160-bit node ID or info_hash. It is a value type, all its
+// operations are allocation-free, and it can be used as a map key.
+type NodeID [NodeIDLength]byte
+
+// NodeIDFromBytes returns the NodeID of a 20-byte slice.
+func NodeIDFromBytes(data []byte) (id NodeID, err error) {
+	if len(data) != NodeIDLength {
+		err = errors.New("node ID should be 20 bytes long")
+		return
+	}
+
+	copy(id[:], data)
+	return
+}
+
+// NodeIDFromString returns the NodeID of a 20-byte raw string.
+func NodeIDFromString(data string) (id NodeID, err error) {
+	if len(data) != NodeIDLength {
+		err = errors.New("node ID should be 20 bytes long")
+		return
+	}
+
+	copy(id[:], data)
+	return
+}
+
+// ParseNodeID parses a NodeID written in hex, with or without the "0x"
+// prefix, or in base32.
+func ParseNodeID(s string) (id NodeID, err error) {
+	var data []byte
+
+	switch {
+	case len(s) == 2*NodeIDLength+2 && (strings.HasPrefix(s, "0x") || strings.HasPrefix(s, "0X")):
+		data, err = hex.DecodeString(s[2:])
+	case len(s) == 2*NodeIDLength:
+		data, err = hex.DecodeString(s)
+	case len(s) == base32.StdEncoding.EncodedLen(NodeIDLength):
+		data, err = base32.StdEncoding.DecodeString(strings.ToUpper(s))
+	default:
+		err = errors.New("node ID should be 40 hex or 32 base32 characters")
+	}
+	if err != nil {
+		return
+	}
+
+	return NodeIDFromBytes(data)
+}
+
+// RandomNodeID returns a random NodeID.
+func RandomNodeID() (id NodeID) {
+	rand.Read(id[:])
+	return
+}
+
+// RandomNodeIDInPrefix returns a random NodeID whose first prefixLen bits are
+// the ones of prefix.
+func RandomNodeIDInPrefix(prefix NodeID, prefixLen int) NodeID {
+	id := RandomNodeID()
+	if prefixLen > 8*NodeIDLength {
+		prefixLen = 8 * NodeIDLength
+	}
+
+	div, mod := prefixLen/8, prefixLen%8
+	copy(id[:div], prefix[:div])
+	if mod > 0 {
+		mask := byte(0xff << uint(8-mod))
+		id[div] = prefix[div]&mask | id[div]&^mask
+	}
+
+	return id
+}
+
+// the masks of the bytes of an IP hashed into a BEP 42 node ID
+var (
+	secureIDMask4 = []byte{0x03, 0x0f, 0x3f, 0xff}
+	secureIDMask6 = []byte{0x01, 0x03, 0x07, 0x0f, 0x1f, 0x3f, 0x7f, 0xff}
+)
+
+var castagnoliTable = crc32.MakeTable(crc32.Castagnoli)
+
+// secureIDPrefix returns the crc32c whose first 21 bits start a BEP 42 node
+// ID of ip with the random number r.
+func secureIDPrefix(ip net.IP, r byte) uint32 {
+	mask := secureIDMask6
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, mask = ip4, secureIDMask4
+	} else {
+		ip = ip.To16()
+	}
+
+	data := make([]byte, len(mask))
+	for i := range mask {
+		data[i] = ip[i] & mask[i]
+	}
+	data[0] |= (r & 0x07) << 5
+	return crc32.Checksum(data, castagnoliTable)
+}
+
+// secureNodeID returns id with the first 21 bits of the BEP 42 node ID of ip
+// and r as its last byte.
+func secureNodeID(ip net.IP, r byte, id NodeID) NodeID {
+	crc := secureIDPrefix(ip, r)
+	id[0] = byte(crc >> 24)
+	id[1] = byte(crc >> 16)
+	id[2] = byte(crc>>8)&0xf8 | id[2]&0x07
+	id[NodeIDLength-1] = r
+	return id
+}
+
+// SecureNodeID returns a random node ID which BEP 42 ties to the external
+// IP ip.
+func SecureNodeID(ip net.IP) NodeID {
+	id := RandomNodeID()
+	return secureNodeID(ip, id[NodeIDLength-1], id)
+}
+
+// IsSecureNodeID reports whether id is tied to ip as BEP 42 says.
+func IsSecureNodeID(id NodeID, ip net.IP) bool {
+	return id == secureNodeID(ip, id[NodeIDLength-1], id)
+}
+
+// Bytes returns a copy of the ID as a byte slice.
+func (id NodeID) Bytes() []byte {
+	data := make([]byte, NodeIDLength)
+	copy(data, id[:])
+	return data
+}
+
+// RawString returns the ID as a 20-byte string.
+func (id NodeID) RawString() string {
+	return string(id[:])
+}
+
+// String returns the ID in hex.
+func (id NodeID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+// HexString returns the ID in hex with the "0x" prefix, like
+// Identity.HexString.
+func (id NodeID) HexString() string {
+	return "0x" + id.String()
+}
+
+// Base32 returns the ID in base32.
+func (id NodeID) Base32() string {
+	return base32.StdEncoding.EncodeToString(id[:])
+}
+
+// IsZero reports whether all bits of the ID are 0, which is used for unknown
+// IDs.
+func (id NodeID) IsZero() bool {
+	return id == NodeID{}
+}
+
+// Bit returns the bit at index, from the most significant one.
+func (id NodeID) Bit(index int) int {
+	return int(id[index/8]>>uint(7-index%8)) & 1
+}
+
+// Xor returns the XOR distance between id and other.
+func (id NodeID) Xor(other NodeID) (distance NodeID) {
+	for i := range id {
+		distance[i] = id[i] ^ other[i]
+	}
+	return
+}
+
+// Compare compares id and other as 160-bit unsigned integers.
+func (id NodeID) Compare(other NodeID) int {
+	for i := range id {
+		if id[i] < other[i] {
+			return -1
+		} else if id[i] > other[i] {
+			return 1
+		}
+	}
+	return 0
+}
+
+// CompareDistance compares the distances from a and from b to id, it returns
+// -1 if a is closer, 1 if b is closer and 0 if they are the same.
+func (id NodeID) CompareDistance(a, b NodeID) int {
+	for i := range id {
+		da, db := a[i]^id[i], b[i]^id[i]
+		if da < db {
+			return -1
+		} else if da > db {
+			return 1
+		}
+	}
+	return 0
+}
+
+// CommonPrefixLen returns how many leading bits id and other share.
+func (id NodeID) CommonPrefixLen(other NodeID) int {
+	for i := range id {
+		if x := id[i] ^ other[i]; x != 0 {
+			return i*8 + bits.LeadingZeros8(x)
+		}
+	}
+	return 8 * NodeIDLength
+}
+
+// BucketIndex returns the index of the bucket other belongs to in a table of
+// 160 buckets around id, that is the position of the highest bit of their
+// distance. It returns -1 if other is id.
+func (id NodeID) BucketIndex(other NodeID) int {
+	return 8*NodeIDLength - 1 - id.CommonPrefixLen(other)
+}
+
+// MarshalText implements encoding.TextMarshaler.
+func (id NodeID) MarshalText() ([]byte, error) {
+	return []byte(id.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler.
+func (id *NodeID) UnmarshalText(text []byte) error {
+	parsed, err := ParseNodeID(string(text))
+	if err != nil {
+		return err
+	}
+
+	*id = parsed
+	return nil
+}
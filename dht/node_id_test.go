@@ -0,0 +1,205 @@
+package dht
+
+import (
+	"encoding/json"
+	"net"
+	"strings"
+	"testing"
+)
+
+// idOf returns the ID of 40 hex characters, the missing ones are zeros.
+func idOf(s string) NodeID {
+	id, err := ParseNodeID(s + strings.Repeat("0", 2*NodeIDLength-len(s)))
+	if err != nil {
+		panic(err)
+	}
+	return id
+}
+
+func TestParseNodeID(t *testing.T) {
+	const hexID = "0123456789abcdef0123456789abcdef01234567"
+	want := NodeID{0x01, 0x23, 0x45, 0x67, 0x89, 0xab, 0xcd, 0xef, 0x01, 0x23, 0x45, 0x67, 0x89, 0xab, 0xcd, 0xef, 0x01, 0x23, 0x45, 0x67}
+	tests := []struct {
+		name string
+		s    string
+		ok   bool
+	}{
+		{"hex", hexID, true},
+		{"upper case hex", strings.ToUpper(hexID), true},
+		{"0x prefix", "0x" + hexID, true},
+		{"0X prefix", "0X" + hexID, true},
+		{"base32", want.Base32(), true},
+		{"lower case base32", strings.ToLower(want.Base32()), true},
+		{"empty", "", false},
+		{"short hex", hexID[:39], false},
+		{"long hex", hexID + "8", false},
+		{"0x prefix of short hex", "0x" + hexID[:38], false},
+		{"not hex", "g" + hexID[1:], false},
+		{"not base32", "!" + want.Base32()[1:], false},
+		{"raw bytes", want.RawString(), false},
+	}
+
+	for _, test := range tests {
+		id, err := ParseNodeID(test.s)
+		if !test.ok {
+			if err == nil {
+				t.Errorf("%s: parsed %q as %s", test.name, test.s, id)
+			}
+			continue
+		}
+		if err != nil || id != want {
+			t.Errorf("%s: %s, %v, want %s", test.name, id, err, want)
+		}
+	}
+
+	if _, err := NodeIDFromBytes(make([]byte, 19)); err == nil {
+		t.Error("19 bytes taken for a node ID")
+	}
+	if id, err := NodeIDFromString(want.RawString()); err != nil || id != want {
+		t.Errorf("NodeIDFromString returned %s, %v", id, err)
+	}
+	if want.HexString() != "0x"+hexID || want.String() != hexID {
+		t.Errorf("hex strings %s and %s", want.HexString(), want)
+	}
+}
+
+func TestNodeIDDistance(t *testing.T) {
+	id := idOf("f0")
+	tests := []struct {
+		other     NodeID
+		xor       NodeID
+		prefixLen int
+		bucket    int
+	}{
+		{id, NodeID{}, 160, -1},
+		{idOf("70"), idOf("80"), 0, 159},
+		{idOf("f8"), idOf("08"), 4, 155},
+		{idOf("f000000000000000000000000000000000000001"), idOf("0000000000000000000000000000000000000001"), 159, 0},
+		{idOf("f00001"), idOf("000001"), 23, 136},
+	}
+	for _, test := range tests {
+		if xor := id.Xor(test.other); xor != test.xor {
+			t.Errorf("%s xor %s = %s, want %s", id, test.other, xor, test.xor)
+		}
+		if n := id.CommonPrefixLen(test.other); n != test.prefixLen {
+			t.Errorf("common prefix of %s and %s is %d bits, want %d", id, test.other, n, test.prefixLen)
+		}
+		if i := id.BucketIndex(test.other); i != test.bucket {
+			t.Errorf("bucket of %s around %s is %d, want %d", test.other, id, i, test.bucket)
+		}
+	}
+
+	// the distance is compared, not the value
+	a, b := idOf("e0"), idOf("01")
+	if id.Compare(a) != 1 || a.Compare(b) != 1 || b.Compare(b) != 0 || b.Compare(a) != -1 {
+		t.Error("Compare does not order the values")
+	}
+	if id.CompareDistance(a, b) != -1 || id.CompareDistance(b, a) != 1 || id.CompareDistance(a, a) != 0 {
+		t.Errorf("%s is closer to %s than %s", a, id, b)
+	}
+	if d := idOf("0f").CompareDistance(a, b); d != 1 {
+		t.Errorf("%s is closer to %s than %s", b, idOf("0f"), a)
+	}
+
+	bits := ""
+	for i := 0; i < 8; i++ {
+		bits += string('0' + byte(idOf("a5").Bit(i)))
+	}
+	if bits != "10100101" {
+		t.Errorf("bits of 0xa5: %s", bits)
+	}
+}
+
+func TestRandomNodeIDInPrefix(t *testing.T) {
+	prefix := RandomNodeID()
+	for _, prefixLen := range []int{0, 1, 7, 8, 13, 159, 160, 200} {
+		shared := prefixLen
+		if shared > 8*NodeIDLength {
+			shared = 8 * NodeIDLength
+		}
+
+		// the bits after the prefix are random, one of them differs in 64 draws
+		differs := shared == 8*NodeIDLength
+		for i := 0; i < 64; i++ {
+			id := RandomNodeIDInPrefix(prefix, prefixLen)
+			if n := id.CommonPrefixLen(prefix); n < shared {
+				t.Fatalf("%d bits: %s shares %d bits with %s", prefixLen, id, n, prefix)
+			}
+			if id != prefix {
+				differs = true
+			}
+		}
+		if !differs {
+			t.Errorf("%d bits: every ID is the prefix", prefixLen)
+		}
+	}
+}
+
+func TestNodeIDText(t *testing.T) {
+	type holder struct {
+		ID    NodeID
+		Peers map[NodeID]int
+	}
+	id := RandomNodeID()
+	data, err := json.Marshal(holder{ID: id, Peers: map[NodeID]int{id: 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"ID":"` + id.String() + `","Peers":{"` + id.String() + `":1}}`
+	if string(data) != want {
+		t.Errorf("marshaled %s, want %s", data, want)
+	}
+
+	var h holder
+	if err := json.Unmarshal(data, &h); err != nil || h.ID != id || h.Peers[id] != 1 {
+		t.Errorf("unmarshaled %+v, %v", h, err)
+	}
+	if err := json.Unmarshal([]byte(`{"ID":"abc"}`), &h); err == nil {
+		t.Error("short ID unmarshaled")
+	}
+}
+
+func TestSecureNodeID(t *testing.T) {
+	// the examples of BEP 42, only the first 21 bits and the last byte are
+	// set by the IP and the random number
+	tests := []struct {
+		ip   string
+		r    byte
+		want string
+	}{
+		{"124.31.75.21", 1, "5fbfbff10c5d6a4ec8a88e4c6ab4c28b95eee401"},
+		{"21.75.31.124", 86, "5a3ce9c14e7a08645677bbd1cfe7d8f956d53256"},
+		{"65.23.51.170", 22, "a5d43220bc8f112a3d426c84764f8c2a1150e616"},
+		{"84.124.73.14", 65, "1b0321dd1bb1fe518101ceef99462b947a01ff41"},
+		{"43.213.53.83", 90, "e56f6cbf5b7c4be0237986d5243b87aa6d51305a"},
+	}
+
+	for _, test := range tests {
+		want, _ := ParseNodeID(test.want)
+		ip := net.ParseIP(test.ip)
+		if !IsSecureNodeID(want, ip) {
+			t.Errorf("%s: %s is not secure", test.ip, want)
+		}
+		if id := secureNodeID(ip, test.r, want); id != want {
+			t.Errorf("%s: %s, want %s", test.ip, id, want)
+		}
+
+		id := SecureNodeID(ip)
+		if !IsSecureNodeID(id, ip) {
+			t.Errorf("%s: SecureNodeID returned %s which is not secure", test.ip, id)
+		}
+		if IsSecureNodeID(id, net.ParseIP("1.1.1.1")) {
+			t.Errorf("%s: %s is secure for another IP", test.ip, id)
+		}
+	}
+
+	// only the first 8 bytes of an IPv6 address count, under the mask
+	ip := net.ParseIP("2001:db8:1:2:3:4:5:6")
+	id := SecureNodeID(ip)
+	if !IsSecureNodeID(id, ip) || !IsSecureNodeID(id, net.ParseIP("2001:db8:1:2::1")) {
+		t.Errorf("%s is not secure for the /64 of %s", id, ip)
+	}
+	if IsSecureNodeID(id, net.ParseIP("2001:db8:1:3::1")) {
+		t.Errorf("%s is secure for another /64", id)
+	}
+}
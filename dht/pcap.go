@@ -0,0 +1,342 @@
+package dht
+
+import (
+	"encoding/binary"
+	"errors"
+	"github.com/johnnyeven/terra/dht/util"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	pcapMagic      = 0xa1b2c3d4
+	pcapMagicNano  = 0xa1b23c4d
+	pcapSnapLength = 65535
+
+	// link types, see http://www.tcpdump.org/linktypes.html
+	linkTypeEthernet = 1
+	linkTypeRaw      = 101
+	linkTypeIPv4     = 228
+	linkTypeIPv6     = 229
+
+	ipProtocolUDP = 17
+)
+
+var ErrNotPcap = errors.New("pcap: not a pcap file")
+
+// CapturedPacket is a UDP datagram of a capture file.
+type CapturedPacket struct {
+	Time time.Time
+	Src  *net.UDPAddr
+	Dst  *net.UDPAddr
+	Data []byte
+}
+
+// PcapWriter writes UDP datagrams to a pcap file of raw IP packets, which
+// Wireshark and tcpdump can read. It is safe for concurrent use.
+type PcapWriter struct {
+	sync.Mutex
+	w io.Writer
+}
+
+// NewPcapWriter writes the pcap file header to w.
+func NewPcapWriter(w io.Writer) (*PcapWriter, error) {
+	header := make([]byte, 24)
+	binary.LittleEndian.PutUint32(header[0:], pcapMagic)
+	binary.LittleEndian.PutUint16(header[4:], 2)
+	binary.LittleEndian.PutUint16(header[6:], 4)
+	binary.LittleEndian.PutUint32(header[16:], pcapSnapLength)
+	binary.LittleEndian.PutUint32(header[20:], linkTypeRaw)
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+
+	return &PcapWriter{w: w}, nil
+}
+
+// WritePacket writes a datagram sent from src to dst at t.
+func (p *PcapWriter) WritePacket(t time.Time, src, dst *net.UDPAddr, data []byte) error {
+	packet := buildUDPPacket(src, dst, data)
+	if len(packet) > pcapSnapLength {
+		return errors.New("pcap: packet too large")
+	}
+
+	record := make([]byte, 16, 16+len(packet))
+	binary.LittleEndian.PutUint32(record[0:], uint32(t.Unix()))
+	binary.LittleEndian.PutUint32(record[4:], uint32(t.Nanosecond()/1000))
+	binary.LittleEndian.PutUint32(record[8:], uint32(len(packet)))
+	binary.LittleEndian.PutUint32(record[12:], uint32(len(packet)))
+	record = append(record, packet...)
+
+	p.Lock()
+	defer p.Unlock()
+
+	_, err := p.w.Write(record)
+	return err
+}
+
+// buildUDPPacket returns the IP packet of a datagram.
+func buildUDPPacket(src, dst *net.UDPAddr, data []byte) []byte {
+	srcIP, dstIP := packetIPs(src.IP, dst.IP)
+
+	udp := make([]byte, 8+len(data))
+	binary.BigEndian.PutUint16(udp[0:], uint16(src.Port))
+	binary.BigEndian.PutUint16(udp[2:], uint16(dst.Port))
+	binary.BigEndian.PutUint16(udp[4:], uint16(len(udp)))
+	copy(udp[8:], data)
+
+	// pseudo header
+	var sum uint32
+	sum = checksumAdd(sum, srcIP)
+	sum = checksumAdd(sum, dstIP)
+	sum += ipProtocolUDP + uint32(len(udp))
+	checksum := checksumFold(checksumAdd(sum, udp))
+	if checksum == 0 {
+		checksum = 0xffff
+	}
+	binary.BigEndian.PutUint16(udp[6:], checksum)
+
+	if len(srcIP) == net.IPv4len {
+		ip := make([]byte, 20, 20+len(udp))
+		ip[0] = 0x45
+		binary.BigEndian.PutUint16(ip[2:], uint16(20+len(udp)))
+		ip[8] = 64
+		ip[9] = ipProtocolUDP
+		copy(ip[12:], srcIP)
+		copy(ip[16:], dstIP)
+		binary.BigEndian.PutUint16(ip[10:], checksumFold(checksumAdd(0, ip)))
+		return append(ip, udp...)
+	}
+
+	ip := make([]byte, 40, 40+len(udp))
+	ip[0] = 0x60
+	binary.BigEndian.PutUint16(ip[4:], uint16(len(udp)))
+	ip[6] = ipProtocolUDP
+	ip[7] = 64
+	copy(ip[8:], srcIP)
+	copy(ip[24:], dstIP)
+	return append(ip, udp...)
+}
+
+// packetIPs returns the addresses of a packet in the same family. A socket
+// listening on [::] or 0.0.0.0 gets the unspecified address of the family of
+// the other end.
+func packetIPs(src, dst net.IP) (net.IP, net.IP) {
+	unspecified := func(ip net.IP) bool {
+		return len(ip) == 0 || ip.IsUnspecified()
+	}
+	switch {
+	case src.To4() != nil && dst.To4() != nil:
+		return src.To4(), dst.To4()
+	case unspecified(src) && dst.To4() != nil:
+		return net.IPv4zero.To4(), dst.To4()
+	case unspecified(dst) && src.To4() != nil:
+		return src.To4(), net.IPv4zero.To4()
+	case unspecified(src):
+		return net.IPv6unspecified, dst.To16()
+	case unspecified(dst):
+		return src.To16(), net.IPv6unspecified
+	}
+	return src.To16(), dst.To16()
+}
+
+func checksumAdd(sum uint32, data []byte) uint32 {
+	for i := 0; i+1 < len(data); i += 2 {
+		sum += uint32(data[i])<<8 | uint32(data[i+1])
+	}
+	if len(data)%2 == 1 {
+		sum += uint32(data[len(data)-1]) << 8
+	}
+	return sum
+}
+
+func checksumFold(sum uint32) uint16 {
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return ^uint16(sum)
+}
+
+// PcapReader reads the UDP datagrams of a pcap file. Raw IP, IPv4, IPv6
+// and Ethernet link types are supported, the other packets are skipped.
+type PcapReader struct {
+	r        io.Reader
+	order    binary.ByteOrder
+	nano     bool
+	linkType uint32
+}
+
+// NewPcapReader reads the pcap file header from r.
+func NewPcapReader(r io.Reader) (*PcapReader, error) {
+	header := make([]byte, 24)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, ErrNotPcap
+	}
+
+	reader := &PcapReader{r: r}
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		switch order.Uint32(header) {
+		case pcapMagic:
+			reader.order = order
+		case pcapMagicNano:
+			reader.order, reader.nano = order, true
+		}
+	}
+	if reader.order == nil {
+		return nil, ErrNotPcap
+	}
+
+	reader.linkType = reader.order.Uint32(header[20:])
+	switch reader.linkType {
+	case linkTypeEthernet, linkTypeRaw, linkTypeIPv4, linkTypeIPv6:
+	default:
+		return nil, errors.New("pcap: unsupported link type")
+	}
+
+	return reader, nil
+}
+
+// Next returns the next UDP datagram, or io.EOF at the end of the file.
+func (p *PcapReader) Next() (*CapturedPacket, error) {
+	for {
+		header := make([]byte, 16)
+		if _, err := io.ReadFull(p.r, header); err != nil {
+			if err == io.ErrUnexpectedEOF {
+				return nil, errors.New("pcap: truncated record")
+			}
+			return nil, err
+		}
+
+		length := p.order.Uint32(header[8:])
+		if length > 1<<20 {
+			return nil, errors.New("pcap: record too large")
+		}
+		data := make([]byte, length)
+		if _, err := io.ReadFull(p.r, data); err != nil {
+			return nil, errors.New("pcap: truncated record")
+		}
+
+		fraction := time.Duration(p.order.Uint32(header[4:]))
+		if !p.nano {
+			fraction *= time.Microsecond
+		}
+		t := time.Unix(int64(p.order.Uint32(header[0:])), int64(fraction))
+
+		if packet := p.parse(data); packet != nil {
+			packet.Time = t
+			return packet, nil
+		}
+	}
+}
+
+// parse returns the datagram of a link layer packet, or nil if it is not
+// a UDP packet.
+func (p *PcapReader) parse(data []byte) *CapturedPacket {
+	if p.linkType == linkTypeEthernet {
+		if len(data) < 14 {
+			return nil
+		}
+		switch binary.BigEndian.Uint16(data[12:]) {
+		case 0x0800, 0x86dd:
+		default:
+			return nil
+		}
+		data = data[14:]
+	}
+	if len(data) == 0 {
+		return nil
+	}
+
+	var src, dst net.IP
+	switch data[0] >> 4 {
+	case 4:
+		headerLength := int(data[0]&0x0f) * 4
+		if len(data) < 20 || headerLength < 20 || len(data) < headerLength || data[9] != ipProtocolUDP {
+			return nil
+		}
+		if total := int(binary.BigEndian.Uint16(data[2:])); total >= headerLength && total < len(data) {
+			data = data[:total]
+		}
+		src, dst = net.IP(data[12:16]), net.IP(data[16:20])
+		data = data[headerLength:]
+	case 6:
+		if len(data) < 40 || data[6] != ipProtocolUDP {
+			return nil
+		}
+		src, dst = net.IP(data[8:24]), net.IP(data[24:40])
+		data = data[40:]
+	default:
+		return nil
+	}
+
+	if len(data) < 8 {
+		return nil
+	}
+	length := int(binary.BigEndian.Uint16(data[4:]))
+	if length < 8 || length > len(data) {
+		length = len(data)
+	}
+
+	return &CapturedPacket{
+		Src:  &net.UDPAddr{IP: append(net.IP(nil), src...), Port: int(binary.BigEndian.Uint16(data[0:]))},
+		Dst:  &net.UDPAddr{IP: append(net.IP(nil), dst...), Port: int(binary.BigEndian.Uint16(data[2:]))},
+		Data: append([]byte(nil), data[8:length]...),
+	}
+}
+
+// CapturedNodeID returns the node ID of local, as found in the first KRPC
+// message it sent in packets.
+func CapturedNodeID(packets []*CapturedPacket, local *net.UDPAddr) (NodeID, error) {
+	for _, packet := range packets {
+		if packet.Src.String() != local.String() {
+			continue
+		}
+
+		decoded, err := util.Decode(packet.Data)
+		if err != nil {
+			continue
+		}
+		message, ok := decoded.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		for _, key := range []string{"a", "r"} {
+			if args, ok := message[key].(map[string]interface{}); ok {
+				if id, ok := args["id"].(string); ok {
+					return NodeIDFromString(id)
+				}
+			}
+		}
+	}
+	return NodeID{}, errors.New("pcap: no message with a node ID sent by " + local.String())
+}
+
+// pcapFile is the capture file of a node.
+type pcapFile struct {
+	*PcapWriter
+	file *os.File
+}
+
+func createPcapFile(path string) (*pcapFile, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+
+	writer, err := NewPcapWriter(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &pcapFile{writer, file}, nil
+}
+
+func (p *pcapFile) Close() error {
+	p.Lock()
+	defer p.Unlock()
+
+	return p.file.Close()
+}
@@ -0,0 +1,262 @@
+package dht
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestPcapRoundTrip(t *testing.T) {
+	tests := []struct {
+		name     string
+		src, dst *net.UDPAddr
+		// the addresses read back, src and dst if nil
+		wantSrc, wantDst *net.UDPAddr
+		data             []byte
+	}{
+		{
+			name: "ipv4",
+			src:  &net.UDPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 6881},
+			dst:  &net.UDPAddr{IP: net.IPv4(5, 6, 7, 8), Port: 51413},
+			data: []byte("d1:ad2:id20:abcdefghij0123456789e1:q4:ping1:t2:aa1:y1:qe"),
+		},
+		{
+			name: "ipv6",
+			src:  &net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 6881},
+			dst:  &net.UDPAddr{IP: net.ParseIP("2001:db8::2"), Port: 6882},
+			data: []byte("odd length"),
+		},
+		{
+			name:    "unspecified ipv4 source",
+			src:     &net.UDPAddr{IP: net.IPv6unspecified, Port: 6881},
+			dst:     &net.UDPAddr{IP: net.IPv4(5, 6, 7, 8), Port: 6881},
+			wantSrc: &net.UDPAddr{IP: net.IPv4zero, Port: 6881},
+			data:    []byte{},
+		},
+		{
+			name:    "unspecified ipv6 destination",
+			src:     &net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 6881},
+			dst:     &net.UDPAddr{Port: 6881},
+			wantDst: &net.UDPAddr{IP: net.IPv6unspecified, Port: 6881},
+			data:    bytes.Repeat([]byte{0xff}, 1400),
+		},
+	}
+
+	for _, test := range tests {
+		var buff bytes.Buffer
+		writer, err := NewPcapWriter(&buff)
+		if err != nil {
+			t.Fatal(err)
+		}
+		now := time.Unix(1600000000, 123456000)
+		if err := writer.WritePacket(now, test.src, test.dst, test.data); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+
+		reader, err := NewPcapReader(&buff)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		packet, err := reader.Next()
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+
+		wantSrc, wantDst := test.wantSrc, test.wantDst
+		if wantSrc == nil {
+			wantSrc = test.src
+		}
+		if wantDst == nil {
+			wantDst = test.dst
+		}
+		if packet.Src.String() != wantSrc.String() || packet.Dst.String() != wantDst.String() {
+			t.Errorf("%s: %s -> %s, want %s -> %s", test.name, packet.Src, packet.Dst, wantSrc, wantDst)
+		}
+		if !bytes.Equal(packet.Data, test.data) {
+			t.Errorf("%s: data %q, want %q", test.name, packet.Data, test.data)
+		}
+		if !packet.Time.Equal(now) {
+			t.Errorf("%s: time %s, want %s", test.name, packet.Time, now)
+		}
+		if _, err := reader.Next(); err != io.EOF {
+			t.Errorf("%s: Next after the last packet returned %v, want io.EOF", test.name, err)
+		}
+	}
+}
+
+func TestPcapReader(t *testing.T) {
+	udp := buildUDPPacket(&net.UDPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 1}, &net.UDPAddr{IP: net.IPv4(5, 6, 7, 8), Port: 2}, []byte("data"))
+	ethernet := append(make([]byte, 12), 0x08, 0x00)
+	arp := append(make([]byte, 12), 0x08, 0x06)
+
+	// header returns a pcap file header in order with link type
+	header := func(order binary.ByteOrder, magic, linkType uint32) []byte {
+		data := make([]byte, 24)
+		order.PutUint32(data[0:], magic)
+		order.PutUint32(data[16:], pcapSnapLength)
+		order.PutUint32(data[20:], linkType)
+		return data
+	}
+	record := func(order binary.ByteOrder, fraction uint32, data []byte) []byte {
+		r := make([]byte, 16)
+		order.PutUint32(r[0:], 1600000000)
+		order.PutUint32(r[4:], fraction)
+		order.PutUint32(r[8:], uint32(len(data)))
+		order.PutUint32(r[12:], uint32(len(data)))
+		return append(r, data...)
+	}
+	concat := func(parts ...[]byte) []byte {
+		return bytes.Join(parts, nil)
+	}
+
+	tests := []struct {
+		name string
+		file []byte
+		// the number of UDP packets, -1 if the file is refused
+		want     int
+		wantTime time.Time
+	}{
+		{"not pcap", []byte("this is not a pcap file"), -1, time.Time{}},
+		{"short", []byte{0xd4, 0xc3}, -1, time.Time{}},
+		{"unsupported link type", header(binary.LittleEndian, pcapMagic, 105), -1, time.Time{}},
+		{"empty", header(binary.LittleEndian, pcapMagic, linkTypeRaw), 0, time.Time{}},
+		{
+			"big endian",
+			concat(header(binary.BigEndian, pcapMagic, linkTypeRaw), record(binary.BigEndian, 5, udp)),
+			1, time.Unix(1600000000, 5000),
+		},
+		{
+			"nanoseconds",
+			concat(header(binary.LittleEndian, pcapMagicNano, linkTypeIPv4), record(binary.LittleEndian, 5, udp)),
+			1, time.Unix(1600000000, 5),
+		},
+		{
+			"ethernet",
+			concat(header(binary.LittleEndian, pcapMagic, linkTypeEthernet),
+				record(binary.LittleEndian, 0, concat(arp, udp)),
+				record(binary.LittleEndian, 0, concat(ethernet, udp))),
+			1, time.Unix(1600000000, 0),
+		},
+		{
+			"not udp",
+			concat(header(binary.LittleEndian, pcapMagic, linkTypeRaw),
+				record(binary.LittleEndian, 0, append(append([]byte(nil), udp[:9]...), append([]byte{6}, udp[10:]...)...))),
+			0, time.Time{},
+		},
+	}
+
+	for _, test := range tests {
+		reader, err := NewPcapReader(bytes.NewReader(test.file))
+		if test.want < 0 {
+			if err == nil {
+				t.Errorf("%s: file not refused", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+
+		n := 0
+		for {
+			packet, err := reader.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatalf("%s: %v", test.name, err)
+			}
+			n++
+			if string(packet.Data) != "data" || !packet.Time.Equal(test.wantTime) {
+				t.Errorf("%s: packet %q at %s", test.name, packet.Data, packet.Time)
+			}
+		}
+		if n != test.want {
+			t.Errorf("%s: %d packets, want %d", test.name, n, test.want)
+		}
+	}
+}
+
+func TestCapturedNodeID(t *testing.T) {
+	local := &net.UDPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 6881}
+	other := &net.UDPAddr{IP: net.IPv4(5, 6, 7, 8), Port: 6881}
+	packet := func(src *net.UDPAddr, data string) *CapturedPacket {
+		return &CapturedPacket{Src: src, Dst: other, Data: []byte(data)}
+	}
+
+	tests := []struct {
+		name    string
+		packets []*CapturedPacket
+		want    string
+	}{
+		{"query", []*CapturedPacket{
+			packet(local, "d1:ad2:id20:abcdefghij0123456789e1:q4:ping1:t2:aa1:y1:qe"),
+		}, "abcdefghij0123456789"},
+		{"response", []*CapturedPacket{
+			packet(local, "d1:rd2:id20:abcdefghij0123456789e1:t2:aa1:y1:re"),
+		}, "abcdefghij0123456789"},
+		{"after other packets", []*CapturedPacket{
+			packet(other, "d1:ad2:id20:ABCDEFGHIJ0123456789e1:q4:ping1:t2:aa1:y1:qe"),
+			packet(local, "not bencode"),
+			packet(local, "d1:eli201e7:Generice1:t2:aa1:y1:ee"),
+			packet(local, "d1:rd2:id20:abcdefghij0123456789e1:t2:aa1:y1:re"),
+		}, "abcdefghij0123456789"},
+		{"none", []*CapturedPacket{
+			packet(other, "d1:ad2:id20:ABCDEFGHIJ0123456789e1:q4:ping1:t2:aa1:y1:qe"),
+		}, ""},
+	}
+
+	for _, test := range tests {
+		id, err := CapturedNodeID(test.packets, local)
+		if test.want == "" {
+			if err == nil {
+				t.Errorf("%s: node ID %s found", test.name, id)
+			}
+			continue
+		}
+		if err != nil || id.RawString() != test.want {
+			t.Errorf("%s: %q, %v, want %q", test.name, id.RawString(), err, test.want)
+		}
+	}
+}
+
+func TestMemoryDeliverWait(t *testing.T) {
+	network := NewMemoryNetwork()
+	conn, err := network.ListenPacket("udp", "127.0.0.1:6881")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	from := &net.UDPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 1}
+	to := conn.LocalAddr().(*net.UDPAddr)
+	for i := 0; i < memoryQueueSize; i++ {
+		network.Deliver([]byte{byte(i)}, from, to)
+	}
+	if network.Deliver([]byte("dropped"), from, to) {
+		t.Error("datagram delivered to a full socket")
+	}
+
+	delivered := make(chan bool)
+	go func() {
+		delivered <- network.DeliverWait([]byte("waited"), from, to)
+	}()
+	select {
+	case <-delivered:
+		t.Fatal("DeliverWait did not wait for room")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	buff := make([]byte, 16)
+	conn.ReadFrom(buff)
+	if !<-delivered {
+		t.Error("DeliverWait failed once there is room")
+	}
+	if network.DeliverWait([]byte("nobody"), from, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}) {
+		t.Error("datagram delivered to no socket")
+	}
+}
@@ -0,0 +1,196 @@
+package dht
+
+import (
+	"github.com/johnnyeven/terra/dht/util"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Peer is a peer of a torrent, as announced by announce_peer or returned by
+// get_peers.
+type Peer struct {
+	IP       net.IP    `json:"ip"`
+	Port     int       `json:"port"`
+	LastSeen time.Time `json:"lastSeen"`
+	// announced with seed=1
+	Seed bool `json:"seed,omitempty"`
+}
+
+// Addr returns the "ip:port" address of the peer, IPv6 addresses are in
+// brackets.
+func (p *Peer) Addr() string {
+	return net.JoinHostPort(p.IP.String(), strconv.Itoa(p.Port))
+}
+
+// CompactIPPortInfo returns the compact form of the peer address, 6 bytes
+// for an IPv4 peer and 18 bytes for an IPv6 one.
+func (p *Peer) CompactIPPortInfo() string {
+	if p.IP.To4() == nil {
+		return string(p.IP.To16()) + string([]byte{byte(p.Port >> 8), byte(p.Port)})
+	}
+	info, _ := util.EncodeCompactIPPortInfo(p.IP, p.Port)
+	return info
+}
+
+// PeerStore keeps the peers of torrents in memory. Peers are forgotten when
+// they have not been seen for a while.
+type PeerStore struct {
+	sync.RWMutex
+	torrents           map[NodeID]map[string]*Peer
+	maxTorrents        int
+	maxPeersPerTorrent int
+	expiredAfter       time.Duration
+}
+
+// NewPeerStore returns a PeerStore pointer, a limit of 0 means unlimited.
+func NewPeerStore(maxTorrents, maxPeersPerTorrent int, expiredAfter time.Duration) *PeerStore {
+	return &PeerStore{
+		torrents:           make(map[NodeID]map[string]*Peer),
+		maxTorrents:        maxTorrents,
+		maxPeersPerTorrent: maxPeersPerTorrent,
+		expiredAfter:       expiredAfter,
+	}
+}
+
+// Add inserts or refreshes a peer of infoHash and reports whether it is
+// stored.
+func (s *PeerStore) Add(infoHash NodeID, peer *Peer) bool {
+	if peer.LastSeen.IsZero() {
+		peer.LastSeen = time.Now()
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	peers, ok := s.torrents[infoHash]
+	if !ok {
+		if s.maxTorrents > 0 && len(s.torrents) >= s.maxTorrents {
+			return false
+		}
+		peers = make(map[string]*Peer)
+		s.torrents[infoHash] = peers
+	}
+
+	key := peer.Addr()
+	if _, ok := peers[key]; !ok && s.maxPeersPerTorrent > 0 && len(peers) >= s.maxPeersPerTorrent {
+		s.evictOldest(peers)
+	}
+	peers[key] = peer
+
+	return true
+}
+
+func (s *PeerStore) evictOldest(peers map[string]*Peer) {
+	var (
+		oldestKey string
+		oldest    time.Time
+	)
+	for key, peer := range peers {
+		if oldestKey == "" || peer.LastSeen.Before(oldest) {
+			oldestKey, oldest = key, peer.LastSeen
+		}
+	}
+	delete(peers, oldestKey)
+}
+
+// Get returns at most n peers of infoHash, the most recently seen first. n
+// of 0 means all.
+func (s *PeerStore) Get(infoHash NodeID, n int) []*Peer {
+	s.RLock()
+	peers := make([]*Peer, 0, len(s.torrents[infoHash]))
+	for _, peer := range s.torrents[infoHash] {
+		peers = append(peers, peer)
+	}
+	s.RUnlock()
+
+	sort.Slice(peers, func(i, j int) bool {
+		return peers[i].LastSeen.After(peers[j].LastSeen)
+	})
+	if n > 0 && len(peers) > n {
+		peers = peers[:n]
+	}
+	return peers
+}
+
+// BloomFilters returns the BEP 33 bloom filters of the IPs of the seeds and
+// of the other peers of infoHash.
+func (s *PeerStore) BloomFilters(infoHash NodeID) (seeds *BloomFilter, peers *BloomFilter) {
+	seeds, peers = &BloomFilter{}, &BloomFilter{}
+
+	s.RLock()
+	defer s.RUnlock()
+
+	for _, peer := range s.torrents[infoHash] {
+		if peer.Seed {
+			seeds.Add(peer.IP)
+		} else {
+			peers.Add(peer.IP)
+		}
+	}
+	return seeds, peers
+}
+
+// Has reports whether there is any peer of infoHash.
+func (s *PeerStore) Has(infoHash NodeID) bool {
+	s.RLock()
+	defer s.RUnlock()
+
+	return len(s.torrents[infoHash]) > 0
+}
+
+// InfoHashes returns the info_hashes which have peers.
+func (s *PeerStore) InfoHashes() []NodeID {
+	s.RLock()
+	defer s.RUnlock()
+
+	infoHashes := make([]NodeID, 0, len(s.torrents))
+	for infoHash := range s.torrents {
+		infoHashes = append(infoHashes, infoHash)
+	}
+	return infoHashes
+}
+
+// Len returns the number of torrents.
+func (s *PeerStore) Len() int {
+	s.RLock()
+	defer s.RUnlock()
+
+	return len(s.torrents)
+}
+
+// PeerCount returns the number of peers over all torrents.
+func (s *PeerStore) PeerCount() int {
+	s.RLock()
+	defer s.RUnlock()
+
+	count := 0
+	for _, peers := range s.torrents {
+		count += len(peers)
+	}
+	return count
+}
+
+// Expire forgets the peers not seen for expiredAfter.
+func (s *PeerStore) Expire() {
+	if s.expiredAfter <= 0 {
+		return
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	now := time.Now()
+	for infoHash, peers := range s.torrents {
+		for key, peer := range peers {
+			if now.Sub(peer.LastSeen) > s.expiredAfter {
+				delete(peers, key)
+			}
+		}
+		if len(peers) == 0 {
+			delete(s.torrents, infoHash)
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package dht
+
+import (
+	"github.com/johnnyeven/terra/dht/util"
+	"sync"
+	"time"
+)
+
+const (
+	// how long a blocked packet sleeps before it checks again
+	limiterPollInterval = 5 * time.Millisecond
+	// how long an idle per-destination bucket is kept
+	limiterDestinationTTL = time.Minute
+	// the share of the global buckets only responses can use, so our own
+	// queries never take the budget of the answers we owe other nodes
+	responseReserve = 0.1
+)
+
+// rateLimiter throttles outgoing packets globally and per destination. While
+// a packet of a higher priority is waiting for the global buckets, packets of
+// a lower priority are held back, and they leave the reserved part of the
+// buckets to responses.
+type rateLimiter struct {
+	sync.Mutex
+	packets         *util.TokenBucket
+	bytes           *util.TokenBucket
+	reservedPackets float64
+	reservedBytes   float64
+	perNodeRate     float64
+	destinations    map[string]*util.TokenBucket
+	waiting         [priorityLevels]int
+	lastSweep       time.Time
+}
+
+func newRateLimiter(packetsPerSecond, bytesPerSecond, packetsPerNode int) *rateLimiter {
+	return &rateLimiter{
+		packets:         util.NewTokenBucket(float64(packetsPerSecond), float64(packetsPerSecond)),
+		bytes:           util.NewTokenBucket(float64(bytesPerSecond), float64(bytesPerSecond)),
+		reservedPackets: float64(packetsPerSecond) * responseReserve,
+		reservedBytes:   float64(bytesPerSecond) * responseReserve,
+		perNodeRate:     float64(packetsPerNode),
+		destinations:    make(map[string]*util.TokenBucket),
+		lastSweep:       time.Now(),
+	}
+}
+
+// Wait blocks until a packet of size bytes may be sent to addr.
+func (l *rateLimiter) Wait(priority int, addr string, size int) {
+	priority = normalizePriority(priority)
+	registered := false
+
+	for {
+		delay := l.reserve(priority, addr, size, &registered)
+		if delay == 0 {
+			return
+		}
+		time.Sleep(delay)
+	}
+}
+
+// Allow takes the tokens of a packet of size bytes to addr and reports
+// whether they were available, it never blocks. A packet of a lower priority
+// than a waiting one is not allowed.
+func (l *rateLimiter) Allow(priority int, addr string, size int) bool {
+	priority = normalizePriority(priority)
+
+	l.Lock()
+	defer l.Unlock()
+
+	l.sweep()
+
+	destination := l.destination(addr)
+	if destination.Delay(1) > 0 || l.delay(priority, size) > 0 || l.preempted(priority) {
+		return false
+	}
+	l.packets.Take(1)
+	l.bytes.Take(float64(size))
+	destination.Take(1)
+	return true
+}
+
+func (l *rateLimiter) reserve(priority int, addr string, size int, registered *bool) time.Duration {
+	l.Lock()
+	defer l.Unlock()
+
+	l.sweep()
+
+	destination := l.destination(addr)
+	if delay := destination.Delay(1); delay > 0 {
+		// blocked by its own destination, don't hold back the others
+		l.unregister(priority, registered)
+		return delay
+	}
+
+	delay := l.delay(priority, size)
+	if delay == 0 && !l.preempted(priority) {
+		l.packets.Take(1)
+		l.bytes.Take(float64(size))
+		destination.Take(1)
+		l.unregister(priority, registered)
+		return 0
+	}
+
+	if !*registered {
+		l.waiting[priority]++
+		*registered = true
+	}
+	if delay < limiterPollInterval {
+		delay = limiterPollInterval
+	}
+	return delay
+}
+
+// delay returns how long a packet of size bytes waits for the global buckets,
+// a packet which is not a response waits until it leaves the reserve intact.
+func (l *rateLimiter) delay(priority int, size int) time.Duration {
+	packets, bytes := 1.0, float64(size)
+	if priority != PriorityResponse {
+		packets += l.reservedPackets
+		bytes += l.reservedBytes
+	}
+
+	delay := l.packets.Delay(packets)
+	if d := l.bytes.Delay(bytes); d > delay {
+		delay = d
+	}
+	return delay
+}
+
+func (l *rateLimiter) preempted(priority int) bool {
+	for p := 0; p < priority; p++ {
+		if l.waiting[p] > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func (l *rateLimiter) unregister(priority int, registered *bool) {
+	if *registered {
+		l.waiting[priority]--
+		*registered = false
+	}
+}
+
+func (l *rateLimiter) destination(addr string) *util.TokenBucket {
+	if l.perNodeRate <= 0 {
+		return nil
+	}
+
+	b, ok := l.destinations[addr]
+	if !ok {
+		b = util.NewTokenBucket(l.perNodeRate, l.perNodeRate)
+		l.destinations[addr] = b
+	}
+	return b
+}
+
+func (l *rateLimiter) sweep() {
+	if time.Since(l.lastSweep) < limiterDestinationTTL {
+		return
+	}
+	l.lastSweep = time.Now()
+
+	for addr, b := range l.destinations {
+		if b.Idle() > limiterDestinationTTL {
+			delete(l.destinations, addr)
+		}
+	}
+}
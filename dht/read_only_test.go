@@ -0,0 +1,131 @@
+package dht_test
+
+import (
+	"context"
+	"github.com/johnnyeven/terra/bt"
+	"github.com/johnnyeven/terra/dht"
+	"github.com/johnnyeven/terra/dht/util"
+	"net"
+	"testing"
+	"time"
+)
+
+// newMemoryNode returns a running node at addr of network, with the BEP 5
+// handlers.
+func newMemoryNode(t *testing.T, network *dht.MemoryNetwork, addr string, readOnly bool) *dht.DistributedHashTable {
+	config := dht.GetNormalConfig()
+	config.TransportConstructor = dht.NewKRPCTransport
+	config.Handler = bt.BTHandlePacket
+	config.HandshakeFunc = bt.FindNode
+	config.PingFunc = bt.Ping
+	config.ListenFunc = network.ListenPacket
+	config.LocalAddr = addr
+	config.SeedNodes = nil
+	config.ReadOnly = readOnly
+	config.MaxQueriesPerSecondPerIP = 0
+	config.MaxPacketsPerSecondPerNode = 0
+
+	table := dht.NewDHT(config)
+	go table.Run()
+	<-table.Ready()
+	return table
+}
+
+// readMessage returns the next KRPC message received on conn, nil if none
+// comes in time.
+func readMessage(t *testing.T, conn net.PacketConn, timeout time.Duration) map[string]interface{} {
+	buff := make([]byte, 2048)
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	n, _, err := conn.ReadFrom(buff)
+	if err != nil {
+		return nil
+	}
+	decoded, err := util.Decode(buff[:n])
+	if err != nil {
+		t.Fatalf("received %q: %v", buff[:n], err)
+	}
+	return decoded.(map[string]interface{})
+}
+
+func TestReadOnlyNode(t *testing.T) {
+	network := dht.NewMemoryNetwork()
+	table := newMemoryNode(t, network, "93.184.0.1:6881", true)
+	defer table.Close()
+	conn, err := network.ListenPacket("udp", "93.184.0.2:6881")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	addr := conn.LocalAddr().(*net.UDPAddr)
+
+	// the queries carry ro=1
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	go bt.PingAddr(ctx, table, addr)
+	query := readMessage(t, conn, time.Second)
+	if query == nil || query["y"] != "q" {
+		t.Fatalf("received %v, want a query", query)
+	}
+	if ro, _ := query["ro"].(int); ro != 1 {
+		t.Errorf("query without ro=1: %v", query)
+	}
+
+	// and the queries of others get no answer, not even an error
+	ping := util.Encode(dht.MakeQuery("aa", dht.PingType, map[string]interface{}{"id": dht.RandomNodeID().RawString()}))
+	if _, err := conn.WriteTo([]byte(ping), table.LocalAddrs()[0]); err != nil {
+		t.Fatal(err)
+	}
+	if message := readMessage(t, conn, 200*time.Millisecond); message != nil {
+		t.Errorf("query answered with %v", message)
+	}
+}
+
+func TestReadOnlyQuerier(t *testing.T) {
+	network := dht.NewMemoryNetwork()
+	table := newMemoryNode(t, network, "93.184.0.1:6881", false)
+	defer table.Close()
+	conn, err := network.ListenPacket("udp", "93.184.0.2:6881")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	addr := conn.LocalAddr().(*net.UDPAddr)
+
+	id := dht.RandomNodeID()
+	rt := table.GetRoutingTable()
+	if !rt.Insert(&dht.Node{ID: id, Addr: addr, LastActiveTime: time.Now()}) {
+		t.Fatal("node not inserted")
+	}
+
+	query := func(ro bool) {
+		q := dht.MakeQuery("aa", dht.PingType, map[string]interface{}{"id": id.RawString()})
+		if ro {
+			q["ro"] = 1
+		}
+		if _, err := conn.WriteTo([]byte(util.Encode(q)), table.LocalAddrs()[0]); err != nil {
+			t.Fatal(err)
+		}
+		// a read-only node is still answered
+		if response := readMessage(t, conn, time.Second); response == nil || response["y"] != "r" {
+			t.Fatalf("query answered with %v", response)
+		}
+	}
+
+	query(true)
+	if _, ok := rt.GetNodeByAddress(addr.String()); ok {
+		t.Error("read-only querier left in the routing table")
+	}
+	// the node lists of other nodes do not bring it back
+	if rt.Insert(&dht.Node{ID: id, Addr: addr, LastActiveTime: time.Now()}) {
+		t.Error("read-only node inserted")
+	}
+	if rejected := rt.RejectedInserts().ReadOnly; rejected != 1 {
+		t.Errorf("%d read-only nodes rejected, want 1", rejected)
+	}
+
+	// until it queries as a regular node
+	query(false)
+	if !rt.Insert(&dht.Node{ID: id, Addr: addr, LastActiveTime: time.Now()}) {
+		t.Error("node not inserted once it is not read-only")
+	}
+}
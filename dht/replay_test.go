@@ -0,0 +1,151 @@
+package dht_test
+
+import (
+	"github.com/johnnyeven/terra/bt"
+	"github.com/johnnyeven/terra/dht"
+	"github.com/johnnyeven/terra/dht/util"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+// testdata/replay.pcap holds a ping sent by the captured node at 5.9.0.1:6881,
+// then the queries of three other nodes to it, the last one of an unknown
+// method.
+func readReplayFixture(t *testing.T) []*dht.CapturedPacket {
+	file, err := os.Open("testdata/replay.pcap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	reader, err := dht.NewPcapReader(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	packets := make([]*dht.CapturedPacket, 0)
+	for {
+		packet, err := reader.Next()
+		if err != nil {
+			return packets
+		}
+		packets = append(packets, packet)
+	}
+}
+
+func TestReplay(t *testing.T) {
+	packets := readReplayFixture(t)
+	if len(packets) != 6 {
+		t.Fatalf("%d packets in the fixture, want 6", len(packets))
+	}
+	local := &net.UDPAddr{IP: net.IPv4(5, 9, 0, 1), Port: 6881}
+	id, err := dht.CapturedNodeID(packets, local)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id.RawString() != "abcdefghij0123456789" {
+		t.Fatalf("captured node ID %x", id.RawString())
+	}
+
+	network := dht.NewMemoryNetwork()
+	config := dht.GetNormalConfig()
+	config.TransportConstructor = dht.NewKRPCTransport
+	config.Handler = bt.BTHandlePacket
+	config.HandshakeFunc = bt.FindNode
+	config.PingFunc = bt.Ping
+	config.ListenFunc = network.ListenPacket
+	config.LocalAddr = local.String()
+	config.NodeID = id.String()
+	// one query per second would be answered otherwise
+	config.MaxQueriesPerSecondPerIP = 0
+	config.MaxPacketsPerSecondPerNode = 0
+
+	table := dht.NewDHT(config)
+	go table.Run()
+	<-table.Ready()
+	defer table.Close()
+	if table.Self.ID != id {
+		t.Fatalf("node ID %s, want %s", table.Self.ID, id)
+	}
+
+	// the other nodes listen for the responses
+	conns := make(map[string]net.PacketConn)
+	for _, packet := range packets[1:] {
+		if conns[packet.Src.String()] != nil {
+			continue
+		}
+		conn, err := network.ListenPacket("udp", packet.Src.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conns[packet.Src.String()] = conn
+	}
+
+	to := table.GetTransport().LocalAddr().(*net.UDPAddr)
+	for _, packet := range packets {
+		if packet.Dst.String() != local.String() {
+			continue
+		}
+		if !network.DeliverWait(packet.Data, packet.Src, to) {
+			t.Fatalf("packet from %s not delivered", packet.Src)
+		}
+	}
+
+	responses := make(map[string]map[string]interface{})
+	buff := make([]byte, 2048)
+	for addr, conn := range conns {
+		conn.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+		for {
+			n, _, err := conn.ReadFrom(buff)
+			if err != nil {
+				break
+			}
+			decoded, err := util.Decode(buff[:n])
+			if err != nil {
+				t.Fatalf("%s received %q: %v", addr, buff[:n], err)
+			}
+			message := decoded.(map[string]interface{})
+			// the node may query the others too
+			if message["y"] != "q" {
+				responses[message["t"].(string)] = message
+			}
+		}
+	}
+
+	tests := []struct {
+		t    string
+		y    string
+		keys []string
+	}{
+		{"p1", "r", []string{"id"}},
+		{"f1", "r", []string{"id", "nodes"}},
+		{"g1", "r", []string{"id", "token"}},
+		// the token of the capture is not valid for the new node
+		{"a1", "e", nil},
+	}
+	for _, test := range tests {
+		response, ok := responses[test.t]
+		if !ok {
+			t.Errorf("query %s not answered", test.t)
+			continue
+		}
+		if response["y"] != test.y {
+			t.Errorf("query %s answered %v, want %s", test.t, response, test.y)
+			continue
+		}
+		if test.y != "r" {
+			continue
+		}
+		r := response["r"].(map[string]interface{})
+		if r["id"] != id.RawString() {
+			t.Errorf("query %s answered by %x, want %s", test.t, r["id"], id)
+		}
+		for _, key := range test.keys {
+			if _, ok := r[key]; !ok {
+				t.Errorf("response to %s has no %s: %v", test.t, key, r)
+			}
+		}
+	}
+}
@@ -4,9 +4,35 @@ import (
 	"net"
 )
 
+// Priorities of outgoing packets, the lower value is sent first.
+const (
+	// responses and errors to the queries of other nodes
+	PriorityResponse = iota
+	// our own lookups and pings
+	PriorityQuery
+	// routing table maintenance
+	PriorityRefresh
+
+	priorityLevels
+)
+
 type Request struct {
 	RemoteAddr net.Addr
 	CMD        string
 	ClientID   interface{}
 	Data       interface{}
+	Priority   int
+	// called with the response of a query, or with an error if the query
+	// failed or timed out
+	Callback func(response interface{}, err error)
+}
+
+func normalizePriority(priority int) int {
+	if priority < 0 {
+		return 0
+	}
+	if priority >= priorityLevels {
+		return priorityLevels - 1
+	}
+	return priority
 }
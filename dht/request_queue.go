@@ -0,0 +1,91 @@
+package dht
+
+import (
+	"container/list"
+	"sync"
+)
+
+// requestQueue holds the requests waiting to be sent, a FIFO queue per
+// priority. When it is full, the newest request of the lowest priority is
+// dropped to make room for a request with a higher priority.
+type requestQueue struct {
+	sync.Mutex
+	queues   [priorityLevels]*list.List
+	size     int
+	capacity int
+	signal   chan struct{}
+}
+
+func newRequestQueue(capacity int) *requestQueue {
+	q := &requestQueue{
+		capacity: capacity,
+		signal:   make(chan struct{}, 1),
+	}
+	for i := range q.queues {
+		q.queues[i] = list.New()
+	}
+	return q
+}
+
+// Push appends the request to the queue of its priority and reports whether
+// it has been accepted. The request dropped to make room for it, if any, is
+// returned.
+func (q *requestQueue) Push(request *Request) (dropped *Request, ok bool) {
+	priority := normalizePriority(request.Priority)
+
+	q.Lock()
+	if q.capacity > 0 && q.size >= q.capacity {
+		if dropped = q.dropLowerThan(priority); dropped == nil {
+			q.Unlock()
+			return nil, false
+		}
+	}
+	q.queues[priority].PushBack(request)
+	q.size++
+	q.Unlock()
+
+	select {
+	case q.signal <- struct{}{}:
+	default:
+	}
+	return dropped, true
+}
+
+func (q *requestQueue) dropLowerThan(priority int) *Request {
+	for p := priorityLevels - 1; p > priority; p-- {
+		if e := q.queues[p].Back(); e != nil {
+			q.queues[p].Remove(e)
+			q.size--
+			return e.Value.(*Request)
+		}
+	}
+	return nil
+}
+
+// Pop returns the oldest request of the highest priority, or nil if the
+// queue is empty.
+func (q *requestQueue) Pop() *Request {
+	q.Lock()
+	defer q.Unlock()
+
+	for _, queue := range q.queues {
+		if e := queue.Front(); e != nil {
+			q.size--
+			return queue.Remove(e).(*Request)
+		}
+	}
+	return nil
+}
+
+// Len returns the number of queued requests.
+func (q *requestQueue) Len() int {
+	q.Lock()
+	defer q.Unlock()
+
+	return q.size
+}
+
+// Signal returns a channel which receives a value after a push.
+func (q *requestQueue) Signal() <-chan struct{} {
+	return q.signal
+}
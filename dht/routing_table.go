@@ -3,17 +3,21 @@ package dht
 import (
 	"sync"
 	"time"
-	"strings"
 	"container/heap"
-	"github.com/johnnyeven/terra/dht/util"
+	"container/list"
+	"net"
+	"sync/atomic"
 )
 
 const maxPrefixLength = 160
 
 type bucket struct {
 	sync.RWMutex
-	nodes          *KeyedDeque
+	nodes *KeyedDeque
+	// the nodes by ID, for GetNeighbors
+	index          *idTree
 	candidates     *KeyedDeque
+	addrs          *addressCounter
 	prefix         *Identity
 	lastChangeTime time.Time
 }
@@ -21,7 +25,9 @@ type bucket struct {
 func newBucket(prefix *Identity) *bucket {
 	return &bucket{
 		nodes:          NewKeyedDeque(),
+		index:          newIDTree(),
 		candidates:     NewKeyedDeque(),
+		addrs:          newAddressCounter(),
 		prefix:         prefix,
 		lastChangeTime: time.Now(),
 	}
@@ -34,13 +40,9 @@ func (b *bucket) LastChangeTime() time.Time {
 	return b.lastChangeTime
 }
 
-func (b *bucket) RandomChildID() string {
-	prefixLen := b.prefix.Size / 8
-
-	return strings.Join([]string{
-		b.prefix.RawString()[:prefixLen],
-		util.RandomString(20 - prefixLen),
-	}, "")
+// RandomChildID returns a random ID in the range of the bucket.
+func (b *bucket) RandomChildID() NodeID {
+	return RandomNodeIDInPrefix(b.prefix.NodeID(), b.prefix.Size)
 }
 
 func (b *bucket) UpdateTimestamp() {
@@ -51,34 +53,44 @@ func (b *bucket) UpdateTimestamp() {
 }
 
 func (b *bucket) Insert(node *Node) bool {
-	isNew := !b.nodes.HasKey(node.ID.RawString())
+	old, ok := b.nodes.Get(node.ID.RawString())
+	if ok {
+		b.addrs.Remove(old.Value.(*Node).Addr.IP)
+	}
 
 	b.nodes.Push(node.ID.RawString(), node)
+	b.index.Insert(node)
+	b.addrs.Add(node.Addr.IP)
 	b.UpdateTimestamp()
 
-	return isNew
+	return !ok
 }
 
-func (b *bucket) Replace(node *Node) {
-	b.nodes.Delete(node.ID.RawString())
-	b.UpdateTimestamp()
-
-	if b.candidates.Len() == 0 {
-		return
+// Replace removes the node and promotes the latest candidate allow accepts,
+// which is returned. The candidates allow refuses are dropped.
+func (b *bucket) Replace(node *Node, allow func(candidate *Node) bool) *Node {
+	if b.nodes.Delete(node.ID.RawString()) != nil {
+		b.index.Remove(node.ID)
+		b.addrs.Remove(node.Addr.IP)
 	}
+	b.UpdateTimestamp()
 
-	candidateNode := b.candidates.Remove(b.candidates.Back()).(*Node)
+	for {
+		e := b.candidates.Back()
+		if e == nil {
+			return nil
+		}
 
-	insertedMiddle := false
-	for e := range b.nodes.Iter() {
-		if e.Value.(*Node).LastActiveTime.After(node.LastActiveTime) && !insertedMiddle {
-			b.nodes.InsertBefore(candidateNode, e)
-			insertedMiddle = true
+		candidateNode, ok := b.candidates.Remove(e).(*Node)
+		if !ok || !allow(candidateNode) {
+			continue
 		}
-	}
 
-	if !insertedMiddle {
-		b.nodes.PushBack(candidateNode)
+		b.nodes.Push(candidateNode.ID.RawString(), candidateNode)
+		b.index.Insert(candidateNode)
+		b.addrs.Add(candidateNode.Addr.IP)
+
+		return candidateNode
 	}
 }
 
@@ -140,6 +152,23 @@ func (tableNode *routingTableNode) SetBucket(b *bucket) {
 	tableNode.bucket = b
 }
 
+// appendNodes appends to nodes the size nodes closest to id of each bucket
+// under tableNode, for which keep returns true.
+func (tableNode *routingTableNode) appendNodes(nodes []*Node, id NodeID, size int, keep func(node *Node) bool) []*Node {
+	if tableNode == nil {
+		return nodes
+	}
+
+	if b := tableNode.Bucket(); b != nil {
+		return b.index.AppendClosest(nodes, id, size, keep)
+	}
+
+	for i := 0; i < 2; i++ {
+		nodes = tableNode.Child(i).appendNodes(nodes, id, size, keep)
+	}
+	return nodes
+}
+
 func (tableNode *routingTableNode) Split() {
 	prefixLen := tableNode.bucket.prefix.Size
 	if prefixLen == maxPrefixLength {
@@ -156,12 +185,15 @@ func (tableNode *routingTableNode) Split() {
 
 	for e := range tableNode.bucket.nodes.Iter() {
 		node := e.Value.(*Node)
-		tableNode.Child(node.ID.Bit(prefixLen)).bucket.nodes.PushBack(node)
+		child := tableNode.Child(node.ID.Bit(prefixLen)).bucket
+		child.nodes.Push(node.ID.RawString(), node)
+		child.index.Insert(node)
+		child.addrs.Add(node.Addr.IP)
 	}
 
 	for e := range tableNode.bucket.candidates.Iter() {
 		node := e.Value.(*Node)
-		tableNode.Child(node.ID.Bit(prefixLen)).bucket.candidates.PushBack(node)
+		tableNode.Child(node.ID.Bit(prefixLen)).bucket.candidates.Push(node.ID.RawString(), node)
 	}
 
 	for i := 0; i < 2; i++ {
@@ -169,14 +201,38 @@ func (tableNode *routingTableNode) Split() {
 	}
 }
 
+// RejectedInserts counts the nodes refused by the routing table, by reason.
+type RejectedInserts struct {
+	// the routing table already holds MaxNodes nodes
+	TableFull uint64 `json:"tableFull"`
+	// the address is blocklisted or banned
+	Blocked uint64 `json:"blocked"`
+	// the address is private or reserved on the public network
+	Reserved uint64 `json:"reserved"`
+	// too many nodes with the same ip
+	IPLimit uint64 `json:"ipLimit"`
+	// too many nodes in the same /24 (ipv4) or /64 (ipv6) network
+	SubnetLimit uint64 `json:"subnetLimit"`
+	// the node queried us as read-only (BEP 43)
+	ReadOnly uint64 `json:"readOnly"`
+}
+
+// how many addresses of read-only nodes are remembered
+const maxReadOnlyNodes = 1024
+
 type routingTable struct {
+	// accessed atomically, keep it first for the 64-bit alignment
+	rejected RejectedInserts
 	sync.RWMutex
 	k             int
 	root          *routingTableNode
 	cachedNodes   *SyncedMap
 	cachedBuckets *KeyedDeque
+	addrs         *addressCounter
 	table         *DistributedHashTable
 	clearQueue    *SyncedList
+	// the addresses of the read-only nodes, oldest first
+	readOnly *KeyedDeque
 }
 
 func newRoutingTable(k int, table *DistributedHashTable) *routingTable {
@@ -187,18 +243,50 @@ func newRoutingTable(k int, table *DistributedHashTable) *routingTable {
 		root:          root,
 		cachedNodes:   NewSyncedMap(),
 		cachedBuckets: NewKeyedDeque(),
+		addrs:         newAddressCounter(),
 		table:         table,
 		clearQueue:    NewSyncedList(),
+		readOnly:      NewKeyedDeque(),
 	}
-	rt.cachedBuckets.Push(root.bucket.prefix.String(), root.bucket)
+	rt.cachedBuckets.Push(root.bucket.prefix.key(), root.bucket)
 	return rt
 }
 
 func (rt *routingTable) Insert(node *Node) bool {
+	isNew := rt.insert(node)
+	if isNew {
+		rt.table.nodeAdded(node)
+	}
+
+	return isNew
+}
+
+func (rt *routingTable) insert(node *Node) bool {
 	rt.Lock()
 	defer rt.Unlock()
 
 	if rt.cachedNodes.Len() >= rt.table.MaxNodes {
+		atomic.AddUint64(&rt.rejected.TableFull, 1)
+		return false
+	}
+
+	if rt.table.Blocked(node.Addr.IP) {
+		atomic.AddUint64(&rt.rejected.Blocked, 1)
+		return false
+	}
+
+	if rt.table.PublicNetwork && !IsPublicAddr(node.Addr) {
+		atomic.AddUint64(&rt.rejected.Reserved, 1)
+		return false
+	}
+
+	if rt.readOnly.HasKey(node.Addr.String()) {
+		atomic.AddUint64(&rt.rejected.ReadOnly, 1)
+		return false
+	}
+
+	if !rt.cachedNodes.Has(node.Addr.String()) &&
+		!rt.allowAddr(rt.addrs, node.Addr.IP, rt.table.MaxNodesPerIP, rt.table.MaxNodesPerSubnet) {
 		return false
 	}
 
@@ -213,29 +301,36 @@ func (rt *routingTable) Insert(node *Node) bool {
 
 		if next != nil {
 			root = next
+		} else if !root.bucket.nodes.HasKey(node.ID.RawString()) &&
+			!rt.allowAddr(root.bucket.addrs, node.Addr.IP, rt.table.MaxNodesPerIPPerBucket, rt.table.MaxNodesPerSubnetPerBucket) {
+
+			return false
 		} else if root.bucket.nodes.Len() < rt.k ||
 			root.bucket.nodes.HasKey(node.ID.RawString()) {
 
+			if old, ok := root.bucket.nodes.Get(node.ID.RawString()); ok {
+				rt.untrack(old.Value.(*Node))
+			}
 			isNew := root.bucket.Insert(node)
 
-			rt.cachedNodes.Set(node.Addr.String(), node)
-			rt.cachedBuckets.Push(root.bucket.prefix.String(), root.bucket)
+			rt.track(node)
+			rt.cachedBuckets.Push(root.bucket.prefix.key(), root.bucket)
 
 			return isNew
-		} else if root.bucket.prefix.Compare(node.ID, prefixLen-1) == 0 {
+		} else if rt.splittable(root.bucket, node, prefixLen-1) {
 			root.Split()
 
-			rt.cachedBuckets.Delete(root.bucket.prefix.String())
+			rt.cachedBuckets.Delete(root.bucket.prefix.key())
 			root.SetBucket(nil)
 
 			for i := 0; i < 2; i++ {
 				bucket = root.Child(i).bucket
-				rt.cachedBuckets.Push(bucket.prefix.String(), bucket)
+				rt.cachedBuckets.Push(bucket.prefix.key(), bucket)
 			}
 
 			root = root.Child(node.ID.Bit(prefixLen - 1))
 		} else {
-			root.bucket.candidates.PushBack(node)
+			root.bucket.candidates.Push(node.ID.RawString(), node)
 			if root.bucket.candidates.Len() > rt.k {
 				root.bucket.candidates.Remove(root.bucket.candidates.Front())
 			}
@@ -249,25 +344,125 @@ func (rt *routingTable) Insert(node *Node) bool {
 	return false
 }
 
-func (rt *routingTable) GetNeighbors(id *Identity, size int) []*Node {
-	rt.RLock()
-	nodes := make([]interface{}, 0, rt.cachedNodes.Len())
-	for item := range rt.cachedNodes.Iter() {
-		nodes = append(nodes, item.Value.(*Node))
+// splittable reports whether the full bucket on the path of node can be split.
+// In client mode only the bucket containing our own ID for the family of node
+// is split, in crawler mode every bucket is.
+func (rt *routingTable) splittable(b *bucket, node *Node, prefixLen int) bool {
+	if rt.table.Mode == ClientMode {
+		return b.prefix.MatchNodeID(rt.table.SelfID(node.Addr.IP.To4() == nil), prefixLen)
+	}
+	return b.prefix.MatchNodeID(node.ID, prefixLen)
+}
+
+// allowAddr reports whether one more node with ip stays in the limits of
+// counter, a limit of 0 means unlimited.
+func (rt *routingTable) allowAddr(counter *addressCounter, ip net.IP, maxIPs, maxSubnets int) bool {
+	ips, subnets := counter.Count(ip)
+	if maxIPs > 0 && ips >= maxIPs {
+		atomic.AddUint64(&rt.rejected.IPLimit, 1)
+		return false
+	}
+	if maxSubnets > 0 && subnets >= maxSubnets {
+		atomic.AddUint64(&rt.rejected.SubnetLimit, 1)
+		return false
 	}
-	rt.RUnlock()
+	return true
+}
 
-	neighbors := getTopK(nodes, id, size)
+// track indexes the node by its address.
+func (rt *routingTable) track(node *Node) {
+	if !rt.cachedNodes.Has(node.Addr.String()) {
+		rt.addrs.Add(node.Addr.IP)
+	}
+	rt.cachedNodes.Set(node.Addr.String(), node)
+}
 
-	result := make([]*Node, len(neighbors))
-	for i, node := range neighbors {
-		result[i] = node.(*Node)
+// untrack removes the address index of the node, unless the address has been
+// taken by another node.
+func (rt *routingTable) untrack(node *Node) {
+	v, ok := rt.cachedNodes.Get(node.Addr.String())
+	if !ok || v.(*Node).ID != node.ID {
+		return
 	}
-	return result
+
+	rt.cachedNodes.Delete(node.Addr.String())
+	rt.addrs.Remove(node.Addr.IP)
 }
 
-func (rt *routingTable) GetNeighborCompactInfos(id *Identity, size int) []string {
-	neighbors := rt.GetNeighbors(id, size)
+// RejectedInserts returns how many nodes have been refused.
+func (rt *routingTable) RejectedInserts() RejectedInserts {
+	return RejectedInserts{
+		TableFull:   atomic.LoadUint64(&rt.rejected.TableFull),
+		Blocked:     atomic.LoadUint64(&rt.rejected.Blocked),
+		Reserved:    atomic.LoadUint64(&rt.rejected.Reserved),
+		IPLimit:     atomic.LoadUint64(&rt.rejected.IPLimit),
+		SubnetLimit: atomic.LoadUint64(&rt.rejected.SubnetLimit),
+		ReadOnly:    atomic.LoadUint64(&rt.rejected.ReadOnly),
+	}
+}
+
+// GetNeighbors returns at most size nodes closest to id, sorted by distance.
+// It starts from the bucket of id and walks the siblings up the trie. The
+// nodes under a deeper sibling are closer to id than the ones under any
+// sibling above it, so the walk stops as soon as there are enough nodes.
+// Each bucket gives its closest nodes from its ID index, so a large bucket
+// of crawler mode is not scanned.
+func (rt *routingTable) GetNeighbors(id NodeID, size int) []*Node {
+	return rt.getNeighbors(id, size, nil)
+}
+
+// GetNeighborsOfFamily returns the nodes of GetNeighbors which have an IPv6
+// address if ipv6 is set, and an IPv4 address otherwise.
+func (rt *routingTable) GetNeighborsOfFamily(id NodeID, size int, ipv6 bool) []*Node {
+	return rt.getNeighbors(id, size, func(node *Node) bool {
+		return (node.Addr.IP.To4() == nil) == ipv6
+	})
+}
+
+// getNeighbors returns the nodes of GetNeighbors for which keep returns
+// true, all if keep is nil.
+func (rt *routingTable) getNeighbors(id NodeID, size int, keep func(node *Node) bool) []*Node {
+	if size <= 0 {
+		return nil
+	}
+
+	rt.RLock()
+	defer rt.RUnlock()
+
+	siblings := make([]*routingTableNode, 0, 16)
+	root := rt.root
+	for prefixLen := 0; prefixLen < maxPrefixLength; prefixLen++ {
+		bit := id.Bit(prefixLen)
+		next := root.Child(bit)
+		if next == nil {
+			break
+		}
+		siblings = append(siblings, root.Child(1-bit))
+		root = next
+	}
+
+	nodes := make([]*Node, 0, size)
+	nodes = root.appendNodes(nodes, id, size, keep)
+	for i := len(siblings) - 1; i >= 0 && len(nodes) < size; i-- {
+		nodes = siblings[i].appendNodes(nodes, id, size, keep)
+	}
+
+	return closestNodes(nodes, id, size)
+}
+
+// GetNeighborCompactInfos returns the compact infos of the IPv4 nodes of
+// GetNeighbors, the entries of nodes.
+func (rt *routingTable) GetNeighborCompactInfos(id NodeID, size int) []string {
+	return compactNodeInfos(rt.GetNeighborsOfFamily(id, size, false))
+}
+
+// GetNeighborCompactInfos6 returns the compact infos of the IPv6 nodes of
+// GetNeighbors, the entries of nodes6.
+func (rt *routingTable) GetNeighborCompactInfos6(id NodeID, size int) []string {
+	return compactNodeInfos(rt.GetNeighborsOfFamily(id, size, true))
+}
+
+func compactNodeInfos(neighbors []*Node) []string {
 	infos := make([]string, len(neighbors))
 
 	for i, node := range neighbors {
@@ -277,7 +472,7 @@ func (rt *routingTable) GetNeighborCompactInfos(id *Identity, size int) []string
 	return infos
 }
 
-func (rt *routingTable) GetNodeBucketByID(id *Identity) (node *Node, bucket *bucket) {
+func (rt *routingTable) GetNodeBucketByID(id NodeID) (node *Node, bucket *bucket) {
 	rt.RLock()
 	defer rt.RUnlock()
 
@@ -313,12 +508,8 @@ func (rt *routingTable) GetNodeByAddress(address string) (node *Node, ok bool) {
 	return
 }
 
-func (rt *routingTable) Remove(id *Identity) {
-	if node, bucket := rt.GetNodeBucketByID(id); node != nil {
-		bucket.Replace(node)
-		rt.cachedNodes.Delete(node.Addr.String())
-		rt.cachedBuckets.Push(bucket.prefix.String(), bucket)
-	}
+func (rt *routingTable) Remove(id NodeID) {
+	rt.remove(id, EventNodeRemoved)
 }
 
 func (rt *routingTable) RemoveByAddr(address string) {
@@ -328,6 +519,56 @@ func (rt *routingTable) RemoveByAddr(address string) {
 	}
 }
 
+// SetReadOnly records whether the node at address queried us as read-only. A
+// read-only node is removed and refused until it queries without ro=1, the
+// node lists of third parties could bring it back otherwise.
+func (rt *routingTable) SetReadOnly(address string, readOnly bool) {
+	if !readOnly {
+		rt.readOnly.Delete(address)
+		return
+	}
+
+	rt.readOnly.Push(address, address)
+	if rt.readOnly.Len() > maxReadOnlyNodes {
+		rt.readOnly.Remove(rt.readOnly.Front())
+	}
+	rt.RemoveByAddr(address)
+}
+
+// EvictByAddr removes the node at address because it stopped responding.
+func (rt *routingTable) EvictByAddr(address string) {
+	v, ok := rt.cachedNodes.Get(address)
+	if ok {
+		rt.remove(v.(*Node).ID, EventNodeEvicted)
+	}
+}
+
+func (rt *routingTable) remove(id NodeID, eventType EventType) {
+	node, bucket := rt.GetNodeBucketByID(id)
+	if node == nil {
+		return
+	}
+
+	rt.untrack(node)
+	// the candidate has waited, it passes the checks of insert again
+	candidate := bucket.Replace(node, func(candidate *Node) bool {
+		if rt.cachedNodes.Has(candidate.Addr.String()) || rt.readOnly.HasKey(candidate.Addr.String()) {
+			return false
+		}
+		return rt.allowAddr(rt.addrs, candidate.Addr.IP, rt.table.MaxNodesPerIP, rt.table.MaxNodesPerSubnet) &&
+			rt.allowAddr(bucket.addrs, candidate.Addr.IP, rt.table.MaxNodesPerIPPerBucket, rt.table.MaxNodesPerSubnetPerBucket)
+	})
+	if candidate != nil {
+		rt.track(candidate)
+	}
+	rt.cachedBuckets.Push(bucket.prefix.key(), bucket)
+
+	rt.table.events.Publish(Event{Type: eventType, Node: node, Addr: node.Addr})
+	if candidate != nil {
+		rt.table.nodeAdded(candidate)
+	}
+}
+
 func (rt *routingTable) Fresh() {
 	now := time.Now()
 
@@ -341,16 +582,82 @@ func (rt *routingTable) Fresh() {
 		for e := range bucket.nodes.Iter() {
 			if i < rt.table.RefreshNodeCount {
 				node := e.Value.(*Node)
-				rt.table.HandshakeFunc(node, rt.table.GetTransport(), []byte(bucket.RandomChildID()))
+				rt.table.RefreshFunc(node, rt.table.GetTransport(), bucket.RandomChildID().Bytes())
 				rt.clearQueue.PushBack(node)
 			}
 			i++
 		}
+		bucket.UpdateTimestamp()
 	}
 
 	rt.clearQueue.Clear()
 }
 
+// BucketSnapshot is a copy of a bucket of the routing table.
+type BucketSnapshot struct {
+	// the bits of the prefix
+	Prefix         string    `json:"prefix"`
+	PrefixLen      int       `json:"prefixLen"`
+	LastChangeTime time.Time `json:"lastChangeTime"`
+	Nodes          []*Node   `json:"nodes"`
+	Candidates     int       `json:"candidates"`
+}
+
+// Buckets returns a snapshot of the buckets in order of prefix.
+func (rt *routingTable) Buckets() []*BucketSnapshot {
+	rt.RLock()
+	defer rt.RUnlock()
+
+	return rt.root.appendBuckets(make([]*BucketSnapshot, 0))
+}
+
+// appendBuckets appends the snapshots of the buckets under tableNode to
+// buckets.
+func (tableNode *routingTableNode) appendBuckets(buckets []*BucketSnapshot) []*BucketSnapshot {
+	if tableNode == nil {
+		return buckets
+	}
+
+	if b := tableNode.Bucket(); b != nil {
+		snapshot := &BucketSnapshot{
+			Prefix:         b.prefix.String(),
+			PrefixLen:      b.prefix.Size,
+			LastChangeTime: b.LastChangeTime(),
+			Nodes:          make([]*Node, 0, b.nodes.Len()),
+			Candidates:     b.candidates.Len(),
+		}
+		b.nodes.Each(func(e *list.Element) bool {
+			node := *e.Value.(*Node)
+			snapshot.Nodes = append(snapshot.Nodes, &node)
+			return true
+		})
+		return append(buckets, snapshot)
+	}
+
+	for i := 0; i < 2; i++ {
+		buckets = tableNode.Child(i).appendBuckets(buckets)
+	}
+	return buckets
+}
+
+// BucketCount returns the number of buckets.
+func (rt *routingTable) BucketCount() int {
+	rt.RLock()
+	defer rt.RUnlock()
+
+	return rt.root.countBuckets()
+}
+
+func (tableNode *routingTableNode) countBuckets() int {
+	if tableNode == nil {
+		return 0
+	}
+	if tableNode.Bucket() != nil {
+		return 1
+	}
+	return tableNode.Child(0).countBuckets() + tableNode.Child(1).countBuckets()
+}
+
 func (rt *routingTable) Len() int {
 	rt.RLock()
 	defer rt.RUnlock()
@@ -358,59 +665,56 @@ func (rt *routingTable) Len() int {
 	return rt.cachedNodes.Len()
 }
 
-// Implementation of heap with heap.Interface.
-type heapItem struct {
-	distance *Identity
-	value    interface{}
+// neighborHeap is a max-heap of nodes by their distance to target, the
+// farthest node is on the top.
+type neighborHeap struct {
+	target NodeID
+	nodes  []*Node
 }
 
-type topKHeap []*heapItem
-
-func (kHeap topKHeap) Len() int {
-	return len(kHeap)
+func (h *neighborHeap) Len() int {
+	return len(h.nodes)
 }
 
-func (kHeap topKHeap) Less(i, j int) bool {
-	return kHeap[i].distance.Compare(kHeap[j].distance, maxPrefixLength) == 1
+func (h *neighborHeap) Less(i, j int) bool {
+	return h.target.CompareDistance(h.nodes[i].ID, h.nodes[j].ID) > 0
 }
 
-func (kHeap topKHeap) Swap(i, j int) {
-	kHeap[i], kHeap[j] = kHeap[j], kHeap[i]
+func (h *neighborHeap) Swap(i, j int) {
+	h.nodes[i], h.nodes[j] = h.nodes[j], h.nodes[i]
 }
 
-func (kHeap *topKHeap) Push(x interface{}) {
-	*kHeap = append(*kHeap, x.(*heapItem))
+func (h *neighborHeap) Push(x interface{}) {
+	h.nodes = append(h.nodes, x.(*Node))
 }
 
-func (kHeap *topKHeap) Pop() interface{} {
-	n := len(*kHeap)
-	x := (*kHeap)[n-1]
-	*kHeap = (*kHeap)[:n-1]
+func (h *neighborHeap) Pop() interface{} {
+	n := len(h.nodes)
+	x := h.nodes[n-1]
+	h.nodes = h.nodes[:n-1]
 	return x
 }
 
-// getTopK solves the top-k problem with heap. It's time complexity is
-// O(n*log(k)). When n is large, time complexity will be too high, need to be
-// optimized.
-func getTopK(queue []interface{}, id *Identity, k int) []interface{} {
-	topkHeap := make(topKHeap, 0, k+1)
+// closestNodes returns the k nodes closest to target sorted by distance, in
+// O(n*log(k)).
+func closestNodes(nodes []*Node, target NodeID, k int) []*Node {
+	h := &neighborHeap{
+		target: target,
+		nodes:  make([]*Node, 0, k+1),
+	}
 
-	for _, value := range queue {
-		node := value.(*Node)
-		item := &heapItem{
-			id.Xor(node.ID),
-			value,
-		}
-		heap.Push(&topkHeap, item)
-		if topkHeap.Len() > k {
-			heap.Pop(&topkHeap)
+	for _, node := range nodes {
+		if h.Len() < k {
+			heap.Push(h, node)
+		} else if target.CompareDistance(node.ID, h.nodes[0].ID) < 0 {
+			h.nodes[0] = node
+			heap.Fix(h, 0)
 		}
 	}
 
-	tops := make([]interface{}, topkHeap.Len())
-	for i := len(tops) - 1; i >= 0; i-- {
-		tops[i] = heap.Pop(&topkHeap).(*heapItem).value
+	result := make([]*Node, h.Len())
+	for i := len(result) - 1; i >= 0; i-- {
+		result[i] = heap.Pop(h).(*Node)
 	}
-
-	return tops
+	return result
 }
@@ -0,0 +1,360 @@
+package dht
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"testing"
+	"time"
+)
+
+// newEmptyRoutingTable returns the routing table of a node with config and a
+// random ID, which does not run.
+func newEmptyRoutingTable(config *Config) *routingTable {
+	config.PublicNetwork = false
+	table := NewDHT(config)
+	table.Self = &Node{ID: RandomNodeID()}
+	table.firewall = newFirewall(nil, 0, 0, 0, 0)
+	return newRoutingTable(table.BucketSize, table)
+}
+
+// newTestRoutingTable returns the routing table of a node in mode offered n
+// random nodes. A client mode table only keeps the buckets around its own ID,
+// so its nodes share a prefix of every length with our ID in turn, the
+// buckets are then filled down to the one of our ID. It stops being offered
+// nodes once it is full.
+func newTestRoutingTable(tb testing.TB, mode string, n int) *routingTable {
+	config := GetNormalConfig()
+	if mode == CrawlerMode {
+		config = GetCrawlerConfig()
+	}
+	config.MaxNodes = math.MaxInt32
+	config.MaxNodesPerIP = 0
+	config.MaxNodesPerSubnet = 0
+	config.MaxNodesPerIPPerBucket = 0
+	config.MaxNodesPerSubnetPerBucket = 0
+	rt := newEmptyRoutingTable(config)
+	table := rt.table
+
+	rejected := 0
+	for i := 0; i < n && rejected < 1000; i++ {
+		id := RandomNodeID()
+		if mode == ClientMode {
+			id = RandomNodeIDInPrefix(table.Self.ID, i%maxPrefixLength)
+		}
+		inserted := rt.insert(&Node{
+			ID:             id,
+			Addr:           &net.UDPAddr{IP: net.IPv4(93, byte(i>>16), byte(i>>8), byte(i)), Port: 6881},
+			LastActiveTime: time.Now(),
+		})
+		if inserted {
+			rejected = 0
+		} else {
+			rejected++
+		}
+	}
+	return rt
+}
+
+// allNodes appends the nodes of the buckets under tableNode to nodes.
+func allNodes(tableNode *routingTableNode, nodes []*Node) []*Node {
+	if tableNode == nil {
+		return nodes
+	}
+	if b := tableNode.Bucket(); b != nil {
+		for e := range b.nodes.Iter() {
+			nodes = append(nodes, e.Value.(*Node))
+		}
+		return nodes
+	}
+	for i := 0; i < 2; i++ {
+		nodes = allNodes(tableNode.Child(i), nodes)
+	}
+	return nodes
+}
+
+func TestGetNeighbors(t *testing.T) {
+	for _, mode := range []string{ClientMode, CrawlerMode} {
+		rt := newTestRoutingTable(t, mode, 2000)
+		all := allNodes(rt.root, nil)
+		// the index follows the removals
+		for i := 0; i < len(all); i += 2 {
+			rt.Remove(all[i].ID)
+		}
+		all = allNodes(rt.root, nil)
+
+		for i := 0; i < 20; i++ {
+			target := RandomNodeID()
+			got := rt.GetNeighbors(target, 8)
+			want := closestNodes(all, target, 8)
+			if len(got) != len(want) {
+				t.Fatalf("%s: GetNeighbors returned %d nodes, want %d", mode, len(got), len(want))
+			}
+			for j := range want {
+				if got[j] != want[j] {
+					t.Fatalf("%s: neighbor %d is %x, want %x", mode, j, got[j].ID, want[j].ID)
+				}
+			}
+		}
+	}
+}
+
+func benchmarkGetNeighbors(b *testing.B, rt *routingTable) {
+	targets := make([]NodeID, 1024)
+	for i := range targets {
+		targets[i] = RandomNodeID()
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		rt.GetNeighbors(targets[i%len(targets)], 8)
+	}
+	b.ReportMetric(float64(rt.Len()), "nodes")
+}
+
+// BenchmarkGetNeighbors is named after the number of nodes the tables hold, a
+// client mode table is full with about 160 buckets of k nodes.
+func BenchmarkGetNeighbors(b *testing.B) {
+	for _, bench := range []struct {
+		mode string
+		n    int
+		// the fewest nodes the table must hold
+		min int
+	}{
+		{ClientMode, 100000, 150 * 8},
+		{CrawlerMode, 10000, 10000},
+		{CrawlerMode, 1000000, 1000000},
+	} {
+		rt := newTestRoutingTable(b, bench.mode, bench.n)
+		if rt.Len() < bench.min {
+			b.Fatalf("%s: %d nodes, want at least %d", bench.mode, rt.Len(), bench.min)
+		}
+		b.Run(fmt.Sprintf("%s/%d", bench.mode, rt.Len()), func(b *testing.B) {
+			benchmarkGetNeighbors(b, rt)
+		})
+	}
+}
+
+// nodeAt returns a node at ip with a random ID sharing prefixLen bits with id,
+// and the next bit different if far.
+func nodeAt(ip string, id NodeID, prefixLen int, far bool) *Node {
+	if far {
+		id[prefixLen/8] ^= 0x80 >> uint(prefixLen%8)
+	}
+	return &Node{
+		ID:             RandomNodeIDInPrefix(id, prefixLen+1),
+		Addr:           &net.UDPAddr{IP: net.ParseIP(ip), Port: 6881},
+		LastActiveTime: time.Now(),
+	}
+}
+
+func TestRoutingTableLimits(t *testing.T) {
+	tests := []struct {
+		name string
+		// MaxNodesPerIP, MaxNodesPerSubnet, MaxNodesPerIPPerBucket and
+		// MaxNodesPerSubnetPerBucket
+		limits [4]int
+		ips    []string
+		want   []bool
+		// the expected RejectedInserts IPLimit and SubnetLimit
+		ipRejects, subnetRejects uint64
+	}{
+		{"per ip", [4]int{2, 0, 0, 0}, []string{"1.1.1.1", "1.1.1.1", "1.1.1.1", "1.1.1.2"}, []bool{true, true, false, true}, 1, 0},
+		{"per subnet", [4]int{0, 2, 0, 0}, []string{"1.1.1.1", "1.1.1.2", "1.1.1.3", "1.1.2.1"}, []bool{true, true, false, true}, 0, 1},
+		{"per ipv6 subnet", [4]int{0, 1, 0, 0}, []string{"2001:db8::1", "2001:db8::2", "2001:db8:0:1::1"}, []bool{true, false, true}, 0, 1},
+		{"per ip per bucket", [4]int{0, 0, 1, 0}, []string{"1.1.1.1", "1.1.1.1", "1.1.1.2"}, []bool{true, false, true}, 1, 0},
+		{"per subnet per bucket", [4]int{0, 0, 0, 2}, []string{"1.1.1.1", "1.1.1.2", "1.1.1.3", "1.1.2.1"}, []bool{true, true, false, true}, 0, 1},
+		{"unlimited", [4]int{}, []string{"1.1.1.1", "1.1.1.1", "1.1.1.1"}, []bool{true, true, true}, 0, 0},
+	}
+
+	for _, test := range tests {
+		config := GetNormalConfig()
+		config.MaxNodesPerIP, config.MaxNodesPerSubnet = test.limits[0], test.limits[1]
+		config.MaxNodesPerIPPerBucket, config.MaxNodesPerSubnetPerBucket = test.limits[2], test.limits[3]
+		rt := newEmptyRoutingTable(config)
+
+		for i, ip := range test.ips {
+			// the nodes fit in the first bucket
+			node := nodeAt(ip, rt.table.Self.ID, 0, true)
+			node.Addr.Port += i
+			if inserted := rt.Insert(node); inserted != test.want[i] {
+				t.Errorf("%s: node %d at %s inserted %v, want %v", test.name, i, node.Addr, inserted, test.want[i])
+			}
+		}
+		rejected := rt.RejectedInserts()
+		if rejected.IPLimit != test.ipRejects || rejected.SubnetLimit != test.subnetRejects {
+			t.Errorf("%s: rejected %+v, want %d for the ip and %d for the subnet", test.name, rejected, test.ipRejects, test.subnetRejects)
+		}
+	}
+
+	// a node inserted again is not counted twice
+	config := GetNormalConfig()
+	config.MaxNodesPerIP = 1
+	rt := newEmptyRoutingTable(config)
+	node := nodeAt("1.1.1.1", rt.table.Self.ID, 0, true)
+	rt.Insert(node)
+	rt.Insert(node)
+	if rejected := rt.RejectedInserts(); rejected.IPLimit != 0 || rt.Len() != 1 {
+		t.Errorf("node inserted again: %d nodes, rejected %+v", rt.Len(), rejected)
+	}
+}
+
+func TestRoutingTablePromotion(t *testing.T) {
+	config := GetNormalConfig()
+	config.K, config.BucketSize = 2, 2
+	config.MaxNodesPerSubnet = 1
+	rt := newEmptyRoutingTable(config)
+	self := rt.table.Self.ID
+
+	// the far bucket is full, c and d wait as candidates, d last
+	a := nodeAt("1.1.1.1", self, 0, true)
+	b := nodeAt("2.2.2.2", self, 0, true)
+	c := nodeAt("3.3.3.3", self, 0, true)
+	d := nodeAt("4.4.4.4", self, 0, true)
+	for _, node := range []*Node{a, b, c, d} {
+		rt.Insert(node)
+	}
+	if rt.Len() != 2 {
+		t.Fatalf("%d nodes, want 2", rt.Len())
+	}
+	// d's subnet is then taken in the near bucket
+	if !rt.Insert(nodeAt("4.4.4.5", self, 0, false)) {
+		t.Fatal("near node not inserted")
+	}
+
+	// d would exceed the subnet limit, c is promoted instead
+	rt.Remove(a.ID)
+	if node, _ := rt.GetNodeBucketByID(c.ID); node == nil {
+		t.Error("candidate c not promoted")
+	}
+	if node, _ := rt.GetNodeBucketByID(d.ID); node != nil {
+		t.Error("candidate d promoted above the subnet limit")
+	}
+	if rejected := rt.RejectedInserts(); rejected.SubnetLimit != 1 {
+		t.Errorf("%d subnet rejects, want 1", rejected.SubnetLimit)
+	}
+	if ips, subnets := rt.addrs.Count(d.Addr.IP); ips != 0 || subnets != 1 {
+		t.Errorf("%d nodes at the ip of d and %d in its subnet, want 0 and 1", ips, subnets)
+	}
+
+	// no candidate is left
+	rt.Remove(b.ID)
+	if rt.Len() != 2 {
+		t.Errorf("%d nodes, want 2", rt.Len())
+	}
+}
+
+// buckets returns the buckets of rt.
+func buckets(rt *routingTable) []*bucket {
+	var buckets []*bucket
+	for e := range rt.cachedBuckets.Iter() {
+		buckets = append(buckets, e.Value.(*bucket))
+	}
+	return buckets
+}
+
+func TestRoutingTableClientSplit(t *testing.T) {
+	rt := newTestRoutingTable(t, ClientMode, 2000)
+	self := rt.table.Self.ID
+
+	// the parent of every bucket covered our ID, and the deepest buckets
+	// are the ones around it
+	deepest := 0
+	for _, b := range buckets(rt) {
+		if !b.prefix.MatchNodeID(self, b.prefix.Size-1) {
+			t.Errorf("bucket %s split away from our ID %s", b.prefix, self)
+		}
+		if b.prefix.Size > deepest {
+			deepest = b.prefix.Size
+		}
+	}
+	if _, b := rt.GetNodeBucketByID(self); b == nil || b.prefix.Size != deepest {
+		t.Errorf("the bucket of our ID is not the deepest one, of %d bits", deepest)
+	}
+
+	// a full bucket away from our ID keeps its nodes, a crawler splits it
+	for _, mode := range []string{ClientMode, CrawlerMode} {
+		config := GetNormalConfig()
+		config.Mode = mode
+		config.K, config.BucketSize = 2, 2
+		rt := newEmptyRoutingTable(config)
+		for i := 0; i < 3; i++ {
+			rt.Insert(nodeAt(fmt.Sprintf("1.1.1.%d", i+1), rt.table.Self.ID, 0, true))
+		}
+		want := 2
+		if mode == CrawlerMode {
+			want = 3
+		}
+		if rt.Len() != want {
+			t.Errorf("%s mode: %d nodes away from our ID, want %d", mode, rt.Len(), want)
+		}
+	}
+}
+
+func TestRoutingTableFamilySplit(t *testing.T) {
+	for _, test := range []struct {
+		family, ip string
+		want       int
+	}{
+		{"IPv6", "2001:db8::%d", 3},
+		{"IPv4", "1.1.1.%d", 2},
+	} {
+		config := GetNormalConfig()
+		config.K, config.BucketSize = 2, 2
+		rt := newEmptyRoutingTable(config)
+
+		// the IPv6 ID is in the other half of the IDs
+		id6 := rt.table.Self.ID
+		id6[0] ^= 0x80
+		rt.table.familyIDs[familyIndex(true)] = &id6
+		if rt.table.SelfID(true) != id6 || rt.table.SelfID(false) != rt.table.Self.ID {
+			t.Fatal("the IDs of the families are not set")
+		}
+
+		// the bucket around the IPv6 ID is only split for IPv6 nodes
+		for i := 0; i < 3; i++ {
+			rt.Insert(nodeAt(fmt.Sprintf(test.ip, i+1), id6, 1+i%2, i%2 == 0))
+		}
+		if rt.Len() != test.want {
+			t.Errorf("%s nodes: %d around the IPv6 ID, want %d", test.family, rt.Len(), test.want)
+		}
+	}
+}
+
+func TestRoutingTableRefresh(t *testing.T) {
+	rt := newTestRoutingTable(t, ClientMode, 2000)
+	for _, b := range buckets(rt) {
+		for i := 0; i < 16; i++ {
+			if id := b.RandomChildID(); !b.prefix.MatchNodeID(id, b.prefix.Size) {
+				t.Fatalf("refresh target %s out of the bucket %s", id, b.prefix)
+			}
+		}
+	}
+
+	// the buckets unchanged for BucketExpiredAfter ask RefreshNodeCount of
+	// their nodes for a target in the bucket
+	rt.table.BucketExpiredAfter = 0
+	rt.table.RefreshNodeCount = 2
+	want := 0
+	for _, b := range buckets(rt) {
+		if n := b.nodes.Len(); n < rt.table.RefreshNodeCount {
+			want += n
+		} else {
+			want += rt.table.RefreshNodeCount
+		}
+	}
+	refreshes := 0
+	rt.table.RefreshFunc = func(node *Node, _ *Transport, target []byte) {
+		refreshes++
+		_, b := rt.GetNodeBucketByID(node.ID)
+		id, err := NodeIDFromBytes(target)
+		if err != nil || b == nil || !b.prefix.MatchNodeID(id, b.prefix.Size) {
+			t.Errorf("refresh target %x of %s out of its bucket", target, node.ID)
+		}
+	}
+	rt.Fresh()
+	if refreshes != want {
+		t.Errorf("%d refreshes, want %d", refreshes, want)
+	}
+}
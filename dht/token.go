@@ -0,0 +1,69 @@
+package dht
+
+import (
+	"crypto/rand"
+	"crypto/sha1"
+	"net"
+	"sync"
+	"time"
+)
+
+// how often the token secret is changed, tokens of the previous secret are
+// still accepted
+const tokenSecretInterval = 5 * time.Minute
+
+// tokenManager issues the tokens returned in get_peers responses and checks
+// the ones sent back in announce_peer queries. A token is bound to the ip of
+// the querying node.
+type tokenManager struct {
+	sync.Mutex
+	secret    []byte
+	previous  []byte
+	rotatedAt time.Time
+}
+
+func newTokenManager() *tokenManager {
+	m := &tokenManager{}
+	m.rotate()
+	m.previous = m.secret
+	return m
+}
+
+func (m *tokenManager) rotate() {
+	m.previous = m.secret
+	m.secret = make([]byte, 20)
+	rand.Read(m.secret)
+	m.rotatedAt = time.Now()
+}
+
+func (m *tokenManager) secrets() (secret, previous []byte) {
+	m.Lock()
+	defer m.Unlock()
+
+	if time.Since(m.rotatedAt) > tokenSecretInterval {
+		m.rotate()
+	}
+	return m.secret, m.previous
+}
+
+func makeToken(secret []byte, ip net.IP) string {
+	h := sha1.New()
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	h.Write(ip)
+	h.Write(secret)
+	return string(h.Sum(nil)[:8])
+}
+
+// Token returns the token of addr.
+func (m *tokenManager) Token(addr *net.UDPAddr) string {
+	secret, _ := m.secrets()
+	return makeToken(secret, addr.IP)
+}
+
+// Validate reports whether token has been issued to addr recently.
+func (m *tokenManager) Validate(token string, addr *net.UDPAddr) bool {
+	secret, previous := m.secrets()
+	return token == makeToken(secret, addr.IP) || token == makeToken(previous, addr.IP)
+}
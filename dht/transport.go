@@ -6,6 +6,8 @@ import (
 	"sync"
 	"strings"
 	"github.com/johnnyeven/terra/dht/util"
+	"github.com/sirupsen/logrus"
+	"sync/atomic"
 )
 
 const RequestRetryTime = 2
@@ -16,17 +18,34 @@ type transaction struct {
 	ResponseChannel chan struct{}
 }
 
+// TransportStats is a snapshot of the transport activity.
+type TransportStats struct {
+	PendingTransactions int    `json:"pendingTransactions"`
+	QueueLength         int    `json:"queueLength"`
+	PacketsIn           uint64 `json:"packetsIn"`
+	PacketsOut          uint64 `json:"packetsOut"`
+	BytesIn             uint64 `json:"bytesIn"`
+	BytesOut            uint64 `json:"bytesOut"`
+}
+
 type Transport struct {
+	// accessed atomically, keep them first for the 64-bit alignment
+	packetsIn  uint64
+	packetsOut uint64
+	bytesIn    uint64
+	bytesOut   uint64
 	TransportDriver
 	*sync.RWMutex
-	transactions   *SyncedMap
-	index          *SyncedMap
-	cursor         uint64
-	maxCursor      uint64
-	dht            *DistributedHashTable
-	client         TransportDriver
-	requestChannel chan *Request
-	quitChannel    chan struct{}
+	transactions *SyncedMap
+	index        *SyncedMap
+	cursor       uint64
+	maxCursor    uint64
+	dht          *DistributedHashTable
+	client       TransportDriver
+	queue        *requestQueue
+	slots        chan struct{}
+	limiter      *rateLimiter
+	quitChannel  chan struct{}
 }
 
 var _ interface {
@@ -123,28 +142,108 @@ func (t *Transport) GetClient() TransportDriver {
 	return t.client
 }
 
+// Stats returns the transport counters.
+func (t *Transport) Stats() TransportStats {
+	return TransportStats{
+		PendingTransactions: t.TransactionLength(),
+		QueueLength:         t.QueueLength(),
+		PacketsIn:           atomic.LoadUint64(&t.packetsIn),
+		PacketsOut:          atomic.LoadUint64(&t.packetsOut),
+		BytesIn:             atomic.LoadUint64(&t.bytesIn),
+		BytesOut:            atomic.LoadUint64(&t.bytesOut),
+	}
+}
+
+// countIn counts a received packet of size bytes.
+func (t *Transport) countIn(size int) {
+	atomic.AddUint64(&t.packetsIn, 1)
+	atomic.AddUint64(&t.bytesIn, uint64(size))
+}
+
+// countOut counts a sent packet of size bytes.
+func (t *Transport) countOut(size int) {
+	atomic.AddUint64(&t.packetsOut, 1)
+	atomic.AddUint64(&t.bytesOut, uint64(size))
+}
+
+// QueueLength returns how many requests are waiting to be sent.
+func (t *Transport) QueueLength() int {
+	return t.queue.Len()
+}
+
 func (t *Transport) Run() {
 
 Run:
 	for {
 		select {
-		case r := <-t.requestChannel:
-			go t.SendRequest(r, RequestRetryTime)
+		case <-t.queue.Signal():
+			for t.queue.Len() > 0 {
+				if !t.acquireSlot() {
+					break Run
+				}
+
+				r := t.queue.Pop()
+				if r == nil {
+					t.releaseSlot()
+					break
+				}
+
+				go func(r *Request) {
+					defer t.releaseSlot()
+					t.SendRequest(r, RequestRetryTime)
+				}(r)
+			}
 		case <-t.quitChannel:
 			break Run
 		}
 	}
-	close(t.requestChannel)
 	close(t.quitChannel)
 }
 
+// acquireSlot blocks until the number of pending requests is below the limit.
+// It returns false if the transport is closed meanwhile.
+func (t *Transport) acquireSlot() bool {
+	if t.slots == nil {
+		return true
+	}
+
+	select {
+	case t.slots <- struct{}{}:
+		return true
+	case <-t.quitChannel:
+		return false
+	}
+}
+
+func (t *Transport) releaseSlot() {
+	if t.slots != nil {
+		<-t.slots
+	}
+}
+
+// Throttle blocks until a packet of size bytes may be sent to addr according
+// to the outgoing rate limits.
+func (t *Transport) Throttle(priority int, addr net.Addr, size int) {
+	t.limiter.Wait(priority, addr.String(), size)
+}
+
+// Allow reports whether a packet of size bytes may be sent to addr now
+// according to the outgoing rate limits, without blocking.
+func (t *Transport) Allow(priority int, addr net.Addr, size int) bool {
+	return t.limiter.Allow(priority, addr.String(), size)
+}
+
 func (t *Transport) SendRequest(request *Request, retry int) {
 	t.client.SendRequest(request, retry)
 }
 
 func (t *Transport) Init(table *DistributedHashTable, client TransportDriver, maxCursor uint64) {
 	t.client = client
-	t.requestChannel = make(chan *Request)
+	t.queue = newRequestQueue(table.RequestQueueSize)
+	if table.MaxPendingRequests > 0 {
+		t.slots = make(chan struct{}, table.MaxPendingRequests)
+	}
+	t.limiter = newRateLimiter(table.MaxPacketsPerSecond, table.MaxBytesPerSecond, table.MaxPacketsPerSecondPerNode)
 	t.quitChannel = make(chan struct{})
 	t.RWMutex = &sync.RWMutex{}
 	t.transactions = NewSyncedMap()
@@ -165,8 +264,23 @@ func (t *Transport) MakeError(id interface{}, remoteAddr net.Addr, tranID interf
 	return t.client.MakeError(id, remoteAddr, tranID, errCode, errMsg)
 }
 
+// Request queues request to be sent. If the queue is full, the request, or a
+// queued one of a lower priority, is dropped and its Callback is called with
+// ErrQueueFull.
 func (t *Transport) Request(request *Request) {
-	t.requestChannel <- request
+	dropped, ok := t.queue.Push(request)
+	if !ok {
+		dropped = request
+	}
+	if dropped == nil {
+		return
+	}
+
+	logrus.Debugf("[Transport].Request queue is full, %s request to %s dropped", dropped.CMD, dropped.RemoteAddr)
+	requestsDroppedTotal.WithLabelValues(methodLabel(dropped.CMD)).Inc()
+	if dropped.Callback != nil {
+		dropped.Callback(nil, ErrQueueFull)
+	}
 }
 
 func (t *Transport) Receive(receiveChannel chan Packet) {
@@ -0,0 +1,147 @@
+package dht
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRequestQueueFull(t *testing.T) {
+	addr := &net.UDPAddr{IP: net.IPv4(93, 184, 0, 1), Port: 6881}
+	tr := &Transport{queue: newRequestQueue(1)}
+
+	errs := make(map[string]error)
+	newRequest := func(cmd string, priority int) *Request {
+		return &Request{
+			CMD:        cmd,
+			RemoteAddr: addr,
+			Priority:   priority,
+			Callback: func(response interface{}, err error) {
+				errs[cmd] = err
+			},
+		}
+	}
+
+	tr.Request(newRequest("refresh", PriorityRefresh))
+	// takes the place of the refresh
+	tr.Request(newRequest("query", PriorityQuery))
+	// nothing of a lower priority to drop
+	tr.Request(newRequest("other", PriorityQuery))
+
+	if errs["refresh"] != ErrQueueFull {
+		t.Errorf("dropped refresh callback err = %v, want ErrQueueFull", errs["refresh"])
+	}
+	if errs["other"] != ErrQueueFull {
+		t.Errorf("rejected query callback err = %v, want ErrQueueFull", errs["other"])
+	}
+	if err, ok := errs["query"]; ok {
+		t.Errorf("queued query callback called with %v", err)
+	}
+	if r := tr.queue.Pop(); r == nil || r.CMD != "query" {
+		t.Errorf("Pop() = %v, want the query", r)
+	}
+}
+
+func TestRateLimiterAllow(t *testing.T) {
+	l := newRateLimiter(1000, 1<<20, 2)
+
+	start := time.Now()
+	for i := 0; i < 2; i++ {
+		if !l.Allow(PriorityResponse, "a", 100) {
+			t.Fatalf("packet %d to a not allowed", i)
+		}
+	}
+	if l.Allow(PriorityResponse, "a", 100) {
+		t.Error("third packet to a allowed above the per node limit")
+	}
+	if !l.Allow(PriorityResponse, "b", 100) {
+		t.Error("packet to b held back by the limit of a")
+	}
+	if time.Since(start) > 100*time.Millisecond {
+		t.Error("Allow blocked")
+	}
+}
+
+func TestRateLimiterResponseReserve(t *testing.T) {
+	l := newRateLimiter(100, 1<<20, 0)
+
+	// the queries take what is left out of the reserve
+	for i := 0; i < 90; i++ {
+		l.Wait(PriorityQuery, "a", 100)
+	}
+	if l.Allow(PriorityQuery, "a", 100) {
+		t.Error("query allowed in the reserve")
+	}
+
+	// more queries wait for the buckets while the responses still go out
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+					l.Wait(PriorityRefresh, "b", 100)
+				}
+			}
+		}()
+	}
+	for i := 0; i < 5; i++ {
+		time.Sleep(20 * time.Millisecond)
+		if !l.Allow(PriorityResponse, "c", 100) {
+			t.Errorf("response %d dropped while queries saturate the limiter", i)
+		}
+	}
+	close(stop)
+	wg.Wait()
+}
+
+// failingConn is a socket on which every write fails.
+type failingConn struct {
+	net.PacketConn
+}
+
+var errWrite = errors.New("write failed")
+
+func (c failingConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	return 0, errWrite
+}
+
+func TestSendRequestError(t *testing.T) {
+	config := newTestConfig(NewMemoryNetwork(), "93.184.0.1:6881")
+	table := NewDHT(config)
+	table.init()
+	defer table.conn.Close()
+
+	node := &Node{ID: RandomNodeID(), Addr: &net.UDPAddr{IP: net.IPv4(93, 184, 0, 2), Port: 6881}, LastActiveTime: time.Now()}
+	if !table.routingTable.Insert(node) {
+		t.Fatal("node not inserted")
+	}
+	events := table.Events().Subscribe(16, EventTransactionTimeout)
+
+	client := &KRPCClient{dht: table, conn: failingConn{table.conn}}
+	request := client.MakeRequest(nil, node.Addr, PingType, map[string]interface{}{"id": table.Self.ID.RawString()})
+	var callbackErr error
+	request.Callback = func(response interface{}, err error) {
+		callbackErr = err
+	}
+	client.SendRequest(request, 2)
+
+	if callbackErr != errWrite {
+		t.Errorf("callback called with %v, want the write error", callbackErr)
+	}
+	if _, ok := table.routingTable.GetNodeByAddress(node.Addr.String()); !ok {
+		t.Error("node evicted on a local send failure")
+	}
+	select {
+	case e := <-events.C:
+		t.Errorf("%v published on a local send failure", e.Type)
+	default:
+	}
+}
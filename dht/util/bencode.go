@@ -3,6 +3,7 @@ package util
 import (
 	"bytes"
 	"errors"
+	"sort"
 	"strconv"
 	"strings"
 	"unicode"
@@ -232,15 +233,19 @@ func EncodeList(data []interface{}) string {
 	return strings.Join([]string{"l", strings.Join(result, ""), "e"}, "")
 }
 
-// EncodeDict encodes a dict value.
+// EncodeDict encodes a dict value, the keys are sorted as bencode requires.
 func EncodeDict(data map[string]interface{}) string {
-	result, i := make([]string, len(data)), 0
+	keys := make([]string, 0, len(data))
+	for key := range data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
 
-	for key, val := range data {
+	result := make([]string, len(keys))
+	for i, key := range keys {
 		result[i] = strings.Join(
-			[]string{EncodeString(key), encodeItem(val)},
+			[]string{EncodeString(key), encodeItem(data[key])},
 			"")
-		i++
 	}
 
 	return strings.Join([]string{"d", strings.Join(result, ""), "e"}, "")
@@ -261,3 +266,46 @@ func Encode(data interface{}) string {
 		panic("invalid type when encode")
 	}
 }
+
+// DecodeRawDict decodes a dict value whose values are kept as the raw
+// bencoded bytes, e.g. to hash the info dict of a torrent exactly as it is.
+func DecodeRawDict(data []byte, start int) (
+	result map[string][]byte, index int, err error) {
+
+	if start >= len(data) || data[start] != 'd' {
+		err = errors.New("invalid dict bencode")
+		return
+	}
+
+	var key interface{}
+	r := make(map[string][]byte)
+
+	index = start + 1
+	for index < len(data) {
+		if data[index] == 'e' {
+			break
+		}
+
+		key, index, err = DecodeString(data, index)
+		if err != nil {
+			return
+		}
+
+		valueStart := index
+		_, index, err = decodeItem(data, index)
+		if err != nil {
+			return
+		}
+
+		r[key.(string)] = data[valueStart:index]
+	}
+
+	if index >= len(data) {
+		err = errors.New("'e' not found when decode dict")
+		return
+	}
+	index++
+
+	result = r
+	return
+}
@@ -0,0 +1,98 @@
+package util
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestEncodeDictKeyOrder(t *testing.T) {
+	tests := []struct {
+		data map[string]interface{}
+		want string
+	}{
+		{
+			map[string]interface{}{},
+			"de",
+		},
+		{
+			map[string]interface{}{"y": "q", "t": "aa", "q": "ping", "a": map[string]interface{}{"id": "abcdefghij0123456789"}},
+			"d1:ad2:id20:abcdefghij0123456789e1:q4:ping1:t2:aa1:y1:qe",
+		},
+		{
+			// raw bytes, not unicode or case folded
+			map[string]interface{}{"b": 1, "a": 2, "B": 3, "ab": 4, "a\x00": 5, "\xff": 6},
+			"d1:Bi3e1:ai2e2:a\x00i5e2:abi4e1:bi1e1:\xffi6ee",
+		},
+		{
+			// BEP 44 signs the encoding of seq and v, salt sorts before them
+			map[string]interface{}{"v": "Hello World!", "seq": 1, "salt": "foobar"},
+			"d4:salt6:foobar3:seqi1e1:v12:Hello World!e",
+		},
+	}
+
+	for _, test := range tests {
+		// map iteration is random, a lucky order must not hide a bug
+		for i := 0; i < 20; i++ {
+			if got := EncodeDict(test.data); got != test.want {
+				t.Fatalf("EncodeDict(%v) = %q, want %q", test.data, got, test.want)
+			}
+		}
+	}
+}
+
+func TestDecode(t *testing.T) {
+	tests := []struct {
+		in   string
+		want interface{}
+		ok   bool
+	}{
+		{"0:", "", true},
+		{"4:spam", "spam", true},
+		{"i42e", 42, true},
+		{"i-3e", -3, true},
+		{"le", []interface{}{}, true},
+		{"l4:spami7ee", []interface{}{"spam", 7}, true},
+		{"de", map[string]interface{}{}, true},
+		{"d3:cow3:moo4:spaml1:a1:bee", map[string]interface{}{"cow": "moo", "spam": []interface{}{"a", "b"}}, true},
+		{"", nil, false},
+		{"5:spam", nil, false},
+		{"-1:", nil, false},
+		{"i12", nil, false},
+		{"ixe", nil, false},
+		{"l4:spam", nil, false},
+		{"d3:cowe", nil, false},
+	}
+
+	for _, test := range tests {
+		got, err := Decode([]byte(test.in))
+		if (err == nil) != test.ok {
+			t.Errorf("Decode(%q) err = %v", test.in, err)
+			continue
+		}
+		if test.ok && !reflect.DeepEqual(got, test.want) {
+			t.Errorf("Decode(%q) = %#v, want %#v", test.in, got, test.want)
+		}
+	}
+}
+
+func TestEncodeDecode(t *testing.T) {
+	values := []interface{}{
+		"",
+		"\x00\xff binary",
+		0,
+		-12345,
+		[]interface{}{"a", 1, []interface{}{}, map[string]interface{}{}},
+		map[string]interface{}{"z": []interface{}{1, 2}, "a": map[string]interface{}{"k": "v"}},
+	}
+
+	for _, value := range values {
+		encoded := Encode(value)
+		decoded, err := Decode([]byte(encoded))
+		if err != nil {
+			t.Fatalf("Decode(%q) err = %v", encoded, err)
+		}
+		if !reflect.DeepEqual(decoded, value) {
+			t.Errorf("Decode(Encode(%#v)) = %#v", value, decoded)
+		}
+	}
+}
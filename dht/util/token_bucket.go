@@ -0,0 +1,99 @@
+package util
+
+import (
+	"sync"
+	"time"
+)
+
+// TokenBucket is a goroutine-safe token bucket. A nil *TokenBucket never
+// limits anything, so callers can use it to represent "unlimited".
+type TokenBucket struct {
+	sync.Mutex
+	rate     float64
+	capacity float64
+	tokens   float64
+	last     time.Time
+}
+
+// NewTokenBucket returns a full bucket refilled with rate tokens per second
+// and holding at most capacity tokens. It returns nil when rate is not
+// positive.
+func NewTokenBucket(rate, capacity float64) *TokenBucket {
+	if rate <= 0 {
+		return nil
+	}
+	if capacity < 1 {
+		capacity = 1
+	}
+
+	return &TokenBucket{
+		rate:     rate,
+		capacity: capacity,
+		tokens:   capacity,
+		last:     time.Now(),
+	}
+}
+
+func (b *TokenBucket) refill(now time.Time) {
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens += elapsed.Seconds() * b.rate
+		if b.tokens > b.capacity {
+			b.tokens = b.capacity
+		}
+	}
+	b.last = now
+}
+
+// Delay returns how long the caller has to wait until n tokens are
+// available. It does not consume anything.
+func (b *TokenBucket) Delay(n float64) time.Duration {
+	if b == nil {
+		return 0
+	}
+
+	b.Lock()
+	defer b.Unlock()
+
+	b.refill(time.Now())
+	if n > b.capacity {
+		n = b.capacity
+	}
+	if b.tokens >= n {
+		return 0
+	}
+
+	return time.Duration((n - b.tokens) / b.rate * float64(time.Second))
+}
+
+// Take consumes n tokens if they are available and reports whether it did.
+func (b *TokenBucket) Take(n float64) bool {
+	if b == nil {
+		return true
+	}
+
+	b.Lock()
+	defer b.Unlock()
+
+	b.refill(time.Now())
+	if n > b.capacity {
+		n = b.capacity
+	}
+	if b.tokens < n {
+		return false
+	}
+
+	b.tokens -= n
+	return true
+}
+
+// Idle returns how long the bucket has not been touched.
+func (b *TokenBucket) Idle() time.Duration {
+	if b == nil {
+		return 0
+	}
+
+	b.Lock()
+	defer b.Unlock()
+
+	return time.Since(b.last)
+}
@@ -8,5 +8,6 @@ require (
 	github.com/jackpal/go-nat-pmp v1.0.1 // indirect
 	github.com/sirupsen/logrus v1.4.2
 	github.com/spf13/cobra v0.0.5
+	github.com/spf13/pflag v1.0.3
 	github.com/spf13/viper v1.5.0
 )
@@ -0,0 +1,61 @@
+package harvest
+
+import (
+	"sync"
+	"time"
+)
+
+// windowSet remembers keys for at least window and at most twice window. It
+// keeps two generations of keys and drops the older one each window.
+type windowSet struct {
+	sync.Mutex
+	window   time.Duration
+	current  map[string]struct{}
+	previous map[string]struct{}
+	rotated  time.Time
+}
+
+func newWindowSet(window time.Duration) *windowSet {
+	return &windowSet{
+		window:   window,
+		current:  make(map[string]struct{}),
+		previous: make(map[string]struct{}),
+		rotated:  time.Now(),
+	}
+}
+
+// Add adds key to the set, it returns false if key has been added within the
+// window. A window of 0 disables de-duplication.
+func (s *windowSet) Add(key string) bool {
+	if s.window <= 0 {
+		return true
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	if now := time.Now(); now.Sub(s.rotated) >= s.window {
+		if now.Sub(s.rotated) >= 2*s.window {
+			s.previous = make(map[string]struct{})
+		} else {
+			s.previous = s.current
+		}
+		s.current = make(map[string]struct{})
+		s.rotated = now
+	}
+
+	if _, ok := s.current[key]; ok {
+		return false
+	}
+	_, seen := s.previous[key]
+	s.current[key] = struct{}{}
+	return !seen
+}
+
+// Len returns the number of keys remembered.
+func (s *windowSet) Len() int {
+	s.Lock()
+	defer s.Unlock()
+
+	return len(s.current) + len(s.previous)
+}
@@ -0,0 +1,175 @@
+package harvest
+
+import (
+	"github.com/johnnyeven/terra/dht"
+	"github.com/sirupsen/logrus"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const flushPeriod = time.Second
+
+// Config is the harvester configuration.
+type Config struct {
+	// how long a seen info_hash is not written again
+	Window time.Duration
+	// the size of the event subscription buffer, events are dropped when it
+	// is full
+	BufferSize int
+	// how often sample_infohashes queries are sent, 0 disables sampling
+	SampleInterval time.Duration
+	// how many nodes are queried each SampleInterval
+	SampleCount int
+	// sends a sample_infohashes query
+	SampleFunc func(node *dht.Node, t *dht.Transport, target []byte)
+	Sinks      []Sink
+}
+
+// GetDefaultConfig returns a Config pointer with default values.
+func GetDefaultConfig() *Config {
+	return &Config{
+		Window:         time.Hour,
+		BufferSize:     4096,
+		SampleInterval: time.Minute,
+		SampleCount:    8,
+	}
+}
+
+// Harvester writes the info_hashes seen by a DHT node to sinks.
+type Harvester struct {
+	// accessed atomically, keep them first for the 64-bit alignment
+	observed   uint64
+	duplicates uint64
+	written    uint64
+	errors     uint64
+
+	table       *dht.DistributedHashTable
+	config      Config
+	seen        *windowSet
+	quitChannel chan struct{}
+	// held while Run is running
+	running   sync.Mutex
+	closeOnce sync.Once
+}
+
+// NewHarvester returns a Harvester pointer of table.
+func NewHarvester(table *dht.DistributedHashTable, config *Config) *Harvester {
+	return &Harvester{
+		table:       table,
+		config:      *config,
+		seen:        newWindowSet(config.Window),
+		quitChannel: make(chan struct{}),
+	}
+}
+
+// Run writes the observed info_hashes until Close is called.
+func (h *Harvester) Run() {
+	h.running.Lock()
+	defer h.running.Unlock()
+
+	sub := h.table.Events().Subscribe(h.config.BufferSize, dht.EventInfoHashObserved)
+	defer sub.Unsubscribe()
+
+	flush := time.NewTicker(flushPeriod)
+	defer flush.Stop()
+
+	var sample <-chan time.Time
+	if h.config.SampleInterval > 0 && h.config.SampleFunc != nil {
+		ticker := time.NewTicker(h.config.SampleInterval)
+		defer ticker.Stop()
+		sample = ticker.C
+	}
+
+	for {
+		select {
+		case event := <-sub.C:
+			h.handle(NewRecord(event))
+		case <-flush.C:
+			h.flush()
+		case <-sample:
+			h.sample()
+		case <-h.quitChannel:
+			return
+		}
+	}
+}
+
+func (h *Harvester) handle(record *Record) {
+	atomic.AddUint64(&h.observed, 1)
+	if !h.seen.Add(record.Key()) {
+		atomic.AddUint64(&h.duplicates, 1)
+		return
+	}
+
+	written := false
+	for _, sink := range h.config.Sinks {
+		if err := sink.Write(record); err != nil {
+			atomic.AddUint64(&h.errors, 1)
+			logrus.Errorf("[Harvester.handle] sink.Write err: %v", err)
+			continue
+		}
+		written = true
+	}
+	if written {
+		atomic.AddUint64(&h.written, 1)
+	}
+}
+
+func (h *Harvester) flush() {
+	for _, sink := range h.config.Sinks {
+		if f, ok := sink.(interface{ Flush() error }); ok {
+			if err := f.Flush(); err != nil {
+				logrus.Errorf("[Harvester.flush] sink.Flush err: %v", err)
+			}
+		}
+	}
+}
+
+// sample sends sample_infohashes queries to the nodes close to a random
+// target.
+func (h *Harvester) sample() {
+	target := dht.RandomNodeID()
+	for _, node := range h.table.GetRoutingTable().GetNeighbors(target, h.config.SampleCount) {
+		h.config.SampleFunc(node, h.table.GetTransport(), target.Bytes())
+	}
+}
+
+// Observed returns how many info_hashes have been observed.
+func (h *Harvester) Observed() uint64 {
+	return atomic.LoadUint64(&h.observed)
+}
+
+// Duplicates returns how many observed info_hashes were seen within the
+// window.
+func (h *Harvester) Duplicates() uint64 {
+	return atomic.LoadUint64(&h.duplicates)
+}
+
+// Written returns how many records have been written to at least one sink.
+func (h *Harvester) Written() uint64 {
+	return atomic.LoadUint64(&h.written)
+}
+
+// Errors returns how many sink writes have failed.
+func (h *Harvester) Errors() uint64 {
+	return atomic.LoadUint64(&h.errors)
+}
+
+// Close stops Run and closes the sinks, the calls after the first one do
+// nothing.
+func (h *Harvester) Close() error {
+	var err error
+	h.closeOnce.Do(func() {
+		close(h.quitChannel)
+		h.running.Lock()
+		defer h.running.Unlock()
+
+		for _, sink := range h.config.Sinks {
+			if e := sink.Close(); e != nil && err == nil {
+				err = e
+			}
+		}
+	})
+	return err
+}
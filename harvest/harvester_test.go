@@ -0,0 +1,98 @@
+package harvest
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"github.com/johnnyeven/terra/dht"
+	"testing"
+	"time"
+)
+
+type failingSink struct{}
+
+func (failingSink) Write(record *Record) error { return errors.New("disk full") }
+func (failingSink) Close() error               { return nil }
+
+func newTestHarvester(sinks ...Sink) *Harvester {
+	config := GetDefaultConfig()
+	config.Sinks = sinks
+	return NewHarvester(nil, config)
+}
+
+func TestHarvesterWritten(t *testing.T) {
+	var buff bytes.Buffer
+	sink := NewJSONSink(&buff)
+	h := newTestHarvester(failingSink{}, sink)
+
+	infoHash := dht.RandomNodeID()
+	h.handle(&Record{InfoHash: infoHash, Method: dht.GetPeersType, Time: time.Now()})
+	h.handle(&Record{InfoHash: infoHash, Method: dht.GetPeersType, Time: time.Now()})
+
+	if h.Observed() != 2 || h.Duplicates() != 1 || h.Written() != 1 || h.Errors() != 1 {
+		t.Errorf("observed %d, duplicates %d, written %d, errors %d, want 2, 1, 1, 1",
+			h.Observed(), h.Duplicates(), h.Written(), h.Errors())
+	}
+
+	// buffered until flushed
+	if buff.Len() != 0 {
+		t.Error("record written before Flush")
+	}
+	h.flush()
+	if buff.Len() == 0 {
+		t.Error("record not written by Flush")
+	}
+}
+
+func TestHarvesterAllSinksFail(t *testing.T) {
+	h := newTestHarvester(failingSink{}, failingSink{})
+	h.handle(&Record{InfoHash: dht.RandomNodeID(), Method: dht.GetPeersType})
+
+	if h.Written() != 0 || h.Errors() != 2 {
+		t.Errorf("written %d, errors %d, want 0, 2", h.Written(), h.Errors())
+	}
+}
+
+// closeSink counts its Close calls.
+type closeSink struct {
+	failingSink
+	closed int
+}
+
+func (s *closeSink) Close() error {
+	s.closed++
+	return nil
+}
+
+func TestHarvesterClose(t *testing.T) {
+	sink := &closeSink{}
+	h := newTestHarvester(sink)
+	for i := 0; i < 2; i++ {
+		if err := h.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if sink.closed != 1 {
+		t.Errorf("sink closed %d times, want 1", sink.closed)
+	}
+}
+
+func TestJSONSink(t *testing.T) {
+	var buff bytes.Buffer
+	sink := NewJSONSink(&buff)
+	record := &Record{InfoHash: dht.RandomNodeID(), Method: dht.AnnouncePeerType, AnnouncedPort: 6881}
+	if err := sink.Write(record); err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	var got Record
+	if err := json.Unmarshal(buff.Bytes(), &got); err != nil {
+		t.Fatalf("%q is not a JSON record: %v", buff.String(), err)
+	}
+	if got.InfoHash != record.InfoHash || got.AnnouncedPort != 6881 {
+		t.Errorf("decoded %+v, want %+v", got, record)
+	}
+}
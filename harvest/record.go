@@ -0,0 +1,44 @@
+package harvest
+
+import (
+	"github.com/johnnyeven/terra/dht"
+	"net"
+	"strconv"
+	"time"
+)
+
+// Record is an info_hash seen in the DHT traffic.
+type Record struct {
+	InfoHash dht.NodeID `json:"infoHash"`
+	// the address of the node which sent the info_hash
+	IP   net.IP `json:"ip"`
+	Port int    `json:"port"`
+	// the port announced in announce_peer
+	AnnouncedPort int       `json:"announcedPort,omitempty"`
+	Method        string    `json:"method"`
+	Time          time.Time `json:"time"`
+}
+
+// NewRecord returns the record of an EventInfoHashObserved event.
+func NewRecord(event dht.Event) *Record {
+	record := &Record{
+		InfoHash:      event.Target,
+		AnnouncedPort: event.Port,
+		Method:        event.Method,
+		Time:          event.Time,
+	}
+	if event.Addr != nil {
+		record.IP = event.Addr.IP
+		record.Port = event.Addr.Port
+	}
+	return record
+}
+
+// Key identifies the record for de-duplication. Announces are told apart by
+// the announcing peer, the other methods only by info_hash.
+func (r *Record) Key() string {
+	if r.Method != dht.AnnouncePeerType {
+		return r.InfoHash.RawString()
+	}
+	return r.InfoHash.RawString() + r.IP.String() + ":" + strconv.Itoa(r.AnnouncedPort)
+}
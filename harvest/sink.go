@@ -0,0 +1,145 @@
+package harvest
+
+import (
+	"bufio"
+	"encoding/json"
+	"github.com/johnnyeven/terra/dht"
+	"github.com/johnnyeven/terra/kv"
+	"github.com/johnnyeven/terra/storage"
+	"io"
+	"os"
+	"sync"
+)
+
+// Sink is where the harvested records are written to.
+type Sink interface {
+	Write(record *Record) error
+	Close() error
+}
+
+// JSONSink writes records as JSON lines.
+type JSONSink struct {
+	sync.Mutex
+	writer  *bufio.Writer
+	encoder *json.Encoder
+	closer  io.Closer
+	// whether each record is flushed as soon as it is written
+	unbuffered bool
+}
+
+// NewJSONSink returns a sink writing JSON lines to w. If w is an io.Closer it
+// is closed by Close.
+func NewJSONSink(w io.Writer) *JSONSink {
+	sink := &JSONSink{writer: bufio.NewWriter(w)}
+	sink.encoder = json.NewEncoder(sink.writer)
+	if closer, ok := w.(io.Closer); ok {
+		sink.closer = closer
+	}
+	return sink
+}
+
+// NewFileSink returns a sink appending JSON lines to the file at path.
+func NewFileSink(path string) (*JSONSink, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return NewJSONSink(f), nil
+}
+
+// NewStdoutSink returns a sink writing JSON lines to the standard output. It
+// is not buffered so that the records show up as they come.
+func NewStdoutSink() *JSONSink {
+	sink := &JSONSink{writer: bufio.NewWriter(os.Stdout), unbuffered: true}
+	sink.encoder = json.NewEncoder(sink.writer)
+	return sink
+}
+
+func (s *JSONSink) Write(record *Record) error {
+	s.Lock()
+	defer s.Unlock()
+
+	if err := s.encoder.Encode(record); err != nil {
+		return err
+	}
+	if s.unbuffered {
+		return s.writer.Flush()
+	}
+	return nil
+}
+
+// Flush writes the buffered records to the underlying writer.
+func (s *JSONSink) Flush() error {
+	s.Lock()
+	defer s.Unlock()
+
+	return s.writer.Flush()
+}
+
+func (s *JSONSink) Close() error {
+	err := s.Flush()
+	if s.closer != nil {
+		if e := s.closer.Close(); err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// KVSink stores records in an embedded key-value store, keyed by
+// Record.Key(). A record replaces the previous one of the same key.
+type KVSink struct {
+	db *kv.DB
+}
+
+// NewKVSink opens or creates the store at path.
+func NewKVSink(path string) (*KVSink, error) {
+	db, err := kv.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return &KVSink{db: db}, nil
+}
+
+// DB returns the underlying store.
+func (s *KVSink) DB() *kv.DB {
+	return s.db
+}
+
+func (s *KVSink) Write(record *Record) error {
+	value, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	return s.db.Put([]byte(record.Key()), value)
+}
+
+func (s *KVSink) Close() error {
+	return s.db.Close()
+}
+
+// StorageSink records the harvested info_hashes and announcing peers in a
+// storage.Store.
+type StorageSink struct {
+	store storage.Store
+}
+
+// NewStorageSink returns a sink writing to store.
+func NewStorageSink(store storage.Store) *StorageSink {
+	return &StorageSink{store: store}
+}
+
+func (s *StorageSink) Write(record *Record) error {
+	if record.Method == dht.AnnouncePeerType && record.AnnouncedPort > 0 {
+		return s.store.AddPeer(record.InfoHash, &dht.Peer{
+			IP:       record.IP,
+			Port:     record.AnnouncedPort,
+			LastSeen: record.Time,
+		})
+	}
+	return s.store.Observe(record.InfoHash, record.Time)
+}
+
+func (s *StorageSink) Close() error {
+	return s.store.Close()
+}
@@ -0,0 +1,525 @@
+// Package kv is an embedded key-value store kept in a single append-only
+// file. The keys are indexed in memory and the values are read from the file
+// on demand, so it does not need any external database.
+package kv
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"os"
+	"sync"
+)
+
+const (
+	opPut    = 1
+	opDelete = 2
+
+	// crc32 and op
+	headerSize = 5
+	// a record can not be larger than this
+	maxRecordSize = 64 << 20
+)
+
+var (
+	ErrNotFound = errors.New("kv: key not found")
+	ErrClosed   = errors.New("kv: database closed")
+	ErrTooLarge = errors.New("kv: record too large")
+	ErrReadOnly = errors.New("kv: database opened read-only")
+	ErrLocked   = errors.New("kv: database locked by another process")
+
+	errCorrupted = errors.New("kv: corrupted record")
+)
+
+// CorruptedError is the error of Open when a record in the middle of the file
+// is corrupted, the records after it would be lost if it was discarded.
+type CorruptedError struct {
+	Path   string
+	Offset int64
+}
+
+func (e *CorruptedError) Error() string {
+	return fmt.Sprintf("kv: %s: corrupted record at offset %d", e.Path, e.Offset)
+}
+
+type entry struct {
+	offset int64
+	length int
+}
+
+// DB is a key-value store. It is safe for concurrent use.
+type DB struct {
+	sync.RWMutex
+	path     string
+	file     *os.File
+	readOnly bool
+	size     int64
+	garbage  int64
+	index    map[string]entry
+	// the keys in ascending order
+	keyList *skipList
+}
+
+// Open opens the database file at path for reading and writing, creating it
+// if needed. The file is locked, it fails with ErrLocked if another process
+// has it open. A torn record at the end of the file, as left by a crash, is
+// discarded, a corrupted one before the end fails with a *CorruptedError.
+func Open(path string) (*DB, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err := lockFile(file); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	db := newDB(path, file)
+	if err := db.load(); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return db, nil
+}
+
+// OpenReadOnly opens the database file at path for reading, while another
+// process may be writing it. It sees the records written before it was
+// opened, up to the first one which can not be read. The file is never
+// modified, the writing methods fail with ErrReadOnly.
+func OpenReadOnly(path string) (*DB, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	db := newDB(path, file)
+	db.readOnly = true
+	if err := db.load(); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return db, nil
+}
+
+func newDB(path string, file *os.File) *DB {
+	return &DB{
+		path:    path,
+		file:    file,
+		index:   make(map[string]entry),
+		keyList: newSkipList(),
+	}
+}
+
+// load rebuilds the index from the file.
+func (db *DB) load() error {
+	info, err := db.file.Stat()
+	if err != nil {
+		return err
+	}
+	if _, err := db.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	reader := bufio.NewReader(db.file)
+
+	var offset int64
+	for {
+		op, key, value, n, err := readRecord(reader)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			if db.readOnly {
+				// the record may be being written
+				break
+			}
+			// a record cut or garbled by a crash can only be the last one
+			if err != io.ErrUnexpectedEOF && n < info.Size()-offset {
+				return &CorruptedError{Path: db.path, Offset: offset}
+			}
+			break
+		}
+
+		valueOffset := offset + n - int64(len(value))
+		db.apply(op, string(key), entry{valueOffset, len(value)}, n)
+		offset += n
+	}
+
+	db.size = offset
+	if db.readOnly || offset == info.Size() {
+		return nil
+	}
+	return db.file.Truncate(offset)
+}
+
+func (db *DB) apply(op byte, key string, e entry, recordSize int64) {
+	if old, ok := db.index[key]; ok {
+		db.garbage += recordOverhead(key, old.length) + int64(old.length)
+	}
+
+	switch op {
+	case opPut:
+		db.index[key] = e
+		db.keyList.Insert(key)
+	case opDelete:
+		delete(db.index, key)
+		db.keyList.Delete(key)
+		db.garbage += recordSize
+	}
+}
+
+func recordOverhead(key string, valueLength int) int64 {
+	return int64(headerSize + uvarintLen(uint64(len(key))) + uvarintLen(uint64(valueLength)) + len(key))
+}
+
+func uvarintLen(x uint64) int {
+	var buf [binary.MaxVarintLen64]byte
+	return binary.PutUvarint(buf[:], x)
+}
+
+// encodeRecord returns crc32 | op | key length | value length | key | value,
+// the crc32 covers everything after itself.
+func encodeRecord(op byte, key, value []byte) []byte {
+	buf := make([]byte, 4, headerSize+2*binary.MaxVarintLen64+len(key)+len(value))
+	buf = append(buf, op)
+
+	var varint [binary.MaxVarintLen64]byte
+	buf = append(buf, varint[:binary.PutUvarint(varint[:], uint64(len(key)))]...)
+	buf = append(buf, varint[:binary.PutUvarint(varint[:], uint64(len(value)))]...)
+	buf = append(buf, key...)
+	buf = append(buf, value...)
+
+	binary.BigEndian.PutUint32(buf, crc32.ChecksumIEEE(buf[4:]))
+	return buf
+}
+
+// readRecord reads the next record, it fails with io.EOF at the end of the
+// file and with io.ErrUnexpectedEOF if the file ends within the record. n is
+// the size of the record as far as its header tells.
+func readRecord(reader *bufio.Reader) (op byte, key, value []byte, n int64, err error) {
+	var header [headerSize]byte
+	if _, err = io.ReadFull(reader, header[:]); err != nil {
+		return
+	}
+	op = header[4]
+	n = headerSize
+
+	counter := &countingReader{reader: reader}
+	defer func() {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+	}()
+	keyLength, err := binary.ReadUvarint(counter)
+	if err != nil {
+		return
+	}
+	valueLength, err := binary.ReadUvarint(counter)
+	n += int64(counter.n)
+	if err != nil {
+		return
+	}
+	if keyLength > maxRecordSize || valueLength > maxRecordSize || keyLength+valueLength > maxRecordSize {
+		if keyLength > math.MaxInt64/4 || valueLength > math.MaxInt64/4 {
+			n = math.MaxInt64
+		} else {
+			n += int64(keyLength + valueLength)
+		}
+		err = ErrTooLarge
+		return
+	}
+	n += int64(keyLength + valueLength)
+
+	data := make([]byte, keyLength+valueLength)
+	if _, err = io.ReadFull(reader, data); err != nil {
+		return
+	}
+
+	crc := crc32.NewIEEE()
+	crc.Write(header[4:])
+	var varint [2 * binary.MaxVarintLen64]byte
+	l := binary.PutUvarint(varint[:], keyLength)
+	l += binary.PutUvarint(varint[l:], valueLength)
+	crc.Write(varint[:l])
+	crc.Write(data)
+	if crc.Sum32() != binary.BigEndian.Uint32(header[:4]) || (op != opPut && op != opDelete) {
+		err = errCorrupted
+		return
+	}
+
+	key, value = data[:keyLength], data[keyLength:]
+	return
+}
+
+type countingReader struct {
+	reader io.ByteReader
+	n      int
+}
+
+func (r *countingReader) ReadByte() (byte, error) {
+	b, err := r.reader.ReadByte()
+	if err == nil {
+		r.n++
+	}
+	return b, err
+}
+
+func (db *DB) write(op byte, key, value []byte) error {
+	if db.file == nil {
+		return ErrClosed
+	}
+	if db.readOnly {
+		return ErrReadOnly
+	}
+	if len(key)+len(value) > maxRecordSize {
+		return ErrTooLarge
+	}
+
+	record := encodeRecord(op, key, value)
+	if _, err := db.file.WriteAt(record, db.size); err != nil {
+		return err
+	}
+
+	valueOffset := db.size + int64(len(record)-len(value))
+	db.apply(op, string(key), entry{valueOffset, len(value)}, int64(len(record)))
+	db.size += int64(len(record))
+	return nil
+}
+
+// Put sets the value of key.
+func (db *DB) Put(key, value []byte) error {
+	db.Lock()
+	defer db.Unlock()
+
+	return db.write(opPut, key, value)
+}
+
+// Delete removes key, it does nothing if key does not exist.
+func (db *DB) Delete(key []byte) error {
+	db.Lock()
+	defer db.Unlock()
+
+	if _, ok := db.index[string(key)]; !ok {
+		return nil
+	}
+	return db.write(opDelete, key, nil)
+}
+
+// Get returns the value of key, or ErrNotFound.
+func (db *DB) Get(key []byte) ([]byte, error) {
+	db.RLock()
+	defer db.RUnlock()
+
+	if db.file == nil {
+		return nil, ErrClosed
+	}
+
+	e, ok := db.index[string(key)]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return db.read(e)
+}
+
+func (db *DB) read(e entry) ([]byte, error) {
+	value := make([]byte, e.length)
+	if _, err := db.file.ReadAt(value, e.offset); err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+// Has reports whether key exists.
+func (db *DB) Has(key []byte) bool {
+	db.RLock()
+	defer db.RUnlock()
+
+	_, ok := db.index[string(key)]
+	return ok
+}
+
+// Len returns the number of keys.
+func (db *DB) Len() int {
+	db.RLock()
+	defer db.RUnlock()
+
+	return len(db.index)
+}
+
+// Keys returns the keys starting with prefix in ascending order.
+func (db *DB) Keys(prefix []byte) [][]byte {
+	db.RLock()
+	defer db.RUnlock()
+
+	return db.keys(prefix)
+}
+
+func (db *DB) keys(prefix []byte) [][]byte {
+	keys := make([][]byte, 0)
+	for node := db.keyList.Seek(string(prefix)); node != nil && bytes.HasPrefix([]byte(node.key), prefix); node = node.next[0] {
+		keys = append(keys, []byte(node.key))
+	}
+	return keys
+}
+
+// KeyRange returns at most limit keys from start included to end excluded,
+// in ascending order. A nil end means no end and a limit of 0 no limit.
+func (db *DB) KeyRange(start, end []byte, limit int) [][]byte {
+	db.RLock()
+	defer db.RUnlock()
+
+	keys := make([][]byte, 0)
+	for node := db.keyList.Seek(string(start)); node != nil; node = node.next[0] {
+		if end != nil && node.key >= string(end) || limit > 0 && len(keys) == limit {
+			break
+		}
+		keys = append(keys, []byte(node.key))
+	}
+	return keys
+}
+
+// Scan calls fn with the keys starting with prefix and their values in
+// ascending order of the keys, until fn returns false. fn must not modify
+// the database.
+func (db *DB) Scan(prefix []byte, fn func(key, value []byte) bool) error {
+	db.RLock()
+	defer db.RUnlock()
+
+	if db.file == nil {
+		return ErrClosed
+	}
+
+	for _, key := range db.keys(prefix) {
+		value, err := db.read(db.index[string(key)])
+		if err != nil {
+			return err
+		}
+		if !fn(key, value) {
+			break
+		}
+	}
+	return nil
+}
+
+// Size returns the size of the file in bytes.
+func (db *DB) Size() int64 {
+	db.RLock()
+	defer db.RUnlock()
+
+	return db.size
+}
+
+// Garbage returns how many bytes of the file are taken by overwritten or
+// deleted records, which Compact gets rid of.
+func (db *DB) Garbage() int64 {
+	db.RLock()
+	defer db.RUnlock()
+
+	return db.garbage
+}
+
+// Compact rewrites the file with the live records only.
+func (db *DB) Compact() error {
+	db.Lock()
+	defer db.Unlock()
+
+	if db.file == nil {
+		return ErrClosed
+	}
+	if db.readOnly {
+		return ErrReadOnly
+	}
+
+	tmpPath := db.path + ".compact"
+	tmp, err := os.OpenFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	// the new file is locked before it takes the place of the old one
+	if err := lockFile(tmp); err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+
+	writer := bufio.NewWriter(tmp)
+	index := make(map[string]entry, len(db.index))
+	var offset int64
+
+	for _, key := range db.keys(nil) {
+		var value []byte
+		value, err = db.read(db.index[string(key)])
+		if err != nil {
+			break
+		}
+
+		record := encodeRecord(opPut, key, value)
+		if _, err = writer.Write(record); err != nil {
+			break
+		}
+		index[string(key)] = entry{offset + int64(len(record)-len(value)), len(value)}
+		offset += int64(len(record))
+	}
+
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, db.path)
+	}
+	if err != nil {
+		tmp.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+
+	db.file.Close()
+	db.file = tmp
+	db.index = index
+	db.size = offset
+	db.garbage = 0
+	return nil
+}
+
+// Sync commits the file to stable storage.
+func (db *DB) Sync() error {
+	db.Lock()
+	defer db.Unlock()
+
+	if db.file == nil {
+		return ErrClosed
+	}
+	if db.readOnly {
+		return nil
+	}
+	return db.file.Sync()
+}
+
+// Close syncs and closes the file.
+func (db *DB) Close() error {
+	db.Lock()
+	defer db.Unlock()
+
+	if db.file == nil {
+		return ErrClosed
+	}
+
+	var err error
+	if !db.readOnly {
+		err = db.file.Sync()
+	}
+	if closeErr := db.file.Close(); err == nil {
+		err = closeErr
+	}
+	db.file = nil
+	return err
+}
@@ -0,0 +1,340 @@
+package kv
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+// tempPath returns the path of a database in a new directory, and a function
+// removing it.
+func tempPath(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "kv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return filepath.Join(dir, "test.db"), func() { os.RemoveAll(dir) }
+}
+
+func openTest(t *testing.T, path string) *DB {
+	db, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func TestDB(t *testing.T) {
+	tests := []struct {
+		name string
+		ops  func(db *DB) error
+		want map[string]string
+	}{
+		{
+			name: "put",
+			ops: func(db *DB) error {
+				return db.Put([]byte("a"), []byte("1"))
+			},
+			want: map[string]string{"a": "1"},
+		},
+		{
+			name: "overwrite",
+			ops: func(db *DB) error {
+				db.Put([]byte("a"), []byte("1"))
+				return db.Put([]byte("a"), []byte("2"))
+			},
+			want: map[string]string{"a": "2"},
+		},
+		{
+			name: "delete",
+			ops: func(db *DB) error {
+				db.Put([]byte("a"), []byte("1"))
+				db.Put([]byte("b"), []byte("2"))
+				return db.Delete([]byte("a"))
+			},
+			want: map[string]string{"b": "2"},
+		},
+		{
+			name: "delete missing",
+			ops: func(db *DB) error {
+				return db.Delete([]byte("a"))
+			},
+			want: map[string]string{},
+		},
+		{
+			name: "empty value",
+			ops: func(db *DB) error {
+				return db.Put([]byte("a"), nil)
+			},
+			want: map[string]string{"a": ""},
+		},
+		{
+			name: "compact",
+			ops: func(db *DB) error {
+				for i := 0; i < 10; i++ {
+					db.Put([]byte("a"), []byte{byte(i)})
+				}
+				db.Put([]byte("b"), []byte("2"))
+				db.Delete([]byte("b"))
+				return db.Compact()
+			},
+			want: map[string]string{"a": "\x09"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path, remove := tempPath(t)
+			defer remove()
+			db := openTest(t, path)
+			if err := test.ops(db); err != nil {
+				t.Fatal(err)
+			}
+			checkDB(t, db, test.want)
+			if err := db.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			// the same after reopening
+			db = openTest(t, path)
+			defer db.Close()
+			checkDB(t, db, test.want)
+		})
+	}
+}
+
+func checkDB(t *testing.T, db *DB, want map[string]string) {
+	t.Helper()
+	if db.Len() != len(want) {
+		t.Errorf("Len() = %d, want %d", db.Len(), len(want))
+	}
+	for key, value := range want {
+		got, err := db.Get([]byte(key))
+		if err != nil {
+			t.Errorf("Get(%q): %v", key, err)
+		} else if string(got) != value {
+			t.Errorf("Get(%q) = %q, want %q", key, got, value)
+		}
+	}
+	if _, err := db.Get([]byte("missing")); err != ErrNotFound {
+		t.Errorf("Get of a missing key returned %v, want ErrNotFound", err)
+	}
+}
+
+func TestKeys(t *testing.T) {
+	path, remove := tempPath(t)
+	defer remove()
+	db := openTest(t, path)
+	defer db.Close()
+
+	keys := []string{"b/2", "a/1", "b/1", "c", "b/3", "a/2", "b"}
+	for _, key := range keys {
+		db.Put([]byte(key), nil)
+	}
+	db.Delete([]byte("b/2"))
+
+	tests := []struct {
+		name string
+		got  [][]byte
+		want []string
+	}{
+		{"all", db.Keys(nil), []string{"a/1", "a/2", "b", "b/1", "b/3", "c"}},
+		{"prefix", db.Keys([]byte("b/")), []string{"b/1", "b/3"}},
+		{"no match", db.Keys([]byte("d")), []string{}},
+		{"range", db.KeyRange([]byte("a/2"), []byte("b/3"), 0), []string{"a/2", "b", "b/1"}},
+		{"range no end", db.KeyRange([]byte("b/0"), nil, 0), []string{"b/1", "b/3", "c"}},
+		{"range limit", db.KeyRange(nil, nil, 2), []string{"a/1", "a/2"}},
+	}
+	for _, test := range tests {
+		got := make([]string, len(test.got))
+		for i, key := range test.got {
+			got[i] = string(key)
+		}
+		if fmt.Sprint(got) != fmt.Sprint(test.want) {
+			t.Errorf("%s: %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestSkipList(t *testing.T) {
+	l := newSkipList()
+	want := make([]string, 0)
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("%d", i*7919%1000)
+		l.Insert(key)
+		l.Insert(key)
+		if i%3 == 0 {
+			l.Delete(key)
+		} else {
+			want = append(want, key)
+		}
+	}
+	sort.Strings(want)
+
+	got := make([]string, 0)
+	for node := l.Seek(""); node != nil; node = node.next[0] {
+		got = append(got, node.key)
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) || l.Len() != len(want) {
+		t.Errorf("%d keys walked, %d counted, want %d in order", len(got), l.Len(), len(want))
+	}
+	for _, key := range []string{"", "5", "50", "9990", "9999"} {
+		node := l.Seek(key)
+		i := sort.SearchStrings(want, key)
+		if i == len(want) && node != nil || i < len(want) && (node == nil || node.key != want[i]) {
+			t.Errorf("Seek(%q) returned %v, want %q", key, node, want[i:])
+		}
+	}
+}
+
+// writeRecords writes the records of puts to a new file at path and returns
+// the offsets of the records.
+func writeRecords(t *testing.T, path string, keys ...string) []int64 {
+	var buff bytes.Buffer
+	offsets := make([]int64, 0, len(keys))
+	for _, key := range keys {
+		offsets = append(offsets, int64(buff.Len()))
+		buff.Write(encodeRecord(opPut, []byte(key), []byte("value of "+key)))
+	}
+	if err := ioutil.WriteFile(path, buff.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return offsets
+}
+
+func TestOpenDamaged(t *testing.T) {
+	tests := []struct {
+		name string
+		// damage modifies the file of records a, b and c
+		damage func(data []byte, offsets []int64) []byte
+		// the keys kept, nil if Open fails with a *CorruptedError
+		want []string
+		// the size of the file after Open
+		size func(data []byte, offsets []int64) int
+	}{
+		{
+			name:   "intact",
+			damage: func(data []byte, offsets []int64) []byte { return data },
+			want:   []string{"a", "b", "c"},
+		},
+		{
+			name:   "torn header",
+			damage: func(data []byte, offsets []int64) []byte { return data[:offsets[2]+3] },
+			want:   []string{"a", "b"},
+			size:   func(data []byte, offsets []int64) int { return int(offsets[2]) },
+		},
+		{
+			name:   "torn value",
+			damage: func(data []byte, offsets []int64) []byte { return data[:len(data)-1] },
+			want:   []string{"a", "b"},
+			size:   func(data []byte, offsets []int64) int { return int(offsets[2]) },
+		},
+		{
+			name: "garbled last record",
+			damage: func(data []byte, offsets []int64) []byte {
+				data[len(data)-1] ^= 0xff
+				return data
+			},
+			want: []string{"a", "b"},
+			size: func(data []byte, offsets []int64) int { return int(offsets[2]) },
+		},
+		{
+			name: "garbled middle record",
+			damage: func(data []byte, offsets []int64) []byte {
+				data[offsets[2]-1] ^= 0xff
+				return data
+			},
+		},
+		{
+			name: "garbled middle length",
+			damage: func(data []byte, offsets []int64) []byte {
+				// a key length within the file
+				data[offsets[1]+headerSize] = 2
+				return data
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path, remove := tempPath(t)
+			defer remove()
+			offsets := writeRecords(t, path, "a", "b", "c")
+			data, _ := ioutil.ReadFile(path)
+			data = test.damage(data, offsets)
+			ioutil.WriteFile(path, data, 0644)
+
+			// a reader stops at the damage and leaves the file as it is
+			readOnly, err := OpenReadOnly(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			readOnly.Close()
+			if info, _ := os.Stat(path); info.Size() != int64(len(data)) {
+				t.Errorf("OpenReadOnly changed the size from %d to %d", len(data), info.Size())
+			}
+
+			db, err := Open(path)
+			if test.want == nil {
+				if _, ok := err.(*CorruptedError); !ok {
+					t.Fatalf("Open returned %v, want a *CorruptedError", err)
+				}
+				if info, _ := os.Stat(path); info.Size() != int64(len(data)) {
+					t.Errorf("corrupted file truncated to %d", info.Size())
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+
+			got := make([]string, 0)
+			for _, key := range db.Keys(nil) {
+				got = append(got, string(key))
+			}
+			if fmt.Sprint(got) != fmt.Sprint(test.want) {
+				t.Errorf("keys %q, want %q", got, test.want)
+			}
+			size := len(data)
+			if test.size != nil {
+				size = test.size(data, offsets)
+			}
+			if db.Size() != int64(size) {
+				t.Errorf("size %d, want %d", db.Size(), size)
+			}
+			if info, _ := os.Stat(path); info.Size() != int64(size) {
+				t.Errorf("file size %d, want %d", info.Size(), size)
+			}
+		})
+	}
+}
+
+func TestOpenReadOnly(t *testing.T) {
+	path, remove := tempPath(t)
+	defer remove()
+	db := openTest(t, path)
+	defer db.Close()
+	db.Put([]byte("a"), []byte("1"))
+
+	// while the writer has it open
+	readOnly, err := OpenReadOnly(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer readOnly.Close()
+
+	if value, err := readOnly.Get([]byte("a")); err != nil || string(value) != "1" {
+		t.Errorf("Get = %q, %v, want 1", value, err)
+	}
+	if err := readOnly.Put([]byte("b"), nil); err != ErrReadOnly {
+		t.Errorf("Put returned %v, want ErrReadOnly", err)
+	}
+	if err := readOnly.Compact(); err != ErrReadOnly {
+		t.Errorf("Compact returned %v, want ErrReadOnly", err)
+	}
+}
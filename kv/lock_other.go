@@ -0,0 +1,13 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package kv
+
+import (
+	"os"
+)
+
+// lockFile does nothing where flock is not available.
+func lockFile(file *os.File) error {
+	return nil
+}
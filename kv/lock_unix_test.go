@@ -0,0 +1,29 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+package kv
+
+import (
+	"testing"
+)
+
+func TestOpenLocked(t *testing.T) {
+	path, remove := tempPath(t)
+	defer remove()
+	db := openTest(t, path)
+	if _, err := Open(path); err != ErrLocked {
+		t.Errorf("second Open returned %v, want ErrLocked", err)
+	}
+
+	// the compacted file is locked too
+	if err := db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(path); err != ErrLocked {
+		t.Errorf("Open after Compact returned %v, want ErrLocked", err)
+	}
+
+	db.Close()
+	db = openTest(t, path)
+	db.Close()
+}
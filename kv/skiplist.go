@@ -0,0 +1,107 @@
+package kv
+
+import (
+	"math/rand"
+)
+
+const (
+	// enough levels for billions of keys
+	maxLevel = 32
+	// one node in four goes up a level
+	levelFactor = 4
+)
+
+// skipList keeps the keys of a DB in ascending order, so that the keys of a
+// prefix or of a range are walked without sorting the others. It is guarded
+// by the lock of the DB.
+type skipList struct {
+	head   slNode
+	level  int
+	length int
+	random *rand.Rand
+}
+
+type slNode struct {
+	key  string
+	next []*slNode
+}
+
+func newSkipList() *skipList {
+	return &skipList{
+		head:   slNode{next: make([]*slNode, maxLevel)},
+		level:  1,
+		random: rand.New(rand.NewSource(rand.Int63())),
+	}
+}
+
+func (l *skipList) randomLevel() int {
+	level := 1
+	for level < maxLevel && l.random.Intn(levelFactor) == 0 {
+		level++
+	}
+	return level
+}
+
+// path fills update with the last node before key at each level.
+func (l *skipList) path(key string, update []*slNode) *slNode {
+	node := &l.head
+	for i := l.level - 1; i >= 0; i-- {
+		for node.next[i] != nil && node.next[i].key < key {
+			node = node.next[i]
+		}
+		if update != nil {
+			update[i] = node
+		}
+	}
+	return node.next[0]
+}
+
+// Insert adds key, it does nothing if key is already there.
+func (l *skipList) Insert(key string) {
+	var update [maxLevel]*slNode
+	if next := l.path(key, update[:]); next != nil && next.key == key {
+		return
+	}
+
+	level := l.randomLevel()
+	for i := l.level; i < level; i++ {
+		update[i] = &l.head
+	}
+	if level > l.level {
+		l.level = level
+	}
+
+	node := &slNode{key: key, next: make([]*slNode, level)}
+	for i := 0; i < level; i++ {
+		node.next[i] = update[i].next[i]
+		update[i].next[i] = node
+	}
+	l.length++
+}
+
+// Delete removes key, it does nothing if key is not there.
+func (l *skipList) Delete(key string) {
+	var update [maxLevel]*slNode
+	node := l.path(key, update[:])
+	if node == nil || node.key != key {
+		return
+	}
+
+	for i := 0; i < len(node.next); i++ {
+		update[i].next[i] = node.next[i]
+	}
+	for l.level > 1 && l.head.next[l.level-1] == nil {
+		l.level--
+	}
+	l.length--
+}
+
+// Seek returns the node of the first key not less than key, nil if there is
+// none. The next keys follow node.next[0].
+func (l *skipList) Seek(key string) *slNode {
+	return l.path(key, nil)
+}
+
+func (l *skipList) Len() int {
+	return l.length
+}
@@ -0,0 +1,376 @@
+// Package metrics implements counters, gauges and histograms exposed in the
+// Prometheus text format, without any dependency.
+package metrics
+
+import (
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultBuckets are the upper bounds of histogram buckets suited to network
+// latencies in seconds.
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+const (
+	counterType   = "counter"
+	gaugeType     = "gauge"
+	histogramType = "histogram"
+)
+
+// desc describes a metric family.
+type desc struct {
+	name       string
+	help       string
+	typ        string
+	labelNames []string
+}
+
+type labelPair struct {
+	name  string
+	value string
+}
+
+// sample is a line of the exposition.
+type sample struct {
+	// appended to the family name, like _bucket
+	suffix string
+	labels []labelPair
+	value  float64
+}
+
+// Collector is a metric family which can be registered.
+type Collector interface {
+	describe() *desc
+	collect() []sample
+}
+
+// value is a float64 updated atomically.
+type value struct {
+	bits uint64
+}
+
+func (v *value) Add(delta float64) {
+	for {
+		old := atomic.LoadUint64(&v.bits)
+		n := math.Float64bits(math.Float64frombits(old) + delta)
+		if atomic.CompareAndSwapUint64(&v.bits, old, n) {
+			return
+		}
+	}
+}
+
+func (v *value) Set(f float64) {
+	atomic.StoreUint64(&v.bits, math.Float64bits(f))
+}
+
+func (v *value) Value() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&v.bits))
+}
+
+// Counter is a value which only goes up.
+type Counter struct {
+	value
+	desc *desc
+}
+
+// NewCounter returns a Counter pointer.
+func NewCounter(name, help string) *Counter {
+	return &Counter{desc: &desc{name: name, help: help, typ: counterType}}
+}
+
+func (c *Counter) Inc() {
+	c.value.Add(1)
+}
+
+// Add adds delta to the counter, negative deltas are ignored.
+func (c *Counter) Add(delta float64) {
+	if delta > 0 {
+		c.value.Add(delta)
+	}
+}
+
+func (c *Counter) describe() *desc {
+	return c.desc
+}
+
+func (c *Counter) collect() []sample {
+	return []sample{{value: c.Value()}}
+}
+
+// Gauge is a value which goes up and down.
+type Gauge struct {
+	value
+	desc *desc
+}
+
+// NewGauge returns a Gauge pointer.
+func NewGauge(name, help string) *Gauge {
+	return &Gauge{desc: &desc{name: name, help: help, typ: gaugeType}}
+}
+
+func (g *Gauge) Inc() {
+	g.Add(1)
+}
+
+func (g *Gauge) Dec() {
+	g.Add(-1)
+}
+
+func (g *Gauge) describe() *desc {
+	return g.desc
+}
+
+func (g *Gauge) collect() []sample {
+	return []sample{{value: g.Value()}}
+}
+
+// GaugeFunc is a gauge whose value is read from a function when collected.
+type GaugeFunc struct {
+	desc *desc
+	fn   func() float64
+}
+
+// NewGaugeFunc returns a GaugeFunc pointer, fn must be safe for concurrent
+// use.
+func NewGaugeFunc(name, help string, fn func() float64) *GaugeFunc {
+	return &GaugeFunc{desc: &desc{name: name, help: help, typ: gaugeType}, fn: fn}
+}
+
+func (g *GaugeFunc) describe() *desc {
+	return g.desc
+}
+
+func (g *GaugeFunc) collect() []sample {
+	return []sample{{value: g.fn()}}
+}
+
+// Histogram counts observations in buckets.
+type Histogram struct {
+	sync.Mutex
+	desc        *desc
+	upperBounds []float64
+	counts      []uint64
+	sum         float64
+	count       uint64
+}
+
+// NewHistogram returns a Histogram pointer with buckets as the upper bounds,
+// DefaultBuckets if nil.
+func NewHistogram(name, help string, buckets []float64) *Histogram {
+	return newHistogram(&desc{name: name, help: help, typ: histogramType}, buckets)
+}
+
+func newHistogram(d *desc, buckets []float64) *Histogram {
+	if buckets == nil {
+		buckets = DefaultBuckets
+	}
+	upperBounds := append([]float64(nil), buckets...)
+	sort.Float64s(upperBounds)
+
+	return &Histogram{
+		desc:        d,
+		upperBounds: upperBounds,
+		counts:      make([]uint64, len(upperBounds)),
+	}
+}
+
+func (h *Histogram) Observe(v float64) {
+	i := sort.SearchFloat64s(h.upperBounds, v)
+
+	h.Lock()
+	defer h.Unlock()
+
+	if i < len(h.counts) {
+		h.counts[i]++
+	}
+	h.sum += v
+	h.count++
+}
+
+// ObserveDuration observes d in seconds.
+func (h *Histogram) ObserveDuration(d time.Duration) {
+	h.Observe(d.Seconds())
+}
+
+func (h *Histogram) describe() *desc {
+	return h.desc
+}
+
+func (h *Histogram) collect() []sample {
+	return h.samples(nil)
+}
+
+// samples returns the cumulative buckets, the sum and the count with labels
+// prepended to the labels of each sample.
+func (h *Histogram) samples(labels []labelPair) []sample {
+	h.Lock()
+	defer h.Unlock()
+
+	samples := make([]sample, 0, len(h.counts)+3)
+	cumulative := uint64(0)
+	for i, upperBound := range h.upperBounds {
+		cumulative += h.counts[i]
+		samples = append(samples, sample{
+			suffix: "_bucket",
+			labels: append(labels[:len(labels):len(labels)], labelPair{"le", formatFloat(upperBound)}),
+			value:  float64(cumulative),
+		})
+	}
+	samples = append(samples,
+		sample{suffix: "_bucket", labels: append(labels[:len(labels):len(labels)], labelPair{"le", "+Inf"}), value: float64(h.count)},
+		sample{suffix: "_sum", labels: labels, value: h.sum},
+		sample{suffix: "_count", labels: labels, value: float64(h.count)},
+	)
+	return samples
+}
+
+// vec holds the children of a metric family by label values.
+type vec struct {
+	sync.RWMutex
+	desc     *desc
+	children map[string]interface{}
+	values   map[string][]string
+	newChild func() interface{}
+}
+
+func newVec(d *desc, newChild func() interface{}) *vec {
+	return &vec{
+		desc:     d,
+		children: make(map[string]interface{}),
+		values:   make(map[string][]string),
+		newChild: newChild,
+	}
+}
+
+// child returns the child of the label values, created if needed. Missing
+// values are empty and extra values are ignored.
+func (v *vec) child(labelValues []string) interface{} {
+	values := make([]string, len(v.desc.labelNames))
+	copy(values, labelValues)
+	key := strings.Join(values, "\xff")
+
+	v.RLock()
+	c, ok := v.children[key]
+	v.RUnlock()
+	if ok {
+		return c
+	}
+
+	v.Lock()
+	defer v.Unlock()
+
+	if c, ok = v.children[key]; !ok {
+		c = v.newChild()
+		v.children[key] = c
+		v.values[key] = values
+	}
+	return c
+}
+
+func (v *vec) describe() *desc {
+	return v.desc
+}
+
+// each calls fn with the labels and the child of each label values, in
+// order of label values.
+func (v *vec) each(fn func(labels []labelPair, child interface{})) {
+	v.RLock()
+	keys := make([]string, 0, len(v.children))
+	for key := range v.children {
+		keys = append(keys, key)
+	}
+	v.RUnlock()
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		v.RLock()
+		child, values := v.children[key], v.values[key]
+		v.RUnlock()
+
+		labels := make([]labelPair, len(values))
+		for i, value := range values {
+			labels[i] = labelPair{v.desc.labelNames[i], value}
+		}
+		fn(labels, child)
+	}
+}
+
+// CounterVec is a family of counters told apart by labels.
+type CounterVec struct {
+	*vec
+}
+
+// NewCounterVec returns a CounterVec pointer.
+func NewCounterVec(name, help string, labelNames ...string) *CounterVec {
+	d := &desc{name: name, help: help, typ: counterType, labelNames: labelNames}
+	return &CounterVec{newVec(d, func() interface{} { return &Counter{desc: d} })}
+}
+
+// WithLabelValues returns the counter of the label values, in the order of
+// the label names.
+func (v *CounterVec) WithLabelValues(labelValues ...string) *Counter {
+	return v.child(labelValues).(*Counter)
+}
+
+func (v *CounterVec) collect() []sample {
+	samples := make([]sample, 0)
+	v.each(func(labels []labelPair, child interface{}) {
+		samples = append(samples, sample{labels: labels, value: child.(*Counter).Value()})
+	})
+	return samples
+}
+
+// GaugeVec is a family of gauges told apart by labels.
+type GaugeVec struct {
+	*vec
+}
+
+// NewGaugeVec returns a GaugeVec pointer.
+func NewGaugeVec(name, help string, labelNames ...string) *GaugeVec {
+	d := &desc{name: name, help: help, typ: gaugeType, labelNames: labelNames}
+	return &GaugeVec{newVec(d, func() interface{} { return &Gauge{desc: d} })}
+}
+
+// WithLabelValues returns the gauge of the label values, in the order of the
+// label names.
+func (v *GaugeVec) WithLabelValues(labelValues ...string) *Gauge {
+	return v.child(labelValues).(*Gauge)
+}
+
+func (v *GaugeVec) collect() []sample {
+	samples := make([]sample, 0)
+	v.each(func(labels []labelPair, child interface{}) {
+		samples = append(samples, sample{labels: labels, value: child.(*Gauge).Value()})
+	})
+	return samples
+}
+
+// HistogramVec is a family of histograms told apart by labels.
+type HistogramVec struct {
+	*vec
+}
+
+// NewHistogramVec returns a HistogramVec pointer, buckets are DefaultBuckets
+// if nil.
+func NewHistogramVec(name, help string, buckets []float64, labelNames ...string) *HistogramVec {
+	d := &desc{name: name, help: help, typ: histogramType, labelNames: labelNames}
+	return &HistogramVec{newVec(d, func() interface{} { return newHistogram(d, buckets) })}
+}
+
+// WithLabelValues returns the histogram of the label values, in the order of
+// the label names.
+func (v *HistogramVec) WithLabelValues(labelValues ...string) *Histogram {
+	return v.child(labelValues).(*Histogram)
+}
+
+func (v *HistogramVec) collect() []sample {
+	samples := make([]sample, 0)
+	v.each(func(labels []labelPair, child interface{}) {
+		samples = append(samples, child.(*Histogram).samples(labels)...)
+	})
+	return samples
+}
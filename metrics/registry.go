@@ -0,0 +1,138 @@
+package metrics
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"math"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ContentType is the content type of the text exposition format.
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+var namePattern = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+
+// DefaultRegistry is the registry of the metrics of the terra packages.
+var DefaultRegistry = NewRegistry()
+
+// Registry is a set of metric families with unique names.
+type Registry struct {
+	sync.RWMutex
+	collectors map[string]Collector
+}
+
+// NewRegistry returns an empty Registry pointer.
+func NewRegistry() *Registry {
+	return &Registry{collectors: make(map[string]Collector)}
+}
+
+// Register adds c to the registry. It fails if the name is invalid or taken.
+func (r *Registry) Register(c Collector) error {
+	d := c.describe()
+	if !namePattern.MatchString(d.name) {
+		return errors.New("invalid metric name: " + d.name)
+	}
+
+	r.Lock()
+	defer r.Unlock()
+
+	if _, ok := r.collectors[d.name]; ok {
+		return errors.New("duplicate metric: " + d.name)
+	}
+	r.collectors[d.name] = c
+	return nil
+}
+
+// MustRegister registers the collectors and panics on error.
+func (r *Registry) MustRegister(collectors ...Collector) {
+	for _, c := range collectors {
+		if err := r.Register(c); err != nil {
+			panic(err)
+		}
+	}
+}
+
+// Unregister removes the metric family of name.
+func (r *Registry) Unregister(name string) {
+	r.Lock()
+	defer r.Unlock()
+
+	delete(r.collectors, name)
+}
+
+// WriteText writes the metrics in the Prometheus text format, in order of
+// name.
+func (r *Registry) WriteText(w io.Writer) error {
+	r.RLock()
+	collectors := make([]Collector, 0, len(r.collectors))
+	for _, c := range r.collectors {
+		collectors = append(collectors, c)
+	}
+	r.RUnlock()
+
+	sort.Slice(collectors, func(i, j int) bool {
+		return collectors[i].describe().name < collectors[j].describe().name
+	})
+
+	buf := bufio.NewWriter(w)
+	for _, c := range collectors {
+		d := c.describe()
+		buf.WriteString("# HELP " + d.name + " " + escapeHelp(d.help) + "\n")
+		buf.WriteString("# TYPE " + d.name + " " + d.typ + "\n")
+
+		for _, s := range c.collect() {
+			buf.WriteString(d.name + s.suffix)
+			if len(s.labels) > 0 {
+				buf.WriteByte('{')
+				for i, label := range s.labels {
+					if i > 0 {
+						buf.WriteByte(',')
+					}
+					buf.WriteString(label.name + `="` + escapeLabelValue(label.value) + `"`)
+				}
+				buf.WriteByte('}')
+			}
+			buf.WriteString(" " + formatFloat(s.value) + "\n")
+		}
+	}
+	return buf.Flush()
+}
+
+// Handler returns an http.Handler serving the metrics.
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", ContentType)
+		r.WriteText(w)
+	})
+}
+
+var (
+	helpReplacer       = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelValueReplacer = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func escapeHelp(s string) string {
+	return helpReplacer.Replace(s)
+}
+
+func escapeLabelValue(s string) string {
+	return labelValueReplacer.Replace(s)
+}
+
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	case math.IsNaN(f):
+		return "NaN"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
@@ -0,0 +1,171 @@
+package metrics
+
+import (
+	"bytes"
+	"math"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWriteText(t *testing.T) {
+	r := NewRegistry()
+
+	requests := NewCounterVec("test_requests_total", "Requests by method\nand code.", "method", "code")
+	requests.WithLabelValues("get", "200").Add(3)
+	requests.WithLabelValues("a\"b\\c\nd", "500").Inc()
+	// missing values are empty
+	requests.WithLabelValues("put").Inc()
+
+	latency := NewHistogram("test_latency_seconds", `Latency, in \seconds.`, []float64{1, 0.5})
+	for _, v := range []float64{0.1, 0.5, 0.7, 3} {
+		latency.Observe(v)
+	}
+
+	temperature := NewGauge("test_temperature", "Temperature.")
+	temperature.Set(-2.5)
+	temperature.Inc()
+
+	sizes := NewHistogramVec("test_size_bytes", "Sizes.", []float64{10}, "kind")
+	sizes.WithLabelValues("b").Observe(20)
+	sizes.WithLabelValues("a").Observe(5)
+
+	r.MustRegister(requests, latency, temperature, sizes,
+		NewGaugeFunc("test_infinity", "Always +Inf.", func() float64 { return math.Inf(1) }))
+	failures := NewCounter("test_errors_total", "Errors.")
+	// a counter does not go down
+	failures.Add(-1)
+	r.MustRegister(failures)
+
+	want := `# HELP test_errors_total Errors.
+# TYPE test_errors_total counter
+test_errors_total 0
+# HELP test_infinity Always +Inf.
+# TYPE test_infinity gauge
+test_infinity +Inf
+# HELP test_latency_seconds Latency, in \\seconds.
+# TYPE test_latency_seconds histogram
+test_latency_seconds_bucket{le="0.5"} 2
+test_latency_seconds_bucket{le="1"} 3
+test_latency_seconds_bucket{le="+Inf"} 4
+test_latency_seconds_sum 4.3
+test_latency_seconds_count 4
+# HELP test_requests_total Requests by method\nand code.
+# TYPE test_requests_total counter
+test_requests_total{method="a\"b\\c\nd",code="500"} 1
+test_requests_total{method="get",code="200"} 3
+test_requests_total{method="put",code=""} 1
+# HELP test_size_bytes Sizes.
+# TYPE test_size_bytes histogram
+test_size_bytes_bucket{kind="a",le="10"} 1
+test_size_bytes_bucket{kind="a",le="+Inf"} 1
+test_size_bytes_sum{kind="a"} 5
+test_size_bytes_count{kind="a"} 1
+test_size_bytes_bucket{kind="b",le="10"} 0
+test_size_bytes_bucket{kind="b",le="+Inf"} 1
+test_size_bytes_sum{kind="b"} 20
+test_size_bytes_count{kind="b"} 1
+# HELP test_temperature Temperature.
+# TYPE test_temperature gauge
+test_temperature -1.5
+`
+
+	var buff bytes.Buffer
+	if err := r.WriteText(&buff); err != nil {
+		t.Fatal(err)
+	}
+	if buff.String() != want {
+		t.Errorf("exposition:\n%s\nwant:\n%s", buff.String(), want)
+	}
+
+	// the handler serves the same
+	recorder := httptest.NewRecorder()
+	r.Handler().ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	if recorder.Header().Get("Content-Type") != ContentType || recorder.Body.String() != want {
+		t.Errorf("handler served %q as %s", recorder.Body.String(), recorder.Header().Get("Content-Type"))
+	}
+
+	r.Unregister("test_temperature")
+	buff.Reset()
+	r.WriteText(&buff)
+	if strings.Contains(buff.String(), "test_temperature") {
+		t.Error("unregistered metric written")
+	}
+}
+
+func TestRegister(t *testing.T) {
+	r := NewRegistry()
+	tests := []struct {
+		name string
+		ok   bool
+	}{
+		{"terra_dht_nodes", true},
+		{"_private:metric_1", true},
+		// taken by the first one
+		{"terra_dht_nodes", false},
+		{"", false},
+		{"1_starts_with_a_digit", false},
+		{"has-dash", false},
+		{"has space", false},
+	}
+	for _, test := range tests {
+		err := r.Register(NewGauge(test.name, ""))
+		if (err == nil) != test.ok {
+			t.Errorf("Register(%q) returned %v", test.name, err)
+		}
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("MustRegister of a duplicate did not panic")
+		}
+	}()
+	r.MustRegister(NewCounter("terra_dht_nodes", ""))
+}
+
+func TestHistogramBuckets(t *testing.T) {
+	h := NewHistogram("test", "", nil)
+	if len(h.upperBounds) != len(DefaultBuckets) {
+		t.Fatalf("%d buckets, want the %d default ones", len(h.upperBounds), len(DefaultBuckets))
+	}
+
+	// an observation on a bound counts in its bucket, the ones above every
+	// bound only in +Inf
+	h = NewHistogram("test", "", []float64{1, 2})
+	for _, v := range []float64{1, 2, 2.5, -1} {
+		h.Observe(v)
+	}
+	samples := h.collect()
+	got := make([]float64, 0)
+	for _, s := range samples {
+		got = append(got, s.value)
+	}
+	want := []float64{2, 3, 4, 4.5, 4}
+	if len(got) != len(want) {
+		t.Fatalf("samples %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("samples %v, want %v", got, want)
+		}
+	}
+}
+
+func TestFormatFloat(t *testing.T) {
+	tests := []struct {
+		f    float64
+		want string
+	}{
+		{0, "0"},
+		{1e21, "1e+21"},
+		{0.25, "0.25"},
+		{math.Inf(1), "+Inf"},
+		{math.Inf(-1), "-Inf"},
+		{math.NaN(), "NaN"},
+	}
+	for _, test := range tests {
+		if s := formatFloat(test.f); s != test.want {
+			t.Errorf("formatFloat(%v) = %s, want %s", test.f, s, test.want)
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package mse
+
+import (
+	"bufio"
+	"crypto/rc4"
+	"github.com/johnnyeven/terra/dht"
+	"net"
+	"sync"
+)
+
+// Conn is a connection after the encryption handshake, what is read and
+// written goes through the selected crypto method.
+type Conn struct {
+	net.Conn
+	reader *bufio.Reader
+	// nil for plaintext
+	encrypt, decrypt *rc4.Cipher
+	crypto           uint32
+	infoHash         dht.NodeID
+	// the initial payload of the initiating side, read first
+	pending []byte
+
+	readMutex  sync.Mutex
+	writeMutex sync.Mutex
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	c.readMutex.Lock()
+	defer c.readMutex.Unlock()
+
+	if len(c.pending) > 0 {
+		n := copy(b, c.pending)
+		c.pending = c.pending[n:]
+		return n, nil
+	}
+
+	n, err := c.reader.Read(b)
+	if c.decrypt != nil {
+		c.decrypt.XORKeyStream(b[:n], b[:n])
+	}
+	return n, err
+}
+
+func (c *Conn) Write(b []byte) (int, error) {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+
+	if c.encrypt == nil {
+		return c.Conn.Write(b)
+	}
+	data := make([]byte, len(b))
+	c.encrypt.XORKeyStream(data, b)
+	return c.Conn.Write(data)
+}
+
+// Crypto returns the selected crypto method, 0 for a connection which
+// skipped the encryption handshake.
+func (c *Conn) Crypto() uint32 {
+	return c.crypto
+}
+
+// InfoHash returns the info_hash the handshake was done for, zero for a
+// connection which skipped it.
+func (c *Conn) InfoHash() dht.NodeID {
+	return c.infoHash
+}
@@ -0,0 +1,269 @@
+package mse
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rc4"
+	"encoding/binary"
+	"github.com/johnnyeven/terra/dht"
+	"io"
+	"net"
+	"time"
+)
+
+// the plaintext BitTorrent handshake starts with it
+const legacyHeader = "\x13BitTorrent protocol"
+
+// Initiate does the handshake of a connection we opened to a peer of
+// infoHash. payload is sent with the handshake, encrypted like the rest of
+// the stream, to save a round trip: it can be the BitTorrent handshake.
+func Initiate(ctx context.Context, conn net.Conn, infoHash dht.NodeID, payload []byte, config *Config) (c *Conn, err error) {
+	if config.Crypto&(CryptoRC4|CryptoPlaintext) == 0 {
+		return nil, ErrNoCrypto
+	}
+	if len(payload) > 0xffff {
+		return nil, ErrBadHandshake
+	}
+	stop := watch(ctx, conn)
+	defer func() {
+		stop()
+		err = contextError(ctx, err)
+	}()
+
+	x, err := newPrivateKey()
+	if err != nil {
+		return nil, err
+	}
+	padA, err := randomPadding(config.Padding)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write(append(publicKey(x), padA...)); err != nil {
+		return nil, err
+	}
+
+	reader := bufio.NewReader(conn)
+	yb := make([]byte, keySize)
+	if _, err := io.ReadFull(reader, yb); err != nil {
+		return nil, err
+	}
+	s, err := sharedSecret(yb, x)
+	if err != nil {
+		return nil, err
+	}
+	skey := infoHash.Bytes()
+	encrypt := newCipher("keyA", s, skey)
+	decrypt := newCipher("keyB", s, skey)
+
+	// VC, crypto_provide, len(PadC), PadC which is empty, len(IA) and IA
+	plain := make([]byte, 16+len(payload))
+	copy(plain, vc)
+	binary.BigEndian.PutUint32(plain[8:], config.Crypto)
+	binary.BigEndian.PutUint16(plain[14:], uint16(len(payload)))
+	copy(plain[16:], payload)
+	encrypt.XORKeyStream(plain, plain)
+
+	message := append(hash([]byte("req1"), s), xor(hash([]byte("req2"), skey), hash([]byte("req3"), s))...)
+	if _, err := conn.Write(append(message, plain...)); err != nil {
+		return nil, err
+	}
+
+	// the answer starts with VC after PadB
+	encryptedVC := make([]byte, len(vc))
+	decrypt.XORKeyStream(encryptedVC, vc)
+	if err := synchronize(reader, encryptedVC, MaxPadding); err != nil {
+		return nil, err
+	}
+	answer := make([]byte, 6)
+	if _, err := io.ReadFull(reader, answer); err != nil {
+		return nil, err
+	}
+	decrypt.XORKeyStream(answer, answer)
+	selected := binary.BigEndian.Uint32(answer)
+	if (selected != CryptoRC4 && selected != CryptoPlaintext) || selected&config.Crypto == 0 {
+		return nil, ErrNoCrypto
+	}
+	if err := skipPadding(reader, decrypt, binary.BigEndian.Uint16(answer[4:])); err != nil {
+		return nil, err
+	}
+
+	c = &Conn{Conn: conn, reader: reader, crypto: selected, infoHash: infoHash}
+	if selected == CryptoRC4 {
+		c.encrypt, c.decrypt = encrypt, decrypt
+	}
+	return c, nil
+}
+
+// Receive does the handshake of a connection opened by a peer of one of
+// infoHashes. The initial payload of the peer is the first data read from
+// the returned Conn. With Config.AllowLegacy a connection which starts with
+// the BitTorrent handshake is let through as it is.
+func Receive(ctx context.Context, conn net.Conn, infoHashes []dht.NodeID, config *Config) (c *Conn, err error) {
+	stop := watch(ctx, conn)
+	defer func() {
+		stop()
+		err = contextError(ctx, err)
+	}()
+
+	reader := bufio.NewReader(conn)
+	if config.AllowLegacy {
+		header, err := reader.Peek(len(legacyHeader))
+		if err != nil {
+			return nil, err
+		}
+		if string(header) == legacyHeader {
+			return &Conn{Conn: conn, reader: reader}, nil
+		}
+	}
+
+	ya := make([]byte, keySize)
+	if _, err := io.ReadFull(reader, ya); err != nil {
+		return nil, err
+	}
+	x, err := newPrivateKey()
+	if err != nil {
+		return nil, err
+	}
+	s, err := sharedSecret(ya, x)
+	if err != nil {
+		return nil, err
+	}
+	padB, err := randomPadding(config.Padding)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write(append(publicKey(x), padB...)); err != nil {
+		return nil, err
+	}
+
+	// HASH('req1', S) comes after PadA, then HASH('req2', SKEY) xor
+	// HASH('req3', S)
+	if err := synchronize(reader, hash([]byte("req1"), s), MaxPadding); err != nil {
+		return nil, err
+	}
+	req2 := make([]byte, 20)
+	if _, err := io.ReadFull(reader, req2); err != nil {
+		return nil, err
+	}
+	req2 = xor(req2, hash([]byte("req3"), s))
+	var infoHash dht.NodeID
+	found := false
+	for _, candidate := range infoHashes {
+		if bytes.Equal(hash([]byte("req2"), candidate.Bytes()), req2) {
+			infoHash, found = candidate, true
+			break
+		}
+	}
+	if !found {
+		return nil, ErrUnknownInfoHash
+	}
+	skey := infoHash.Bytes()
+	decrypt := newCipher("keyA", s, skey)
+	encrypt := newCipher("keyB", s, skey)
+
+	// VC, crypto_provide, len(PadC), PadC, len(IA) and IA
+	offer := make([]byte, 14)
+	if _, err := io.ReadFull(reader, offer); err != nil {
+		return nil, err
+	}
+	decrypt.XORKeyStream(offer, offer)
+	if !bytes.Equal(offer[:8], vc) {
+		return nil, ErrBadHandshake
+	}
+	selected := config.selectCrypto(binary.BigEndian.Uint32(offer[8:]))
+	if selected == 0 {
+		return nil, ErrNoCrypto
+	}
+	if err := skipPadding(reader, decrypt, binary.BigEndian.Uint16(offer[12:])); err != nil {
+		return nil, err
+	}
+	size := make([]byte, 2)
+	if _, err := io.ReadFull(reader, size); err != nil {
+		return nil, err
+	}
+	decrypt.XORKeyStream(size, size)
+	payload := make([]byte, binary.BigEndian.Uint16(size))
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		return nil, err
+	}
+	decrypt.XORKeyStream(payload, payload)
+
+	// VC, crypto_select, len(PadD) and PadD which is empty
+	answer := make([]byte, 14)
+	copy(answer, vc)
+	binary.BigEndian.PutUint32(answer[8:], selected)
+	encrypt.XORKeyStream(answer, answer)
+	if _, err := conn.Write(answer); err != nil {
+		return nil, err
+	}
+
+	c = &Conn{Conn: conn, reader: reader, crypto: selected, infoHash: infoHash, pending: payload}
+	if selected == CryptoRC4 {
+		c.encrypt, c.decrypt = encrypt, decrypt
+	}
+	return c, nil
+}
+
+// synchronize reads until mark, which can come after up to padding bytes.
+func synchronize(reader *bufio.Reader, mark []byte, padding int) error {
+	window := make([]byte, 0, padding+len(mark))
+	for len(window) < cap(window) {
+		b, err := reader.ReadByte()
+		if err != nil {
+			return err
+		}
+		window = append(window, b)
+		if bytes.HasSuffix(window, mark) {
+			return nil
+		}
+	}
+	return ErrNoSync
+}
+
+// skipPadding reads and decrypts a padding of size bytes.
+func skipPadding(reader *bufio.Reader, decrypt *rc4.Cipher, size uint16) error {
+	if size > MaxPadding {
+		return ErrBadHandshake
+	}
+	padding := make([]byte, size)
+	if _, err := io.ReadFull(reader, padding); err != nil {
+		return err
+	}
+	decrypt.XORKeyStream(padding, padding)
+	return nil
+}
+
+func xor(a, b []byte) []byte {
+	c := make([]byte, len(a))
+	for i := range a {
+		c[i] = a[i] ^ b[i]
+	}
+	return c
+}
+
+// watch makes the pending I/O of conn fail once ctx is done, by moving its
+// deadline to the past. It returns the func to stop watching.
+func watch(ctx context.Context, conn net.Conn) func() {
+	if ctx.Done() == nil {
+		return func() {}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Unix(1, 0))
+		case <-done:
+		}
+	}()
+	return func() { close(done) }
+}
+
+// contextError returns the error of ctx instead of err if ctx is done.
+func contextError(ctx context.Context, err error) error {
+	if err != nil && ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
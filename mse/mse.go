@@ -0,0 +1,161 @@
+// Package mse implements the message stream encryption of BitTorrent, also
+// known as protocol encryption: a Diffie-Hellman key exchange hidden behind
+// random padding, after which the peers talk over RC4 or in plaintext. It
+// wraps any net.Conn, the peer wire handshakes are then done on the wrapped
+// connection:
+//
+//	conn, err := mse.Initiate(ctx, tcpConn, infoHash, nil, mse.GetDefaultConfig())
+//	c, err := peer.Connect(ctx, conn, infoHash, peer.GetDefaultConfig())
+//
+// and on the answering side:
+//
+//	conn, err := mse.Receive(ctx, tcpConn, infoHashes, mse.GetDefaultConfig())
+//	c, err := peer.Accept(ctx, conn, peer.GetDefaultConfig(), accept)
+package mse
+
+import (
+	"crypto/rand"
+	"crypto/rc4"
+	"crypto/sha1"
+	"errors"
+	"math/big"
+)
+
+// the crypto methods, as the bits of crypto_provide and crypto_select
+const (
+	CryptoPlaintext uint32 = 0x01
+	CryptoRC4       uint32 = 0x02
+)
+
+const (
+	// the size of a public key and of the shared secret
+	keySize = 96
+	// the size of a private key
+	privateKeySize = 20
+	// the longest padding allowed
+	MaxPadding = 512
+	// the RC4 keystream bytes dropped before use
+	rc4Discard = 1024
+)
+
+var (
+	ErrNoCrypto        = errors.New("mse: no crypto method in common")
+	ErrUnknownInfoHash = errors.New("mse: unknown info_hash")
+	ErrNoSync          = errors.New("mse: handshake not found")
+	ErrBadHandshake    = errors.New("mse: invalid handshake")
+)
+
+var (
+	// the 768 bit prime of the key exchange
+	p, _ = new(big.Int).SetString("FFFFFFFFFFFFFFFFC90FDAA22168C234C4C6628B80DC1CD1"+
+		"29024E088A67CC74020BBEA63B139B22514A08798E3404DD"+
+		"EF9519B3CD3A431B302B0A6DF25F14374FE1356D6D51C245"+
+		"E485B576625E7EC6F44C42E9A63A36210000000000090563", 16)
+	g = big.NewInt(2)
+	// the verification constant, 8 zero bytes
+	vc = make([]byte, 8)
+)
+
+type Config struct {
+	// the crypto methods offered when initiating, and accepted when
+	// receiving
+	Crypto uint32
+	// whether plaintext is selected over RC4 when the other side offers
+	// both, the handshake is still obfuscated
+	PreferPlaintext bool
+	// whether a received connection can start with the BitTorrent
+	// handshake instead of the encryption one
+	AllowLegacy bool
+	// the random padding after the public key is up to this long, no more
+	// than MaxPadding
+	Padding int
+}
+
+// GetDefaultConfig returns a Config pointer which offers and accepts RC4 and
+// plaintext, preferring RC4, and accepts unencrypted connections.
+func GetDefaultConfig() *Config {
+	return &Config{
+		Crypto:      CryptoRC4 | CryptoPlaintext,
+		AllowLegacy: true,
+		Padding:     MaxPadding,
+	}
+}
+
+// selectCrypto returns the method picked among the provided ones.
+func (config *Config) selectCrypto(provided uint32) uint32 {
+	common := provided & config.Crypto
+	switch {
+	case common&CryptoPlaintext != 0 && (config.PreferPlaintext || common&CryptoRC4 == 0):
+		return CryptoPlaintext
+	case common&CryptoRC4 != 0:
+		return CryptoRC4
+	}
+	return 0
+}
+
+// newPrivateKey returns a random private key.
+func newPrivateKey() (*big.Int, error) {
+	b := make([]byte, privateKeySize)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+// publicKey returns the public key of x, padded to keySize bytes.
+func publicKey(x *big.Int) []byte {
+	return pad(new(big.Int).Exp(g, x, p))
+}
+
+// sharedSecret returns S of the public key y of the other side and our
+// private key x.
+func sharedSecret(y []byte, x *big.Int) ([]byte, error) {
+	yInt := new(big.Int).SetBytes(y)
+	// a key of 0, 1 or p - 1 gives away the secret
+	if yInt.Cmp(big.NewInt(1)) <= 0 || yInt.Cmp(new(big.Int).Sub(p, big.NewInt(1))) >= 0 {
+		return nil, ErrBadHandshake
+	}
+	return pad(new(big.Int).Exp(yInt, x, p)), nil
+}
+
+func pad(n *big.Int) []byte {
+	b := make([]byte, keySize)
+	nb := n.Bytes()
+	copy(b[keySize-len(nb):], nb)
+	return b
+}
+
+// hash returns the SHA-1 of the concatenation of parts.
+func hash(parts ...[]byte) []byte {
+	h := sha1.New()
+	for _, part := range parts {
+		h.Write(part)
+	}
+	return h.Sum(nil)
+}
+
+// newCipher returns the RC4 stream of the side named key, "keyA" for the
+// initiating one and "keyB" for the receiving one.
+func newCipher(key string, s, skey []byte) *rc4.Cipher {
+	cipher, _ := rc4.NewCipher(hash([]byte(key), s, skey))
+	discard := make([]byte, rc4Discard)
+	cipher.XORKeyStream(discard, discard)
+	return cipher
+}
+
+// randomPadding returns up to max random bytes.
+func randomPadding(max int) ([]byte, error) {
+	if max <= 0 {
+		return nil, nil
+	}
+	if max > MaxPadding {
+		max = MaxPadding
+	}
+	n, err := rand.Int(rand.Reader, big.NewInt(int64(max)+1))
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, n.Int64())
+	_, err = rand.Read(b)
+	return b, err
+}
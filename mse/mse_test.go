@@ -0,0 +1,358 @@
+package mse
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/hex"
+	"github.com/johnnyeven/terra/dht"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// the keys of the vectors, computed separately from this package
+var (
+	privateA = new(big.Int).SetBytes(bytes.Repeat([]byte{0x11}, privateKeySize))
+	privateB = new(big.Int).SetBytes(bytes.Repeat([]byte{0x22}, privateKeySize))
+	testSKEY = bytes.Repeat([]byte{0xaa}, 20)
+
+	publicA = "3476dc8d123697fcc69e9121618a08514ffa536506df209ce956ad3cf819f76f3fcebc46f4e8be364ec8f1445b9dbf8a9" +
+		"528ca7bfbc89ad13f28137640a2cfd1055d55d5cc6676d18b410e086631309e95fa7b0dae2b8379186b17ad3472c755"
+	publicB = "0816092aa9b6a0bfdd7b86a6bac830dea6c71c4008a1fb53b69dc1c4acd99f8f3cf79d9d9ac411e18b59c0b58146912e5" +
+		"1d0e508d20064b8633a85e20061823d9284b907b2dd0612884e61e9ebb8c9b462eda2f227491a6082bc58d6a1315c39"
+	secret = "ef037082d79ae7baeddb00b3ba4f24ec8a79c06c927258e89e01c46f8249187e672c919b9ff29abeb97fd230f6302fb12" +
+		"1a5bad27c4c34e48722446a121d5e213b13e9eeb6dd23716be80c8a1cf31af29589c5245e74b3b8713d6b229ce05731"
+)
+
+func unhex(t *testing.T, s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestKeyExchange(t *testing.T) {
+	if key := hex.EncodeToString(publicKey(privateA)); key != publicA {
+		t.Errorf("public key A %s, want %s", key, publicA)
+	}
+	if key := hex.EncodeToString(publicKey(privateB)); key != publicB {
+		t.Errorf("public key B %s, want %s", key, publicB)
+	}
+
+	// both sides get the same secret
+	sA, err := sharedSecret(unhex(t, publicB), privateA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sB, err := sharedSecret(unhex(t, publicA), privateB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hex.EncodeToString(sA) != secret || hex.EncodeToString(sB) != secret {
+		t.Errorf("shared secrets %x and %x, want %s", sA, sB, secret)
+	}
+
+	// a key with leading zeros is padded
+	if key := publicKey(big.NewInt(1)); len(key) != keySize || key[keySize-1] != 2 || key[0] != 0 {
+		t.Errorf("public key of 1 is %x", key)
+	}
+
+	weak := [][]byte{
+		make([]byte, keySize),
+		pad(big.NewInt(1)),
+		pad(new(big.Int).Sub(p, big.NewInt(1))),
+		pad(p),
+	}
+	for _, key := range weak {
+		if _, err := sharedSecret(key, privateA); err != ErrBadHandshake {
+			t.Errorf("shared secret of %x returned %v, want ErrBadHandshake", key, err)
+		}
+	}
+}
+
+func TestCipher(t *testing.T) {
+	s := unhex(t, secret)
+	tests := []struct {
+		key string
+		// the keystream after the discarded bytes
+		want string
+	}{
+		{"keyA", "9c4d2fe499f8f0af9c3219454fc94990"},
+		{"keyB", "f27fd82f8ee22362d1dbd7ff78e6c3fe"},
+	}
+	for _, test := range tests {
+		stream := make([]byte, 16)
+		newCipher(test.key, s, testSKEY).XORKeyStream(stream, stream)
+		if hex.EncodeToString(stream) != test.want {
+			t.Errorf("%s keystream %x, want %s", test.key, stream, test.want)
+		}
+	}
+}
+
+func TestHashes(t *testing.T) {
+	s := unhex(t, secret)
+	if req1 := hex.EncodeToString(hash([]byte("req1"), s)); req1 != "32dd7e3b16e8d7a1b444ea3f4167e202514f9feb" {
+		t.Errorf("req1 %s", req1)
+	}
+	req23 := xor(hash([]byte("req2"), testSKEY), hash([]byte("req3"), s))
+	if hex.EncodeToString(req23) != "f770bd1f0311a36eeb8902bcf57d003c1963a435" {
+		t.Errorf("req2 xor req3 %x", req23)
+	}
+}
+
+func TestSynchronize(t *testing.T) {
+	mark := []byte("mark")
+	tests := []struct {
+		padding int
+		err     error
+	}{
+		{0, nil},
+		{MaxPadding, nil},
+		{MaxPadding + 1, ErrNoSync},
+	}
+	for _, test := range tests {
+		data := append(bytes.Repeat([]byte{'m'}, test.padding), mark...)
+		reader := bufio.NewReader(bytes.NewReader(append(data, "rest"...)))
+		if err := synchronize(reader, mark, MaxPadding); err != test.err {
+			t.Errorf("%d bytes of padding: %v, want %v", test.padding, err, test.err)
+			continue
+		}
+		if rest, _ := ioutil.ReadAll(reader); test.err == nil && string(rest) != "rest" {
+			t.Errorf("%d bytes of padding: %q left", test.padding, rest)
+		}
+	}
+
+	// the stream ends first
+	if err := synchronize(bufio.NewReader(strings.NewReader("mar")), mark, MaxPadding); err != io.EOF {
+		t.Errorf("short stream: %v, want io.EOF", err)
+	}
+}
+
+func TestRandomPadding(t *testing.T) {
+	for _, max := range []int{-1, 0, 1, MaxPadding, 2 * MaxPadding} {
+		for i := 0; i < 20; i++ {
+			b, err := randomPadding(max)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(b) > max && len(b) > MaxPadding || max <= 0 && len(b) != 0 {
+				t.Fatalf("%d bytes of padding up to %d", len(b), max)
+			}
+		}
+	}
+}
+
+func tcpPipe(t *testing.T) (net.Conn, net.Conn) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	accepted := make(chan net.Conn)
+	go func() {
+		conn, _ := listener.Accept()
+		accepted <- conn
+	}()
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn, <-accepted
+}
+
+type handshakeResult struct {
+	conn *Conn
+	err  error
+}
+
+// handshake runs Initiate and Receive on the two ends of a connection, the
+// receiving end is closed if it fails.
+func handshake(t *testing.T, infoHash dht.NodeID, payload []byte, initiator *Config, infoHashes []dht.NodeID, receiver *Config) (*Conn, error, *Conn, error) {
+	dialed, accepted := tcpPipe(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	received := make(chan handshakeResult)
+	go func() {
+		c, err := Receive(ctx, accepted, infoHashes, receiver)
+		if err != nil {
+			accepted.Close()
+		}
+		received <- handshakeResult{c, err}
+	}()
+	c, err := Initiate(ctx, dialed, infoHash, payload, initiator)
+	if err != nil {
+		dialed.Close()
+	}
+	result := <-received
+	return c, err, result.conn, result.err
+}
+
+// exchange checks data gets through both ways.
+func exchange(t *testing.T, name string, a, b net.Conn) {
+	done := make(chan error)
+	go func() {
+		_, err := a.Write([]byte("from a"))
+		done <- err
+	}()
+	buff := make([]byte, 6)
+	if _, err := io.ReadFull(b, buff); err != nil || string(buff) != "from a" {
+		t.Errorf("%s: read %q, %v", name, buff, err)
+	}
+	if err := <-done; err != nil {
+		t.Errorf("%s: %v", name, err)
+	}
+
+	go func() {
+		_, err := b.Write([]byte("from b"))
+		done <- err
+	}()
+	if _, err := io.ReadFull(a, buff); err != nil || string(buff) != "from b" {
+		t.Errorf("%s: read %q, %v", name, buff, err)
+	}
+	if err := <-done; err != nil {
+		t.Errorf("%s: %v", name, err)
+	}
+}
+
+func TestHandshake(t *testing.T) {
+	infoHash := dht.RandomNodeID()
+	other := dht.RandomNodeID()
+	config := func(crypto uint32, preferPlaintext bool, padding int) *Config {
+		config := GetDefaultConfig()
+		config.Crypto = crypto
+		config.PreferPlaintext = preferPlaintext
+		config.Padding = padding
+		return config
+	}
+	both := CryptoRC4 | CryptoPlaintext
+
+	tests := []struct {
+		name       string
+		initiator  *Config
+		receiver   *Config
+		infoHashes []dht.NodeID
+		payload    []byte
+		// the selected method, or the error of Receive
+		want uint32
+		err  error
+	}{
+		{"rc4", config(both, false, MaxPadding), config(both, false, MaxPadding), []dht.NodeID{other, infoHash}, []byte("\x13BitTorrent protocol"), CryptoRC4, nil},
+		{"rc4 only", config(CryptoRC4, false, 0), config(both, true, 0), []dht.NodeID{infoHash}, nil, CryptoRC4, nil},
+		{"plaintext", config(both, false, 0), config(both, true, 0), []dht.NodeID{infoHash}, []byte("payload"), CryptoPlaintext, nil},
+		{"plaintext only", config(CryptoPlaintext, false, 0), config(both, false, 0), []dht.NodeID{infoHash}, nil, CryptoPlaintext, nil},
+		{"maximum padding", config(both, false, 2*MaxPadding), config(both, false, 2*MaxPadding), []dht.NodeID{infoHash}, bytes.Repeat([]byte{1}, 0xffff), CryptoRC4, nil},
+		{"no common crypto", config(CryptoRC4, false, 0), config(CryptoPlaintext, false, 0), []dht.NodeID{infoHash}, nil, 0, ErrNoCrypto},
+		{"unknown info_hash", config(both, false, MaxPadding), config(both, false, MaxPadding), []dht.NodeID{other}, nil, 0, ErrUnknownInfoHash},
+	}
+
+	for _, test := range tests {
+		initiated, initiateErr, received, receiveErr := handshake(t, infoHash, test.payload, test.initiator, test.infoHashes, test.receiver)
+		if test.err != nil {
+			if receiveErr != test.err {
+				t.Errorf("%s: Receive returned %v, want %v", test.name, receiveErr, test.err)
+			}
+			// the connection was closed on the initiator
+			if initiateErr == nil {
+				t.Errorf("%s: Initiate succeeded", test.name)
+				initiated.Close()
+			}
+			continue
+		}
+		if initiateErr != nil || receiveErr != nil {
+			t.Errorf("%s: %v, %v", test.name, initiateErr, receiveErr)
+			continue
+		}
+
+		if initiated.Crypto() != test.want || received.Crypto() != test.want {
+			t.Errorf("%s: crypto %d and %d, want %d", test.name, initiated.Crypto(), received.Crypto(), test.want)
+		}
+		if initiated.InfoHash() != infoHash || received.InfoHash() != infoHash {
+			t.Errorf("%s: info_hash %s and %s, want %s", test.name, initiated.InfoHash(), received.InfoHash(), infoHash)
+		}
+		// the payload is read first
+		if len(test.payload) > 0 {
+			payload := make([]byte, len(test.payload))
+			if _, err := io.ReadFull(received, payload); err != nil || !bytes.Equal(payload, test.payload) {
+				t.Errorf("%s: payload %q, %v", test.name, payload, err)
+			}
+		}
+		exchange(t, test.name, initiated, received)
+		initiated.Close()
+		received.Close()
+	}
+}
+
+func TestInitiateErrors(t *testing.T) {
+	conn, _ := tcpPipe(t)
+	defer conn.Close()
+
+	config := GetDefaultConfig()
+	config.Crypto = 0
+	if _, err := Initiate(context.Background(), conn, dht.RandomNodeID(), nil, config); err != ErrNoCrypto {
+		t.Errorf("no crypto method: %v, want ErrNoCrypto", err)
+	}
+	if _, err := Initiate(context.Background(), conn, dht.RandomNodeID(), make([]byte, 0x10000), GetDefaultConfig()); err != ErrBadHandshake {
+		t.Errorf("long payload: %v, want ErrBadHandshake", err)
+	}
+
+	// nobody answers
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := Initiate(ctx, conn, dht.RandomNodeID(), nil, GetDefaultConfig()); err != context.DeadlineExceeded {
+		t.Errorf("no answer: %v, want context.DeadlineExceeded", err)
+	}
+}
+
+func TestLegacy(t *testing.T) {
+	handshake := legacyHeader + strings.Repeat("\x00", 8) + strings.Repeat("h", 40)
+	tests := []struct {
+		name        string
+		allowLegacy bool
+	}{
+		{"allowed", true},
+		{"refused", false},
+	}
+
+	for _, test := range tests {
+		dialed, accepted := tcpPipe(t)
+		sent := handshake
+		if !test.allowLegacy {
+			sent += strings.Repeat("x", keySize+MaxPadding)
+		}
+		go dialed.Write([]byte(sent))
+
+		config := GetDefaultConfig()
+		config.AllowLegacy = test.allowLegacy
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		c, err := Receive(ctx, accepted, []dht.NodeID{dht.RandomNodeID()}, config)
+		if !test.allowLegacy {
+			// taken for a public key and padding, req1 never comes
+			if err != ErrNoSync {
+				t.Errorf("%s: %v, want ErrNoSync", test.name, err)
+			}
+		} else if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		} else {
+			if c.Crypto() != 0 || c.InfoHash() != (dht.NodeID{}) {
+				t.Errorf("%s: crypto %d and info_hash %s", test.name, c.Crypto(), c.InfoHash())
+			}
+			// the handshake is read as it was sent
+			data := make([]byte, len(handshake))
+			if _, err := io.ReadFull(c, data); err != nil || string(data) != handshake {
+				t.Errorf("%s: read %q, %v", test.name, data, err)
+			}
+			exchange(t, test.name, dialed, c)
+		}
+		cancel()
+		dialed.Close()
+		accepted.Close()
+	}
+}
@@ -0,0 +1,422 @@
+package peer
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"github.com/johnnyeven/terra/dht"
+	"net"
+	"sync"
+	"time"
+)
+
+// pendingMessages is how many messages can arrive before the extension
+// handshake of the other side, they are kept for ReadMessage.
+const pendingMessages = 64
+
+var (
+	ErrInfoHashMismatch = errors.New("peer: info_hash mismatch")
+	ErrRejected         = errors.New("peer: info_hash rejected")
+	ErrNotSupported     = errors.New("peer: extension not supported by the peer")
+	ErrClosed           = errors.New("peer: connection closed")
+)
+
+// Dialer opens the connections to the peers, *net.Dialer is one. It can be
+// replaced to go through a proxy or to reach an in-memory peer.
+type Dialer interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+type Config struct {
+	// our peer ID
+	PeerID dht.NodeID
+	// the reserved bits we send besides the extension protocol one
+	Reserved Reserved
+	// the extension handshake we send, the extension protocol is not used
+	// if nil
+	Extended *ExtendedHandshake
+	// how long connecting can take
+	DialTimeout time.Duration
+	// how long the handshakes, extension handshake included, can take
+	HandshakeTimeout time.Duration
+	// how long the other side can stay silent, it should send keepalives
+	ReadTimeout time.Duration
+	// how long writing a message can take
+	WriteTimeout time.Duration
+	// a keepalive is sent if nothing else has been sent for this long, 0
+	// disables them
+	KeepAliveInterval time.Duration
+	// longer messages are rejected
+	MaxMessageLength int
+	// net.Dialer if nil
+	Dialer Dialer
+}
+
+// GetDefaultConfig returns a config with a random peer ID in the Azureus
+// style, the extension protocol enabled without any extension, and the
+// timeouts of most clients.
+func GetDefaultConfig() *Config {
+	config := &Config{
+		Extended: &ExtendedHandshake{
+			M: map[string]int{},
+			V: "terra",
+		},
+		DialTimeout:       10 * time.Second,
+		HandshakeTimeout:  20 * time.Second,
+		ReadTimeout:       3 * time.Minute,
+		WriteTimeout:      30 * time.Second,
+		KeepAliveInterval: 2 * time.Minute,
+		MaxMessageLength:  DefaultMaxMessageLength,
+	}
+	copy(config.PeerID[:], "-TR0001-")
+	rand.Read(config.PeerID[8:])
+	config.Reserved.Set(DHTExtension)
+	return config
+}
+
+// Conn is a connection to a peer on which the handshakes are done. Messages
+// can be read by one goroutine while others write.
+type Conn struct {
+	conn     net.Conn
+	config   *Config
+	infoHash dht.NodeID
+	remote   *Handshake
+	// the extension handshake of the other side, nil if it has not been
+	// received
+	extended      *ExtendedHandshake
+	extendedMutex sync.RWMutex
+	pending       []*Message
+
+	writeMutex  sync.Mutex
+	lastWrite   time.Time
+	closeOnce   sync.Once
+	quitChannel chan struct{}
+}
+
+// Dial connects to the peer at address and does the handshakes for
+// infoHash.
+func Dial(ctx context.Context, address string, infoHash dht.NodeID, config *Config) (*Conn, error) {
+	dialer := config.Dialer
+	if dialer == nil {
+		dialer = &net.Dialer{Timeout: config.DialTimeout}
+	}
+
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	return Connect(ctx, conn, infoHash, config)
+}
+
+// Connect does the handshakes for infoHash on conn, a connection to a peer
+// opened by the caller, such as one wrapped by the encryption of package
+// mse.
+func Connect(ctx context.Context, conn net.Conn, infoHash dht.NodeID, config *Config) (*Conn, error) {
+	c := newConn(conn, config)
+	if err := c.handshake(ctx, &infoHash, nil); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// Accept does the handshakes of an incoming connection, accept tells
+// whether the info_hash asked for is served.
+func Accept(ctx context.Context, conn net.Conn, config *Config, accept func(infoHash dht.NodeID) bool) (*Conn, error) {
+	c := newConn(conn, config)
+	if err := c.handshake(ctx, nil, accept); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func newConn(conn net.Conn, config *Config) *Conn {
+	return &Conn{
+		conn:        conn,
+		config:      config,
+		quitChannel: make(chan struct{}),
+	}
+}
+
+// handshake does the handshakes, for infoHash if it is the dialing side or
+// for what accept takes if it is the accepting one.
+func (c *Conn) handshake(ctx context.Context, infoHash *dht.NodeID, accept func(dht.NodeID) bool) (err error) {
+	stop := c.watch(ctx, c.conn.SetDeadline)
+	defer func() {
+		stop()
+		err = c.contextError(ctx, err)
+	}()
+	if c.config.HandshakeTimeout > 0 {
+		c.conn.SetDeadline(time.Now().Add(c.config.HandshakeTimeout))
+	}
+
+	local := &Handshake{Reserved: c.config.Reserved, PeerID: c.config.PeerID}
+	if c.config.Extended != nil {
+		local.Reserved.Set(ExtensionProtocol)
+	}
+
+	if infoHash != nil {
+		local.InfoHash = *infoHash
+		if err := WriteHandshake(c.conn, local); err != nil {
+			return err
+		}
+	}
+
+	remote, err := ReadHandshake(c.conn)
+	if err != nil {
+		return err
+	}
+	if infoHash != nil && remote.InfoHash != *infoHash {
+		return ErrInfoHashMismatch
+	}
+	if infoHash == nil {
+		if accept != nil && !accept(remote.InfoHash) {
+			return ErrRejected
+		}
+		local.InfoHash = remote.InfoHash
+		if err := WriteHandshake(c.conn, local); err != nil {
+			return err
+		}
+	}
+	if err := ReadPeerID(c.conn, remote); err != nil {
+		return err
+	}
+	c.infoHash = local.InfoHash
+	c.remote = remote
+	c.lastWrite = time.Now()
+
+	if c.config.Extended != nil && remote.Reserved.Has(ExtensionProtocol) {
+		if err := c.exchangeExtended(); err != nil {
+			return err
+		}
+	}
+
+	c.conn.SetDeadline(time.Time{})
+	if c.config.KeepAliveInterval > 0 {
+		go c.keepAlive()
+	}
+	return nil
+}
+
+// exchangeExtended sends our extension handshake and reads messages until
+// the one of the other side, the others are kept for ReadMessage.
+func (c *Conn) exchangeExtended() error {
+	payload, err := c.config.Extended.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	if err := WriteMessage(c.conn, NewExtended(ExtendedHandshakeID, payload)); err != nil {
+		return err
+	}
+
+	for {
+		m, err := ReadMessage(c.conn, c.config.MaxMessageLength)
+		if err != nil {
+			return err
+		}
+		if m == nil {
+			continue
+		}
+		if m.ID == Extended && m.ExtendedID == ExtendedHandshakeID {
+			extended, err := ParseExtendedHandshake(m.Payload)
+			if err != nil {
+				return err
+			}
+			c.setExtended(extended)
+			return nil
+		}
+
+		if len(c.pending) == pendingMessages {
+			return errors.New("peer: no extension handshake")
+		}
+		c.pending = append(c.pending, m)
+	}
+}
+
+// watch makes the pending I/O fail once ctx is done, by moving the deadline
+// set by setDeadline to the past. It returns the func to stop watching.
+func (c *Conn) watch(ctx context.Context, setDeadline func(time.Time) error) func() {
+	if ctx.Done() == nil {
+		return func() {}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			setDeadline(time.Unix(1, 0))
+		case <-done:
+		}
+	}()
+	return func() { close(done) }
+}
+
+// contextError returns the error of ctx instead of err if ctx is done.
+func (c *Conn) contextError(ctx context.Context, err error) error {
+	if err != nil && ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// ReadMessage returns the next message. Keepalives are not returned, they
+// only show that the other side is alive. An extension handshake received
+// after the first one updates Extended and is returned.
+func (c *Conn) ReadMessage(ctx context.Context) (*Message, error) {
+	if len(c.pending) > 0 {
+		m := c.pending[0]
+		c.pending = c.pending[1:]
+		return m, nil
+	}
+
+	stop := c.watch(ctx, c.conn.SetReadDeadline)
+	defer stop()
+
+	for {
+		deadline := time.Time{}
+		if c.config.ReadTimeout > 0 {
+			deadline = time.Now().Add(c.config.ReadTimeout)
+		}
+		c.conn.SetReadDeadline(deadline)
+
+		m, err := ReadMessage(c.conn, c.config.MaxMessageLength)
+		if err != nil {
+			return nil, c.contextError(ctx, err)
+		}
+		if m == nil {
+			continue
+		}
+
+		if m.ID == Extended && m.ExtendedID == ExtendedHandshakeID {
+			if extended, err := ParseExtendedHandshake(m.Payload); err == nil {
+				c.setExtended(extended)
+			}
+		}
+		return m, nil
+	}
+}
+
+// WriteMessage sends m, a nil m is a keepalive.
+func (c *Conn) WriteMessage(ctx context.Context, m *Message) error {
+	data, err := m.MarshalBinary()
+	if err != nil {
+		return err
+	}
+
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+
+	select {
+	case <-c.quitChannel:
+		return ErrClosed
+	default:
+	}
+
+	stop := c.watch(ctx, c.conn.SetWriteDeadline)
+	defer stop()
+
+	deadline := time.Time{}
+	if c.config.WriteTimeout > 0 {
+		deadline = time.Now().Add(c.config.WriteTimeout)
+	}
+	c.conn.SetWriteDeadline(deadline)
+
+	if _, err := c.conn.Write(data); err != nil {
+		return c.contextError(ctx, err)
+	}
+	c.lastWrite = time.Now()
+	return nil
+}
+
+// WriteExtended sends an extended message of the extension name, with the
+// ID the other side gave it in its extension handshake.
+func (c *Conn) WriteExtended(ctx context.Context, name string, payload []byte) error {
+	id, ok := c.ExtensionID(name)
+	if !ok {
+		return ErrNotSupported
+	}
+	return c.WriteMessage(ctx, NewExtended(id, payload))
+}
+
+// ExtensionID returns the extended message ID the other side uses for the
+// extension name.
+func (c *Conn) ExtensionID(name string) (byte, bool) {
+	extended := c.Extended()
+	if extended == nil {
+		return 0, false
+	}
+	id, ok := extended.M[name]
+	return byte(id), ok && id > 0
+}
+
+func (c *Conn) keepAlive() {
+	ticker := time.NewTicker(c.config.KeepAliveInterval / 4)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			c.writeMutex.Lock()
+			idle := time.Since(c.lastWrite)
+			c.writeMutex.Unlock()
+
+			if idle >= c.config.KeepAliveInterval {
+				if err := c.WriteMessage(context.Background(), nil); err != nil {
+					return
+				}
+			}
+		case <-c.quitChannel:
+			return
+		}
+	}
+}
+
+// InfoHash returns the info_hash of the connection.
+func (c *Conn) InfoHash() dht.NodeID {
+	return c.infoHash
+}
+
+// PeerID returns the peer ID of the other side.
+func (c *Conn) PeerID() dht.NodeID {
+	return c.remote.PeerID
+}
+
+// Reserved returns the reserved bits of the other side.
+func (c *Conn) Reserved() Reserved {
+	return c.remote.Reserved
+}
+
+// Extended returns the extension handshake of the other side, or nil if it
+// does not support the extension protocol.
+func (c *Conn) Extended() *ExtendedHandshake {
+	c.extendedMutex.RLock()
+	defer c.extendedMutex.RUnlock()
+
+	return c.extended
+}
+
+func (c *Conn) setExtended(extended *ExtendedHandshake) {
+	c.extendedMutex.Lock()
+	defer c.extendedMutex.Unlock()
+
+	c.extended = extended
+}
+
+func (c *Conn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+// Close closes the connection, it can be called several times.
+func (c *Conn) Close() error {
+	err := ErrClosed
+	c.closeOnce.Do(func() {
+		close(c.quitChannel)
+		err = c.conn.Close()
+	})
+	return err
+}
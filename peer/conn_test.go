@@ -0,0 +1,365 @@
+package peer
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/johnnyeven/terra/dht"
+	"net"
+	"testing"
+	"time"
+)
+
+// tcpPipe returns both ends of a loopback TCP connection. net.Pipe does not
+// buffer, the two sides of a handshake would block each other on it.
+func tcpPipe(t *testing.T) (net.Conn, net.Conn) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	accepted := make(chan net.Conn)
+	go func() {
+		conn, _ := listener.Accept()
+		accepted <- conn
+	}()
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn, <-accepted
+}
+
+func testConfig(peerID string, extended bool) *Config {
+	config := GetDefaultConfig()
+	copy(config.PeerID[:], peerID)
+	config.HandshakeTimeout = 5 * time.Second
+	config.KeepAliveInterval = 0
+	if !extended {
+		config.Extended = nil
+	} else {
+		config.Extended.M["ut_pex"] = 1
+	}
+	return config
+}
+
+// connectPair does the handshakes of both sides, the accepting side serves
+// infoHash only.
+func connectPair(t *testing.T, infoHash, served dht.NodeID, dialConfig, acceptConfig *Config) (*Conn, error, *Conn, error) {
+	dialEnd, acceptEnd := tcpPipe(t)
+
+	type result struct {
+		conn *Conn
+		err  error
+	}
+	accepted := make(chan result)
+	go func() {
+		conn, err := Accept(context.Background(), acceptEnd, acceptConfig, func(id dht.NodeID) bool {
+			return id == served
+		})
+		accepted <- result{conn, err}
+	}()
+
+	dialed, dialErr := Connect(context.Background(), dialEnd, infoHash, dialConfig)
+	r := <-accepted
+	return dialed, dialErr, r.conn, r.err
+}
+
+func TestHandshake(t *testing.T) {
+	infoHash := dht.RandomNodeID()
+	tests := []struct {
+		name                         string
+		dialExtended, acceptExtended bool
+	}{
+		{"both extended", true, true},
+		{"dialer only", true, false},
+		{"acceptor only", false, true},
+		{"neither", false, false},
+	}
+
+	for _, test := range tests {
+		dialed, dialErr, accepted, acceptErr := connectPair(t, infoHash, infoHash,
+			testConfig("dialer", test.dialExtended), testConfig("acceptor", test.acceptExtended))
+		if dialErr != nil || acceptErr != nil {
+			t.Fatalf("%s: %v, %v", test.name, dialErr, acceptErr)
+		}
+
+		if dialed.InfoHash() != infoHash || accepted.InfoHash() != infoHash {
+			t.Errorf("%s: info_hashes %s and %s", test.name, dialed.InfoHash(), accepted.InfoHash())
+		}
+		if !bytes.HasPrefix(dialed.PeerID().Bytes(), []byte("acceptor")) || !bytes.HasPrefix(accepted.PeerID().Bytes(), []byte("dialer")) {
+			t.Errorf("%s: peer IDs %q and %q", test.name, dialed.PeerID().Bytes(), accepted.PeerID().Bytes())
+		}
+		if !dialed.Reserved().Has(DHTExtension) || dialed.Reserved().Has(ExtensionProtocol) != test.acceptExtended {
+			t.Errorf("%s: reserved bits %x", test.name, dialed.Reserved())
+		}
+
+		// the extension handshakes are exchanged if both sides support them
+		both := test.dialExtended && test.acceptExtended
+		for side, conn := range map[string]*Conn{"dialer": dialed, "acceptor": accepted} {
+			if (conn.Extended() != nil) != both {
+				t.Errorf("%s: %s got extension handshake %+v", test.name, side, conn.Extended())
+			}
+			if id, ok := conn.ExtensionID("ut_pex"); ok != both || both && id != 1 {
+				t.Errorf("%s: %s ut_pex ID %d, %v", test.name, side, id, ok)
+			}
+		}
+		if !both {
+			if err := dialed.WriteExtended(context.Background(), "ut_pex", nil); err != ErrNotSupported {
+				t.Errorf("%s: WriteExtended returned %v, want ErrNotSupported", test.name, err)
+			}
+		}
+
+		dialed.Close()
+		accepted.Close()
+	}
+}
+
+func TestHandshakeErrors(t *testing.T) {
+	infoHash := dht.RandomNodeID()
+
+	// the acceptor does not serve the info_hash
+	dialed, dialErr, _, acceptErr := connectPair(t, infoHash, dht.RandomNodeID(), testConfig("dialer", true), testConfig("acceptor", true))
+	if acceptErr != ErrRejected {
+		t.Errorf("Accept returned %v, want ErrRejected", acceptErr)
+	}
+	if dialErr == nil {
+		dialed.Close()
+		t.Error("Connect succeeded on a rejected info_hash")
+	}
+
+	// the other side answers with another info_hash
+	dialEnd, other := tcpPipe(t)
+	defer other.Close()
+	go func() {
+		if _, err := ReadHandshake(other); err == nil {
+			WriteHandshake(other, &Handshake{InfoHash: dht.RandomNodeID()})
+		}
+	}()
+	if _, err := Connect(context.Background(), dialEnd, infoHash, testConfig("dialer", true)); err != ErrInfoHashMismatch {
+		t.Errorf("Connect returned %v, want ErrInfoHashMismatch", err)
+	}
+
+	// not a BitTorrent handshake
+	dialEnd, other = tcpPipe(t)
+	defer other.Close()
+	go other.Write(bytes.Repeat([]byte("HTTP/1.1 400 Bad Request\r\n"), 4))
+	if _, err := Connect(context.Background(), dialEnd, infoHash, testConfig("dialer", true)); err != ErrBadHandshake {
+		t.Errorf("Connect returned %v, want ErrBadHandshake", err)
+	}
+}
+
+func TestMessageFraming(t *testing.T) {
+	tests := []struct {
+		message *Message
+		wire    string
+	}{
+		{nil, "00000000"},
+		{&Message{ID: Choke}, "0000000100"},
+		{&Message{ID: Unchoke}, "0000000101"},
+		{&Message{ID: Interested}, "0000000102"},
+		{&Message{ID: NotInterested}, "0000000103"},
+		{NewHave(0x01020304), "000000050401020304"},
+		{NewBitfield([]byte{0xff, 0x80}), "0000000305ff80"},
+		{NewRequest(1, 0x4000, 0x4000), "0000000d06000000010000400000004000"},
+		{NewPiece(1, 2, []byte("abc")), "0000000c070000000100000002616263"},
+		{NewCancel(1, 0x4000, 0x4000), "0000000d08000000010000400000004000"},
+		{NewPort(6881), "00000003091ae1"},
+		{NewExtended(0, []byte("de")), "0000000414006465"},
+		{NewExtended(3, nil), "000000021403"},
+		{&Message{ID: MessageID(13), Payload: []byte{}}, ""},
+	}
+
+	for _, test := range tests {
+		data, err := test.message.MarshalBinary()
+		if test.wire == "" {
+			if err == nil {
+				t.Errorf("%s marshalled", test.message.ID)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if wire := fmt.Sprintf("%x", data); wire != test.wire {
+			t.Errorf("%v: %s, want %s", test.message, wire, test.wire)
+		}
+
+		m, err := ReadMessage(bytes.NewReader(data), DefaultMaxMessageLength)
+		if err != nil {
+			t.Errorf("%s: %v", test.wire, err)
+			continue
+		}
+		if test.message == nil {
+			if m != nil {
+				t.Errorf("keepalive read as %+v", m)
+			}
+			continue
+		}
+		if m.ID != test.message.ID || m.Index != test.message.Index || m.Begin != test.message.Begin ||
+			m.Length != test.message.Length || m.Port != test.message.Port || m.ExtendedID != test.message.ExtendedID ||
+			!bytes.Equal(m.Payload, test.message.Payload) {
+			t.Errorf("%s read as %+v, want %+v", test.wire, m, test.message)
+		}
+	}
+}
+
+func TestReadMessageErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		wire []byte
+		max  int
+	}{
+		{"choke with a body", []byte{0, 0, 0, 2, 0, 0}, 0},
+		{"short have", []byte{0, 0, 0, 3, 4, 0, 0}, 0},
+		{"short request", []byte{0, 0, 0, 2, 6, 0}, 0},
+		{"short piece", []byte{0, 0, 0, 2, 7, 0}, 0},
+		{"long port", []byte{0, 0, 0, 4, 9, 0, 0, 0}, 0},
+		{"empty extended", []byte{0, 0, 0, 1, 20}, 0},
+		{"too large", []byte{0, 0, 0, 9, 5, 0, 0, 0, 0, 0, 0, 0, 0}, 8},
+		{"truncated", []byte{0, 0, 0, 5, 4, 0}, 0},
+	}
+	for _, test := range tests {
+		if m, err := ReadMessage(bytes.NewReader(test.wire), test.max); err == nil {
+			t.Errorf("%s: read as %+v", test.name, m)
+		}
+	}
+
+	// an unknown message is returned as it is
+	m, err := ReadMessage(bytes.NewReader([]byte{0, 0, 0, 3, 13, 1, 2}), 0)
+	if err != nil || m.ID != 13 || !bytes.Equal(m.Payload, []byte{1, 2}) {
+		t.Errorf("unknown message read as %+v, %v", m, err)
+	}
+}
+
+// rawPeer does the handshakes of a peer on conn by hand, then sends before
+// its extension handshake.
+func rawPeer(t *testing.T, conn net.Conn, before ...*Message) {
+	remote, err := ReadHandshake(conn)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	local := &Handshake{InfoHash: remote.InfoHash}
+	local.Reserved.Set(ExtensionProtocol)
+	WriteHandshake(conn, local)
+	ReadPeerID(conn, remote)
+
+	for _, m := range before {
+		WriteMessage(conn, m)
+	}
+	payload, _ := (&ExtendedHandshake{M: map[string]int{"ut_metadata": 2}}).MarshalBinary()
+	WriteMessage(conn, NewExtended(ExtendedHandshakeID, payload))
+}
+
+func TestExtendedHandshakeQueued(t *testing.T) {
+	dialEnd, other := tcpPipe(t)
+	defer other.Close()
+	before := []*Message{NewBitfield([]byte{0xf0}), nil, NewHave(3), NewPort(6881)}
+	go rawPeer(t, other, before...)
+
+	conn, err := Connect(context.Background(), dialEnd, dht.RandomNodeID(), testConfig("dialer", true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if id, ok := conn.ExtensionID("ut_metadata"); !ok || id != 2 {
+		t.Errorf("ut_metadata ID %d, %v, want 2", id, ok)
+	}
+
+	// the messages sent before the extension handshake come first, without
+	// the keepalive
+	for _, want := range []*Message{before[0], before[2], before[3]} {
+		m, err := conn.ReadMessage(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m.ID != want.ID || m.Index != want.Index || !bytes.Equal(m.Payload, want.Payload) {
+			t.Errorf("read %+v, want %+v", m, want)
+		}
+	}
+
+	// a later extension handshake replaces the first one
+	payload, _ := (&ExtendedHandshake{M: map[string]int{"ut_pex": 5}}).MarshalBinary()
+	WriteMessage(other, nil)
+	WriteMessage(other, NewExtended(ExtendedHandshakeID, payload))
+	m, err := conn.ReadMessage(context.Background())
+	if err != nil || m.ID != Extended {
+		t.Fatalf("read %+v, %v", m, err)
+	}
+	if id, ok := conn.ExtensionID("ut_pex"); !ok || id != 5 {
+		t.Errorf("ut_pex ID %d, %v after the second extension handshake", id, ok)
+	}
+}
+
+func TestKeepAlive(t *testing.T) {
+	dialEnd, other := tcpPipe(t)
+	defer other.Close()
+	go rawPeer(t, other)
+
+	config := testConfig("dialer", true)
+	config.KeepAliveInterval = 40 * time.Millisecond
+	conn, err := Connect(context.Background(), dialEnd, dht.RandomNodeID(), config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// the extension handshake, then keepalives while nothing else is sent
+	other.SetReadDeadline(time.Now().Add(time.Second))
+	if m, err := ReadMessage(other, 0); err != nil || m == nil || m.ID != Extended {
+		t.Fatalf("read %+v, %v, want the extension handshake", m, err)
+	}
+	for i := 0; i < 2; i++ {
+		start := time.Now()
+		m, err := ReadMessage(other, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m != nil {
+			t.Fatalf("read %+v, want a keepalive", m)
+		}
+		if time.Since(start) > 500*time.Millisecond {
+			t.Errorf("keepalive after %s", time.Since(start))
+		}
+	}
+
+	conn.Close()
+	if err := conn.WriteMessage(context.Background(), NewHave(1)); err != ErrClosed {
+		t.Errorf("WriteMessage after Close returned %v, want ErrClosed", err)
+	}
+	if err := conn.Close(); err != ErrClosed {
+		t.Errorf("second Close returned %v, want ErrClosed", err)
+	}
+}
+
+func TestContextCancel(t *testing.T) {
+	// the other side never answers the handshake
+	dialEnd, other := tcpPipe(t)
+	defer other.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := Connect(ctx, dialEnd, dht.RandomNodeID(), testConfig("dialer", true)); err != context.DeadlineExceeded {
+		t.Errorf("Connect returned %v, want context.DeadlineExceeded", err)
+	}
+
+	// the other side sends nothing after the handshakes
+	dialEnd, other = tcpPipe(t)
+	defer other.Close()
+	go rawPeer(t, other)
+	conn, err := Connect(context.Background(), dialEnd, dht.RandomNodeID(), testConfig("dialer", true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	ctx, cancel = context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+	}()
+	if _, err := conn.ReadMessage(ctx); err != context.Canceled {
+		t.Errorf("ReadMessage returned %v, want context.Canceled", err)
+	}
+}
@@ -0,0 +1,107 @@
+package peer
+
+import (
+	"errors"
+	"github.com/johnnyeven/terra/dht/util"
+	"net"
+)
+
+// ExtendedHandshakeID is the extended message ID of the extension handshake.
+const ExtendedHandshakeID = 0
+
+// ExtendedHandshake is the BEP 10 extension handshake.
+type ExtendedHandshake struct {
+	// the extended message IDs of the supported extensions by name, such as
+	// ut_metadata or ut_pex, 0 disables an extension
+	M map[string]int
+	// the client name and version
+	V string
+	// the TCP listen port
+	Port int
+	// the address of the other side as seen by this side
+	YourIP net.IP
+	// how many outstanding requests this side accepts
+	ReqQ int
+	// the size of the info dict, BEP 9
+	MetadataSize int
+	// the other keys of the dict
+	Extra map[string]interface{}
+}
+
+// MarshalBinary returns the bencoded handshake.
+func (h *ExtendedHandshake) MarshalBinary() ([]byte, error) {
+	dict := make(map[string]interface{}, len(h.Extra)+6)
+	for key, value := range h.Extra {
+		dict[key] = value
+	}
+
+	m := make(map[string]interface{}, len(h.M))
+	for name, id := range h.M {
+		m[name] = id
+	}
+	dict["m"] = m
+	if h.V != "" {
+		dict["v"] = h.V
+	}
+	if h.Port > 0 {
+		dict["p"] = h.Port
+	}
+	if h.YourIP != nil {
+		ip := h.YourIP.To4()
+		if ip == nil {
+			ip = h.YourIP.To16()
+		}
+		dict["yourip"] = string(ip)
+	}
+	if h.ReqQ > 0 {
+		dict["reqq"] = h.ReqQ
+	}
+	if h.MetadataSize > 0 {
+		dict["metadata_size"] = h.MetadataSize
+	}
+
+	return []byte(util.Encode(dict)), nil
+}
+
+// ParseExtendedHandshake parses the payload of an extension handshake.
+func ParseExtendedHandshake(payload []byte) (*ExtendedHandshake, error) {
+	decoded, err := util.Decode(payload)
+	if err != nil {
+		return nil, err
+	}
+	dict, ok := decoded.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("peer: extension handshake is not a dict")
+	}
+
+	h := &ExtendedHandshake{
+		M:     make(map[string]int),
+		Extra: make(map[string]interface{}),
+	}
+	for key, value := range dict {
+		switch key {
+		case "m":
+			m, _ := value.(map[string]interface{})
+			for name, id := range m {
+				if n, ok := id.(int); ok && n > 0 && n < 256 {
+					h.M[name] = n
+				}
+			}
+		case "v":
+			h.V, _ = value.(string)
+		case "p":
+			h.Port, _ = value.(int)
+		case "yourip":
+			if ip, ok := value.(string); ok && (len(ip) == net.IPv4len || len(ip) == net.IPv6len) {
+				h.YourIP = net.IP(ip)
+			}
+		case "reqq":
+			h.ReqQ, _ = value.(int)
+		case "metadata_size":
+			h.MetadataSize, _ = value.(int)
+		default:
+			h.Extra[key] = value
+		}
+	}
+	return h, nil
+}
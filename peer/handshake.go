@@ -0,0 +1,93 @@
+// Package peer implements the BitTorrent peer wire protocol of BEP 3 over
+// TCP, with the extension protocol of BEP 10. A Conn does the handshakes and
+// reads and writes the messages, what to do with them is left to its users,
+// such as metadata fetchers and downloaders.
+package peer
+
+import (
+	"bytes"
+	"errors"
+	"github.com/johnnyeven/terra/dht"
+	"io"
+)
+
+const (
+	protocol = "BitTorrent protocol"
+	// 1 byte protocol length, protocol, reserved, info_hash and peer ID
+	handshakeLength = 1 + len(protocol) + 8 + 20 + 20
+)
+
+var ErrBadHandshake = errors.New("peer: invalid handshake")
+
+// Reserved is the reserved bytes of a handshake, its bits tell which
+// extensions a peer supports.
+type Reserved [8]byte
+
+// the bits of the extensions, as [byte index, mask]
+var (
+	// BEP 10
+	ExtensionProtocol = [2]byte{5, 0x10}
+	// BEP 6
+	FastExtension = [2]byte{7, 0x04}
+	// BEP 5, the peer sends its DHT port in a port message
+	DHTExtension = [2]byte{7, 0x01}
+)
+
+// Set sets the bit of extension.
+func (r *Reserved) Set(extension [2]byte) {
+	r[extension[0]] |= extension[1]
+}
+
+// Has reports whether the bit of extension is set.
+func (r Reserved) Has(extension [2]byte) bool {
+	return r[extension[0]]&extension[1] != 0
+}
+
+// Handshake is the first message each side of a connection sends.
+type Handshake struct {
+	Reserved Reserved
+	InfoHash dht.NodeID
+	PeerID   dht.NodeID
+}
+
+// MarshalBinary returns the handshake on the wire.
+func (h *Handshake) MarshalBinary() ([]byte, error) {
+	buf := make([]byte, 0, handshakeLength)
+	buf = append(buf, byte(len(protocol)))
+	buf = append(buf, protocol...)
+	buf = append(buf, h.Reserved[:]...)
+	buf = append(buf, h.InfoHash[:]...)
+	buf = append(buf, h.PeerID[:]...)
+	return buf, nil
+}
+
+// WriteHandshake writes h to w.
+func WriteHandshake(w io.Writer, h *Handshake) error {
+	data, _ := h.MarshalBinary()
+	_, err := w.Write(data)
+	return err
+}
+
+// ReadHandshake reads a handshake from r. The peer ID is read separately by
+// ReadPeerID, so a receiving side can check the info_hash and answer
+// before the peer ID arrives, as some clients wait for it.
+func ReadHandshake(r io.Reader) (*Handshake, error) {
+	buf := make([]byte, handshakeLength-20)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+	if int(buf[0]) != len(protocol) || !bytes.Equal(buf[1:1+len(protocol)], []byte(protocol)) {
+		return nil, ErrBadHandshake
+	}
+
+	h := &Handshake{}
+	copy(h.Reserved[:], buf[1+len(protocol):])
+	copy(h.InfoHash[:], buf[1+len(protocol)+8:])
+	return h, nil
+}
+
+// ReadPeerID reads the peer ID which ends a handshake into h.
+func ReadPeerID(r io.Reader, h *Handshake) error {
+	_, err := io.ReadFull(r, h.PeerID[:])
+	return err
+}
@@ -0,0 +1,219 @@
+package peer
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// MessageID is the type of a message.
+type MessageID byte
+
+const (
+	Choke MessageID = iota
+	Unchoke
+	Interested
+	NotInterested
+	Have
+	Bitfield
+	Request
+	Piece
+	Cancel
+	Port
+
+	// BEP 10
+	Extended MessageID = 20
+)
+
+var messageNames = map[MessageID]string{
+	Choke:         "choke",
+	Unchoke:       "unchoke",
+	Interested:    "interested",
+	NotInterested: "not_interested",
+	Have:          "have",
+	Bitfield:      "bitfield",
+	Request:       "request",
+	Piece:         "piece",
+	Cancel:        "cancel",
+	Port:          "port",
+	Extended:      "extended",
+}
+
+func (id MessageID) String() string {
+	if name, ok := messageNames[id]; ok {
+		return name
+	}
+	return fmt.Sprintf("unknown(%d)", byte(id))
+}
+
+// DefaultMaxMessageLength is large enough for a piece message of a 16 KiB
+// block and for the bitfield of a torrent of 1M pieces.
+const DefaultMaxMessageLength = 1 << 20
+
+var ErrMessageTooLarge = errors.New("peer: message too large")
+
+// Message is a peer wire message. A nil *Message is a keepalive.
+type Message struct {
+	ID MessageID
+	// the piece index of have, request, piece and cancel
+	Index uint32
+	// the offset in the piece of request, piece and cancel
+	Begin uint32
+	// the block length of request and cancel
+	Length uint32
+	// the bitfield, the block of piece, or the payload of extended
+	Payload []byte
+	// the DHT port of port
+	Port uint16
+	// the extended message ID of extended, 0 is the extension handshake
+	ExtendedID byte
+}
+
+func NewHave(index uint32) *Message {
+	return &Message{ID: Have, Index: index}
+}
+
+func NewBitfield(bitfield []byte) *Message {
+	return &Message{ID: Bitfield, Payload: bitfield}
+}
+
+func NewRequest(index, begin, length uint32) *Message {
+	return &Message{ID: Request, Index: index, Begin: begin, Length: length}
+}
+
+func NewPiece(index, begin uint32, block []byte) *Message {
+	return &Message{ID: Piece, Index: index, Begin: begin, Payload: block}
+}
+
+func NewCancel(index, begin, length uint32) *Message {
+	return &Message{ID: Cancel, Index: index, Begin: begin, Length: length}
+}
+
+func NewPort(port uint16) *Message {
+	return &Message{ID: Port, Port: port}
+}
+
+func NewExtended(extendedID byte, payload []byte) *Message {
+	return &Message{ID: Extended, ExtendedID: extendedID, Payload: payload}
+}
+
+// MarshalBinary returns the message on the wire, with its length prefix.
+func (m *Message) MarshalBinary() ([]byte, error) {
+	if m == nil {
+		return make([]byte, 4), nil
+	}
+
+	var body []byte
+	switch m.ID {
+	case Choke, Unchoke, Interested, NotInterested:
+	case Have:
+		body = make([]byte, 4)
+		binary.BigEndian.PutUint32(body, m.Index)
+	case Bitfield:
+		body = m.Payload
+	case Request, Cancel:
+		body = make([]byte, 12)
+		binary.BigEndian.PutUint32(body[0:], m.Index)
+		binary.BigEndian.PutUint32(body[4:], m.Begin)
+		binary.BigEndian.PutUint32(body[8:], m.Length)
+	case Piece:
+		body = make([]byte, 8, 8+len(m.Payload))
+		binary.BigEndian.PutUint32(body[0:], m.Index)
+		binary.BigEndian.PutUint32(body[4:], m.Begin)
+		body = append(body, m.Payload...)
+	case Port:
+		body = make([]byte, 2)
+		binary.BigEndian.PutUint16(body, m.Port)
+	case Extended:
+		body = append([]byte{m.ExtendedID}, m.Payload...)
+	default:
+		return nil, fmt.Errorf("peer: unknown message %s", m.ID)
+	}
+
+	buf := make([]byte, 5, 5+len(body))
+	binary.BigEndian.PutUint32(buf, uint32(1+len(body)))
+	buf[4] = byte(m.ID)
+	return append(buf, body...), nil
+}
+
+// WriteMessage writes m to w, a nil m is a keepalive.
+func WriteMessage(w io.Writer, m *Message) error {
+	data, err := m.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+// ReadMessage reads a message from r, it returns nil for a keepalive.
+// Messages longer than maxLength are rejected. Unknown messages are
+// returned with their body as Payload.
+func ReadMessage(r io.Reader, maxLength int) (*Message, error) {
+	var prefix [4]byte
+	if _, err := io.ReadFull(r, prefix[:]); err != nil {
+		return nil, err
+	}
+	length := binary.BigEndian.Uint32(prefix[:])
+	if length == 0 {
+		return nil, nil
+	}
+	if maxLength > 0 && length > uint32(maxLength) {
+		return nil, ErrMessageTooLarge
+	}
+
+	buf := make([]byte, length)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+
+	m := &Message{ID: MessageID(buf[0])}
+	body := buf[1:]
+	invalid := func() (*Message, error) {
+		return nil, fmt.Errorf("peer: invalid %s message of %d bytes", m.ID, len(body))
+	}
+
+	switch m.ID {
+	case Choke, Unchoke, Interested, NotInterested:
+		if len(body) != 0 {
+			return invalid()
+		}
+	case Have:
+		if len(body) != 4 {
+			return invalid()
+		}
+		m.Index = binary.BigEndian.Uint32(body)
+	case Request, Cancel:
+		if len(body) != 12 {
+			return invalid()
+		}
+		m.Index = binary.BigEndian.Uint32(body[0:])
+		m.Begin = binary.BigEndian.Uint32(body[4:])
+		m.Length = binary.BigEndian.Uint32(body[8:])
+	case Piece:
+		if len(body) < 8 {
+			return invalid()
+		}
+		m.Index = binary.BigEndian.Uint32(body[0:])
+		m.Begin = binary.BigEndian.Uint32(body[4:])
+		m.Payload = body[8:]
+	case Port:
+		if len(body) != 2 {
+			return invalid()
+		}
+		m.Port = binary.BigEndian.Uint16(body)
+	case Extended:
+		if len(body) < 1 {
+			return invalid()
+		}
+		m.ExtendedID = body[0]
+		m.Payload = body[1:]
+	default:
+		m.Payload = body
+	}
+	return m, nil
+}
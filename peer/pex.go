@@ -0,0 +1,243 @@
+package peer
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"github.com/johnnyeven/terra/dht"
+	"github.com/johnnyeven/terra/dht/util"
+	"net"
+	"sync"
+	"time"
+)
+
+// PexExtension is the name of the BEP 11 peer exchange extension.
+const PexExtension = "ut_pex"
+
+const (
+	// a pex message can not be sent more often than this
+	DefaultPexInterval = time.Minute
+	// how many peers a pex message can add and drop
+	MaxPexPeers = 50
+)
+
+// the flags of the added peers
+const (
+	PexEncryption = 0x01
+	PexSeed       = 0x02
+	PexUTP        = 0x04
+	PexHolepunch  = 0x08
+	PexReachable  = 0x10
+)
+
+var (
+	ErrPexTooSoon = errors.New("peer: pex message sent too soon")
+	ErrPexFlood   = errors.New("peer: pex message received too soon")
+)
+
+// PexPeer is a peer of a pex message.
+type PexPeer struct {
+	IP    net.IP
+	Port  int
+	Flags byte
+}
+
+func (p PexPeer) key() string {
+	return util.GenerateAddress(p.IP.String(), p.Port)
+}
+
+// PexMessage is the payload of a ut_pex message, the IPv4 and IPv6 peers are
+// in the same lists.
+type PexMessage struct {
+	Added   []PexPeer
+	Dropped []PexPeer
+}
+
+// MarshalBinary returns the bencoded message.
+func (m *PexMessage) MarshalBinary() ([]byte, error) {
+	added, addedFlags, added6, added6Flags := compactPexPeers(m.Added)
+	dropped, _, dropped6, _ := compactPexPeers(m.Dropped)
+
+	return []byte(util.Encode(map[string]interface{}{
+		"added":    added,
+		"added.f":  addedFlags,
+		"added6":   added6,
+		"added6.f": added6Flags,
+		"dropped":  dropped,
+		"dropped6": dropped6,
+	})), nil
+}
+
+func compactPexPeers(peers []PexPeer) (v4, v4Flags, v6, v6Flags string) {
+	var buf4, flags4, buf6, flags6 []byte
+	for _, peer := range peers {
+		var port [2]byte
+		binary.BigEndian.PutUint16(port[:], uint16(peer.Port))
+		if ip := peer.IP.To4(); ip != nil {
+			buf4 = append(append(buf4, ip...), port[:]...)
+			flags4 = append(flags4, peer.Flags)
+		} else if ip := peer.IP.To16(); ip != nil {
+			buf6 = append(append(buf6, ip...), port[:]...)
+			flags6 = append(flags6, peer.Flags)
+		}
+	}
+	return string(buf4), string(flags4), string(buf6), string(flags6)
+}
+
+// ParsePex parses the payload of a ut_pex message. The flags are 0 if they
+// are missing.
+func ParsePex(payload []byte) (*PexMessage, error) {
+	decoded, err := util.Decode(payload)
+	if err != nil {
+		return nil, err
+	}
+	dict, ok := decoded.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("peer: pex message is not a dict")
+	}
+
+	m := &PexMessage{}
+	for _, family := range []struct {
+		suffix string
+		size   int
+	}{{"", net.IPv4len + 2}, {"6", net.IPv6len + 2}} {
+		added, _ := dict["added"+family.suffix].(string)
+		flags, _ := dict["added"+family.suffix+".f"].(string)
+		dropped, _ := dict["dropped"+family.suffix].(string)
+
+		m.Added = append(m.Added, parsePexPeers(added, flags, family.size)...)
+		m.Dropped = append(m.Dropped, parsePexPeers(dropped, "", family.size)...)
+	}
+	return m, nil
+}
+
+func parsePexPeers(compact, flags string, size int) []PexPeer {
+	peers := make([]PexPeer, 0, len(compact)/size)
+	for i := 0; i+size <= len(compact); i += size {
+		peer := PexPeer{
+			IP:   net.IP(compact[i : i+size-2]),
+			Port: int(binary.BigEndian.Uint16([]byte(compact[i+size-2 : i+size]))),
+		}
+		if len(flags) > i/size {
+			peer.Flags = flags[i/size]
+		}
+		peers = append(peers, peer)
+	}
+	return peers
+}
+
+// Pex runs peer exchange on a connection. The peers it learns are added to
+// a dht.PeerStore, the one the DHT node answers get_peers from, and the
+// messages are limited to one per Interval each way as BEP 11 requires.
+type Pex struct {
+	sync.Mutex
+	conn  *Conn
+	store *dht.PeerStore
+	// the minimum time between two messages
+	Interval time.Duration
+
+	lastSent     time.Time
+	lastReceived time.Time
+	// the peers the other side has been told about
+	sent map[string]PexPeer
+}
+
+// NewPex returns the peer exchange of conn, whose config must have the
+// ut_pex extension in its extension handshake. store can be nil.
+func NewPex(conn *Conn, store *dht.PeerStore) *Pex {
+	return &Pex{
+		conn:     conn,
+		store:    store,
+		Interval: DefaultPexInterval,
+		sent:     make(map[string]PexPeer),
+	}
+}
+
+// Handle handles m if it is a pex message, and returns it. It fails with
+// ErrPexFlood if the other side sends messages too often, the message is
+// then ignored.
+func (p *Pex) Handle(m *Message) (*PexMessage, error) {
+	if m == nil || m.ID != Extended || p.conn.config.Extended == nil {
+		return nil, nil
+	}
+	if id, ok := p.conn.config.Extended.M[PexExtension]; !ok || id <= 0 || byte(id) != m.ExtendedID {
+		return nil, nil
+	}
+
+	p.Lock()
+	now := time.Now()
+	if !p.lastReceived.IsZero() && now.Sub(p.lastReceived) < p.Interval {
+		p.Unlock()
+		return nil, ErrPexFlood
+	}
+	p.lastReceived = now
+	p.Unlock()
+
+	pex, err := ParsePex(m.Payload)
+	if err != nil {
+		return nil, err
+	}
+	if len(pex.Added) > MaxPexPeers {
+		pex.Added = pex.Added[:MaxPexPeers]
+	}
+	if len(pex.Dropped) > MaxPexPeers {
+		pex.Dropped = pex.Dropped[:MaxPexPeers]
+	}
+
+	if p.store != nil {
+		for _, peer := range pex.Added {
+			if peer.Port <= 0 || peer.IP.IsUnspecified() {
+				continue
+			}
+			p.store.Add(p.conn.InfoHash(), &dht.Peer{IP: peer.IP, Port: peer.Port, LastSeen: now, Seed: peer.Flags&PexSeed != 0})
+		}
+	}
+	return pex, nil
+}
+
+// Send tells the other side about the change from the peers of the last
+// message to peers, it fails with ErrPexTooSoon if the last message was
+// sent less than Interval ago. At most MaxPexPeers are added and dropped,
+// the others are left to the next message.
+func (p *Pex) Send(ctx context.Context, peers []PexPeer) error {
+	p.Lock()
+	defer p.Unlock()
+
+	if !p.lastSent.IsZero() && time.Since(p.lastSent) < p.Interval {
+		return ErrPexTooSoon
+	}
+
+	current := make(map[string]PexPeer, len(peers))
+	for _, peer := range peers {
+		current[peer.key()] = peer
+	}
+
+	m := &PexMessage{}
+	for key, peer := range current {
+		if _, ok := p.sent[key]; !ok && len(m.Added) < MaxPexPeers {
+			m.Added = append(m.Added, peer)
+		}
+	}
+	for key, peer := range p.sent {
+		if _, ok := current[key]; !ok && len(m.Dropped) < MaxPexPeers {
+			m.Dropped = append(m.Dropped, peer)
+		}
+	}
+	if len(m.Added) == 0 && len(m.Dropped) == 0 {
+		return nil
+	}
+
+	payload, _ := m.MarshalBinary()
+	if err := p.conn.WriteExtended(ctx, PexExtension, payload); err != nil {
+		return err
+	}
+
+	for _, peer := range m.Added {
+		p.sent[peer.key()] = peer
+	}
+	for _, peer := range m.Dropped {
+		delete(p.sent, peer.key())
+	}
+	p.lastSent = time.Now()
+	return nil
+}
@@ -0,0 +1,243 @@
+package peer
+
+import (
+	"context"
+	"fmt"
+	"github.com/johnnyeven/terra/dht"
+	"net"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestPexMessage(t *testing.T) {
+	tests := []struct {
+		name    string
+		message *PexMessage
+		wire    string
+	}{
+		{
+			name:    "empty",
+			message: &PexMessage{},
+			wire:    "d5:added0:7:added.f0:6:added60:8:added6.f0:7:dropped0:8:dropped60:e",
+		},
+		{
+			name: "ipv4",
+			message: &PexMessage{
+				Added:   []PexPeer{{net.IPv4(1, 2, 3, 4), 6881, PexSeed | PexUTP}, {net.IPv4(5, 6, 7, 8), 1, 0}},
+				Dropped: []PexPeer{{net.IPv4(9, 9, 9, 9), 80, 0}},
+			},
+			wire: "d5:added12:\x01\x02\x03\x04\x1a\xe1\x05\x06\x07\x08\x00\x017:added.f2:\x06\x006:added60:8:added6.f0:" +
+				"7:dropped6:\x09\x09\x09\x09\x00\x508:dropped60:e",
+		},
+		{
+			name: "ipv6",
+			message: &PexMessage{
+				Added:   []PexPeer{{net.ParseIP("2001:db8::1"), 6881, PexEncryption}},
+				Dropped: []PexPeer{{net.ParseIP("2001:db8::2"), 6882, 0}},
+			},
+			wire: "d5:added0:7:added.f0:6:added618:\x20\x01\x0d\xb8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01\x1a\xe1" +
+				"8:added6.f1:\x017:dropped0:8:dropped618:\x20\x01\x0d\xb8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x02\x1a\xe2e",
+		},
+	}
+
+	for _, test := range tests {
+		data, err := test.message.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != test.wire {
+			t.Errorf("%s: %q, want %q", test.name, data, test.wire)
+		}
+
+		parsed, err := ParsePex(data)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if fmt.Sprint(parsed.Added) != fmt.Sprint(test.message.Added) || fmt.Sprint(parsed.Dropped) != fmt.Sprint(test.message.Dropped) {
+			t.Errorf("%s: parsed %+v, want %+v", test.name, parsed, test.message)
+		}
+	}
+}
+
+func TestParsePex(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload string
+		added   string
+		dropped string
+	}{
+		{"no flags", "d5:added6:\x01\x02\x03\x04\x00\x01e", "[{1.2.3.4 1 0}]", "[]"},
+		{"short flags", "d5:added12:\x01\x02\x03\x04\x00\x01\x05\x06\x07\x08\x00\x027:added.f1:\x02e", "[{1.2.3.4 1 2} {5.6.7.8 2 0}]", "[]"},
+		{"trailing bytes", "d5:added8:\x01\x02\x03\x04\x00\x01\xff\xff7:dropped3:abce", "[{1.2.3.4 1 0}]", "[]"},
+		{"wrong types", "d5:addedi1e7:droppedle6:added6i0ee", "[]", "[]"},
+		{"not a dict", "le", "", ""},
+		{"not bencode", "nope", "", ""},
+	}
+
+	for _, test := range tests {
+		m, err := ParsePex([]byte(test.payload))
+		if test.added == "" {
+			if err == nil {
+				t.Errorf("%s: parsed %+v", test.name, m)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if added := fmt.Sprint(m.Added); added != test.added {
+			t.Errorf("%s: added %s, want %s", test.name, added, test.added)
+		}
+		if dropped := fmt.Sprint(m.Dropped); dropped != test.dropped {
+			t.Errorf("%s: dropped %s, want %s", test.name, dropped, test.dropped)
+		}
+	}
+}
+
+// pexPair returns two connected Pex with the ut_pex extension, the accepting
+// one adds the peers it learns to store.
+func pexPair(t *testing.T, store *dht.PeerStore) (*Pex, *Pex) {
+	infoHash := dht.RandomNodeID()
+	dialed, dialErr, accepted, acceptErr := connectPair(t, infoHash, infoHash, testConfig("dialer", true), testConfig("acceptor", true))
+	if dialErr != nil || acceptErr != nil {
+		t.Fatal(dialErr, acceptErr)
+	}
+	return NewPex(dialed, nil), NewPex(accepted, store)
+}
+
+func receivePex(t *testing.T, pex *Pex) (*PexMessage, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	m, err := pex.conn.ReadMessage(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pex.Handle(m)
+}
+
+func sortedAddrs(peers []PexPeer) []string {
+	addrs := make([]string, len(peers))
+	for i, peer := range peers {
+		addrs[i] = peer.key()
+	}
+	sort.Strings(addrs)
+	return addrs
+}
+
+func TestPexExchange(t *testing.T) {
+	store := dht.NewPeerStore(0, 0, time.Hour)
+	sender, receiver := pexPair(t, store)
+	defer sender.conn.Close()
+	defer receiver.conn.Close()
+	sender.Interval = 50 * time.Millisecond
+	receiver.Interval = 50 * time.Millisecond
+
+	a := PexPeer{net.IPv4(1, 1, 1, 1), 1, 0}
+	b := PexPeer{net.IPv4(2, 2, 2, 2), 2, PexSeed}
+	c := PexPeer{net.ParseIP("2001:db8::3"), 3, 0}
+	steps := []struct {
+		peers   []PexPeer
+		added   []PexPeer
+		dropped []PexPeer
+	}{
+		{[]PexPeer{a, b}, []PexPeer{a, b}, nil},
+		// only the change is sent
+		{[]PexPeer{b, c}, []PexPeer{c}, []PexPeer{a}},
+		{nil, nil, []PexPeer{b, c}},
+	}
+
+	for i, step := range steps {
+		if err := sender.Send(context.Background(), step.peers); err != nil {
+			t.Fatalf("step %d: %v", i, err)
+		}
+		m, err := receivePex(t, receiver)
+		if err != nil {
+			t.Fatalf("step %d: %v", i, err)
+		}
+		if fmt.Sprint(sortedAddrs(m.Added)) != fmt.Sprint(sortedAddrs(step.added)) ||
+			fmt.Sprint(sortedAddrs(m.Dropped)) != fmt.Sprint(sortedAddrs(step.dropped)) {
+			t.Errorf("step %d: added %v dropped %v, want %v and %v", i, m.Added, m.Dropped, step.added, step.dropped)
+		}
+
+		// nothing changed, nothing is sent
+		if i == 0 {
+			if err := sender.Send(context.Background(), step.peers); err != ErrPexTooSoon {
+				t.Errorf("Send within Interval returned %v, want ErrPexTooSoon", err)
+			}
+		}
+		time.Sleep(sender.Interval)
+		if err := sender.Send(context.Background(), step.peers); err != nil {
+			t.Errorf("step %d: Send without change returned %v", i, err)
+		}
+	}
+
+	if n := len(store.Get(receiver.conn.InfoHash(), 10)); n != 3 {
+		t.Errorf("%d peers in the store, want 3", n)
+	}
+	// b is flagged as a seed
+	seeds, peers := store.BloomFilters(receiver.conn.InfoHash())
+	if seeds.Estimate() != 1 || !seeds.Test(b.IP) || peers.Estimate() != 2 {
+		t.Errorf("%d seeds and %d peers, want 1 and 2", seeds.Estimate(), peers.Estimate())
+	}
+}
+
+func TestPexLimits(t *testing.T) {
+	store := dht.NewPeerStore(0, 0, time.Hour)
+	sender, receiver := pexPair(t, store)
+	defer sender.conn.Close()
+	defer receiver.conn.Close()
+	sender.Interval = 0
+
+	peers := make([]PexPeer, 2*MaxPexPeers)
+	for i := range peers {
+		peers[i] = PexPeer{net.IPv4(10, 0, byte(i>>8), byte(i)), 6881, 0}
+	}
+	if err := sender.Send(context.Background(), peers); err != nil {
+		t.Fatal(err)
+	}
+	m, err := receivePex(t, receiver)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Added) != MaxPexPeers {
+		t.Errorf("%d peers added, want %d", len(m.Added), MaxPexPeers)
+	}
+
+	// the others are left to the next message, which comes too soon
+	if err := sender.Send(context.Background(), peers); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := receivePex(t, receiver); err != ErrPexFlood {
+		t.Errorf("second message handled with %v, want ErrPexFlood", err)
+	}
+
+	// not a pex message
+	if m, err := receiver.Handle(NewHave(1)); m != nil || err != nil {
+		t.Errorf("have handled as %+v, %v", m, err)
+	}
+	if m, err := receiver.Handle(NewExtended(7, nil)); m != nil || err != nil {
+		t.Errorf("other extension handled as %+v, %v", m, err)
+	}
+}
+
+func TestPexNotSupported(t *testing.T) {
+	infoHash := dht.RandomNodeID()
+	dialed, dialErr, accepted, acceptErr := connectPair(t, infoHash, infoHash, testConfig("dialer", true), testConfig("acceptor", false))
+	if dialErr != nil || acceptErr != nil {
+		t.Fatal(dialErr, acceptErr)
+	}
+	defer dialed.Close()
+	defer accepted.Close()
+
+	pex := NewPex(dialed, nil)
+	if err := pex.Send(context.Background(), []PexPeer{{net.IPv4(1, 1, 1, 1), 1, 0}}); err != ErrNotSupported {
+		t.Errorf("Send returned %v, want ErrNotSupported", err)
+	}
+	// nothing was sent, so nothing is too soon
+	if err := pex.Send(context.Background(), nil); err != nil {
+		t.Errorf("Send after a failure returned %v", err)
+	}
+}
@@ -0,0 +1,103 @@
+package search
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const defaultLimit = 50
+
+type response struct {
+	Total   int       `json:"total"`
+	Results []*Result `json:"results"`
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+// Handler returns an http.Handler answering GET requests with the results of
+// a search as JSON. The query string parameters are q, min_size, max_size,
+// min_files, max_files, since, until, offset and limit. since and until are
+// RFC 3339 times or durations before now.
+func Handler(index *Index) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+
+		if r.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			json.NewEncoder(w).Encode(&errorResponse{Error: "method not allowed"})
+			return
+		}
+
+		query, err := ParseQuery(r.URL.Query())
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(&errorResponse{Error: err.Error()})
+			return
+		}
+
+		results, total := index.Search(query)
+		json.NewEncoder(w).Encode(&response{Total: total, Results: results})
+	})
+}
+
+// ParseQuery returns the Query of URL query string values.
+func ParseQuery(values url.Values) (*Query, error) {
+	query := &Query{Text: values.Get("q"), Limit: defaultLimit}
+
+	var err error
+	parseInt := func(key string, bits int) int64 {
+		s := values.Get(key)
+		if s == "" || err != nil {
+			return 0
+		}
+		var v int64
+		if v, err = strconv.ParseInt(s, 10, bits); err == nil && v < 0 {
+			err = errors.New(key + " should not be negative")
+		}
+		return v
+	}
+	parseTime := func(key string) time.Time {
+		s := values.Get(key)
+		if s == "" || err != nil {
+			return time.Time{}
+		}
+		var t time.Time
+		t, err = ParseTime(s)
+		return t
+	}
+
+	query.MinSize = parseInt("min_size", 64)
+	query.MaxSize = parseInt("max_size", 64)
+	query.MinFiles = int(parseInt("min_files", 32))
+	query.MaxFiles = int(parseInt("max_files", 32))
+	query.Offset = int(parseInt("offset", 32))
+	if values.Get("limit") != "" {
+		query.Limit = int(parseInt("limit", 32))
+	}
+	query.Since = parseTime("since")
+	query.Until = parseTime("until")
+
+	if err != nil {
+		return nil, err
+	}
+	return query, nil
+}
+
+// ParseTime parses an RFC 3339 time, or a duration which is subtracted from
+// the current time.
+func ParseTime(s string) (time.Time, error) {
+	if d, err := time.ParseDuration(s); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, errors.New("invalid time: " + s)
+	}
+	return t, nil
+}
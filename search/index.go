@@ -0,0 +1,273 @@
+package search
+
+import (
+	"github.com/johnnyeven/terra/dht"
+	"github.com/johnnyeven/terra/storage"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// BM25 parameters
+const (
+	k1 = 1.2
+	b  = 0.75
+)
+
+// nameWeight is how many times a token of the name counts more than a token
+// of a file path.
+const nameWeight = 3
+
+// Query is a search query. Zero filters are not applied.
+type Query struct {
+	// all the tokens of Text must match
+	Text     string
+	MinSize  int64
+	MaxSize  int64
+	MinFiles int
+	MaxFiles int
+	// first seen time bounds
+	Since  time.Time
+	Until  time.Time
+	Offset int
+	// 0 means no limit
+	Limit int
+}
+
+// Result is a torrent matching a query.
+type Result struct {
+	Torrent *storage.Torrent `json:"torrent"`
+	Score   float64          `json:"score"`
+}
+
+type document struct {
+	torrent *storage.Torrent
+	// weighted number of tokens
+	length int
+	// tokens of the document with their weighted frequency
+	terms map[string]int
+}
+
+// Index is an in-memory inverted index of torrent names and file paths.
+type Index struct {
+	sync.RWMutex
+	documents map[dht.NodeID]*document
+	postings  map[string]map[dht.NodeID]int
+	// sum of the document lengths
+	totalLength int
+}
+
+// NewIndex returns an empty Index pointer.
+func NewIndex() *Index {
+	return &Index{
+		documents: make(map[dht.NodeID]*document),
+		postings:  make(map[string]map[dht.NodeID]int),
+	}
+}
+
+// Build returns an index of the torrents of store which have metadata.
+func Build(store storage.Store) (*Index, error) {
+	index := NewIndex()
+	err := store.Range(time.Time{}, time.Time{}, func(torrent *storage.Torrent) bool {
+		index.Add(torrent)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return index, nil
+}
+
+// Rebuild replaces the content of index with the torrents of store. The
+// searches meanwhile are answered from the previous content.
+func (index *Index) Rebuild(store storage.Store) error {
+	built, err := Build(store)
+	if err != nil {
+		return err
+	}
+
+	index.Lock()
+	defer index.Unlock()
+
+	index.documents = built.documents
+	index.postings = built.postings
+	index.totalLength = built.totalLength
+	return nil
+}
+
+// FileCount returns the number of files of a torrent, a torrent without a
+// file list is a single file.
+func FileCount(metadata *storage.Metadata) int {
+	if len(metadata.Files) == 0 {
+		return 1
+	}
+	return len(metadata.Files)
+}
+
+// Add indexes torrent, replacing the previous version of it. Torrents
+// without metadata are ignored.
+func (index *Index) Add(torrent *storage.Torrent) {
+	if torrent.Metadata == nil {
+		return
+	}
+
+	terms := make(map[string]int)
+	length := 0
+	for _, token := range indexTokens(torrent.Metadata.Name) {
+		terms[token] += nameWeight
+		length += nameWeight
+	}
+	for _, file := range torrent.Metadata.Files {
+		for _, token := range indexTokens(file.Path) {
+			terms[token]++
+			length++
+		}
+	}
+
+	index.Lock()
+	defer index.Unlock()
+
+	index.remove(torrent.InfoHash)
+	index.documents[torrent.InfoHash] = &document{torrent: torrent, length: length, terms: terms}
+	index.totalLength += length
+	for token, frequency := range terms {
+		posting, ok := index.postings[token]
+		if !ok {
+			posting = make(map[dht.NodeID]int)
+			index.postings[token] = posting
+		}
+		posting[torrent.InfoHash] = frequency
+	}
+}
+
+// Remove removes the torrent of infoHash from the index.
+func (index *Index) Remove(infoHash dht.NodeID) {
+	index.Lock()
+	defer index.Unlock()
+
+	index.remove(infoHash)
+}
+
+func (index *Index) remove(infoHash dht.NodeID) {
+	doc, ok := index.documents[infoHash]
+	if !ok {
+		return
+	}
+
+	for token := range doc.terms {
+		posting := index.postings[token]
+		delete(posting, infoHash)
+		if len(posting) == 0 {
+			delete(index.postings, token)
+		}
+	}
+	index.totalLength -= doc.length
+	delete(index.documents, infoHash)
+}
+
+// Len returns the number of indexed torrents.
+func (index *Index) Len() int {
+	index.RLock()
+	defer index.RUnlock()
+
+	return len(index.documents)
+}
+
+func (query *Query) match(torrent *storage.Torrent) bool {
+	size, files := torrent.Metadata.Size, FileCount(torrent.Metadata)
+	switch {
+	case query.MinSize > 0 && size < query.MinSize,
+		query.MaxSize > 0 && size > query.MaxSize,
+		query.MinFiles > 0 && files < query.MinFiles,
+		query.MaxFiles > 0 && files > query.MaxFiles,
+		!query.Since.IsZero() && torrent.FirstSeen.Before(query.Since),
+		!query.Until.IsZero() && !torrent.FirstSeen.Before(query.Until):
+		return false
+	}
+	return true
+}
+
+// Search returns the torrents matching query ranked by BM25, and the total
+// number of matches before Offset and Limit are applied. An empty query text
+// matches every torrent, ranked by first seen time.
+func (index *Index) Search(query *Query) ([]*Result, int) {
+	index.RLock()
+	defer index.RUnlock()
+
+	results := make([]*Result, 0)
+	tokens := uniqueTokens(Tokenize(query.Text))
+
+	if len(tokens) == 0 {
+		for _, doc := range index.documents {
+			if query.match(doc.torrent) {
+				results = append(results, &Result{Torrent: doc.torrent})
+			}
+		}
+		sort.Slice(results, func(i, j int) bool {
+			return results[i].Torrent.FirstSeen.After(results[j].Torrent.FirstSeen)
+		})
+		return page(results, query.Offset, query.Limit), len(results)
+	}
+
+	// start from the rarest token to visit as few documents as possible
+	sort.Slice(tokens, func(i, j int) bool {
+		return len(index.postings[tokens[i]]) < len(index.postings[tokens[j]])
+	})
+
+	n := float64(len(index.documents))
+	averageLength := float64(index.totalLength) / n
+Documents:
+	for infoHash := range index.postings[tokens[0]] {
+		doc := index.documents[infoHash]
+		if !query.match(doc.torrent) {
+			continue
+		}
+
+		score := 0.0
+		for _, token := range tokens {
+			posting := index.postings[token]
+			frequency, ok := posting[infoHash]
+			if !ok {
+				continue Documents
+			}
+
+			df := float64(len(posting))
+			idf := math.Log(1 + (n-df+0.5)/(df+0.5))
+			tf := float64(frequency)
+			score += idf * tf * (k1 + 1) / (tf + k1*(1-b+b*float64(doc.length)/averageLength))
+		}
+		results = append(results, &Result{Torrent: doc.torrent, Score: score})
+	}
+
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Score != results[j].Score {
+			return results[i].Score > results[j].Score
+		}
+		return results[i].Torrent.FirstSeen.After(results[j].Torrent.FirstSeen)
+	})
+	return page(results, query.Offset, query.Limit), len(results)
+}
+
+func uniqueTokens(tokens []string) []string {
+	seen := make(map[string]struct{}, len(tokens))
+	unique := tokens[:0]
+	for _, token := range tokens {
+		if _, ok := seen[token]; !ok {
+			seen[token] = struct{}{}
+			unique = append(unique, token)
+		}
+	}
+	return unique
+}
+
+func page(results []*Result, offset, limit int) []*Result {
+	if offset >= len(results) {
+		return results[:0]
+	}
+	results = results[offset:]
+	if limit > 0 && limit < len(results) {
+		results = results[:limit]
+	}
+	return results
+}
@@ -0,0 +1,135 @@
+package search
+
+import (
+	"fmt"
+	"github.com/johnnyeven/terra/dht"
+	"github.com/johnnyeven/terra/storage"
+	"testing"
+	"time"
+)
+
+func TestTokenize(t *testing.T) {
+	tests := []struct {
+		text string
+		want []string
+	}{
+		{"", []string{}},
+		{"Ubuntu-20.04_Desktop.iso", []string{"ubuntu", "20", "04", "desktop", "iso"}},
+		{"café Noël", []string{"café", "noël"}},
+		{"東", []string{"東"}},
+		{"東京", []string{"東京"}},
+		{"東京タワー", []string{"東京", "京タ", "タワ", "ワー"}},
+		{"abc東京def", []string{"abc", "東京", "def"}},
+		{"한국 어", []string{"한국", "어"}},
+	}
+	for _, test := range tests {
+		if got := Tokenize(test.text); fmt.Sprint(got) != fmt.Sprint(test.want) {
+			t.Errorf("Tokenize(%q) = %q, want %q", test.text, got, test.want)
+		}
+	}
+}
+
+func TestIndexTokens(t *testing.T) {
+	tests := []struct {
+		text string
+		want []string
+	}{
+		{"東", []string{"東"}},
+		{"東京", []string{"東", "京", "東京"}},
+		{"the 東京", []string{"the", "東", "京", "東京"}},
+	}
+	for _, test := range tests {
+		if got := indexTokens(test.text); fmt.Sprint(got) != fmt.Sprint(test.want) {
+			t.Errorf("indexTokens(%q) = %q, want %q", test.text, got, test.want)
+		}
+	}
+}
+
+type testStore struct {
+	storage.Store
+	torrents []*storage.Torrent
+}
+
+func (s *testStore) Range(from, to time.Time, fn func(*storage.Torrent) bool) error {
+	for _, torrent := range s.torrents {
+		if !fn(torrent) {
+			break
+		}
+	}
+	return nil
+}
+
+func newTorrent(name string, size int64, files ...string) *storage.Torrent {
+	metadata := &storage.Metadata{Name: name, Size: size}
+	for _, file := range files {
+		metadata.Files = append(metadata.Files, storage.File{Path: file})
+	}
+	return &storage.Torrent{InfoHash: dht.RandomNodeID(), Metadata: metadata, FirstSeen: time.Now()}
+}
+
+func TestSearch(t *testing.T) {
+	torrents := []*storage.Torrent{
+		newTorrent("Ubuntu 20.04 Desktop", 3000, "ubuntu-20.04-desktop-amd64.iso"),
+		newTorrent("Debian 11", 600, "debian-11.iso", "README"),
+		newTorrent("東京タワー", 100),
+		newTorrent("京都", 200),
+		{InfoHash: dht.RandomNodeID()},
+	}
+	index, err := Build(&testStore{torrents: torrents})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if index.Len() != 4 {
+		t.Errorf("Len() = %d, want 4 torrents with metadata", index.Len())
+	}
+
+	tests := []struct {
+		query Query
+		want  []string
+	}{
+		{Query{Text: "ubuntu"}, []string{"Ubuntu 20.04 Desktop"}},
+		{Query{Text: "UBUNTU amd64"}, []string{"Ubuntu 20.04 Desktop"}},
+		{Query{Text: "ubuntu debian"}, []string{}},
+		{Query{Text: "iso", MaxSize: 1000}, []string{"Debian 11"}},
+		{Query{Text: "iso", MinFiles: 2}, []string{"Debian 11"}},
+		{Query{Text: "東京"}, []string{"東京タワー"}},
+		{Query{Text: "京"}, []string{"東京タワー", "京都"}},
+		{Query{Text: "タ"}, []string{"東京タワー"}},
+		{Query{Text: "大阪"}, []string{}},
+	}
+	for _, test := range tests {
+		results, total := index.Search(&test.query)
+		names := make(map[string]bool)
+		for _, result := range results {
+			names[result.Torrent.Metadata.Name] = true
+		}
+		if total != len(test.want) || len(names) != len(test.want) {
+			t.Errorf("%+v: %d results, want %q", test.query, total, test.want)
+			continue
+		}
+		for _, name := range test.want {
+			if !names[name] {
+				t.Errorf("%+v: %q not found", test.query, name)
+			}
+		}
+	}
+}
+
+func TestRebuild(t *testing.T) {
+	store := &testStore{torrents: []*storage.Torrent{newTorrent("old", 1)}}
+	index, err := Build(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store.torrents = []*storage.Torrent{newTorrent("new", 1), newTorrent("newer", 1)}
+	if err := index.Rebuild(store); err != nil {
+		t.Fatal(err)
+	}
+	if _, total := index.Search(&Query{Text: "old"}); total != 0 {
+		t.Error("torrent removed from the store still found")
+	}
+	if _, total := index.Search(&Query{Text: "new"}); total != 1 || index.Len() != 2 {
+		t.Error("torrents added to the store not found")
+	}
+}
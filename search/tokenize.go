@@ -0,0 +1,68 @@
+package search
+
+import (
+	"strings"
+	"unicode"
+)
+
+// isCJK reports whether r is written without spaces between words. The
+// prolonged sound mark of katakana is not in the Katakana script.
+func isCJK(r rune) bool {
+	return r == 'ー' || unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana, unicode.Hangul)
+}
+
+// Tokenize splits text into lower case tokens. Words are separated by any
+// rune which is neither a letter nor a digit, so dots, underscores and dashes
+// of file names separate words too. Runs of CJK characters are split into
+// overlapping bigrams, a single CJK character is a token by itself.
+func Tokenize(text string) []string {
+	return tokenize(text, false)
+}
+
+// indexTokens returns the tokens of Tokenize, with the characters of the
+// CJK runs as tokens too, so that a one character query matches them.
+func indexTokens(text string) []string {
+	return tokenize(text, true)
+}
+
+func tokenize(text string, unigrams bool) []string {
+	tokens := make([]string, 0)
+	var word []rune
+	var cjk []rune
+
+	flushWord := func() {
+		if len(word) > 0 {
+			tokens = append(tokens, string(word))
+			word = word[:0]
+		}
+	}
+	flushCJK := func() {
+		if len(cjk) == 1 || unigrams {
+			for _, r := range cjk {
+				tokens = append(tokens, string(r))
+			}
+		}
+		for i := 0; i+1 < len(cjk); i++ {
+			tokens = append(tokens, string(cjk[i:i+2]))
+		}
+		cjk = cjk[:0]
+	}
+
+	for _, r := range strings.ToLower(text) {
+		switch {
+		case isCJK(r):
+			flushWord()
+			cjk = append(cjk, r)
+		case unicode.IsLetter(r) || unicode.IsDigit(r) || unicode.Is(unicode.Mn, r):
+			flushCJK()
+			word = append(word, r)
+		default:
+			flushWord()
+			flushCJK()
+		}
+	}
+	flushWord()
+	flushCJK()
+
+	return tokens
+}
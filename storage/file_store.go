@@ -0,0 +1,308 @@
+package storage
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"github.com/johnnyeven/terra/dht"
+	"github.com/johnnyeven/terra/kv"
+	"sync"
+	"time"
+)
+
+// key prefixes of the FileStore records
+const (
+	// t/<info_hash> -> Torrent
+	torrentPrefix = "t/"
+	// p/<info_hash><ip:port> -> Peer
+	peerPrefix = "p/"
+	// s/<last seen><info_hash> -> nothing, the index by last seen time
+	seenPrefix = "s/"
+)
+
+// compactRatio is the share of garbage in the file above which CompactPeers
+// rewrites the file.
+const compactRatio = 0.5
+
+// rangeBatch is the number of keys Range reads at once.
+const rangeBatch = 256
+
+var _ interface {
+	Store
+} = (*FileStore)(nil)
+
+// FileStore is a Store embedded in a single append-only file.
+type FileStore struct {
+	// serializes the read-modify-write of torrents
+	sync.Mutex
+	db       *kv.DB
+	torrents int
+}
+
+// OpenFileStore opens or creates the store at path. It fails with
+// kv.ErrLocked if another process has it open.
+func OpenFileStore(path string) (*FileStore, error) {
+	db, err := kv.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return newFileStore(db), nil
+}
+
+// OpenFileStoreReadOnly opens the store at path for reading, while another
+// process may be writing it.
+func OpenFileStoreReadOnly(path string) (*FileStore, error) {
+	db, err := kv.OpenReadOnly(path)
+	if err != nil {
+		return nil, err
+	}
+	return newFileStore(db), nil
+}
+
+func newFileStore(db *kv.DB) *FileStore {
+	return &FileStore{
+		db:       db,
+		torrents: len(db.Keys([]byte(torrentPrefix))),
+	}
+}
+
+func torrentKey(infoHash dht.NodeID) []byte {
+	return append([]byte(torrentPrefix), infoHash.Bytes()...)
+}
+
+func peerKey(infoHash dht.NodeID, peer *dht.Peer) []byte {
+	return append(append([]byte(peerPrefix), infoHash.Bytes()...), peer.Addr()...)
+}
+
+func seenKey(t time.Time, infoHash dht.NodeID) []byte {
+	key := make([]byte, len(seenPrefix)+8, len(seenPrefix)+8+dht.NodeIDLength)
+	copy(key, seenPrefix)
+	binary.BigEndian.PutUint64(key[len(seenPrefix):], uint64(t.UnixNano()))
+	return append(key, infoHash.Bytes()...)
+}
+
+func seenTime(t time.Time) []byte {
+	key := make([]byte, len(seenPrefix)+8)
+	copy(key, seenPrefix)
+	binary.BigEndian.PutUint64(key[len(seenPrefix):], uint64(t.UnixNano()))
+	return key
+}
+
+// prefixEnd returns the first key after the keys starting with prefix.
+func prefixEnd(prefix string) []byte {
+	end := []byte(prefix)
+	end[len(end)-1]++
+	return end
+}
+
+func (s *FileStore) get(infoHash dht.NodeID) (*Torrent, error) {
+	value, err := s.db.Get(torrentKey(infoHash))
+	if err == kv.ErrNotFound {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	torrent := &Torrent{}
+	if err := json.Unmarshal(value, torrent); err != nil {
+		return nil, err
+	}
+	return torrent, nil
+}
+
+func (s *FileStore) put(torrent *Torrent) error {
+	value, err := json.Marshal(torrent)
+	if err != nil {
+		return err
+	}
+	return s.db.Put(torrentKey(torrent.InfoHash), value)
+}
+
+func (s *FileStore) Observe(infoHash dht.NodeID, t time.Time) error {
+	s.Lock()
+	defer s.Unlock()
+
+	return s.observe(infoHash, t)
+}
+
+func (s *FileStore) observe(infoHash dht.NodeID, t time.Time) error {
+	torrent, err := s.get(infoHash)
+	created := err == ErrNotFound
+	if created {
+		torrent = &Torrent{InfoHash: infoHash, FirstSeen: t}
+	} else if err != nil {
+		return err
+	}
+
+	torrent.Seen++
+	if t.Before(torrent.FirstSeen) {
+		torrent.FirstSeen = t
+	}
+	if t.After(torrent.LastSeen) {
+		if !torrent.LastSeen.IsZero() {
+			if err := s.db.Delete(seenKey(torrent.LastSeen, infoHash)); err != nil {
+				return err
+			}
+		}
+		torrent.LastSeen = t
+		if err := s.db.Put(seenKey(t, infoHash), nil); err != nil {
+			return err
+		}
+	}
+	if err := s.put(torrent); err != nil {
+		return err
+	}
+	if created {
+		s.torrents++
+	}
+	return nil
+}
+
+func (s *FileStore) AddPeer(infoHash dht.NodeID, peer *dht.Peer) error {
+	s.Lock()
+	defer s.Unlock()
+
+	if peer.LastSeen.IsZero() {
+		p := *peer
+		p.LastSeen = time.Now()
+		peer = &p
+	}
+
+	value, err := json.Marshal(peer)
+	if err != nil {
+		return err
+	}
+	if err := s.db.Put(peerKey(infoHash, peer), value); err != nil {
+		return err
+	}
+	return s.observe(infoHash, peer.LastSeen)
+}
+
+func (s *FileStore) SetMetadata(infoHash dht.NodeID, metadata *Metadata) error {
+	s.Lock()
+	defer s.Unlock()
+
+	torrent, err := s.get(infoHash)
+	if err != nil {
+		return err
+	}
+	torrent.Metadata = metadata
+	return s.put(torrent)
+}
+
+func (s *FileStore) Get(infoHash dht.NodeID) (*Torrent, error) {
+	return s.get(infoHash)
+}
+
+func (s *FileStore) Peers(infoHash dht.NodeID) ([]*dht.Peer, error) {
+	peers := make([]*dht.Peer, 0)
+	prefix := append([]byte(peerPrefix), infoHash.Bytes()...)
+	var err error
+	scanErr := s.db.Scan(prefix, func(key, value []byte) bool {
+		peer := &dht.Peer{}
+		if err = json.Unmarshal(value, peer); err != nil {
+			return false
+		}
+		peers = append(peers, peer)
+		return true
+	})
+	if scanErr != nil {
+		return nil, scanErr
+	}
+	return peers, err
+}
+
+func (s *FileStore) Count() int {
+	s.Lock()
+	defer s.Unlock()
+
+	return s.torrents
+}
+
+// Range walks the seen time index from from to to, a batch of keys at a time.
+func (s *FileStore) Range(from, to time.Time, fn func(*Torrent) bool) error {
+	start := []byte(seenPrefix)
+	if !from.IsZero() {
+		start = seenTime(from)
+	}
+	end := prefixEnd(seenPrefix)
+	if !to.IsZero() {
+		end = seenTime(to)
+	}
+
+	for {
+		keys := s.db.KeyRange(start, end, rangeBatch)
+		for _, key := range keys {
+			infoHash, err := dht.NodeIDFromBytes(key[len(seenPrefix)+8:])
+			if err != nil {
+				return err
+			}
+			torrent, err := s.get(infoHash)
+			if err == ErrNotFound {
+				// removed meanwhile
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			if !fn(torrent) {
+				return nil
+			}
+		}
+		if len(keys) < rangeBatch {
+			return nil
+		}
+		start = append(keys[len(keys)-1], 0)
+	}
+}
+
+func (s *FileStore) CompactPeers(t time.Time) (int, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	stale := make([][]byte, 0)
+	var err error
+	scanErr := s.db.Scan([]byte(peerPrefix), func(key, value []byte) bool {
+		peer := &dht.Peer{}
+		if err = json.Unmarshal(value, peer); err != nil {
+			return false
+		}
+		if peer.LastSeen.Before(t) {
+			stale = append(stale, key)
+		}
+		return true
+	})
+	if scanErr != nil {
+		return 0, scanErr
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	for _, key := range stale {
+		if err := s.db.Delete(key); err != nil {
+			return 0, err
+		}
+	}
+
+	if float64(s.db.Garbage()) > float64(s.db.Size())*compactRatio {
+		if err := s.db.Compact(); err != nil {
+			return len(stale), err
+		}
+	}
+	return len(stale), nil
+}
+
+// Compact rewrites the file without the overwritten and removed records.
+func (s *FileStore) Compact() error {
+	return s.db.Compact()
+}
+
+// Sync commits the store to disk.
+func (s *FileStore) Sync() error {
+	return s.db.Sync()
+}
+
+func (s *FileStore) Close() error {
+	return s.db.Close()
+}
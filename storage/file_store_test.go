@@ -0,0 +1,85 @@
+package storage
+
+import (
+	"github.com/johnnyeven/terra/dht"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileStoreRange(t *testing.T) {
+	dir, err := ioutil.TempDir("", "storage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "test.db")
+
+	store, err := OpenFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// more than a batch of torrents, each seen twice
+	start := time.Unix(1600000000, 0)
+	n := 2*rangeBatch + 10
+	infoHashes := make([]dht.NodeID, n)
+	for i := range infoHashes {
+		infoHashes[i] = dht.RandomNodeID()
+		if err := store.Observe(infoHashes[i], start.Add(time.Duration(i)*time.Second)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := n - 1; i >= n-5; i-- {
+		// seen again later, moved to the end in reverse order
+		store.Observe(infoHashes[i], start.Add(time.Duration(2*n-i)*time.Second))
+	}
+	if store.Count() != n {
+		t.Errorf("Count() = %d, want %d", store.Count(), n)
+	}
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	store, err = OpenFileStoreReadOnly(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if store.Count() != n {
+		t.Errorf("Count() after reopening = %d, want %d", store.Count(), n)
+	}
+
+	tests := []struct {
+		name     string
+		from, to time.Time
+		limit    int
+		want     int
+	}{
+		{"all", time.Time{}, time.Time{}, 0, n},
+		{"from", start.Add(10 * time.Second), time.Time{}, 0, n - 10},
+		{"to", time.Time{}, start.Add(10 * time.Second), 0, 10},
+		{"from to", start.Add(rangeBatch * time.Second), start.Add(2 * rangeBatch * time.Second), 0, rangeBatch},
+		{"stopped", time.Time{}, time.Time{}, rangeBatch + 1, rangeBatch + 1},
+	}
+	for _, test := range tests {
+		var last time.Time
+		count := 0
+		err := store.Range(test.from, test.to, func(torrent *Torrent) bool {
+			if torrent.LastSeen.Before(last) {
+				t.Errorf("%s: %s returned after %s", test.name, torrent.LastSeen, last)
+			}
+			last = torrent.LastSeen
+			count++
+			return count != test.limit
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count != test.want {
+			t.Errorf("%s: %d torrents, want %d", test.name, count, test.want)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package storage
+
+import (
+	"errors"
+	"github.com/johnnyeven/terra/dht"
+	"time"
+)
+
+var ErrNotFound = errors.New("torrent not found")
+
+// File is a file of a torrent.
+type File struct {
+	Path   string `json:"path"`
+	Length int64  `json:"length"`
+}
+
+// Metadata is the info dictionary of a torrent, as far as we care.
+type Metadata struct {
+	Name  string `json:"name"`
+	Files []File `json:"files,omitempty"`
+	// the total length of the files
+	Size int64 `json:"size"`
+}
+
+// Torrent is what is known about an info_hash.
+type Torrent struct {
+	InfoHash  dht.NodeID `json:"infoHash"`
+	FirstSeen time.Time  `json:"firstSeen"`
+	LastSeen  time.Time  `json:"lastSeen"`
+	// how many times the info_hash has been observed
+	Seen     int       `json:"seen"`
+	Metadata *Metadata `json:"metadata,omitempty"`
+}
+
+// Store keeps the torrents and peers discovered in the DHT.
+type Store interface {
+	// Observe records that infoHash has been seen at t.
+	Observe(infoHash dht.NodeID, t time.Time) error
+	// AddPeer records a peer of infoHash, the torrent is observed at the
+	// last seen time of the peer.
+	AddPeer(infoHash dht.NodeID, peer *dht.Peer) error
+	// SetMetadata sets the metadata of an observed torrent.
+	SetMetadata(infoHash dht.NodeID, metadata *Metadata) error
+	// Get returns the torrent of infoHash or ErrNotFound.
+	Get(infoHash dht.NodeID) (*Torrent, error)
+	// Peers returns the peers of infoHash.
+	Peers(infoHash dht.NodeID) ([]*dht.Peer, error)
+	// Count returns the number of torrents.
+	Count() int
+	// Range calls fn with the torrents last seen in [from, to) in ascending
+	// order of last seen time, until fn returns false. A zero time means
+	// unbounded.
+	Range(from, to time.Time, fn func(*Torrent) bool) error
+	// CompactPeers removes the peers last seen before t and returns how many
+	// were removed.
+	CompactPeers(t time.Time) (int, error)
+	Close() error
+}
@@ -0,0 +1,204 @@
+package torrent
+
+import (
+	"crypto/sha1"
+	"errors"
+	"github.com/johnnyeven/terra/dht/util"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	MinPieceLength = 16 << 10
+	MaxPieceLength = 16 << 20
+
+	// the piece length is chosen to get about this many pieces
+	targetPieces = 1500
+)
+
+// CreateOptions are the options of Create.
+type CreateOptions struct {
+	// the name of the torrent, the base name of the root if empty
+	Name string
+	// a power of two of at least 16 KiB, chosen from the total length if 0
+	PieceLength int64
+	// the trackers, the first one is the announce URL and they all go to the
+	// announce-list, one per tier, if there are several
+	Trackers []string
+	// web seeds
+	URLList   []string
+	Comment   string
+	CreatedBy string
+	// the creation date, now if zero
+	CreationDate time.Time
+	Private      bool
+}
+
+// PieceLengthFor returns the piece length of a torrent of length bytes.
+func PieceLengthFor(length int64) int64 {
+	pieceLength := int64(MinPieceLength)
+	for pieceLength < MaxPieceLength && length/pieceLength > targetPieces {
+		pieceLength *= 2
+	}
+	return pieceLength
+}
+
+// Create returns the v1 torrent of the file or directory at root. The files
+// of a directory are sorted by path, the files which are not regular files
+// are left out.
+func Create(root string, options CreateOptions) (*MetaInfo, error) {
+	stat, err := os.Stat(root)
+	if err != nil {
+		return nil, err
+	}
+
+	paths := make([]string, 0)
+	files := make([]File, 0)
+	if stat.IsDir() {
+		err = filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if !info.Mode().IsRegular() {
+				return nil
+			}
+
+			rel, err := filepath.Rel(root, path)
+			if err != nil {
+				return err
+			}
+			paths = append(paths, path)
+			files = append(files, File{Path: strings.Split(filepath.ToSlash(rel), "/"), Length: info.Size()})
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		if len(files) == 0 {
+			return nil, errors.New("torrent: no file in " + root)
+		}
+	} else {
+		paths = append(paths, root)
+	}
+
+	var length int64
+	for _, file := range files {
+		length += file.Length
+	}
+	if !stat.IsDir() {
+		length = stat.Size()
+	}
+	if length == 0 {
+		return nil, errors.New("torrent: no data in " + root)
+	}
+
+	pieceLength := options.PieceLength
+	if pieceLength == 0 {
+		pieceLength = PieceLengthFor(length)
+	}
+	if pieceLength < MinPieceLength || pieceLength&(pieceLength-1) != 0 {
+		return nil, errors.New("torrent: piece length should be a power of two of at least 16 KiB")
+	}
+
+	pieces, err := hashPieces(paths, pieceLength)
+	if err != nil {
+		return nil, err
+	}
+
+	name := options.Name
+	if name == "" {
+		name = filepath.Base(filepath.Clean(root))
+	}
+	info := map[string]interface{}{
+		"name":         name,
+		"piece length": int(pieceLength),
+		"pieces":       string(pieces),
+	}
+	if options.Private {
+		info["private"] = 1
+	}
+	if stat.IsDir() {
+		list := make([]interface{}, len(files))
+		for i, file := range files {
+			list[i] = map[string]interface{}{
+				"length": int(file.Length),
+				"path":   stringsToList(file.Path),
+			}
+		}
+		info["files"] = list
+	} else {
+		info["length"] = int(length)
+	}
+
+	metainfo := map[string]interface{}{
+		"info": info,
+	}
+	if len(options.Trackers) > 0 {
+		metainfo["announce"] = options.Trackers[0]
+	}
+	if len(options.Trackers) > 1 {
+		tiers := make([]interface{}, len(options.Trackers))
+		for i, tracker := range options.Trackers {
+			tiers[i] = []interface{}{tracker}
+		}
+		metainfo["announce-list"] = tiers
+	}
+	if len(options.URLList) > 0 {
+		metainfo["url-list"] = stringsToList(options.URLList)
+	}
+	if options.Comment != "" {
+		metainfo["comment"] = options.Comment
+	}
+	if options.CreatedBy != "" {
+		metainfo["created by"] = options.CreatedBy
+	}
+	date := options.CreationDate
+	if date.IsZero() {
+		date = time.Now()
+	}
+	metainfo["creation date"] = int(date.Unix())
+
+	return Parse([]byte(util.Encode(metainfo)))
+}
+
+// hashPieces returns the concatenated SHA-1 hashes of the pieces of the
+// files read one after the other.
+func hashPieces(paths []string, pieceLength int64) ([]byte, error) {
+	pieces := make([]byte, 0)
+	buf := make([]byte, pieceLength)
+	filled := 0
+
+	for _, path := range paths {
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+
+		for {
+			n, err := io.ReadFull(file, buf[filled:])
+			filled += n
+			if filled == len(buf) {
+				hash := sha1.Sum(buf)
+				pieces = append(pieces, hash[:]...)
+				filled = 0
+			}
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				break
+			}
+			if err != nil {
+				file.Close()
+				return nil, err
+			}
+		}
+		file.Close()
+	}
+
+	if filled > 0 {
+		hash := sha1.Sum(buf[:filled])
+		pieces = append(pieces, hash[:]...)
+	}
+	return pieces, nil
+}
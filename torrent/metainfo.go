@@ -0,0 +1,524 @@
+// Package torrent reads and writes .torrent files, the metainfo files of
+// BEP 3 with the multi-tracker (BEP 12), web seed (BEP 19), private (BEP 27)
+// and v2 (BEP 52) extensions.
+package torrent
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/johnnyeven/terra/dht"
+	"github.com/johnnyeven/terra/dht/util"
+	"io/ioutil"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// PieceHashLength is the length of the SHA-1 hash of a v1 piece.
+const PieceHashLength = sha1.Size
+
+var ErrNoInfo = errors.New("torrent: no info dict")
+
+// File is a file of a torrent.
+type File struct {
+	// the path components under the torrent directory
+	Path   []string `json:"path"`
+	Length int64    `json:"length"`
+	// the BEP 47 attributes, "p" marks a padding file
+	Attr string `json:"attr,omitempty"`
+	// the merkle root of the file in a v2 torrent
+	PiecesRoot []byte `json:"-"`
+}
+
+// Padding reports whether the file is a padding file.
+func (f File) Padding() bool {
+	return strings.Contains(f.Attr, "p")
+}
+
+// Info is the info dict of a torrent.
+type Info struct {
+	Name        string `json:"name"`
+	PieceLength int64  `json:"pieceLength"`
+	// the concatenated SHA-1 hashes of the v1 pieces
+	Pieces  []byte `json:"-"`
+	Private bool   `json:"private"`
+	// the length of a single file torrent
+	Length int64 `json:"length,omitempty"`
+	// the files of a multi-file torrent or a v2 torrent
+	Files []File `json:"files,omitempty"`
+	// 2 for v2 and hybrid torrents, 0 for v1 torrents
+	MetaVersion int `json:"metaVersion,omitempty"`
+}
+
+// MultiFile reports whether the torrent is a directory of files.
+func (info *Info) MultiFile() bool {
+	return info.Files != nil
+}
+
+// TotalLength returns the length of all the files.
+func (info *Info) TotalLength() int64 {
+	if !info.MultiFile() {
+		return info.Length
+	}
+
+	var length int64
+	for _, file := range info.Files {
+		length += file.Length
+	}
+	return length
+}
+
+// NumPieces returns the number of v1 pieces.
+func (info *Info) NumPieces() int {
+	return len(info.Pieces) / PieceHashLength
+}
+
+// Piece returns the SHA-1 hash of the i-th v1 piece.
+func (info *Info) Piece(i int) []byte {
+	return info.Pieces[i*PieceHashLength : (i+1)*PieceHashLength]
+}
+
+// V1 reports whether the torrent has v1 pieces, V2 whether it has a v2 file
+// tree. A hybrid torrent is both.
+func (info *Info) V1() bool {
+	return len(info.Pieces) > 0
+}
+
+func (info *Info) V2() bool {
+	return info.MetaVersion == 2
+}
+
+// MetaInfo is the content of a .torrent file.
+type MetaInfo struct {
+	Announce     string     `json:"announce,omitempty"`
+	AnnounceList [][]string `json:"announceList,omitempty"`
+	// web seeds
+	URLList      []string  `json:"urlList,omitempty"`
+	Comment      string    `json:"comment,omitempty"`
+	CreatedBy    string    `json:"createdBy,omitempty"`
+	CreationDate time.Time `json:"-"`
+	Encoding     string    `json:"encoding,omitempty"`
+	Info         *Info     `json:"info"`
+	// the bencoded info dict as found in the file, the info hashes are
+	// computed from it
+	InfoBytes []byte `json:"-"`
+	// the SHA-1 info hash, or the truncated SHA-256 one of v2 only torrents
+	// which is what the DHT and the trackers use for them
+	InfoHash dht.NodeID `json:"infoHash"`
+	// the SHA-256 info hash of v2 and hybrid torrents, nil for v1 torrents
+	InfoHashV2 []byte `json:"-"`
+
+	// the other keys of the file, such as piece layers, kept raw
+	extra map[string][]byte
+}
+
+// Load parses the .torrent file at path.
+func Load(path string) (*MetaInfo, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(data)
+}
+
+// Parse parses the content of a .torrent file.
+func Parse(data []byte) (*MetaInfo, error) {
+	raw, index, err := util.DecodeRawDict(data, 0)
+	if err != nil {
+		return nil, fmt.Errorf("torrent: %v", err)
+	}
+	if index != len(data) {
+		return nil, errors.New("torrent: data after the metainfo dict")
+	}
+
+	infoBytes, ok := raw["info"]
+	if !ok {
+		return nil, ErrNoInfo
+	}
+
+	m := &MetaInfo{
+		InfoBytes: infoBytes,
+		InfoHash:  sha1.Sum(infoBytes),
+		extra:     make(map[string][]byte),
+	}
+
+	for key, value := range raw {
+		if key == "info" {
+			continue
+		}
+		decoded, err := util.Decode(value)
+		if err != nil {
+			return nil, fmt.Errorf("torrent: %s: %v", key, err)
+		}
+
+		switch key {
+		case "announce":
+			m.Announce, _ = decoded.(string)
+		case "announce-list":
+			m.AnnounceList = parseAnnounceList(decoded)
+		case "url-list":
+			switch v := decoded.(type) {
+			case string:
+				if v != "" {
+					m.URLList = []string{v}
+				}
+			case []interface{}:
+				m.URLList = stringList(v)
+			}
+		case "comment":
+			m.Comment, _ = decoded.(string)
+		case "created by":
+			m.CreatedBy, _ = decoded.(string)
+		case "creation date":
+			if seconds, ok := decoded.(int); ok && seconds > 0 {
+				m.CreationDate = time.Unix(int64(seconds), 0)
+			}
+		case "encoding":
+			m.Encoding, _ = decoded.(string)
+		default:
+			m.extra[key] = value
+		}
+	}
+
+	decoded, err := util.Decode(infoBytes)
+	if err != nil {
+		return nil, fmt.Errorf("torrent: info: %v", err)
+	}
+	info, ok := decoded.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("torrent: info is not a dict")
+	}
+	if m.Info, err = parseInfo(info); err != nil {
+		return nil, err
+	}
+	if m.Info.V2() {
+		hash := sha256.Sum256(infoBytes)
+		m.InfoHashV2 = hash[:]
+		if !m.Info.V1() {
+			copy(m.InfoHash[:], hash[:dht.NodeIDLength])
+		}
+	}
+
+	return m, nil
+}
+
+func parseAnnounceList(decoded interface{}) [][]string {
+	tiers, ok := decoded.([]interface{})
+	if !ok {
+		return nil
+	}
+
+	list := make([][]string, 0, len(tiers))
+	for _, tier := range tiers {
+		if trackers, ok := tier.([]interface{}); ok {
+			if urls := stringList(trackers); len(urls) > 0 {
+				list = append(list, urls)
+			}
+		}
+	}
+	return list
+}
+
+func stringList(items []interface{}) []string {
+	list := make([]string, 0, len(items))
+	for _, item := range items {
+		if s, ok := item.(string); ok && s != "" {
+			list = append(list, s)
+		}
+	}
+	return list
+}
+
+func parseInfo(dict map[string]interface{}) (*Info, error) {
+	info := &Info{}
+
+	name, ok := utf8String(dict, "name")
+	if !ok {
+		return nil, errors.New("torrent: info has no name")
+	}
+	if err := validPathComponent(name); err != nil {
+		return nil, fmt.Errorf("torrent: invalid name: %v", err)
+	}
+	info.Name = name
+
+	pieceLength, ok := dict["piece length"].(int)
+	if !ok || pieceLength <= 0 {
+		return nil, errors.New("torrent: info has no valid piece length")
+	}
+	info.PieceLength = int64(pieceLength)
+
+	private, _ := dict["private"].(int)
+	info.Private = private == 1
+	info.MetaVersion, _ = dict["meta version"].(int)
+	if info.MetaVersion != 0 && info.MetaVersion != 1 && info.MetaVersion != 2 {
+		return nil, fmt.Errorf("torrent: unsupported meta version %d", info.MetaVersion)
+	}
+	if info.MetaVersion == 1 {
+		info.MetaVersion = 0
+	}
+
+	if pieces, ok := dict["pieces"].(string); ok {
+		if len(pieces)%PieceHashLength != 0 {
+			return nil, errors.New("torrent: pieces length is not a multiple of 20")
+		}
+		info.Pieces = []byte(pieces)
+	}
+
+	if files, ok := dict["files"].([]interface{}); ok {
+		info.Files = make([]File, 0, len(files))
+		for i, item := range files {
+			file, err := parseFile(item)
+			if err != nil {
+				return nil, fmt.Errorf("torrent: file %d: %v", i, err)
+			}
+			info.Files = append(info.Files, file)
+		}
+	} else if length, ok := dict["length"].(int); ok {
+		if length < 0 {
+			return nil, errors.New("torrent: negative length")
+		}
+		info.Length = int64(length)
+	}
+
+	if info.V2() {
+		tree, ok := dict["file tree"].(map[string]interface{})
+		if !ok {
+			return nil, errors.New("torrent: v2 info has no file tree")
+		}
+		files, err := parseFileTree(tree, nil)
+		if err != nil {
+			return nil, fmt.Errorf("torrent: file tree: %v", err)
+		}
+		// a hybrid torrent lists its files twice, the v1 list has the
+		// padding files
+		if !info.V1() {
+			if len(files) == 1 && len(files[0].Path) == 1 && files[0].Path[0] == info.Name {
+				info.Length = files[0].Length
+			} else {
+				info.Files = files
+			}
+		}
+	}
+
+	if !info.V1() && !info.V2() {
+		return nil, errors.New("torrent: info has neither pieces nor file tree")
+	}
+	if info.V1() {
+		pieces := (info.TotalLength() + info.PieceLength - 1) / info.PieceLength
+		if int64(info.NumPieces()) != pieces {
+			return nil, fmt.Errorf("torrent: %d pieces of %d bytes for %d bytes", info.NumPieces(), info.PieceLength, info.TotalLength())
+		}
+	}
+
+	return info, nil
+}
+
+// utf8String returns the key.utf-8 value of dict if it is there, the value
+// of key else.
+func utf8String(dict map[string]interface{}, key string) (string, bool) {
+	if s, ok := dict[key+".utf-8"].(string); ok {
+		return s, true
+	}
+	s, ok := dict[key].(string)
+	return s, ok
+}
+
+func parseFile(item interface{}) (File, error) {
+	dict, ok := item.(map[string]interface{})
+	if !ok {
+		return File{}, errors.New("not a dict")
+	}
+
+	length, ok := dict["length"].(int)
+	if !ok || length < 0 {
+		return File{}, errors.New("no valid length")
+	}
+
+	items, ok := dict["path.utf-8"].([]interface{})
+	if !ok {
+		items, ok = dict["path"].([]interface{})
+	}
+	if !ok || len(items) == 0 {
+		return File{}, errors.New("no path")
+	}
+	path := make([]string, len(items))
+	for i, item := range items {
+		component, ok := item.(string)
+		if !ok {
+			return File{}, errors.New("path is not a list of strings")
+		}
+		if err := validPathComponent(component); err != nil {
+			return File{}, err
+		}
+		path[i] = component
+	}
+
+	attr, _ := dict["attr"].(string)
+	return File{Path: path, Length: int64(length), Attr: attr}, nil
+}
+
+// parseFileTree returns the files of a v2 file tree in order.
+func parseFileTree(tree map[string]interface{}, dir []string) ([]File, error) {
+	names := make([]string, 0, len(tree))
+	for name := range tree {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	files := make([]File, 0)
+	for _, name := range names {
+		node, ok := tree[name].(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("%s is not a dict", name)
+		}
+		if err := validPathComponent(name); err != nil {
+			return nil, err
+		}
+		path := append(append([]string(nil), dir...), name)
+
+		if leaf, ok := node[""].(map[string]interface{}); ok {
+			length, ok := leaf["length"].(int)
+			if !ok || length < 0 {
+				return nil, fmt.Errorf("%s has no valid length", strings.Join(path, "/"))
+			}
+			file := File{Path: path, Length: int64(length)}
+			if root, ok := leaf["pieces root"].(string); ok {
+				file.PiecesRoot = []byte(root)
+			}
+			attr, _ := leaf["attr"].(string)
+			file.Attr = attr
+			files = append(files, file)
+			continue
+		}
+
+		children, err := parseFileTree(node, path)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, children...)
+	}
+	return files, nil
+}
+
+// validPathComponent rejects the names which would escape the torrent
+// directory.
+func validPathComponent(name string) error {
+	switch {
+	case name == "", name == ".", name == "..":
+		return fmt.Errorf("invalid path component %q", name)
+	case strings.ContainsAny(name, "/\\\x00"):
+		return fmt.Errorf("path component %q has a separator", name)
+	}
+	return nil
+}
+
+// Trackers returns the tracker URLs, the announce-list if there is one or
+// the announce URL.
+func (m *MetaInfo) Trackers() []string {
+	if len(m.AnnounceList) == 0 {
+		if m.Announce == "" {
+			return nil
+		}
+		return []string{m.Announce}
+	}
+
+	trackers := make([]string, 0)
+	for _, tier := range m.AnnounceList {
+		trackers = append(trackers, tier...)
+	}
+	return trackers
+}
+
+// Magnet returns the magnet link of the torrent.
+func (m *MetaInfo) Magnet() string {
+	var buf bytes.Buffer
+	buf.WriteString("magnet:?")
+	if m.Info.V1() {
+		buf.WriteString("xt=urn:btih:" + m.InfoHash.String())
+	}
+	if m.InfoHashV2 != nil {
+		if m.Info.V1() {
+			buf.WriteString("&")
+		}
+		// multihash of sha2-256
+		buf.WriteString("xt=urn:btmh:1220" + hex.EncodeToString(m.InfoHashV2))
+	}
+	buf.WriteString("&dn=" + url.QueryEscape(m.Info.Name))
+	for _, tracker := range m.Trackers() {
+		buf.WriteString("&tr=" + url.QueryEscape(tracker))
+	}
+	return buf.String()
+}
+
+// Encode returns the bencoded metainfo, the info dict is written as it was
+// parsed so the info hash does not change.
+func (m *MetaInfo) Encode() []byte {
+	values := make(map[string][]byte, len(m.extra)+8)
+	for key, value := range m.extra {
+		values[key] = value
+	}
+
+	set := func(key string, value interface{}) {
+		values[key] = []byte(util.Encode(value))
+	}
+	if m.Announce != "" {
+		set("announce", m.Announce)
+	}
+	if len(m.AnnounceList) > 0 {
+		tiers := make([]interface{}, len(m.AnnounceList))
+		for i, tier := range m.AnnounceList {
+			tiers[i] = stringsToList(tier)
+		}
+		set("announce-list", tiers)
+	}
+	if len(m.URLList) > 0 {
+		set("url-list", stringsToList(m.URLList))
+	}
+	if m.Comment != "" {
+		set("comment", m.Comment)
+	}
+	if m.CreatedBy != "" {
+		set("created by", m.CreatedBy)
+	}
+	if !m.CreationDate.IsZero() {
+		set("creation date", int(m.CreationDate.Unix()))
+	}
+	if m.Encoding != "" {
+		set("encoding", m.Encoding)
+	}
+	values["info"] = m.InfoBytes
+
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var buf bytes.Buffer
+	buf.WriteByte('d')
+	for _, key := range keys {
+		buf.WriteString(strconv.Itoa(len(key)) + ":" + key)
+		buf.Write(values[key])
+	}
+	buf.WriteByte('e')
+	return buf.Bytes()
+}
+
+// WriteFile writes the .torrent file to path.
+func (m *MetaInfo) WriteFile(path string) error {
+	return ioutil.WriteFile(path, m.Encode(), 0644)
+}
+
+func stringsToList(items []string) []interface{} {
+	list := make([]interface{}, len(items))
+	for i, item := range items {
+		list[i] = item
+	}
+	return list
+}
@@ -0,0 +1,251 @@
+package torrent
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// pieces returns n fake piece hashes.
+func pieces(n int) string {
+	return strings.Repeat("01234567890123456789", n)
+}
+
+func bstring(s string) string {
+	return fmt.Sprintf("%d:%s", len(s), s)
+}
+
+func TestParse(t *testing.T) {
+	single := "d6:lengthi40000e4:name5:a.iso12:piece lengthi16384e6:pieces" + bstring(pieces(3)) + "e"
+	multi := "d5:filesld6:lengthi10e4:pathl3:dir5:a.txteed4:attr1:p6:lengthi6e4:pathl4:.pad1:6eed6:lengthi16e10:path.utf-8l5:b.txteee" +
+		"4:name3:dir12:piece lengthi16e6:pieces" + bstring(pieces(2)) + "7:privatei1ee"
+	v2 := "d9:file treed5:b.txtd0:d6:lengthi5e11:pieces root32:" + strings.Repeat("r", 32) + "eee12:meta versioni2e4:name1:x12:piece lengthi16384ee"
+
+	tests := []struct {
+		name string
+		data string
+		// the error message, the torrent is valid if empty
+		err   string
+		check func(t *testing.T, m *MetaInfo)
+	}{
+		{
+			name: "single file",
+			data: "d8:announce" + bstring("http://tracker/announce") + "13:creation datei1600000000e4:info" + single + "e",
+			check: func(t *testing.T, m *MetaInfo) {
+				if m.Info.Name != "a.iso" || m.Info.MultiFile() || m.Info.TotalLength() != 40000 || m.Info.NumPieces() != 3 {
+					t.Errorf("info %+v", m.Info)
+				}
+				if m.InfoHash != sha1.Sum([]byte(single)) {
+					t.Errorf("info hash %s is not the hash of the info dict", m.InfoHash)
+				}
+				if !m.CreationDate.Equal(time.Unix(1600000000, 0)) || m.Announce != "http://tracker/announce" {
+					t.Errorf("metainfo %+v", m)
+				}
+				if m.InfoHashV2 != nil {
+					t.Error("v1 torrent has a v2 info hash")
+				}
+			},
+		},
+		{
+			name: "multi file",
+			data: "d13:announce-listll1:ael1:b1:cel0:ee4:info" + multi + "e",
+			check: func(t *testing.T, m *MetaInfo) {
+				info := m.Info
+				if !info.MultiFile() || len(info.Files) != 3 || info.TotalLength() != 32 || !info.Private {
+					t.Fatalf("info %+v", info)
+				}
+				if strings.Join(info.Files[0].Path, "/") != "dir/a.txt" || !info.Files[1].Padding() || info.Files[2].Path[0] != "b.txt" {
+					t.Errorf("files %+v", info.Files)
+				}
+				// the empty tier is left out
+				if fmt.Sprint(m.AnnounceList) != "[[a] [b c]]" || fmt.Sprint(m.Trackers()) != "[a b c]" {
+					t.Errorf("announce list %q", m.AnnounceList)
+				}
+			},
+		},
+		{
+			name: "v2",
+			data: "d4:info" + v2 + "e",
+			check: func(t *testing.T, m *MetaInfo) {
+				hash := sha256.Sum256([]byte(v2))
+				if !bytes.Equal(m.InfoHashV2, hash[:]) || !bytes.Equal(m.InfoHash[:], hash[:20]) {
+					t.Errorf("info hashes %s and %x", m.InfoHash, m.InfoHashV2)
+				}
+				if m.Info.V1() || !m.Info.V2() || len(m.Info.Files) != 1 || len(m.Info.Files[0].PiecesRoot) != 32 {
+					t.Errorf("info %+v", m.Info)
+				}
+			},
+		},
+		{
+			name: "utf-8 name",
+			data: "d4:infod6:lengthi1e4:name3:bad10:name.utf-85:good!12:piece lengthi1e6:pieces" + bstring(pieces(1)) + "ee",
+			check: func(t *testing.T, m *MetaInfo) {
+				if m.Info.Name != "good!" {
+					t.Errorf("name %q", m.Info.Name)
+				}
+			},
+		},
+		{name: "not bencode", data: "nope", err: "torrent: "},
+		{name: "trailing data", data: "d4:info" + single + "ee", err: "data after the metainfo dict"},
+		{name: "no info", data: "d8:announce1:ae", err: ErrNoInfo.Error()},
+		{name: "info not a dict", data: "d4:infoi1ee", err: "info is not a dict"},
+		{name: "no name", data: "d4:infod6:lengthi1e12:piece lengthi1e6:pieces" + bstring(pieces(1)) + "ee", err: "no name"},
+		{name: "dot dot name", data: "d4:infod6:lengthi1e4:name2:..12:piece lengthi1e6:pieces" + bstring(pieces(1)) + "ee", err: "invalid name"},
+		{name: "no piece length", data: "d4:infod6:lengthi1e4:name1:a6:pieces" + bstring(pieces(1)) + "ee", err: "piece length"},
+		{name: "short pieces", data: "d4:infod6:lengthi1e4:name1:a12:piece lengthi1e6:pieces3:abcee", err: "multiple of 20"},
+		{name: "wrong piece count", data: "d4:infod6:lengthi40000e4:name1:a12:piece lengthi16384e6:pieces" + bstring(pieces(2)) + "ee", err: "2 pieces"},
+		{name: "no pieces", data: "d4:infod6:lengthi1e4:name1:a12:piece lengthi1eee", err: "neither pieces nor file tree"},
+		{name: "separator in path", data: "d4:infod5:filesld6:lengthi1e4:pathl3:a/beee4:name1:a12:piece lengthi1e6:pieces" + bstring(pieces(1)) + "ee", err: "separator"},
+		{name: "meta version 3", data: "d4:infod12:meta versioni3e4:name1:a12:piece lengthi1eee", err: "unsupported meta version 3"},
+	}
+
+	for _, test := range tests {
+		m, err := Parse([]byte(test.data))
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s: error %v, want %q", test.name, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		t.Run(test.name, func(t *testing.T) {
+			test.check(t, m)
+		})
+	}
+}
+
+func TestEncode(t *testing.T) {
+	// an info dict with unsorted keys and an unknown key keeps its hash
+	info := "d4:name1:a6:lengthi1e12:piece lengthi1e6:pieces" + bstring(pieces(1)) + "1:zi0ee"
+	data := "d7:comment2:hi4:info" + info + "12:piece layersd0:0:ee"
+
+	m, err := Parse([]byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.Announce = "udp://tracker:6969"
+	encoded := m.Encode()
+
+	parsed, err := Parse(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.InfoHash != m.InfoHash || !bytes.Equal(parsed.InfoBytes, []byte(info)) {
+		t.Error("the info dict changed")
+	}
+	if parsed.Comment != "hi" || parsed.Announce != "udp://tracker:6969" {
+		t.Errorf("metainfo %+v", parsed)
+	}
+	if !bytes.Contains(encoded, []byte("12:piece layersd0:0:e")) {
+		t.Errorf("unknown key lost: %q", encoded)
+	}
+}
+
+func TestMagnet(t *testing.T) {
+	single := "d6:lengthi1e4:name3:a b12:piece lengthi1e6:pieces" + bstring(pieces(1)) + "e"
+	m, err := Parse([]byte("d8:announce" + bstring("http://t/a?b=1") + "4:info" + single + "e"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := "magnet:?xt=urn:btih:" + m.InfoHash.String() + "&dn=a+b&tr=http%3A%2F%2Ft%2Fa%3Fb%3D1"
+	if magnet := m.Magnet(); magnet != want {
+		t.Errorf("Magnet() = %s, want %s", magnet, want)
+	}
+}
+
+func TestPieceLengthFor(t *testing.T) {
+	tests := []struct {
+		length int64
+		want   int64
+	}{
+		{0, MinPieceLength},
+		{MinPieceLength * targetPieces, MinPieceLength},
+		{MinPieceLength*targetPieces + MinPieceLength, 2 * MinPieceLength},
+		{4 << 30, 4 << 20},
+		{1 << 50, MaxPieceLength},
+	}
+	for _, test := range tests {
+		if got := PieceLengthFor(test.length); got != test.want {
+			t.Errorf("PieceLengthFor(%d) = %d, want %d", test.length, got, test.want)
+		}
+	}
+}
+
+func TestCreate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "torrent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	root := filepath.Join(dir, "root")
+	files := map[string]string{
+		"b.txt":     strings.Repeat("b", 20000),
+		"a/c.txt":   "c",
+		"a/d/e.txt": strings.Repeat("e", 16384),
+	}
+	for path, content := range files {
+		path = filepath.Join(root, path)
+		os.MkdirAll(filepath.Dir(path), 0755)
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name    string
+		root    string
+		options CreateOptions
+		paths   []string
+		pieces  int
+	}{
+		{"directory", root, CreateOptions{Trackers: []string{"a", "b"}}, []string{"a/c.txt", "a/d/e.txt", "b.txt"}, 3},
+		{"file", filepath.Join(root, "b.txt"), CreateOptions{Name: "renamed", Private: true}, nil, 2},
+	}
+	for _, test := range tests {
+		m, err := Create(test.root, test.options)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		// what is written is read back
+		parsed, err := Parse(m.Encode())
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if parsed.InfoHash != m.InfoHash || parsed.Info.NumPieces() != test.pieces {
+			t.Errorf("%s: %d pieces, want %d", test.name, parsed.Info.NumPieces(), test.pieces)
+		}
+
+		paths := make([]string, 0)
+		for _, file := range parsed.Info.Files {
+			paths = append(paths, strings.Join(file.Path, "/"))
+		}
+		if test.paths != nil && fmt.Sprint(paths) != fmt.Sprint(test.paths) {
+			t.Errorf("%s: files %q, want %q", test.name, paths, test.paths)
+		}
+		if test.options.Name != "" && parsed.Info.Name != test.options.Name || parsed.Info.Private != test.options.Private {
+			t.Errorf("%s: info %+v", test.name, parsed.Info)
+		}
+		if len(test.options.Trackers) > 1 && len(parsed.AnnounceList) != len(test.options.Trackers) {
+			t.Errorf("%s: announce list %q", test.name, parsed.AnnounceList)
+		}
+	}
+
+	// the first piece of the file is the hash of its first bytes
+	m, _ := Create(filepath.Join(root, "b.txt"), CreateOptions{})
+	hash := sha1.Sum([]byte(files["b.txt"][:m.Info.PieceLength]))
+	if !bytes.Equal(m.Info.Piece(0), hash[:]) {
+		t.Error("first piece hash")
+	}
+}
@@ -0,0 +1,169 @@
+package utp
+
+import (
+	"time"
+)
+
+// LEDBAT parameters of BEP 29
+const (
+	// the queuing delay the sender aims at, in microseconds
+	targetDelay = 100000
+	// how much the window can grow in an RTT, in bytes
+	maxWindowIncrease = 3000
+	// the window never gets smaller than a packet
+	minWindow = maxPayloadSize
+	// the window is not let grow beyond this
+	maxWindow = 1 << 20
+	// the first window
+	initialWindow = 3 * maxPayloadSize
+	// how long a minimum of the delays is kept, the base delay is the
+	// minimum of the last two
+	delayHistoryPeriod = time.Minute
+)
+
+// the retransmission timeout bounds
+const (
+	initialTimeout = time.Second
+	minTimeout     = 500 * time.Millisecond
+	maxTimeout     = 30 * time.Second
+)
+
+// delayHistory keeps the minimum of the one way delays, the base delay. The
+// delays have the offset of the clocks of both sides in them, only their
+// differences to the base delay mean something.
+type delayHistory struct {
+	current, previous uint32
+	hasCurrent        bool
+	hasPrevious       bool
+	periodStart       time.Time
+}
+
+// add records a delay sample.
+func (h *delayHistory) add(delay uint32, now time.Time) {
+	if now.Sub(h.periodStart) >= delayHistoryPeriod {
+		h.previous, h.hasPrevious = h.current, h.hasCurrent
+		h.hasCurrent = false
+		h.periodStart = now
+	}
+	if !h.hasCurrent || int32(delay-h.current) < 0 {
+		h.current, h.hasCurrent = delay, true
+	}
+}
+
+// base returns the base delay.
+func (h *delayHistory) base() uint32 {
+	if h.hasPrevious && int32(h.previous-h.current) < 0 {
+		return h.previous
+	}
+	return h.current
+}
+
+// congestion is the LEDBAT congestion control of a connection: the window
+// grows while the queuing delay is below targetDelay and shrinks above it,
+// so uTP gives way to the other traffic of the link.
+type congestion struct {
+	window    float64
+	slowStart bool
+	ssthresh  float64
+	delays    delayHistory
+
+	rtt, rttVar time.Duration
+	timeout     time.Duration
+}
+
+func newCongestion() *congestion {
+	return &congestion{
+		window:    initialWindow,
+		slowStart: true,
+		ssthresh:  maxWindow,
+		timeout:   initialTimeout,
+	}
+}
+
+// onAck updates the window for bytesAcked acknowledged bytes, delay is the
+// one way delay the other side measured, 0 if it did not.
+func (c *congestion) onAck(bytesAcked int, delay uint32, now time.Time) {
+	if bytesAcked <= 0 || delay == 0 {
+		return
+	}
+	c.delays.add(delay, now)
+	ourDelay := float64(delay - c.delays.base())
+	if ourDelay > 10*targetDelay {
+		// the clock of the other side jumped
+		ourDelay = targetDelay
+	}
+
+	acked := float64(bytesAcked)
+	windowFactor := acked / c.window
+	if acked > c.window {
+		windowFactor = c.window / acked
+	}
+	offTarget := (targetDelay - ourDelay) / targetDelay
+	ledbatWindow := c.window + maxWindowIncrease*offTarget*windowFactor
+
+	if c.slowStart {
+		ssWindow := c.window + windowFactor*maxPayloadSize
+		switch {
+		case ssWindow > c.ssthresh:
+			c.slowStart = false
+		case ourDelay > 0.9*targetDelay:
+			c.slowStart = false
+			c.ssthresh = c.window
+		default:
+			if ssWindow > ledbatWindow {
+				ledbatWindow = ssWindow
+			}
+		}
+	}
+	c.setWindow(ledbatWindow)
+}
+
+// onLoss halves the window when a packet is lost.
+func (c *congestion) onLoss() {
+	c.setWindow(c.window / 2)
+	c.slowStart = false
+	c.ssthresh = c.window
+}
+
+// onTimeout shrinks the window to a packet and backs the timeout off when
+// nothing is acknowledged in time.
+func (c *congestion) onTimeout() {
+	c.setWindow(minWindow)
+	c.slowStart = true
+	c.timeout *= 2
+	if c.timeout > maxTimeout {
+		c.timeout = maxTimeout
+	}
+}
+
+// onRTT updates the timeout with the RTT of a packet sent once, as TCP does.
+func (c *congestion) onRTT(rtt time.Duration) {
+	if c.rtt == 0 {
+		c.rtt, c.rttVar = rtt, rtt/2
+	} else {
+		delta := c.rtt - rtt
+		if delta < 0 {
+			delta = -delta
+		}
+		c.rttVar += (delta - c.rttVar) / 4
+		c.rtt += (rtt - c.rtt) / 8
+	}
+
+	c.timeout = c.rtt + 4*c.rttVar
+	if c.timeout < minTimeout {
+		c.timeout = minTimeout
+	}
+	if c.timeout > maxTimeout {
+		c.timeout = maxTimeout
+	}
+}
+
+func (c *congestion) setWindow(window float64) {
+	if window < minWindow {
+		window = minWindow
+	}
+	if window > maxWindow {
+		window = maxWindow
+	}
+	c.window = window
+}
@@ -0,0 +1,618 @@
+package utp
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	stateSynSent = iota
+	stateConnected
+	stateClosed
+)
+
+const (
+	// a SYN is given up after this many timeouts
+	maxSynRetransmits = 3
+	// a packet is taken as lost after this many duplicate ACKs, or when
+	// this many packets after it are selectively acknowledged
+	duplicateAcks = 3
+)
+
+// outgoingPacket is a packet sent and not acknowledged yet.
+type outgoingPacket struct {
+	typ           byte
+	seqNr         uint16
+	payload       []byte
+	sentAt        time.Time
+	transmissions int
+	acked         bool
+	// lost, it is not in flight any more
+	needResend bool
+	// resent after duplicate ACKs, it is not resent so again
+	fastResent bool
+}
+
+// incomingPacket is a packet received ahead of the ones missing before it.
+type incomingPacket struct {
+	typ     byte
+	payload []byte
+}
+
+// Conn is a uTP connection. Reads and writes can be done concurrently.
+type Conn struct {
+	socket *Socket
+	remote net.Addr
+	// the connection ID of the received packets and of the sent ones
+	recvID, sendID uint16
+
+	mutex sync.Mutex
+	state int
+	// why the connection is over
+	err error
+	// closed and replaced whenever something waited for may have changed
+	changed chan struct{}
+
+	// the sequence number of the next packet sent
+	seqNr      uint16
+	outgoing   []*outgoingPacket
+	inFlight   int
+	sendBuffer []byte
+	peerWindow int
+	lastAckNr  uint16
+	dupAcks    int
+	// losses of the packets sent before it do not halve the window again
+	lossSeqNr   uint16
+	congestion  *congestion
+	timeoutAt   time.Time
+	retransmits int
+	lastSend    time.Time
+	closing     bool
+	finSent     bool
+	finAcked    bool
+
+	// the sequence number of the last packet received in order
+	ackNr       uint16
+	reorder     map[uint16]*incomingPacket
+	reorderSize int
+	readBuffer  []byte
+	// the delay of the last packet received, sent back in each packet
+	replyDelay uint32
+	lastWindow int
+	eof        bool
+
+	readDeadline, writeDeadline time.Time
+}
+
+func newConn(s *Socket, remote net.Addr, recvID, sendID uint16) *Conn {
+	c := &Conn{
+		socket:     s,
+		remote:     remote,
+		recvID:     recvID,
+		sendID:     sendID,
+		changed:    make(chan struct{}),
+		peerWindow: initialWindow,
+		congestion: newCongestion(),
+		reorder:    make(map[uint16]*incomingPacket),
+	}
+	c.setSeqNr(1)
+	return c
+}
+
+// setSeqNr sets the sequence number of the first packet sent.
+func (c *Conn) setSeqNr(seqNr uint16) {
+	c.seqNr = seqNr
+	c.lastAckNr = seqNr - 1
+	c.lossSeqNr = seqNr
+}
+
+// connect sends the SYN and waits for the answer.
+func (c *Conn) connect(ctx context.Context) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.queue(stSyn, nil, time.Now())
+	for c.state == stateSynSent {
+		changed := c.changed
+		c.mutex.Unlock()
+		select {
+		case <-changed:
+		case <-ctx.Done():
+		case <-c.socket.quitChannel:
+		}
+		c.mutex.Lock()
+
+		if c.state == stateSynSent && ctx.Err() != nil {
+			c.fail(ctx.Err())
+		}
+	}
+	if c.state == stateClosed && c.err != nil {
+		return c.err
+	}
+	return nil
+}
+
+// queue sends a new packet, it is resent until it is acknowledged.
+func (c *Conn) queue(typ byte, payload []byte, now time.Time) {
+	p := &outgoingPacket{typ: typ, seqNr: c.seqNr, payload: payload}
+	c.seqNr++
+	c.outgoing = append(c.outgoing, p)
+	c.transmit(p, now)
+}
+
+func (c *Conn) transmit(p *outgoingPacket, now time.Time) {
+	p.sentAt = now
+	p.transmissions++
+	p.needResend = false
+	c.inFlight += len(p.payload)
+	if c.timeoutAt.IsZero() {
+		c.timeoutAt = now.Add(c.congestion.timeout)
+	}
+	c.send(p.typ, p.seqNr, p.payload, now)
+}
+
+func (c *Conn) send(typ byte, seqNr uint16, payload []byte, now time.Time) {
+	h := &header{
+		typ:           typ,
+		connID:        c.sendID,
+		timestamp:     timestamp(now),
+		timestampDiff: c.replyDelay,
+		wndSize:       uint32(c.receiveWindow()),
+		seqNr:         seqNr,
+		ackNr:         c.ackNr,
+	}
+	if typ == stSyn {
+		h.connID = c.recvID
+	}
+	if typ == stState {
+		h.sack = c.sackMask()
+	}
+	c.lastWindow = int(h.wndSize)
+	c.lastSend = now
+	c.socket.write(h.marshal(payload), c.remote)
+}
+
+// sendState acknowledges the received packets, a state packet does not take
+// a sequence number.
+func (c *Conn) sendState(now time.Time) {
+	c.send(stState, c.seqNr, nil, now)
+}
+
+// flush sends the lost packets and then the buffered data as long as the
+// window lets it, and the FIN once everything is sent after Close. A packet
+// is always let go if nothing is in flight.
+func (c *Conn) flush(now time.Time) {
+	if c.state != stateConnected {
+		return
+	}
+	window := int(c.congestion.window)
+	if c.peerWindow < window {
+		window = c.peerWindow
+	}
+
+	for _, p := range c.outgoing {
+		if !p.needResend {
+			continue
+		}
+		if c.inFlight > 0 && c.inFlight+len(p.payload) > window {
+			return
+		}
+		c.transmit(p, now)
+	}
+
+	for len(c.sendBuffer) > 0 {
+		size := len(c.sendBuffer)
+		if size > maxPayloadSize {
+			size = maxPayloadSize
+		}
+		if c.inFlight > 0 && c.inFlight+size > window {
+			return
+		}
+		payload := make([]byte, size)
+		copy(payload, c.sendBuffer)
+		c.sendBuffer = c.sendBuffer[size:]
+		c.queue(stData, payload, now)
+	}
+
+	if c.closing && !c.finSent {
+		c.finSent = true
+		c.queue(stFin, nil, now)
+	}
+}
+
+// receive handles a packet of the connection.
+func (c *Conn) receive(h *header, payload []byte, now time.Time) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.state == stateClosed {
+		return
+	}
+	defer c.broadcast()
+
+	if h.typ == stReset {
+		c.fail(ErrReset)
+		return
+	}
+	if h.typ == stSyn {
+		// the SYN this connection was accepted for, or a resent one
+		c.sendState(now)
+		return
+	}
+	if c.state == stateSynSent {
+		if h.ackNr != c.seqNr-1 {
+			return
+		}
+		c.state = stateConnected
+		c.ackNr = h.seqNr - 1
+	}
+	if !seqLess(h.ackNr, c.seqNr) {
+		// acknowledges what was never sent
+		return
+	}
+
+	c.replyDelay = timestamp(now) - h.timestamp
+	windowChanged := c.peerWindow != int(h.wndSize)
+	c.peerWindow = int(h.wndSize)
+	c.ack(h, h.typ == stState && len(payload) == 0 && !windowChanged, now)
+
+	if h.typ == stData || h.typ == stFin {
+		c.receiveData(h, payload, now)
+	}
+	c.flush(now)
+
+	if c.closing && c.finAcked {
+		c.state = stateClosed
+		c.err = ErrClosed
+		c.socket.remove(c)
+	}
+}
+
+// ack handles the acknowledgements of h, duplicate tells whether h can be a
+// duplicate ACK.
+func (c *Conn) ack(h *header, duplicate bool, now time.Time) {
+	bytesAcked := 0
+	for _, p := range c.outgoing {
+		if p.acked || (seqLess(h.ackNr, p.seqNr) && !h.sacked(p.seqNr)) {
+			continue
+		}
+		if !p.needResend {
+			c.inFlight -= len(p.payload)
+		}
+		p.acked, p.needResend = true, false
+		bytesAcked += len(p.payload)
+		if p.transmissions == 1 {
+			c.congestion.onRTT(now.Sub(p.sentAt))
+		}
+	}
+	for len(c.outgoing) > 0 && c.outgoing[0].acked {
+		c.outgoing = c.outgoing[1:]
+	}
+	// the FIN is the last packet, a selective ACK of it does not tell the
+	// data before it arrived
+	if c.finSent && len(c.outgoing) == 0 {
+		c.finAcked = true
+	}
+	c.congestion.onAck(bytesAcked, h.timestampDiff, now)
+
+	switch {
+	case seqLess(c.lastAckNr, h.ackNr):
+		c.lastAckNr = h.ackNr
+		c.dupAcks = 0
+		c.retransmits = 0
+		c.timeoutAt = time.Time{}
+		if len(c.outgoing) > 0 {
+			c.timeoutAt = now.Add(c.congestion.timeout)
+		}
+	case duplicate && h.ackNr == c.lastAckNr && len(c.outgoing) > 0:
+		c.dupAcks++
+	}
+	if len(c.outgoing) == 0 {
+		return
+	}
+
+	// the first packet not acknowledged is lost if the ones after it keep
+	// coming
+	first := c.outgoing[0]
+	sacked := 0
+	for _, p := range c.outgoing[1:] {
+		if p.acked {
+			sacked++
+		}
+	}
+	if (c.dupAcks >= duplicateAcks || sacked >= duplicateAcks) && !first.fastResent && !first.needResend {
+		first.fastResent = true
+		first.needResend = true
+		c.inFlight -= len(first.payload)
+		if !seqLess(first.seqNr, c.lossSeqNr) {
+			c.congestion.onLoss()
+			c.lossSeqNr = c.seqNr
+		}
+	}
+}
+
+// receiveData handles a data or FIN packet and acknowledges it. A packet
+// ahead of the ones missing is kept until they arrive.
+func (c *Conn) receiveData(h *header, payload []byte, now time.Time) {
+	defer c.sendState(now)
+
+	offset := h.seqNr - c.ackNr
+	if offset == 0 || offset >= 0x8000 {
+		// received already
+		return
+	}
+	if offset > 1 {
+		if _, ok := c.reorder[h.seqNr]; ok || c.receiveWindow() < len(payload) {
+			return
+		}
+		c.reorder[h.seqNr] = &incomingPacket{typ: h.typ, payload: append([]byte(nil), payload...)}
+		c.reorderSize += len(payload)
+		return
+	}
+	if c.receiveWindow() < len(payload) {
+		return
+	}
+
+	c.deliver(h.typ, payload)
+	for {
+		p, ok := c.reorder[c.ackNr+1]
+		if !ok {
+			break
+		}
+		delete(c.reorder, c.ackNr+1)
+		c.reorderSize -= len(p.payload)
+		c.deliver(p.typ, p.payload)
+	}
+}
+
+// deliver takes the next packet in order. The data after a FIN is dropped,
+// so is the data received after Close.
+func (c *Conn) deliver(typ byte, payload []byte) {
+	c.ackNr++
+	switch {
+	case c.eof:
+	case typ == stFin:
+		c.eof = true
+	case !c.closing:
+		c.readBuffer = append(c.readBuffer, payload...)
+	}
+}
+
+// receiveWindow returns how much more data can be received.
+func (c *Conn) receiveWindow() int {
+	window := c.socket.config.ReadBufferSize - len(c.readBuffer) - c.reorderSize
+	if window < 0 {
+		return 0
+	}
+	return window
+}
+
+// sackMask returns the selective ACK bitmask of the packets received ahead,
+// nil if there are none.
+func (c *Conn) sackMask() []byte {
+	var mask []byte
+	for seqNr := range c.reorder {
+		offset := int(seqNr - c.ackNr - 2)
+		if offset >= maxSACKSize*8 {
+			continue
+		}
+		if size := (offset/8 + 4) / 4 * 4; size > len(mask) {
+			mask = append(mask, make([]byte, size-len(mask))...)
+		}
+		mask[offset/8] |= 1 << uint(offset%8)
+	}
+	return mask
+}
+
+// tick resends the packets when nothing is acknowledged in time and sends a
+// keepalive when nothing has been sent for a while.
+func (c *Conn) tick(now time.Time) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.state == stateClosed {
+		return
+	}
+
+	if !c.timeoutAt.IsZero() && !now.Before(c.timeoutAt) {
+		// a peer which is out of buffer is probed without giving up on it
+		if c.peerWindow >= maxPayloadSize || c.state == stateSynSent {
+			c.retransmits++
+		}
+		limit := c.socket.config.MaxRetransmits
+		if c.state == stateSynSent {
+			limit = maxSynRetransmits
+		}
+		if c.retransmits > limit {
+			c.fail(ErrTimeout)
+			c.broadcast()
+			return
+		}
+
+		c.congestion.onTimeout()
+		for _, p := range c.outgoing {
+			if !p.acked && !p.needResend {
+				p.needResend = true
+				c.inFlight -= len(p.payload)
+			}
+		}
+		c.lossSeqNr = c.seqNr
+		c.timeoutAt = time.Time{}
+		if c.state == stateSynSent {
+			c.transmit(c.outgoing[0], now)
+		}
+		c.flush(now)
+	}
+
+	if c.state == stateConnected && now.Sub(c.lastSend) >= c.socket.config.KeepAliveInterval {
+		c.sendState(now)
+	}
+}
+
+// fail ends the connection with err.
+func (c *Conn) fail(err error) {
+	c.state = stateClosed
+	c.err = err
+	c.socket.remove(c)
+}
+
+// abort resets the connection.
+func (c *Conn) abort(err error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.state == stateClosed {
+		return
+	}
+	c.send(stReset, c.seqNr, nil, time.Now())
+	c.fail(err)
+	c.broadcast()
+}
+
+func (c *Conn) broadcast() {
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
+
+// wait waits for a change until deadline, c.mutex is held.
+func (c *Conn) wait(deadline time.Time) {
+	changed := c.changed
+	c.mutex.Unlock()
+	defer c.mutex.Lock()
+
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case <-changed:
+	case <-timeout:
+	}
+}
+
+// Read reads the received data, it returns io.EOF once the other side has
+// closed the connection and everything it sent has been read.
+func (c *Conn) Read(b []byte) (int, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for {
+		if c.closing {
+			return 0, ErrClosed
+		}
+		if len(c.readBuffer) > 0 {
+			n := copy(b, c.readBuffer)
+			c.readBuffer = c.readBuffer[n:]
+			if len(c.readBuffer) == 0 {
+				c.readBuffer = nil
+			}
+			// the other side may wait for the window to open
+			if c.state == stateConnected && c.lastWindow < maxPayloadSize && c.receiveWindow() >= maxPayloadSize {
+				c.sendState(time.Now())
+			}
+			return n, nil
+		}
+		if c.eof {
+			return 0, io.EOF
+		}
+		if c.state == stateClosed {
+			return 0, c.err
+		}
+		if !c.readDeadline.IsZero() && !time.Now().Before(c.readDeadline) {
+			return 0, errDeadline
+		}
+		c.wait(c.readDeadline)
+	}
+}
+
+// Write buffers b to be sent, it blocks while the buffer is full.
+func (c *Conn) Write(b []byte) (int, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	n := 0
+	for len(b) > 0 {
+		if c.closing {
+			return n, ErrClosed
+		}
+		if c.state == stateClosed {
+			return n, c.err
+		}
+		if !c.writeDeadline.IsZero() && !time.Now().Before(c.writeDeadline) {
+			return n, errDeadline
+		}
+
+		space := c.socket.config.WriteBufferSize - len(c.sendBuffer)
+		if space <= 0 {
+			c.wait(c.writeDeadline)
+			continue
+		}
+		if space > len(b) {
+			space = len(b)
+		}
+		c.sendBuffer = append(c.sendBuffer, b[:space]...)
+		b = b[space:]
+		n += space
+		c.flush(time.Now())
+	}
+	return n, nil
+}
+
+// Close sends a FIN once the written data is sent, the connection is
+// forgotten when the FIN is acknowledged. It does not wait for it.
+func (c *Conn) Close() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.closing {
+		return ErrClosed
+	}
+	c.closing = true
+	c.readBuffer = nil
+	defer c.broadcast()
+
+	if c.state != stateClosed {
+		c.flush(time.Now())
+	}
+	return nil
+}
+
+func (c *Conn) LocalAddr() net.Addr {
+	return c.socket.Addr()
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.readDeadline, c.writeDeadline = t, t
+	c.broadcast()
+	return nil
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.readDeadline = t
+	c.broadcast()
+	return nil
+}
+
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.writeDeadline = t
+	c.broadcast()
+	return nil
+}
@@ -0,0 +1,591 @@
+package utp
+
+import (
+	"context"
+	"crypto/sha1"
+	"github.com/johnnyeven/terra/bt"
+	"github.com/johnnyeven/terra/dht"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// sentPacket is a packet a lossyConn was asked to send.
+type sentPacket struct {
+	h       *header
+	at      time.Time
+	dropped bool
+}
+
+// lossyConn is a net.PacketConn which drops the uTP packets drop returns
+// true for, and records them all.
+type lossyConn struct {
+	net.PacketConn
+
+	mutex sync.Mutex
+	drop  func(h *header) bool
+	sent  []sentPacket
+}
+
+func (c *lossyConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	h, _, err := parsePacket(b)
+	if err == nil {
+		c.mutex.Lock()
+		dropped := c.drop != nil && c.drop(h)
+		c.sent = append(c.sent, sentPacket{h, time.Now(), dropped})
+		c.mutex.Unlock()
+		if dropped {
+			return len(b), nil
+		}
+	}
+	return c.PacketConn.WriteTo(b, addr)
+}
+
+func (c *lossyConn) setDrop(drop func(h *header) bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.drop = drop
+}
+
+func (c *lossyConn) packets() []sentPacket {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return append([]sentPacket(nil), c.sent...)
+}
+
+// socketPair returns two sockets on the loopback, the packets they send go
+// through their lossyConn.
+func socketPair(t *testing.T) (*Socket, *lossyConn, *Socket, *lossyConn) {
+	newSocket := func() (*Socket, *lossyConn) {
+		conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		lossy := &lossyConn{PacketConn: conn}
+		return NewSocket(lossy, GetDefaultConfig()), lossy
+	}
+	dialer, dialerConn := newSocket()
+	acceptor, acceptorConn := newSocket()
+	return dialer, dialerConn, acceptor, acceptorConn
+}
+
+// connect returns the two sides of a connection from dialer to acceptor.
+func connect(t *testing.T, dialer, acceptor *Socket) (net.Conn, net.Conn) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, _ := acceptor.Accept()
+		accepted <- conn
+	}()
+	dialed, err := dialer.DialContext(ctx, "tcp", acceptor.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dialed, <-accepted
+}
+
+func randomData(size int, seed int64) []byte {
+	data := make([]byte, size)
+	rand.New(rand.NewSource(seed)).Read(data)
+	return data
+}
+
+// transfer writes data to from and closes it, to must read all of it and
+// then io.EOF.
+func transfer(t *testing.T, from, to net.Conn, data []byte) {
+	written := make(chan error, 1)
+	go func() {
+		_, err := from.Write(data)
+		if err == nil {
+			err = from.Close()
+		}
+		written <- err
+	}()
+
+	to.SetReadDeadline(time.Now().Add(30 * time.Second))
+	received, err := ioutil.ReadAll(to)
+	if err != nil {
+		t.Fatalf("read %d bytes: %v", len(received), err)
+	}
+	if err := <-written; err != nil {
+		t.Fatal(err)
+	}
+	if sha1.Sum(received) != sha1.Sum(data) {
+		t.Fatalf("received %d bytes which differ from the %d written", len(received), len(data))
+	}
+}
+
+func TestLoopbackTransfer(t *testing.T) {
+	dialer, _, acceptor, _ := socketPair(t)
+	defer dialer.Close()
+	defer acceptor.Close()
+	dialed, accepted := connect(t, dialer, acceptor)
+
+	// the acceptor echoes what it reads until the dialer closes
+	echoed := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(accepted, accepted)
+		accepted.Close()
+		echoed <- err
+	}()
+
+	data := randomData(4<<20, 1)
+	go dialed.Write(data)
+	dialed.SetReadDeadline(time.Now().Add(30 * time.Second))
+	received := make([]byte, len(data))
+	if _, err := io.ReadFull(dialed, received); err != nil {
+		t.Fatal(err)
+	}
+	if sha1.Sum(received) != sha1.Sum(data) {
+		t.Fatal("the echoed data differs")
+	}
+
+	dialed.Close()
+	if err := <-echoed; err != nil {
+		t.Errorf("echo ended with %v", err)
+	}
+}
+
+func TestFastRetransmit(t *testing.T) {
+	dialer, dialerConn, acceptor, acceptorConn := socketPair(t)
+	defer dialer.Close()
+	defer acceptor.Close()
+
+	// the first transmission of the third data packet is lost
+	var dataSeqNrs []uint16
+	var lost uint16
+	dialerConn.setDrop(func(h *header) bool {
+		if h.typ != stData {
+			return false
+		}
+		for _, seqNr := range dataSeqNrs {
+			if seqNr == h.seqNr {
+				return false
+			}
+		}
+		dataSeqNrs = append(dataSeqNrs, h.seqNr)
+		if len(dataSeqNrs) == 3 {
+			lost = h.seqNr
+			return true
+		}
+		return false
+	})
+
+	dialed, accepted := connect(t, dialer, acceptor)
+	transfer(t, dialed, accepted, randomData(100*maxPayloadSize, 2))
+
+	// the packets received after the lost one are selectively acknowledged
+	sacked := false
+	for _, p := range acceptorConn.packets() {
+		if p.h.typ == stState && len(p.h.sack) > 0 && p.h.ackNr+1 == lost {
+			sacked = true
+		}
+	}
+	if !sacked {
+		t.Error("no selective ACK of the packets after the lost one")
+	}
+
+	// it is resent once, before the timeout
+	var transmissions []time.Time
+	for _, p := range dialerConn.packets() {
+		if p.h.typ == stData && p.h.seqNr == lost {
+			transmissions = append(transmissions, p.at)
+		}
+	}
+	if len(transmissions) != 2 {
+		t.Fatalf("the lost packet was sent %d times, want 2", len(transmissions))
+	}
+	if delay := transmissions[1].Sub(transmissions[0]); delay >= minTimeout {
+		t.Errorf("the lost packet was resent after %s, not before the timeout", delay)
+	}
+}
+
+func TestFinAfterLoss(t *testing.T) {
+	dialer, dialerConn, acceptor, _ := socketPair(t)
+	defer dialer.Close()
+	defer acceptor.Close()
+
+	// the last data packet is lost once, the FIN after it is selectively
+	// acknowledged and it is resent on the timeout
+	sent := 0
+	dialerConn.setDrop(func(h *header) bool {
+		if h.typ != stData {
+			return false
+		}
+		sent++
+		return sent == 5
+	})
+
+	dialed, accepted := connect(t, dialer, acceptor)
+	transfer(t, dialed, accepted, randomData(5*maxPayloadSize, 3))
+}
+
+func TestRandomLoss(t *testing.T) {
+	dialer, dialerConn, acceptor, acceptorConn := socketPair(t)
+	defer dialer.Close()
+	defer acceptor.Close()
+
+	dialed, accepted := connect(t, dialer, acceptor)
+	// the data and the acknowledgements are lost, in both directions
+	random := rand.New(rand.NewSource(3))
+	var mutex sync.Mutex
+	drop := func(h *header) bool {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return random.Intn(100) < 5
+	}
+	dialerConn.setDrop(drop)
+	acceptorConn.setDrop(drop)
+
+	transfer(t, dialed, accepted, randomData(256<<10, 4))
+
+	dropped := 0
+	for _, p := range append(dialerConn.packets(), acceptorConn.packets()...) {
+		if p.dropped {
+			dropped++
+		}
+	}
+	if dropped == 0 {
+		t.Error("no packet was dropped")
+	}
+}
+
+func TestClose(t *testing.T) {
+	dialer, _, acceptor, _ := socketPair(t)
+	defer dialer.Close()
+	defer acceptor.Close()
+	dialed, accepted := connect(t, dialer, acceptor)
+
+	dialed.Write([]byte("hello"))
+	if err := dialed.Close(); err != nil {
+		t.Fatal(err)
+	}
+	accepted.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if data, err := ioutil.ReadAll(accepted); err != nil || string(data) != "hello" {
+		t.Fatalf("read %q, %v after the FIN", data, err)
+	}
+
+	if err := dialed.Close(); err != ErrClosed {
+		t.Errorf("second Close returned %v, want ErrClosed", err)
+	}
+	if _, err := dialed.Write([]byte("more")); err != ErrClosed {
+		t.Errorf("Write after Close returned %v, want ErrClosed", err)
+	}
+	if _, err := dialed.Read(make([]byte, 1)); err != ErrClosed {
+		t.Errorf("Read after Close returned %v, want ErrClosed", err)
+	}
+
+	// the connections are forgotten once the FINs are acknowledged
+	accepted.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for len(dialer.connections())+len(acceptor.connections()) > 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d and %d connections left", len(dialer.connections()), len(acceptor.connections()))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestReset(t *testing.T) {
+	dialer, _, acceptor, _ := socketPair(t)
+	defer dialer.Close()
+	dialed, _ := connect(t, dialer, acceptor)
+
+	// closing a socket resets its connections
+	acceptor.Close()
+	dialed.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := dialed.Read(make([]byte, 1)); err != ErrReset {
+		t.Errorf("Read returned %v, want ErrReset", err)
+	}
+	if _, err := dialed.Write([]byte("data")); err != ErrReset {
+		t.Errorf("Write returned %v, want ErrReset", err)
+	}
+	if _, err := acceptor.Accept(); err != ErrSocketClosed {
+		t.Errorf("Accept returned %v, want ErrSocketClosed", err)
+	}
+	if _, err := acceptor.DialContext(context.Background(), "udp", "127.0.0.1:1"); err != ErrSocketClosed {
+		t.Errorf("DialContext returned %v, want ErrSocketClosed", err)
+	}
+}
+
+func TestResetUnknownConnection(t *testing.T) {
+	socket, err := Listen("udp4", "127.0.0.1:0", GetDefaultConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer socket.Close()
+	raw, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer raw.Close()
+
+	tests := []struct {
+		name  string
+		h     *header
+		reset bool
+	}{
+		{"data", &header{typ: stData, connID: 1234, seqNr: 7}, true},
+		{"fin", &header{typ: stFin, connID: 1235, seqNr: 8}, true},
+		{"state", &header{typ: stState, connID: 1236, seqNr: 9}, true},
+		// a reset is not answered
+		{"reset", &header{typ: stReset, connID: 1237, seqNr: 10}, false},
+	}
+
+	buff := make([]byte, 1500)
+	for _, test := range tests {
+		raw.WriteTo(test.h.marshal([]byte("payload")), socket.Addr())
+		raw.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		n, _, err := raw.ReadFrom(buff)
+		if !test.reset {
+			if err == nil {
+				t.Errorf("%s: answered with %x", test.name, buff[:n])
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		h, _, err := parsePacket(buff[:n])
+		if err != nil || h.typ != stReset || h.connID != test.h.connID || h.ackNr != test.h.seqNr {
+			t.Errorf("%s: answered with %+v, %v", test.name, h, err)
+		}
+	}
+}
+
+func TestDial(t *testing.T) {
+	socket, err := Listen("udp4", "127.0.0.1:0", GetDefaultConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer socket.Close()
+	raw, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer raw.Close()
+
+	// nobody answers
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := socket.DialContext(ctx, "udp", raw.LocalAddr().String()); err != context.DeadlineExceeded {
+		t.Errorf("DialContext returned %v, want context.DeadlineExceeded", err)
+	}
+
+	// the SYN is answered with a reset
+	go func() {
+		buff := make([]byte, 1500)
+		for {
+			n, addr, err := raw.ReadFrom(buff)
+			if err != nil {
+				return
+			}
+			if h, _, err := parsePacket(buff[:n]); err == nil && h.typ == stSyn {
+				reset := &header{typ: stReset, connID: h.connID + 1, ackNr: h.seqNr}
+				raw.WriteTo(reset.marshal(nil), addr)
+			}
+		}
+	}()
+	if _, err := socket.DialContext(context.Background(), "udp", raw.LocalAddr().String()); err != ErrReset {
+		t.Errorf("DialContext returned %v, want ErrReset", err)
+	}
+
+	if _, err := socket.DialContext(context.Background(), "ip", raw.LocalAddr().String()); err == nil {
+		t.Error("dialed over ip")
+	}
+}
+
+func TestDeadline(t *testing.T) {
+	dialer, _, acceptor, _ := socketPair(t)
+	defer dialer.Close()
+	defer acceptor.Close()
+	dialed, _ := connect(t, dialer, acceptor)
+
+	dialed.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	_, err := dialed.Read(make([]byte, 1))
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		t.Errorf("Read returned %v, want a timeout", err)
+	}
+}
+
+// newSharedNode returns a DHT node at addr of network whose uTP packets go
+// to a shared Socket.
+func newSharedNode(t *testing.T, network *dht.MemoryNetwork, addr string) (*dht.DistributedHashTable, *Socket) {
+	var socket *Socket
+	config := dht.GetNormalConfig()
+	config.TransportConstructor = dht.NewKRPCTransport
+	config.Handler = bt.BTHandlePacket
+	config.HandshakeFunc = bt.FindNode
+	config.PingFunc = bt.Ping
+	config.ListenFunc = network.ListenPacket
+	config.LocalAddr = addr
+	config.SeedNodes = nil
+	config.MaxQueriesPerSecondPerIP = 0
+	config.MaxPacketsPerSecondPerNode = 0
+	config.OtherPacketHandler = func(table *dht.DistributedHashTable, packet dht.Packet) {
+		socket.HandlePacket(packet.Data, packet.RemoteAddr)
+	}
+
+	table := dht.NewDHT(config)
+	socket = NewSharedSocket(table, GetDefaultConfig())
+	go table.Run()
+	<-table.Ready()
+	return table, socket
+}
+
+func TestSharedSocket(t *testing.T) {
+	network := dht.NewMemoryNetwork()
+	tableA, socketA := newSharedNode(t, network, "10.0.0.1:6881")
+	defer tableA.Close()
+	defer socketA.Close()
+	tableB, socketB := newSharedNode(t, network, "10.0.0.2:6881")
+	defer tableB.Close()
+	defer socketB.Close()
+
+	if addr := socketA.Addr().String(); addr != "10.0.0.1:6881" {
+		t.Errorf("socket address %s, want the one of the node", addr)
+	}
+
+	// uTP goes to the sockets
+	dialed, accepted := connect(t, socketA, socketB)
+	transfer(t, dialed, accepted, randomData(256<<10, 5))
+
+	// and KRPC to the nodes
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	node, err := bt.PingAddr(ctx, tableA, &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 6881})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if node.ID != tableB.Self.ID {
+		t.Errorf("ping answered by %s, want %s", node.ID, tableB.Self.ID)
+	}
+}
+
+func TestCongestion(t *testing.T) {
+	now := time.Now()
+	base := uint32(1000)
+	steps := []struct {
+		name string
+		step func(c *congestion)
+		// the window compared to the one before the step, -1 smaller, 0 the
+		// same, 1 larger
+		change    int
+		slowStart bool
+	}{
+		{"no delay", func(c *congestion) { c.onAck(maxPayloadSize, 0, now) }, 0, true},
+		{"nothing acked", func(c *congestion) { c.onAck(0, base, now) }, 0, true},
+		{"at the base delay", func(c *congestion) { c.onAck(maxPayloadSize, base, now) }, 1, true},
+		{"below the target", func(c *congestion) { c.onAck(maxPayloadSize, base+targetDelay/2, now) }, 1, true},
+		{"near the target", func(c *congestion) { c.onAck(maxPayloadSize, base+targetDelay*95/100, now) }, 1, false},
+		{"above the target", func(c *congestion) { c.onAck(maxPayloadSize, base+2*targetDelay, now) }, -1, false},
+		// taken as targetDelay
+		{"clock jump", func(c *congestion) { c.onAck(maxPayloadSize, base+20*targetDelay, now) }, 0, false},
+		{"loss", (*congestion).onLoss, -1, false},
+		{"timeout", (*congestion).onTimeout, -1, true},
+	}
+
+	c := newCongestion()
+	if c.window != initialWindow {
+		t.Fatalf("initial window %f, want %d", c.window, initialWindow)
+	}
+	for _, step := range steps {
+		before := c.window
+		step.step(c)
+		change := 0
+		if c.window < before {
+			change = -1
+		} else if c.window > before {
+			change = 1
+		}
+		if change != step.change || c.slowStart != step.slowStart {
+			t.Errorf("%s: window %f -> %f, slow start %v", step.name, before, c.window, c.slowStart)
+		}
+	}
+	if c.window != minWindow {
+		t.Errorf("window %f after a timeout, want %d", c.window, minWindow)
+	}
+
+	c = newCongestion()
+	c.window = 10 * maxPayloadSize
+	c.onLoss()
+	if c.window != 5*maxPayloadSize || c.ssthresh != c.window {
+		t.Errorf("window %f and ssthresh %f after a loss", c.window, c.ssthresh)
+	}
+	for i := 0; i < 10; i++ {
+		c.onLoss()
+	}
+	if c.window != minWindow {
+		t.Errorf("window %f after losses, want %d", c.window, minWindow)
+	}
+	c.setWindow(2 * maxWindow)
+	if c.window != maxWindow {
+		t.Errorf("window %f, want %d", c.window, maxWindow)
+	}
+}
+
+func TestCongestionTimeout(t *testing.T) {
+	tests := []struct {
+		name string
+		rtts []time.Duration
+		want time.Duration
+	}{
+		{"short", []time.Duration{10 * time.Millisecond}, minTimeout},
+		// rtt + 4 * rtt / 2
+		{"first", []time.Duration{time.Second}, 3 * time.Second},
+		{"steady", []time.Duration{time.Second, time.Second}, 2500 * time.Millisecond},
+		{"long", []time.Duration{time.Minute}, maxTimeout},
+	}
+	for _, test := range tests {
+		c := newCongestion()
+		for _, rtt := range test.rtts {
+			c.onRTT(rtt)
+		}
+		if c.timeout != test.want {
+			t.Errorf("%s: timeout %s, want %s", test.name, c.timeout, test.want)
+		}
+	}
+
+	c := newCongestion()
+	for i, want := range []time.Duration{2 * time.Second, 4 * time.Second, 8 * time.Second, 16 * time.Second, maxTimeout, maxTimeout} {
+		c.onTimeout()
+		if c.timeout != want {
+			t.Errorf("timeout %s after %d timeouts, want %s", c.timeout, i+1, want)
+		}
+	}
+}
+
+func TestDelayHistory(t *testing.T) {
+	start := time.Now()
+	var h delayHistory
+	steps := []struct {
+		delay uint32
+		at    time.Duration
+		base  uint32
+	}{
+		{500, 0, 500},
+		{700, time.Second, 500},
+		{300, 2 * time.Second, 300},
+		// a new period, the minimum of the last one is kept
+		{400, delayHistoryPeriod + 3*time.Second, 300},
+		// the period before the last one is forgotten
+		{600, 2*delayHistoryPeriod + 4*time.Second, 400},
+		// the delays wrap
+		{0xfffffff0, 2*delayHistoryPeriod + 5*time.Second, 0xfffffff0},
+	}
+	for i, step := range steps {
+		h.add(step.delay, start.Add(step.at))
+		if base := h.base(); base != step.base {
+			t.Errorf("step %d: base %d, want %d", i, base, step.base)
+		}
+	}
+}
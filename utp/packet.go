@@ -0,0 +1,126 @@
+package utp
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+// the packet types
+const (
+	stData  = 0
+	stFin   = 1
+	stState = 2
+	stReset = 3
+	stSyn   = 4
+)
+
+const (
+	version    = 1
+	headerSize = 20
+	// the selective ACK extension
+	extSACK = 1
+	// the largest packet sent, small enough not to be fragmented on most
+	// paths
+	maxPacketSize = 1400
+	// the largest payload of a data packet
+	maxPayloadSize = maxPacketSize - headerSize
+	// the largest selective ACK bitmask sent, in bytes
+	maxSACKSize = 32
+)
+
+var errBadPacket = errors.New("utp: invalid packet")
+
+// header is the header of a packet, with the bitmask of its selective ACK
+// extension if it has one.
+type header struct {
+	typ       byte
+	connID    uint16
+	timestamp uint32
+	// the delay of the last packet received by the sender, as the sender
+	// measured it
+	timestampDiff uint32
+	wndSize       uint32
+	seqNr         uint16
+	ackNr         uint16
+	sack          []byte
+}
+
+// marshal returns the packet of h and payload.
+func (h *header) marshal(payload []byte) []byte {
+	size := headerSize + len(payload)
+	extension := byte(0)
+	if len(h.sack) > 0 {
+		extension = extSACK
+		size += 2 + len(h.sack)
+	}
+
+	buf := make([]byte, headerSize, size)
+	buf[0] = h.typ<<4 | version
+	buf[1] = extension
+	binary.BigEndian.PutUint16(buf[2:], h.connID)
+	binary.BigEndian.PutUint32(buf[4:], h.timestamp)
+	binary.BigEndian.PutUint32(buf[8:], h.timestampDiff)
+	binary.BigEndian.PutUint32(buf[12:], h.wndSize)
+	binary.BigEndian.PutUint16(buf[16:], h.seqNr)
+	binary.BigEndian.PutUint16(buf[18:], h.ackNr)
+	if len(h.sack) > 0 {
+		buf = append(buf, 0, byte(len(h.sack)))
+		buf = append(buf, h.sack...)
+	}
+	return append(buf, payload...)
+}
+
+// parsePacket returns the header and the payload of data. The extensions
+// other than the selective ACK are skipped.
+func parsePacket(data []byte) (*header, []byte, error) {
+	if len(data) < headerSize || data[0]&0x0f != version || data[0]>>4 > stSyn {
+		return nil, nil, errBadPacket
+	}
+
+	h := &header{
+		typ:           data[0] >> 4,
+		connID:        binary.BigEndian.Uint16(data[2:]),
+		timestamp:     binary.BigEndian.Uint32(data[4:]),
+		timestampDiff: binary.BigEndian.Uint32(data[8:]),
+		wndSize:       binary.BigEndian.Uint32(data[12:]),
+		seqNr:         binary.BigEndian.Uint16(data[16:]),
+		ackNr:         binary.BigEndian.Uint16(data[18:]),
+	}
+
+	extension := data[1]
+	data = data[headerSize:]
+	for extension != 0 {
+		if len(data) < 2 || len(data) < 2+int(data[1]) {
+			return nil, nil, errBadPacket
+		}
+		next, size := data[0], int(data[1])
+		if extension == extSACK {
+			h.sack = data[2 : 2+size]
+		}
+		extension = next
+		data = data[2+size:]
+	}
+	return h, data, nil
+}
+
+// sacked reports whether the selective ACK of h acknowledges seqNr. The bit
+// i of the byte j stands for ackNr + 2 + 8j + i.
+func (h *header) sacked(seqNr uint16) bool {
+	offset := int(seqNr - h.ackNr - 2)
+	if offset < 0 || offset >= len(h.sack)*8 {
+		return false
+	}
+	return h.sack[offset/8]&(1<<uint(offset%8)) != 0
+}
+
+// seqLess reports whether a comes before b, the sequence numbers wrap.
+func seqLess(a, b uint16) bool {
+	return int16(a-b) < 0
+}
+
+// timestamp returns the microseconds of t truncated to 32 bits, as the
+// packets carry them.
+func timestamp(t time.Time) uint32 {
+	return uint32(t.UnixNano() / int64(time.Microsecond))
+}
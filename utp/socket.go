@@ -0,0 +1,367 @@
+// Package utp implements the uTP transport of BEP 29, the reliable ordered
+// stream many BitTorrent peers accept connections over, on top of UDP. Its
+// LEDBAT congestion control gives way to the other traffic of the link.
+//
+// A Socket is a net.Listener of uTP connections and dials them, it can be the
+// Dialer of peer.Config. It reads its own UDP socket, or it shares the one
+// of a DHT node: the node passes the packets which are not KRPC messages to
+// HandlePacket, and the Socket sends through the node.
+//
+//	var socket *utp.Socket
+//	config.OtherPacketHandler = func(table *dht.DistributedHashTable, packet dht.Packet) {
+//		socket.HandlePacket(packet.Data, packet.RemoteAddr)
+//	}
+//	table := dht.NewDHT(config)
+//	socket = utp.NewSharedSocket(table, utp.GetDefaultConfig())
+//	go table.Run()
+package utp
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// how often the retransmission timeouts and the keepalives are checked
+const tickInterval = 50 * time.Millisecond
+
+var (
+	ErrClosed       = errors.New("utp: connection closed")
+	ErrReset        = errors.New("utp: connection reset by peer")
+	ErrTimeout      = errors.New("utp: connection timed out")
+	ErrSocketClosed = errors.New("utp: socket closed")
+	errDeadline     = &deadlineError{}
+)
+
+type deadlineError struct{}
+
+func (e *deadlineError) Error() string   { return "utp: i/o timeout" }
+func (e *deadlineError) Timeout() bool   { return true }
+func (e *deadlineError) Temporary() bool { return true }
+
+// PacketWriter sends the packets of a Socket, a net.PacketConn is one and so
+// is a *dht.DistributedHashTable.
+type PacketWriter interface {
+	WriteTo(b []byte, addr net.Addr) (int, error)
+}
+
+type Config struct {
+	// how many connections can wait for Accept, the SYNs beyond are dropped
+	Backlog int
+	// how much received data can wait for Read, it is the window the other
+	// side is given
+	ReadBufferSize int
+	// how much written data can wait to be sent, Write blocks beyond
+	WriteBufferSize int
+	// how many timeouts in a row a connection is given up after, a SYN
+	// is sent maxSynRetransmits times at most
+	MaxRetransmits int
+	// a keepalive is sent if nothing else has been sent for this long
+	KeepAliveInterval time.Duration
+}
+
+// GetDefaultConfig returns a Config pointer with the values of most clients.
+func GetDefaultConfig() *Config {
+	return &Config{
+		Backlog:           32,
+		ReadBufferSize:    1 << 20,
+		WriteBufferSize:   1 << 20,
+		MaxRetransmits:    6,
+		KeepAliveInterval: 29 * time.Second,
+	}
+}
+
+// connKey finds the connection of a packet: the connection ID of a packet is
+// the receive ID of the connection it is for.
+type connKey struct {
+	addr string
+	id   uint16
+}
+
+// Socket multiplexes the uTP connections of a UDP socket by remote address
+// and connection ID.
+type Socket struct {
+	writer PacketWriter
+	// the socket read by the Socket, nil if it is shared
+	conn   net.PacketConn
+	config Config
+
+	mutex   sync.Mutex
+	conns   map[connKey]*Conn
+	backlog chan *Conn
+
+	closeOnce   sync.Once
+	quitChannel chan struct{}
+}
+
+// Listen opens a UDP socket at address and returns the Socket reading it.
+func Listen(network, address string, config *Config) (*Socket, error) {
+	conn, err := net.ListenPacket(network, address)
+	if err != nil {
+		return nil, err
+	}
+	return NewSocket(conn, config), nil
+}
+
+// NewSocket returns a Socket reading conn, the packets which are not uTP
+// ones are dropped. Closing the Socket closes conn.
+func NewSocket(conn net.PacketConn, config *Config) *Socket {
+	s := newSocket(conn, config)
+	s.conn = conn
+	go s.read()
+	return s
+}
+
+// NewSharedSocket returns a Socket sending through writer, whose owner reads
+// the packets and passes the uTP ones to HandlePacket.
+func NewSharedSocket(writer PacketWriter, config *Config) *Socket {
+	return newSocket(writer, config)
+}
+
+func newSocket(writer PacketWriter, config *Config) *Socket {
+	s := &Socket{
+		writer:      writer,
+		config:      *config,
+		conns:       make(map[connKey]*Conn),
+		backlog:     make(chan *Conn, config.Backlog),
+		quitChannel: make(chan struct{}),
+	}
+	go s.run()
+	return s
+}
+
+func (s *Socket) read() {
+	buff := make([]byte, 65536)
+	for {
+		n, addr, err := s.conn.ReadFrom(buff)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			s.Close()
+			return
+		}
+		s.HandlePacket(buff[:n], addr)
+	}
+}
+
+// run checks the timers of the connections until the Socket is closed.
+func (s *Socket) run() {
+	ticker := time.NewTicker(tickInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			for _, c := range s.connections() {
+				c.tick(now)
+			}
+		case <-s.quitChannel:
+			return
+		}
+	}
+}
+
+func (s *Socket) connections() []*Conn {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	conns := make([]*Conn, 0, len(s.conns))
+	for _, c := range s.conns {
+		conns = append(conns, c)
+	}
+	return conns
+}
+
+// HandlePacket handles a packet received from addr, it reports whether it is
+// a uTP packet. data is not kept.
+func (s *Socket) HandlePacket(data []byte, addr net.Addr) bool {
+	h, payload, err := parsePacket(data)
+	if err != nil {
+		return false
+	}
+	select {
+	case <-s.quitChannel:
+		return true
+	default:
+	}
+
+	key := connKey{addr.String(), h.connID}
+	now := time.Now()
+
+	s.mutex.Lock()
+	var c *Conn
+	switch h.typ {
+	case stSyn:
+		// the ID of a SYN is the receive ID of the dialing side, which sends
+		// with the next one
+		key.id++
+		if c = s.conns[key]; c == nil {
+			c = s.incoming(key, addr, h)
+		}
+	case stReset:
+		// the ID of a reset can be the send ID of the connection
+		if c = s.conns[key]; c == nil {
+			for _, id := range []uint16{h.connID + 1, h.connID - 1} {
+				if other := s.conns[connKey{key.addr, id}]; other != nil && other.sendID == h.connID {
+					c = other
+				}
+			}
+		}
+	default:
+		c = s.conns[key]
+	}
+	s.mutex.Unlock()
+
+	if c == nil {
+		if h.typ != stReset && h.typ != stSyn {
+			s.reset(h.connID, addr, h.seqNr)
+		}
+		return true
+	}
+	c.receive(h, payload, now)
+	return true
+}
+
+// incoming returns the connection of a SYN and queues it for Accept, or nil
+// if the backlog is full. s.mutex is held.
+func (s *Socket) incoming(key connKey, addr net.Addr, syn *header) *Conn {
+	c := newConn(s, addr, key.id, syn.connID)
+	c.state = stateConnected
+	c.ackNr = syn.seqNr
+	c.setSeqNr(randomUint16())
+
+	select {
+	case s.backlog <- c:
+	default:
+		return nil
+	}
+	s.conns[key] = c
+	return c
+}
+
+// reset tells the other side a packet is for a connection which does not
+// exist.
+func (s *Socket) reset(connID uint16, addr net.Addr, ackNr uint16) {
+	h := &header{
+		typ:       stReset,
+		connID:    connID,
+		timestamp: timestamp(time.Now()),
+		seqNr:     randomUint16(),
+		ackNr:     ackNr,
+	}
+	s.write(h.marshal(nil), addr)
+}
+
+func (s *Socket) write(data []byte, addr net.Addr) {
+	s.writer.WriteTo(data, addr)
+}
+
+func (s *Socket) remove(c *Conn) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	key := connKey{c.remote.String(), c.recvID}
+	if s.conns[key] == c {
+		delete(s.conns, key)
+	}
+}
+
+// Accept returns the next connection dialed to the socket.
+func (s *Socket) Accept() (net.Conn, error) {
+	select {
+	case c := <-s.backlog:
+		return c, nil
+	case <-s.quitChannel:
+		return nil, ErrSocketClosed
+	}
+}
+
+// DialContext connects to address. The network can be the one of a stream,
+// tcp, tcp4 and tcp6 standing for udp, udp4 and udp6, so the Socket can be
+// the Dialer of peer.Config.
+func (s *Socket) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+		network = "udp" + network[3:]
+	case "udp", "udp4", "udp6":
+	default:
+		return nil, net.UnknownNetworkError(network)
+	}
+
+	addr, err := net.ResolveUDPAddr(network, address)
+	if err != nil {
+		return nil, err
+	}
+	c, err := s.dial(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (s *Socket) dial(ctx context.Context, addr net.Addr) (*Conn, error) {
+	s.mutex.Lock()
+	select {
+	case <-s.quitChannel:
+		s.mutex.Unlock()
+		return nil, ErrSocketClosed
+	default:
+	}
+	key := connKey{addr: addr.String()}
+	for {
+		key.id = randomUint16()
+		if s.conns[key] == nil && s.conns[connKey{key.addr, key.id + 1}] == nil {
+			break
+		}
+	}
+	c := newConn(s, addr, key.id, key.id+1)
+	s.conns[key] = c
+	s.mutex.Unlock()
+
+	if err := c.connect(ctx); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Addr returns the local address of the socket, the first one of a DHT
+// node. It is nil if it is not known.
+func (s *Socket) Addr() net.Addr {
+	switch w := s.writer.(type) {
+	case net.PacketConn:
+		return w.LocalAddr()
+	case interface{ LocalAddrs() []*net.UDPAddr }:
+		if addrs := w.LocalAddrs(); len(addrs) > 0 {
+			return addrs[0]
+		}
+	}
+	return nil
+}
+
+// Close stops accepting connections and resets the open ones. The UDP
+// socket is closed if the Socket reads it.
+func (s *Socket) Close() error {
+	err := ErrSocketClosed
+	s.closeOnce.Do(func() {
+		close(s.quitChannel)
+		for _, c := range s.connections() {
+			c.abort(ErrSocketClosed)
+		}
+		err = nil
+		if s.conn != nil {
+			err = s.conn.Close()
+		}
+	})
+	return err
+}
+
+func randomUint16() uint16 {
+	var b [2]byte
+	rand.Read(b[:])
+	return binary.BigEndian.Uint16(b[:])
+}